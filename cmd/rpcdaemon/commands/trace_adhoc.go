@@ -420,6 +420,9 @@ func (ot *OeTracer) CaptureEnd(depth int, output []byte, startGas, endGas uint64
 	}
 }
 
+func (ot *OeTracer) CaptureEnter(typ vm.OpCode, from common.Address, to common.Address, input []byte, gas uint64, value *uint256.Int) {
+}
+
 func (ot *OeTracer) CaptureState(env *vm.EVM, pc uint64, op vm.OpCode, gas, cost uint64, scope *vm.ScopeContext, rData []byte, opDepth int, err error) {
 	memory := scope.Memory
 	st := scope.Stack
@@ -532,6 +535,9 @@ func (ot *OeTracer) CaptureState(env *vm.EVM, pc uint64, op vm.OpCode, gas, cost
 func (ot *OeTracer) CaptureFault(env *vm.EVM, pc uint64, op vm.OpCode, gas, cost uint64, scope *vm.ScopeContext, opDepth int, err error) {
 }
 
+func (ot *OeTracer) CaptureExit(output []byte, gasUsed uint64, err error) {
+}
+
 func (ot *OeTracer) CaptureSelfDestruct(from common.Address, to common.Address, value *big.Int) {
 	trace := &ParityTrace{}
 	trace.Type = SUICIDE
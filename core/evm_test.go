@@ -0,0 +1,60 @@
+package core
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/holiman/uint256"
+
+	"github.com/ledgerwatch/erigon/common"
+	"github.com/ledgerwatch/erigon/core/types"
+	"github.com/ledgerwatch/erigon/core/vm"
+	"github.com/ledgerwatch/erigon/crypto"
+	"github.com/ledgerwatch/erigon/params"
+)
+
+func TestNewEVMTxContextEffectiveGasPrice(t *testing.T) {
+	var (
+		config  = params.AllCliqueProtocolChanges
+		key, _  = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+		sender  = crypto.PubkeyToAddress(key.PublicKey)
+		to      = common.HexToAddress("0xaa")
+		signer  = types.LatestSignerForChainID(config.ChainID)
+		baseFee = big.NewInt(10)
+	)
+	chainID, _ := uint256.FromBig(config.ChainID)
+	tests := []struct {
+		tip, feeCap uint64
+		price       int64
+	}{
+		{2, 100, 12}, // base fee plus tip
+		{2, 11, 11},  // capped by the fee cap
+	}
+	for i, tt := range tests {
+		tx := &types.DynamicFeeTransaction{
+			CommonTx: types.CommonTx{ChainID: chainID, To: &to, Value: new(uint256.Int), Gas: 21000},
+			Tip:      uint256.NewInt(tt.tip),
+			FeeCap:   uint256.NewInt(tt.feeCap),
+		}
+		signed, err := types.SignTx(tx, *signer, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg, err := signed.AsMessage(*signer, baseFee, config.Rules(0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		evm := vm.NewEVM(vm.BlockContext{}, NewEVMTxContext(msg), nil, config, vm.Config{})
+		if evm.Origin() != sender {
+			t.Errorf("test %d: unexpected origin %x", i, evm.Origin())
+		}
+		if price := evm.GasPrice(); price.Int64() != tt.price {
+			t.Errorf("test %d: expected gas price %d, got %v", i, tt.price, price)
+		}
+		// The returned price is a copy
+		evm.GasPrice().SetInt64(0)
+		if evm.TxContext().GasPrice.Int64() != tt.price {
+			t.Errorf("test %d: gas price was modified", i)
+		}
+	}
+}
@@ -107,6 +107,16 @@ func newTestAction(addr common.Address, r *rand.Rand) testAction {
 			},
 			args: make([]int64, 2),
 		},
+		{
+			name: "SetTransientState",
+			fn: func(a testAction, s *IntraBlockState) {
+				var key common.Hash
+				binary.BigEndian.PutUint16(key[:], uint16(a.args[0]))
+				val := uint256.NewInt(uint64(a.args[1]))
+				s.SetTransientState(addr, key, *val)
+			},
+			args: make([]int64, 2),
+		},
 		{
 			name: "SetCode",
 			fn: func(a testAction, s *IntraBlockState) {
@@ -302,6 +312,17 @@ func (test *snapshotTest) checkEqual(state, checkstate *IntraBlockState) error {
 				}
 			}
 		}
+		// Check transient storage.
+		for key, value := range state.transientStorage[addr] {
+			if !checkeq("GetTransientState("+key.Hex()+")", checkstate.GetTransientState(addr, key), value) {
+				return err
+			}
+		}
+		for key, value := range checkstate.transientStorage[addr] {
+			if !checkeq("GetTransientState("+key.Hex()+")", state.GetTransientState(addr, key), value) {
+				return err
+			}
+		}
 	}
 
 	if state.GetRefund() != checkstate.GetRefund() {
@@ -314,3 +335,34 @@ func (test *snapshotTest) checkEqual(state, checkstate *IntraBlockState) error {
 	}
 	return nil
 }
+
+func TestTransientStorage(t *testing.T) {
+	state := New(nil)
+
+	key := common.Hash{0x01}
+	value := *uint256.NewInt(0x11)
+	addr := common.Address{}
+
+	state.SetTransientState(addr, key, value)
+	if exp, got := 1, state.journal.length(); exp != got {
+		t.Fatalf("journal length mismatch: have %d, want %d", got, exp)
+	}
+	// the retrieved value should equal what was set
+	if got := state.GetTransientState(addr, key); got != value {
+		t.Fatalf("transient storage mismatch: have %x, want %x", got, value)
+	}
+
+	// revert the transient state being set and then check that the
+	// value is now the empty hash
+	state.journal.revert(state, 0)
+	if got, exp := state.GetTransientState(addr, key), (uint256.Int{}); exp != got {
+		t.Fatalf("transient storage mismatch: have %x, want %x", got, exp)
+	}
+
+	// transient storage is discarded when the next transaction is prepared
+	state.SetTransientState(addr, key, value)
+	state.Prepare(common.Hash{0x02}, common.Hash{}, 1)
+	if got, exp := state.GetTransientState(addr, key), (uint256.Int{}); exp != got {
+		t.Fatalf("transient storage not cleared: have %x, want %x", got, exp)
+	}
+}
@@ -137,6 +137,10 @@ type (
 		key      common.Hash
 		prevalue uint256.Int
 	}
+	fakeStorageReset struct {
+		account *common.Address
+		prev    Storage
+	}
 	codeChange struct {
 		account  *common.Address
 		prevcode []byte
@@ -161,6 +165,12 @@ type (
 		address *common.Address
 		slot    *common.Hash
 	}
+
+	transientStorageChange struct {
+		account  *common.Address
+		key      common.Hash
+		prevalue uint256.Int
+	}
 )
 
 func (ch createObjectChange) revert(s *IntraBlockState) {
@@ -262,6 +272,14 @@ func (ch fakeStorageChange) dirtied() *common.Address {
 	return ch.account
 }
 
+func (ch fakeStorageReset) revert(s *IntraBlockState) {
+	s.getStateObject(*ch.account).fakeStorage = ch.prev
+}
+
+func (ch fakeStorageReset) dirtied() *common.Address {
+	return ch.account
+}
+
 func (ch refundChange) revert(s *IntraBlockState) {
 	s.refund = ch.prev
 }
@@ -308,3 +326,11 @@ func (ch accessListAddSlotChange) revert(s *IntraBlockState) {
 func (ch accessListAddSlotChange) dirtied() *common.Address {
 	return nil
 }
+
+func (ch transientStorageChange) revert(s *IntraBlockState) {
+	s.setTransientState(*ch.account, ch.key, ch.prevalue)
+}
+
+func (ch transientStorageChange) dirtied() *common.Address {
+	return nil
+}
@@ -232,6 +232,16 @@ func (so *stateObject) SetState(key *common.Hash, value uint256.Int) {
 //
 // Note this function should only be used for debugging purpose.
 func (so *stateObject) SetStorage(storage Storage) {
+	// The `fake` storage won't be committed to database, but it is journaled
+	// so that overrides can be reverted together with the rest of the state.
+	var prev Storage
+	if so.fakeStorage != nil {
+		prev = so.fakeStorage.Copy()
+	}
+	so.db.journal.append(fakeStorageReset{
+		account: &so.address,
+		prev:    prev,
+	})
 	// Allocate fake storage if it's nil.
 	if so.fakeStorage == nil {
 		so.fakeStorage = make(Storage)
@@ -239,8 +249,6 @@ func (so *stateObject) SetStorage(storage Storage) {
 	for key, value := range storage {
 		so.fakeStorage[key] = value
 	}
-	// Don't bother journal since this function should only be used for
-	// debugging and the `fake` storage won't be committed to database.
 }
 
 func (so *stateObject) setState(key *common.Hash, value uint256.Int) {
@@ -17,8 +17,8 @@
 package core
 
 import (
+	"errors"
 	"fmt"
-	"math/bits"
 
 	"github.com/ledgerwatch/erigon/consensus"
 
@@ -95,6 +95,7 @@ type Message interface {
 // message no matter the execution itself is successful or not.
 type ExecutionResult struct {
 	UsedGas    uint64 // Total used gas but include the refunded gas
+	ExtraGas   uint64 // Part of UsedGas charged up front by vm.Config.ExtraGas
 	Err        error  // Any error encountered during the execution(listed in core/vm/errors.go)
 	ReturnData []byte // Returned data from evm(function result or data supplied with revert opcode)
 }
@@ -128,71 +129,13 @@ func (result *ExecutionResult) Revert() []byte {
 
 // IntrinsicGas computes the 'intrinsic gas' for a message with the given data.
 func IntrinsicGas(data []byte, accessList types.AccessList, isContractCreation bool, isHomestead, isEIP2028 bool) (uint64, error) {
-	// Set the starting gas for the raw transaction
-	var gas uint64
-	if isContractCreation && isHomestead {
-		gas = params.TxGasContractCreation
-	} else {
-		gas = params.TxGas
+	// Access lists only come with Berlin transactions, they are charged whenever present
+	rules := params.Rules{IsHomestead: isHomestead, IsIstanbul: isEIP2028, IsBerlin: true}
+	gas, err := vm.IntrinsicGas(data, accessList, isContractCreation, rules)
+	if errors.Is(err, vm.ErrGasUintOverflow) {
+		return 0, ErrGasUintOverflow
 	}
-
-	// Auxiliary variables for overflow protection
-	var product, overflow uint64
-
-	// Bump the required gas by the amount of transactional data
-	if len(data) > 0 {
-		// Zero and non-zero bytes are priced differently
-		var nz uint64
-		for _, byt := range data {
-			if byt != 0 {
-				nz++
-			}
-		}
-		// Make sure we don't exceed uint64 for all data combinations
-		nonZeroGas := params.TxDataNonZeroGasFrontier
-		if isEIP2028 {
-			nonZeroGas = params.TxDataNonZeroGasEIP2028
-		}
-
-		overflow, product = bits.Mul64(nz, nonZeroGas)
-		if overflow != 0 {
-			return 0, ErrGasUintOverflow
-		}
-		gas, overflow = bits.Add64(gas, product, 0)
-		if overflow != 0 {
-			return 0, ErrGasUintOverflow
-		}
-
-		z := uint64(len(data)) - nz
-		overflow, product = bits.Mul64(z, params.TxDataZeroGas)
-		if overflow != 0 {
-			return 0, ErrGasUintOverflow
-		}
-		gas, overflow = bits.Add64(gas, product, 0)
-		if overflow != 0 {
-			return 0, ErrGasUintOverflow
-		}
-	}
-	if accessList != nil {
-		overflow, product = bits.Mul64(uint64(len(accessList)), params.TxAccessListAddressGas)
-		if overflow != 0 {
-			return 0, ErrGasUintOverflow
-		}
-		gas, overflow = bits.Add64(gas, product, 0)
-		if overflow != 0 {
-			return 0, ErrGasUintOverflow
-		}
-
-		overflow, product = bits.Mul64(uint64(accessList.StorageKeys()), params.TxAccessListStorageKeyGas)
-		if overflow != 0 {
-			return 0, ErrGasUintOverflow
-		}
-		gas, overflow = bits.Add64(gas, product, 0)
-		if overflow != 0 {
-			return 0, ErrGasUintOverflow
-		}
-	}
-	return gas, nil
+	return gas, err
 }
 
 // NewStateTransition initialises and returns a new state transition object.
@@ -384,10 +327,18 @@ func (st *StateTransition) TransitionDb(refunds bool, gasBailout bool) (*Executi
 	if err != nil {
 		return nil, err
 	}
-	if st.gas < gas {
-		return nil, fmt.Errorf("%w: have %d, want %d", ErrIntrinsicGas, st.gas, gas)
+	// The extra gas of the chain, if any, is charged along with it
+	var extraGas uint64
+	if extra := st.evm.Config().ExtraGas; extra != nil {
+		extraGas = extra(st.evm.TxContext(), st.data)
+		if gas+extraGas < gas {
+			return nil, ErrGasUintOverflow
+		}
+	}
+	if st.gas < gas+extraGas {
+		return nil, fmt.Errorf("%w: have %d, want %d", ErrIntrinsicGas, st.gas, gas+extraGas)
 	}
-	st.gas -= gas
+	st.gas -= gas + extraGas
 
 	var bailout bool
 	// Gas bailout (for trace_call) should only be applied if there is not sufficient balance to perform value transfer
@@ -399,7 +350,7 @@ func (st *StateTransition) TransitionDb(refunds bool, gasBailout bool) (*Executi
 
 	// Set up the initial access list.
 	if st.evm.ChainRules().IsBerlin {
-		st.state.PrepareAccessList(msg.From(), msg.To(), vm.ActivePrecompiles(st.evm.ChainRules()), msg.AccessList())
+		st.state.PrepareAccessList(msg.From(), msg.To(), vm.ActivePrecompilesWith(st.evm.ChainRules(), st.evm.Config().Precompiles), msg.AccessList())
 	}
 
 	var (
@@ -417,13 +368,19 @@ func (st *StateTransition) TransitionDb(refunds bool, gasBailout bool) (*Executi
 		st.state.SetNonce(msg.From(), st.state.GetNonce(sender.Address())+1)
 		ret, st.gas, vmerr = st.evm.Call(sender, st.to(), st.data, st.gas, st.value, bailout)
 	}
+	var refund uint64
 	if refunds {
 		if london {
 			// After EIP-3529: refunds are capped to gasUsed / 5
-			st.refundGas(params.RefundQuotientEIP3529)
+			refund = st.refundGas(params.RefundQuotientEIP3529)
 		} else {
 			// Before EIP-3529: refunds were capped to gasUsed / 2
-			st.refundGas(params.RefundQuotient)
+			refund = st.refundGas(params.RefundQuotient)
+		}
+	}
+	if cfg := st.evm.Config(); cfg.Debug {
+		if tracer, ok := cfg.Tracer.(vm.TxEndTracer); ok {
+			tracer.CaptureTxEnd(st.gas, refund)
 		}
 	}
 	effectiveTip := st.gasPrice
@@ -463,12 +420,15 @@ func (st *StateTransition) TransitionDb(refunds bool, gasBailout bool) (*Executi
 
 	return &ExecutionResult{
 		UsedGas:    st.gasUsed(),
+		ExtraGas:   extraGas,
 		Err:        vmerr,
 		ReturnData: ret,
 	}, nil
 }
 
-func (st *StateTransition) refundGas(refundQuotient uint64) {
+// refundGas applies the refund counter and gives the remaining gas back to the
+// sender and the gas pool, returning the refunded gas.
+func (st *StateTransition) refundGas(refundQuotient uint64) uint64 {
 	// Apply refund counter, capped to half of the used gas.
 	refund := st.gasUsed() / refundQuotient
 	if refund > st.state.GetRefund() {
@@ -483,6 +443,7 @@ func (st *StateTransition) refundGas(refundQuotient uint64) {
 	// Also return remaining gas to the block gas counter so it is
 	// available for the next transaction.
 	st.gp.AddGas(st.gas)
+	return refund
 }
 
 // gasUsed returns the amount of gas used up by the state transition.
@@ -0,0 +1,137 @@
+package core
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/holiman/uint256"
+	"github.com/ledgerwatch/erigon-lib/kv/memdb"
+
+	"github.com/ledgerwatch/erigon/common"
+	"github.com/ledgerwatch/erigon/consensus/ethash"
+	"github.com/ledgerwatch/erigon/core/state"
+	"github.com/ledgerwatch/erigon/core/types"
+	"github.com/ledgerwatch/erigon/core/vm"
+	"github.com/ledgerwatch/erigon/crypto"
+	"github.com/ledgerwatch/erigon/params"
+)
+
+// txEndTracer records the CaptureTxEnd of a transaction.
+type txEndTracer struct {
+	*vm.StructLogger
+	restGas, refund uint64
+	calls           int
+}
+
+func (t *txEndTracer) CaptureTxEnd(restGas uint64, refund uint64) {
+	t.restGas, t.refund = restGas, refund
+	t.calls++
+}
+
+func TestCaptureTxEnd(t *testing.T) {
+	config := *params.AllEthashProtocolChanges
+	config.LondonBlock = big.NewInt(0)
+	var (
+		key, _   = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+		sender   = crypto.PubkeyToAddress(key.PublicKey)
+		clearer  = common.HexToAddress("0xaa")
+		reverter = common.HexToAddress("0xbb")
+		signer   = types.LatestSignerForChainID(config.ChainID)
+	)
+	_, tx := memdb.NewTestTx(t)
+	ibs := state.New(state.NewPlainStateReader(tx))
+	ibs.AddBalance(sender, uint256.NewInt(params.Ether))
+	// SSTORE(0, 0), SSTORE(1, 0)
+	clear := []byte{byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.SSTORE), byte(vm.PUSH1), 0, byte(vm.PUSH1), 1, byte(vm.SSTORE)}
+	ibs.SetCode(clearer, append(clear, byte(vm.STOP)))
+	// The same, then REVERT(0, 0)
+	ibs.SetCode(reverter, append(clear, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.REVERT)))
+	for _, addr := range []common.Address{clearer, reverter} {
+		for _, slot := range []common.Hash{{}, {31: 1}} {
+			ibs.SetState(addr, &slot, *uint256.NewInt(1))
+		}
+	}
+
+	var txs []types.Transaction
+	for nonce, to := range []common.Address{clearer, reverter} {
+		signed, err := types.SignTx(types.NewTransaction(uint64(nonce), to, new(uint256.Int), 100000, uint256.NewInt(1), nil), *signer, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		txs = append(txs, signed)
+	}
+	header := &types.Header{Number: big.NewInt(1), GasLimit: 10000000, Difficulty: big.NewInt(1), BaseFee: big.NewInt(1)}
+	block := types.NewBlock(header, txs, nil, nil)
+
+	tracers := make([]*txEndTracer, len(txs))
+	results, err := TraceBlock(&config, block, ibs, func(uint64) common.Hash { return common.Hash{} }, ethash.NewFaker(), vm.Config{}, func(txIndex int) vm.Tracer {
+		tracers[txIndex] = &txEndTracer{StructLogger: vm.NewStructLogger(nil)}
+		return tracers[txIndex]
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, tracer := range tracers {
+		if tracer.calls != 1 {
+			t.Fatalf("tx %d: CaptureTxEnd called %d times", i, tracer.calls)
+		}
+		if used := results[i].Result.UsedGas; tracer.restGas != 100000-used {
+			t.Errorf("tx %d: have rest gas %d, want %d", i, tracer.restGas, 100000-used)
+		}
+	}
+	// The refund of clearing two slots exceeds the EIP-3529 cap
+	if used := results[0].Result.UsedGas + tracers[0].refund; tracers[0].refund != used/params.RefundQuotientEIP3529 {
+		t.Errorf("have refund %d, want the cap %d", tracers[0].refund, used/params.RefundQuotientEIP3529)
+	}
+	if !results[1].Result.Failed() || tracers[1].refund != 0 {
+		t.Errorf("have refund %d for the reverted transaction", tracers[1].refund)
+	}
+}
+
+func TestExtraGas(t *testing.T) {
+	var (
+		config = params.AllEthashProtocolChanges
+		key, _ = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+		sender = crypto.PubkeyToAddress(key.PublicKey)
+		to     = common.HexToAddress("0xaa")
+		signer = types.LatestSignerForChainID(config.ChainID)
+	)
+	// A data fee of 100 gas per byte
+	extraGas := func(txCtx vm.TxContext, data []byte) uint64 {
+		if txCtx.Origin != sender {
+			t.Errorf("unexpected origin %x", txCtx.Origin)
+		}
+		return 100 * uint64(len(data))
+	}
+	apply := func(gas uint64, cfg vm.Config) (*ExecutionResult, error) {
+		_, tx := memdb.NewTestTx(t)
+		ibs := state.New(state.NewPlainStateReader(tx))
+		ibs.AddBalance(sender, uint256.NewInt(params.Ether))
+		signed, err := types.SignTx(types.NewTransaction(0, to, new(uint256.Int), gas, uint256.NewInt(1), []byte{1, 2, 3}), *signer, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg, err := signed.AsMessage(*signer, nil, config.Rules(0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		evm := vm.NewEVM(vm.BlockContext{CanTransfer: CanTransfer, Transfer: Transfer}, NewEVMTxContext(msg), ibs, config, cfg)
+		return ApplyMessage(evm, msg, new(GasPool).AddGas(gas), true /* refunds */, false /* gasBailout */)
+	}
+	plain, err := apply(100000, vm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l2, err := apply(100000, vm.Config{ExtraGas: extraGas})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plain.ExtraGas != 0 || l2.ExtraGas != 300 || l2.UsedGas != plain.UsedGas+300 {
+		t.Errorf("have used gas %d and extra gas %d, want %d and 300", l2.UsedGas, l2.ExtraGas, plain.UsedGas+300)
+	}
+	// The extra gas must be covered like the intrinsic gas
+	if _, err := apply(plain.UsedGas+299, vm.Config{ExtraGas: extraGas}); !errors.Is(err, ErrIntrinsicGas) {
+		t.Errorf("unexpected error %v", err)
+	}
+}
@@ -0,0 +1,58 @@
+package core
+
+import (
+	"fmt"
+
+	"github.com/ledgerwatch/erigon/common"
+	"github.com/ledgerwatch/erigon/consensus"
+	"github.com/ledgerwatch/erigon/core/state"
+	"github.com/ledgerwatch/erigon/core/types"
+	"github.com/ledgerwatch/erigon/core/vm"
+	"github.com/ledgerwatch/erigon/params"
+)
+
+// TraceResult is the outcome of a transaction traced by TraceBlock.
+type TraceResult struct {
+	TxHash common.Hash
+	Tracer vm.Tracer // as returned by the tracer factory, nil if not traced
+	Result *ExecutionResult
+}
+
+// TraceBlock executes the transactions of the block one after the other on top
+// of ibs, which must hold the state of the parent block, and traces each with
+// the tracer returned by tracerFactory for its index, nil meaning no tracing.
+// A single EVM is reused across the transactions. The fees are paid to the
+// coinbase as part of each transaction, but the block and uncle rewards are
+// not applied. An error is returned if a transaction cannot be applied, which
+// only happens for invalid blocks.
+func TraceBlock(config *params.ChainConfig, block *types.Block, ibs *state.IntraBlockState, blockHashFunc func(n uint64) common.Hash, engine consensus.Engine, cfg vm.Config, tracerFactory func(txIndex int) vm.Tracer) ([]TraceResult, error) {
+	header := block.Header()
+	cfg.SkipAnalysis = SkipAnalysis(config, header.Number.Uint64())
+	blockContext := NewEVMBlockContext(header, blockHashFunc, engine, nil)
+	evm := vm.NewEVM(blockContext, vm.TxContext{}, ibs, config, cfg)
+	rules := evm.ChainRules()
+	signer := types.MakeSigner(config, header.Number.Uint64())
+	gp := new(GasPool).AddGas(header.GasLimit)
+
+	results := make([]TraceResult, 0, len(block.Transactions()))
+	for i, tx := range block.Transactions() {
+		msg, err := tx.AsMessage(*signer, header.BaseFee, rules)
+		if err != nil {
+			return nil, fmt.Errorf("transaction %x: %w", tx.Hash(), err)
+		}
+		ibs.Prepare(tx.Hash(), block.Hash(), i)
+
+		tracer := tracerFactory(i)
+		evm.SetTracer(tracer)
+		evm.Reset(NewEVMTxContext(msg), ibs)
+		result, err := ApplyMessage(evm, msg, gp, true /* refunds */, false /* gasBailout */)
+		if err != nil {
+			return nil, fmt.Errorf("transaction %x failed: %w", tx.Hash(), err)
+		}
+		if err = ibs.FinalizeTx(rules, state.NewNoopWriter()); err != nil {
+			return nil, err
+		}
+		results = append(results, TraceResult{TxHash: tx.Hash(), Tracer: tracer, Result: result})
+	}
+	return results, nil
+}
@@ -0,0 +1,87 @@
+package core
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/holiman/uint256"
+	"github.com/ledgerwatch/erigon-lib/kv/memdb"
+
+	"github.com/ledgerwatch/erigon/common"
+	"github.com/ledgerwatch/erigon/consensus/ethash"
+	"github.com/ledgerwatch/erigon/core/state"
+	"github.com/ledgerwatch/erigon/core/types"
+	"github.com/ledgerwatch/erigon/core/vm"
+	"github.com/ledgerwatch/erigon/crypto"
+	"github.com/ledgerwatch/erigon/params"
+)
+
+func TestTraceBlock(t *testing.T) {
+	var (
+		config   = params.AllEthashProtocolChanges
+		key, _   = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+		sender   = crypto.PubkeyToAddress(key.PublicKey)
+		counter  = common.HexToAddress("0xaa")
+		coinbase = common.HexToAddress("0xcb")
+		signer   = types.LatestSignerForChainID(config.ChainID)
+	)
+	_, tx := memdb.NewTestTx(t)
+	ibs := state.New(state.NewPlainStateReader(tx))
+	ibs.AddBalance(sender, uint256.NewInt(params.Ether))
+	// SSTORE(0, SLOAD(0) + 1)
+	ibs.SetCode(counter, []byte{byte(vm.PUSH1), 1, byte(vm.PUSH1), 0, byte(vm.SLOAD), byte(vm.ADD), byte(vm.PUSH1), 0, byte(vm.SSTORE)})
+
+	var txs []types.Transaction
+	for nonce := uint64(0); nonce < 3; nonce++ {
+		signed, err := types.SignTx(types.NewTransaction(nonce, counter, new(uint256.Int), 100000, uint256.NewInt(1), nil), *signer, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		txs = append(txs, signed)
+	}
+	header := &types.Header{Number: big.NewInt(1), GasLimit: 10000000, Difficulty: big.NewInt(1), Coinbase: coinbase}
+	block := types.NewBlock(header, txs, nil, nil)
+
+	// The second transaction is left untraced
+	tracers := make(map[int]*vm.StructLogger)
+	results, err := TraceBlock(config, block, ibs, func(uint64) common.Hash { return common.Hash{} }, ethash.NewFaker(), vm.Config{}, func(txIndex int) vm.Tracer {
+		if txIndex == 1 {
+			return nil
+		}
+		tracers[txIndex] = vm.NewStructLogger(nil)
+		return tracers[txIndex]
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 3 {
+		t.Fatalf("expected 3 results, got %d", len(results))
+	}
+	var fees uint64
+	for i, res := range results {
+		if res.TxHash != txs[i].Hash() || res.Result.Failed() {
+			t.Errorf("tx %d: unexpected result %+v", i, res)
+		}
+		if (res.Tracer == nil) != (i == 1) {
+			t.Errorf("tx %d: unexpected tracer %v", i, res.Tracer)
+		}
+		fees += res.Result.UsedGas
+	}
+	// Each transaction sees the state left by the previous ones
+	for i, want := range map[int]uint64{0: 0, 2: 2} {
+		logs := tracers[i].StructLogs()
+		if len(logs) < 4 || logs[3].Op != vm.ADD || logs[3].Stack[1].Uint64() != want {
+			t.Errorf("tx %d: unexpected counter value in trace", i)
+		}
+	}
+	var (
+		slot  common.Hash
+		value uint256.Int
+	)
+	if ibs.GetState(counter, &slot, &value); value.Uint64() != 3 {
+		t.Errorf("unexpected counter %d", value.Uint64())
+	}
+	if got := ibs.GetBalance(coinbase).Uint64(); got != fees {
+		t.Errorf("coinbase received %d, want %d", got, fees)
+	}
+}
@@ -20,6 +20,7 @@ import (
 	"math/big"
 	"time"
 
+	"github.com/holiman/uint256"
 	"github.com/ledgerwatch/erigon/common"
 	"github.com/ledgerwatch/erigon/core/types"
 )
@@ -114,13 +115,11 @@ type AccessListTracer struct {
 	list accessList                  // Set of accounts and storage slots touched
 }
 
-func (a *AccessListTracer) CaptureAccountWrite(account common.Address) error {
-	panic("implement me")
-}
-
 // NewAccessListTracer creates a new tracer that can generate AccessLists.
 // An optional AccessList can be specified to occupy slots and addresses in
-// the resulting accesslist.
+// the resulting accesslist. The sender, the destination and the precompiles
+// are warm regardless of the list, so they are left out of it unless some of
+// their storage slots are accessed.
 func NewAccessListTracer(acl types.AccessList, from, to common.Address, precompiles []common.Address) *AccessListTracer {
 	excl := map[common.Address]struct{}{
 		from: {}, to: {},
@@ -143,6 +142,9 @@ func NewAccessListTracer(acl types.AccessList, from, to common.Address, precompi
 	}
 }
 
+func (a *AccessListTracer) CaptureEnter(typ OpCode, from common.Address, to common.Address, input []byte, gas uint64, value *uint256.Int) {
+}
+
 // CaptureState captures all opcodes that touch storage or addresses and adds them to the accesslist.
 func (a *AccessListTracer) CaptureState(env *EVM, pc uint64, op OpCode, gas, cost uint64, scope *ScopeContext, rData []byte, depth int, err error) {
 	stack := scope.Stack
@@ -171,7 +173,9 @@ func (*AccessListTracer) CaptureEnd(depth int, output []byte, startGas, endGas u
 }
 
 func (a *AccessListTracer) CaptureStart(env *EVM, depth int, from common.Address, to common.Address, precompile bool, create bool, callType CallType, input []byte, gas uint64, value *big.Int, code []byte) {
-	panic("implement me")
+}
+
+func (a *AccessListTracer) CaptureExit(output []byte, gasUsed uint64, err error) {
 }
 
 func (a *AccessListTracer) CaptureSelfDestruct(from common.Address, to common.Address, value *big.Int) {
@@ -181,6 +185,10 @@ func (a *AccessListTracer) CaptureAccountRead(account common.Address) error {
 	return nil
 }
 
+func (a *AccessListTracer) CaptureAccountWrite(account common.Address) error {
+	return nil
+}
+
 // AccessList returns the current accesslist maintained by the tracer.
 func (a *AccessListTracer) AccessList() types.AccessList {
 	return a.list.accessList()
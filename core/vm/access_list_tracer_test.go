@@ -0,0 +1,62 @@
+package vm
+
+import (
+	"testing"
+
+	"github.com/holiman/uint256"
+
+	"github.com/ledgerwatch/erigon/common"
+	"github.com/ledgerwatch/erigon/core/types"
+)
+
+func TestAccessListTracer(t *testing.T) {
+	var (
+		sender  = common.HexToAddress("0x01")
+		outer   = common.HexToAddress("0xaa")
+		storage = common.HexToAddress("0xbb")
+		queried = common.HexToAddress("0xcc")
+		sha256  = common.BytesToAddress([]byte{2})
+	)
+	tracer := NewAccessListTracer(nil, sender, outer, []common.Address{sha256})
+	vmenv, s := newTestEVM(t, Config{Debug: true, Tracer: tracer})
+	// staticCall performs a STATICCALL to the given address without input
+	staticCall := func(addr byte) []byte {
+		return []byte{byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), addr, byte(GAS), byte(STATICCALL), byte(POP)}
+	}
+	// SLOAD(1), BALANCE(0xcc), BALANCE(0x01) and calls to 0xbb and sha256
+	code := []byte{byte(PUSH1), 1, byte(SLOAD), byte(POP), byte(PUSH1), 0xcc, byte(BALANCE), byte(POP), byte(PUSH1), 0x01, byte(BALANCE), byte(POP)}
+	code = append(code, staticCall(0xbb)...)
+	code = append(code, staticCall(0x02)...)
+	s.SetCode(outer, append(code, byte(STOP)))
+	// EXTCODESIZE(0xbb) touches itself without slots, then SLOAD(2) and SLOAD(3)
+	s.SetCode(storage, []byte{byte(PUSH1), 0xbb, byte(EXTCODESIZE), byte(POP), byte(PUSH1), 2, byte(SLOAD), byte(POP), byte(PUSH1), 3, byte(SLOAD), byte(STOP)})
+
+	if _, _, err := vmenv.Call(AccountRef(sender), outer, nil, 1000000, new(uint256.Int), false /* bailout */); err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[common.Address]types.AccessTuple)
+	for _, tuple := range tracer.AccessList() {
+		if _, ok := got[tuple.Address]; ok {
+			t.Errorf("address %x listed twice", tuple.Address)
+		}
+		got[tuple.Address] = tuple
+	}
+	if len(got) != 3 {
+		t.Errorf("unexpected access list %v", tracer.AccessList())
+	}
+	// The destination is only listed for its storage slot
+	if tuple := got[outer]; len(tuple.StorageKeys) != 1 || tuple.StorageKeys[0] != common.BigToHash(common.Big1) {
+		t.Errorf("unexpected destination entry %+v", tuple)
+	}
+	if tuple, ok := got[storage]; !ok || len(tuple.StorageKeys) != 2 {
+		t.Errorf("unexpected storage entry %+v", tuple)
+	}
+	if tuple, ok := got[queried]; !ok || len(tuple.StorageKeys) != 0 {
+		t.Errorf("unexpected queried entry %+v", tuple)
+	}
+	for _, excluded := range []common.Address{sender, sha256} {
+		if _, ok := got[excluded]; ok {
+			t.Errorf("address %x should be excluded", excluded)
+		}
+	}
+}
@@ -16,6 +16,15 @@
 
 package vm
 
+// pushDataSize returns the number of immediate bytes following op in the code,
+// which is only non-zero for PUSH1..PUSH32.
+func pushDataSize(op OpCode) int {
+	if op >= PUSH1 && op <= PUSH32 {
+		return int(op - PUSH1 + 1)
+	}
+	return 0
+}
+
 // codeBitmap collects data locations in code.
 func codeBitmap(code []byte) []uint64 {
 	// The bitmap is 4 bytes longer than necessary, in case the code
@@ -26,9 +35,8 @@ func codeBitmap(code []byte) []uint64 {
 	for pc := 0; pc < len(code); {
 		op := OpCode(code[pc])
 		pc++
-		if op >= PUSH1 && op <= PUSH32 {
-			numbits := int(op - PUSH1 + 1)
-			x := uint64(1) << (op - PUSH1)
+		if numbits := pushDataSize(op); numbits > 0 {
+			x := uint64(1) << (numbits - 1)
 			x = x | (x - 1) // Smear the bit to the right
 			idx := pc / 64
 			shift := pc & 63
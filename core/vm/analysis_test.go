@@ -100,3 +100,23 @@ func BenchmarkJumpDest(b *testing.B) {
 		b.StopTimer()
 	}
 }
+
+func TestContractJumpDest(t *testing.T) {
+	// PUSH1 0x5b; JUMPDEST; PUSH2 0x5b5b; JUMPDEST
+	code := []byte{byte(PUSH1), 0x5b, byte(JUMPDEST), byte(PUSH2), 0x5b, 0x5b, byte(JUMPDEST)}
+	for _, hash := range []common.Hash{{}, crypto.Keccak256Hash(code)} {
+		contract := NewContract(AccountRef(common.Address{}), AccountRef(common.Address{}), new(uint256.Int), 0, false /* skipAnalysis */)
+		contract.SetCallCode(&common.Address{}, hash, code)
+		for pc, want := range []bool{false, false, true, false, false, false, true, false} {
+			if got := contract.HasJumpDest(uint64(pc)); got != want {
+				t.Errorf("code hash %x, pc %d: got %v, want %v", hash, pc, got, want)
+			}
+		}
+		if op := contract.OpCodeAt(1); op != JUMPDEST {
+			t.Errorf("expected the raw PUSH data byte, got %v", op)
+		}
+		if op := contract.OpCodeAt(uint64(len(code))); op != STOP {
+			t.Errorf("expected STOP beyond the code, got %v", op)
+		}
+	}
+}
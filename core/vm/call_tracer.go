@@ -0,0 +1,398 @@
+package vm
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"math/big"
+	"time"
+
+	"github.com/holiman/uint256"
+
+	"github.com/ledgerwatch/erigon/accounts/abi"
+	"github.com/ledgerwatch/erigon/common"
+	"github.com/ledgerwatch/erigon/common/hexutil"
+	"github.com/ledgerwatch/erigon/params"
+)
+
+// CallFrame is a single node of the call tree built by the CallTracer. Its
+// JSON encoding follows the schema of the well known callTracer.
+type CallFrame struct {
+	Type        string         `json:"type"`
+	From        common.Address `json:"from"`
+	To          common.Address `json:"to,omitempty"`
+	Value       *hexutil.Big   `json:"value,omitempty"`
+	Gas         hexutil.Uint64 `json:"gas"`               // gas at entry, after the EIP-150 cap and the stipend
+	Stipend     hexutil.Uint64 `json:"stipend,omitempty"` // part of Gas added to value transfers, not forwarded by the caller
+	GasUsed     hexutil.Uint64 `json:"gasUsed"`
+	GasLeft     hexutil.Uint64 `json:"gasLeft"`               // gas at exit, returned to the caller
+	SelfGasUsed hexutil.Uint64 `json:"selfGasUsed,omitempty"` // GasUsed less that of the sub-calls, see processGas
+	Input       hexutil.Bytes  `json:"input"`
+	Output      hexutil.Bytes  `json:"output,omitempty"`
+	Error       string         `json:"error,omitempty"`
+	Calls       []CallFrame    `json:"calls,omitempty"`
+	Logs        []CallLog      `json:"logs,omitempty"`
+	Decoded     *DecodedCall   `json:"decoded,omitempty"` // Input and Output decoded with the ABIs set with SetABIs
+
+	MaxStackHeight int `json:"maxStackHeight,omitempty"` // highest stack of the frame, with Config.EnableStackStats
+
+	// StorageAddress is the address whose storage and balance a DELEGATECALL
+	// or CALLCODE frame runs against, the one of its caller, while To is the
+	// address its code is loaded from. It is not set for other frames, which
+	// run against To.
+	StorageAddress *common.Address `json:"storageAddress,omitempty"`
+
+	// The stages of the gas accounting of the call, which are not set for the
+	// top-level frame. The caller pays GasBase for the call itself (access,
+	// value transfer, new account and memory expansion), leaving GasAvailable,
+	// all but 1/64 of which can be forwarded (EIP-150). The callee gets the
+	// lesser of that and GasRequested, the gas argument of the CALL family,
+	// plus the Stipend, as Gas, and GasLeft goes back to the caller on return.
+	// Created frames have no gas argument.
+	GasBase      *hexutil.Uint64 `json:"gasBase,omitempty"`
+	GasRequested *hexutil.Uint64 `json:"gasRequested,omitempty"`
+	GasAvailable *hexutil.Uint64 `json:"gasAvailable,omitempty"`
+}
+
+// callGasStages holds the gas accounting of a call before it enters its
+// frame, see CallFrame.GasBase.
+type callGasStages struct {
+	base, requested, available *hexutil.Uint64
+}
+
+// ABIRegistry holds the ABIs the CallTracer decodes calls with: that of the
+// called address if known, or else the method matching the selector.
+type ABIRegistry struct {
+	Contracts map[common.Address]abi.ABI
+	Methods   map[[4]byte]abi.Method
+}
+
+// method returns the method called by the input sent to addr, or nil.
+func (r *ABIRegistry) method(addr common.Address, input []byte) *abi.Method {
+	if len(input) < 4 {
+		return nil
+	}
+	if contract, ok := r.Contracts[addr]; ok {
+		if method, err := contract.MethodById(input); err == nil {
+			return method
+		}
+	}
+	if method, ok := r.Methods[*(*[4]byte)(input)]; ok {
+		return &method
+	}
+	return nil
+}
+
+// DecodedCall is the input and output of a call frame decoded with the ABI of
+// the called method. Outputs are only set for successful calls.
+type DecodedCall struct {
+	Method  string         `json:"method"` // signature, e.g. transfer(address,uint256)
+	Inputs  []DecodedValue `json:"inputs"`
+	Outputs []DecodedValue `json:"outputs,omitempty"`
+}
+
+// DecodedValue is an argument or result of a DecodedCall, with the Go value
+// the abi package decodes its type to.
+type DecodedValue struct {
+	Name  string      `json:"name,omitempty"`
+	Type  string      `json:"type"`
+	Value interface{} `json:"value"`
+}
+
+// decodeValues decodes data with the given arguments.
+func decodeValues(args abi.Arguments, data []byte) ([]DecodedValue, error) {
+	values, err := args.UnpackValues(data)
+	if err != nil {
+		return nil, err
+	}
+	decoded := make([]DecodedValue, len(values))
+	for i, arg := range args.NonIndexed() {
+		decoded[i] = DecodedValue{Name: arg.Name, Type: arg.Type.String(), Value: values[i]}
+	}
+	return decoded, nil
+}
+
+// decode fills in Decoded for the calls into methods of the registry. Calls
+// that fail to decode keep their raw input and output only.
+func (f *CallFrame) decode(abis *ABIRegistry) {
+	if abis == nil || f.Type == CREATE.String() || f.Type == CREATE2.String() {
+		return
+	}
+	method := abis.method(f.To, f.Input)
+	if method == nil {
+		return
+	}
+	inputs, err := decodeValues(method.Inputs, f.Input[4:])
+	if err != nil {
+		return
+	}
+	f.Decoded = &DecodedCall{Method: method.Sig, Inputs: inputs}
+	if f.Error == "" {
+		f.Decoded.Outputs, _ = decodeValues(method.Outputs, f.Output)
+	}
+}
+
+// CallLog is a log emitted by a call frame, recorded by a CallTracer created
+// with NewCallTracerWithLogs.
+type CallLog struct {
+	Address  common.Address `json:"address"`
+	Topics   []common.Hash  `json:"topics"`
+	Data     hexutil.Bytes  `json:"data"`
+	Position hexutil.Uint   `json:"position"`           // number of sub-calls made by the frame before the log
+	Reverted bool           `json:"reverted,omitempty"` // discarded by the failure of this or an enclosing frame
+}
+
+// revertLogs flags the logs of the frame and of its sub-calls as reverted, or
+// drops them.
+func (f *CallFrame) revertLogs(drop bool) {
+	if drop {
+		f.Logs = nil
+	}
+	for i := range f.Logs {
+		f.Logs[i].Reverted = true
+	}
+	for i := range f.Calls {
+		f.Calls[i].revertLogs(drop)
+	}
+}
+
+// processGas records the gas used by the frame and its sub-calls, which are
+// all known by then, and the part of it used by the frame itself. The latter is
+// zero if the sub-calls used more, thanks to the stipend of value transfers.
+// Failed frames used gas up to the point of failure.
+func (f *CallFrame) processGas(gasUsed uint64) {
+	f.GasUsed = hexutil.Uint64(gasUsed)
+	if gasUsed <= uint64(f.Gas) {
+		f.GasLeft = f.Gas - f.GasUsed
+	}
+	var subtree uint64
+	for i := range f.Calls {
+		subtree += uint64(f.Calls[i].GasUsed)
+	}
+	if subtree < gasUsed {
+		f.SelfGasUsed = hexutil.Uint64(gasUsed - subtree)
+	}
+}
+
+// processOutput fills in the outcome of the frame. Output of failed frames is
+// only kept for reverts, where it carries the revert reason.
+func (f *CallFrame) processOutput(output []byte, err error) {
+	if err == nil || errors.Is(err, ErrExecutionReverted) {
+		f.Output = common.CopyBytes(output)
+	}
+	if err != nil {
+		f.Error = err.Error()
+	}
+}
+
+var (
+	_ LogTracer         = (*CallTracer)(nil)
+	_ StackHeightTracer = (*CallTracer)(nil)
+)
+
+// CallTracer is a native tracer that reconstructs the tree of call frames of
+// a transaction from the CaptureEnter/CaptureExit hooks, without looking at
+// individual opcodes.
+type CallTracer struct {
+	callstack    []CallFrame
+	withLogs     bool // record the logs of every frame
+	dropReverted bool // drop the logs of failed frames instead of flagging them
+	abis         *ABIRegistry
+
+	next callGasStages // of the call or create about to enter its frame
+}
+
+// NewCallTracer returns a new call tree tracer.
+func NewCallTracer() *CallTracer {
+	return &CallTracer{}
+}
+
+// NewCallTracerWithLogs returns a new call tree tracer that also records the
+// logs emitted by each frame. Logs of failed frames are flagged as reverted, or
+// dropped if dropReverted is set.
+func NewCallTracerWithLogs(dropReverted bool) *CallTracer {
+	return &CallTracer{withLogs: true, dropReverted: dropReverted}
+}
+
+// SetABIs makes the tracer decode the calls into the methods of the registry,
+// see CallFrame.Decoded. It must be set before tracing.
+func (t *CallTracer) SetABIs(abis *ABIRegistry) {
+	t.abis = abis
+}
+
+func (t *CallTracer) CaptureStart(env *EVM, depth int, from common.Address, to common.Address, precompile bool, create bool, callType CallType, input []byte, gas uint64, value *big.Int, code []byte) {
+	if depth != 0 {
+		return
+	}
+	typ := CALL
+	switch callType {
+	case CREATET:
+		typ = CREATE
+	case CREATE2T:
+		typ = CREATE2
+	}
+	root := CallFrame{
+		Type:  typ.String(),
+		From:  from,
+		To:    to,
+		Gas:   hexutil.Uint64(gas),
+		Input: common.CopyBytes(input),
+	}
+	if value != nil {
+		root.Value = (*hexutil.Big)(new(big.Int).Set(value))
+	}
+	t.callstack = []CallFrame{root}
+}
+
+func (t *CallTracer) CaptureEnter(typ OpCode, from common.Address, to common.Address, input []byte, gas uint64, value *uint256.Int) {
+	frame := CallFrame{
+		Type:  typ.String(),
+		From:  from,
+		To:    to,
+		Gas:   hexutil.Uint64(gas),
+		Input: common.CopyBytes(input),
+
+		GasBase:      t.next.base,
+		GasRequested: t.next.requested,
+		GasAvailable: t.next.available,
+	}
+	t.next = callGasStages{}
+	if typ == DELEGATECALL || typ == CALLCODE {
+		storage := from
+		frame.StorageAddress = &storage
+	}
+	if value != nil {
+		frame.Value = (*hexutil.Big)(value.ToBig())
+		if (typ == CALL || typ == CALLCODE) && !value.IsZero() {
+			frame.Stipend = hexutil.Uint64(params.CallStipend)
+		}
+	}
+	t.callstack = append(t.callstack, frame)
+}
+
+// CaptureState records the gas accounting of the CALL and CREATE families for
+// the frame they enter next, if they don't fail before that.
+func (t *CallTracer) CaptureState(env *EVM, pc uint64, op OpCode, gas, cost uint64, scope *ScopeContext, rData []byte, depth int, err error) {
+	t.next = callGasStages{}
+	if err != nil {
+		return
+	}
+	switch op {
+	case CALL, CALLCODE, DELEGATECALL, STATICCALL:
+		// The cost includes the gas forwarded to the callee
+		if cost < env.callGasTemp || gas < cost-env.callGasTemp {
+			return
+		}
+		requested, overflow := scope.Stack.Back(0).Uint64WithOverflow()
+		if overflow {
+			requested = math.MaxUint64
+		}
+		base := cost - env.callGasTemp
+		available := gas - base
+		t.next = callGasStages{(*hexutil.Uint64)(&base), (*hexutil.Uint64)(&requested), (*hexutil.Uint64)(&available)}
+	case CREATE, CREATE2:
+		if gas < cost {
+			return
+		}
+		available := gas - cost
+		t.next = callGasStages{base: (*hexutil.Uint64)(&cost), available: (*hexutil.Uint64)(&available)}
+	}
+}
+
+func (t *CallTracer) CaptureFault(env *EVM, pc uint64, op OpCode, gas, cost uint64, scope *ScopeContext, depth int, err error) {
+}
+
+func (t *CallTracer) CaptureEnd(depth int, output []byte, startGas, endGas uint64, d time.Duration, err error) {
+	if depth != 0 || len(t.callstack) == 0 {
+		return
+	}
+	t.callstack[0].processGas(startGas - endGas)
+	t.callstack[0].processOutput(output, err)
+	t.callstack[0].decode(t.abis)
+	if err != nil {
+		t.callstack[0].revertLogs(t.dropReverted)
+	}
+}
+
+func (t *CallTracer) CaptureExit(output []byte, gasUsed uint64, err error) {
+	size := len(t.callstack)
+	if size <= 1 {
+		return
+	}
+	call := t.callstack[size-1]
+	t.callstack = t.callstack[:size-1]
+	size--
+
+	call.processGas(gasUsed)
+	call.processOutput(output, err)
+	call.decode(t.abis)
+	if err != nil {
+		call.revertLogs(t.dropReverted)
+	}
+	t.callstack[size-1].Calls = append(t.callstack[size-1].Calls, call)
+}
+
+// CaptureSelfDestruct records the self-destruct as a leaf of the current frame,
+// with the beneficiary as the recipient of the remaining balance.
+func (t *CallTracer) CaptureSelfDestruct(from common.Address, to common.Address, value *big.Int) {
+	size := len(t.callstack)
+	if size == 0 {
+		return
+	}
+	frame := CallFrame{
+		Type:  SELFDESTRUCT.String(),
+		From:  from,
+		To:    to,
+		Input: []byte{},
+	}
+	if value != nil {
+		frame.Value = (*hexutil.Big)(new(big.Int).Set(value))
+	}
+	t.callstack[size-1].Calls = append(t.callstack[size-1].Calls, frame)
+}
+
+// CaptureLog records the log in the current frame when logs are requested.
+func (t *CallTracer) CaptureLog(depth int, pc uint64, addr common.Address, topics []common.Hash, data []byte) {
+	size := len(t.callstack)
+	if !t.withLogs || size == 0 {
+		return
+	}
+	frame := &t.callstack[size-1]
+	frame.Logs = append(frame.Logs, CallLog{
+		Address:  addr,
+		Topics:   append([]common.Hash{}, topics...),
+		Data:     common.CopyBytes(data),
+		Position: hexutil.Uint(len(frame.Calls)),
+	})
+}
+
+// CaptureStackHeight records the highest stack of the returning frame.
+func (t *CallTracer) CaptureStackHeight(depth int, maxHeight int) {
+	if size := len(t.callstack); size > 0 {
+		t.callstack[size-1].MaxStackHeight = maxHeight
+	}
+}
+
+func (t *CallTracer) CaptureAccountRead(account common.Address) error {
+	return nil
+}
+
+func (t *CallTracer) CaptureAccountWrite(account common.Address) error {
+	return nil
+}
+
+// Result returns the root of the call tree, or nil if nothing was traced.
+func (t *CallTracer) Result() *CallFrame {
+	if len(t.callstack) == 0 {
+		return nil
+	}
+	return &t.callstack[0]
+}
+
+// GetResult returns the call tree encoded in the callTracer JSON format.
+func (t *CallTracer) GetResult() (json.RawMessage, error) {
+	if len(t.callstack) != 1 {
+		return nil, errors.New("incorrect number of top-level calls")
+	}
+	return json.Marshal(&t.callstack[0])
+}
@@ -0,0 +1,471 @@
+package vm
+
+import (
+	"encoding/json"
+	"math/big"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/holiman/uint256"
+
+	"github.com/ledgerwatch/erigon/accounts/abi"
+	"github.com/ledgerwatch/erigon/common"
+	"github.com/ledgerwatch/erigon/params"
+)
+
+func TestCallTracer(t *testing.T) {
+	var (
+		caller      = common.HexToAddress("0x01")
+		outer       = common.HexToAddress("0xaa")
+		destructed  = common.HexToAddress("0xbb")
+		reverter    = common.HexToAddress("0xcc")
+		beneficiary = common.HexToAddress("0xee")
+	)
+	tracer := NewCallTracer()
+	vmenv, s := newTestEVM(t, Config{Debug: true, Tracer: tracer})
+	s.SetCode(outer, []byte{
+		// CALL(gas, 0xbb, 0, 0, 0, 0, 0)
+		byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0,
+		byte(PUSH1), 0xbb, byte(GAS), byte(CALL), byte(POP),
+		// CALL(gas, 0xcc, 0, 0, 0, 0, 0)
+		byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0,
+		byte(PUSH1), 0xcc, byte(GAS), byte(CALL), byte(POP),
+		byte(STOP),
+	})
+	s.SetCode(destructed, []byte{byte(PUSH1), 0xee, byte(SELFDESTRUCT)})
+	s.AddBalance(destructed, uint256.NewInt(100))
+	// REVERT with the single byte 0x2a as revert data
+	s.SetCode(reverter, []byte{byte(PUSH1), 0x2a, byte(PUSH1), 0, byte(MSTORE8), byte(PUSH1), 1, byte(PUSH1), 0, byte(REVERT)})
+
+	if _, _, err := vmenv.Call(AccountRef(caller), outer, []byte{0x01, 0x02}, 1000000, new(uint256.Int), false /* bailout */); err != nil {
+		t.Fatal(err)
+	}
+	root := tracer.Result()
+	if root == nil {
+		t.Fatal("no call tree recorded")
+	}
+	if root.Type != "CALL" || root.From != caller || root.To != outer || uint64(root.Gas) != 1000000 || root.GasUsed == 0 {
+		t.Errorf("unexpected root frame %+v", root)
+	}
+	if len(root.Calls) != 2 {
+		t.Fatalf("expected 2 sub-calls, got %d", len(root.Calls))
+	}
+	first, second := root.Calls[0], root.Calls[1]
+	if first.To != destructed || first.Error != "" || len(first.Calls) != 1 {
+		t.Fatalf("unexpected first sub-call %+v", first)
+	}
+	leaf := first.Calls[0]
+	if leaf.Type != "SELFDESTRUCT" || leaf.From != destructed || leaf.To != beneficiary || leaf.Value.ToInt().Uint64() != 100 {
+		t.Errorf("unexpected self-destruct leaf %+v", leaf)
+	}
+	if second.To != reverter || second.Error != ErrExecutionReverted.Error() || len(second.Output) != 1 || second.Output[0] != 0x2a {
+		t.Errorf("unexpected reverted sub-call %+v", second)
+	}
+
+	res, err := tracer.GetResult()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(res, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	for _, field := range []string{"type", "from", "to", "gas", "gasUsed", "input", "calls"} {
+		if _, ok := decoded[field]; !ok {
+			t.Errorf("field %q missing from %s", field, res)
+		}
+	}
+	if decoded["input"] != "0x0102" {
+		t.Errorf("unexpected input encoding %v", decoded["input"])
+	}
+}
+
+func TestCallTracerLogs(t *testing.T) {
+	var (
+		outer    = common.HexToAddress("0xaa")
+		reverter = common.HexToAddress("0xbb")
+	)
+	code := []byte{
+		// LOG1(0, 0, 0x01)
+		byte(PUSH1), 1, byte(PUSH1), 0, byte(PUSH1), 0, byte(LOG1),
+		// CALL(gas, 0xbb, 0, 0, 0, 0, 0)
+		byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0,
+		byte(PUSH1), 0xbb, byte(GAS), byte(CALL), byte(POP),
+		// LOG0(0, 0)
+		byte(PUSH1), 0, byte(PUSH1), 0, byte(LOG0),
+		byte(STOP),
+	}
+	// LOG0(0, 0), then REVERT(0, 0)
+	reverting := []byte{byte(PUSH1), 0, byte(PUSH1), 0, byte(LOG0), byte(PUSH1), 0, byte(PUSH1), 0, byte(REVERT)}
+
+	for _, dropReverted := range []bool{false, true} {
+		tracer := NewCallTracerWithLogs(dropReverted)
+		vmenv, s := newTestEVM(t, Config{Debug: true, Tracer: tracer})
+		s.SetCode(outer, code)
+		s.SetCode(reverter, reverting)
+		if _, _, err := vmenv.Call(AccountRef(common.Address{}), outer, nil, 1000000, new(uint256.Int), false /* bailout */); err != nil {
+			t.Fatal(err)
+		}
+		root := tracer.Result()
+		if len(root.Logs) != 2 {
+			t.Fatalf("expected 2 logs in the root frame, got %+v", root.Logs)
+		}
+		first, second := root.Logs[0], root.Logs[1]
+		if first.Address != outer || len(first.Topics) != 1 || first.Topics[0] != common.BigToHash(common.Big1) || first.Position != 0 || first.Reverted {
+			t.Errorf("unexpected first log %+v", first)
+		}
+		// Emitted after the sub-call
+		if len(second.Topics) != 0 || second.Position != 1 || second.Reverted {
+			t.Errorf("unexpected second log %+v", second)
+		}
+		inner := root.Calls[0].Logs
+		switch {
+		case dropReverted && len(inner) != 0:
+			t.Errorf("reverted logs not dropped: %+v", inner)
+		case !dropReverted && (len(inner) != 1 || !inner[0].Reverted || inner[0].Address != reverter):
+			t.Errorf("reverted log not flagged: %+v", inner)
+		}
+	}
+	// Logs are only recorded on request
+	tracer := NewCallTracer()
+	vmenv, s := newTestEVM(t, Config{Debug: true, Tracer: tracer})
+	s.SetCode(outer, code)
+	if _, _, err := vmenv.Call(AccountRef(common.Address{}), outer, nil, 1000000, new(uint256.Int), false /* bailout */); err != nil {
+		t.Fatal(err)
+	}
+	if logs := tracer.Result().Logs; logs != nil {
+		t.Errorf("unexpected logs %+v", logs)
+	}
+}
+
+func TestCallTracerSelfGas(t *testing.T) {
+	var (
+		outer    = common.HexToAddress("0xaa")
+		middle   = common.HexToAddress("0xbb")
+		reverter = common.HexToAddress("0xcc")
+	)
+	// call performs a CALL(gas, addr, 0, 0, 0, 0, 0)
+	call := func(addr byte) []byte {
+		return []byte{byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), addr, byte(GAS), byte(CALL), byte(POP)}
+	}
+	tracer := NewCallTracer()
+	vmenv, s := newTestEVM(t, Config{Debug: true, Tracer: tracer})
+	s.SetCode(outer, append(call(0xbb), byte(STOP)))
+	// MSTORE(0, 1), then the reverting call
+	s.SetCode(middle, append([]byte{byte(PUSH1), 1, byte(PUSH1), 0, byte(MSTORE)}, call(0xcc)...))
+	// Hash some memory before reverting
+	s.SetCode(reverter, []byte{byte(PUSH1), 64, byte(PUSH1), 0, byte(SHA3), byte(PUSH1), 0, byte(PUSH1), 0, byte(REVERT)})
+	if _, _, err := vmenv.Call(AccountRef(common.Address{}), outer, nil, 1000000, new(uint256.Int), false /* bailout */); err != nil {
+		t.Fatal(err)
+	}
+	root := tracer.Result()
+	if len(root.Calls) != 1 || len(root.Calls[0].Calls) != 1 {
+		t.Fatalf("unexpected call tree %+v", root)
+	}
+	mid, leaf := root.Calls[0], root.Calls[0].Calls[0]
+	// The reverted frame paid for everything up to the REVERT
+	want := 4*GasFastestStep + params.Sha3Gas + 2*params.Sha3WordGas + 2*params.MemoryGas
+	if leaf.Error == "" || uint64(leaf.GasUsed) != want || leaf.SelfGasUsed != leaf.GasUsed {
+		t.Errorf("unexpected reverted frame gas %d, self %d, want %d", leaf.GasUsed, leaf.SelfGasUsed, want)
+	}
+	for _, frame := range []*CallFrame{root, &mid} {
+		if frame.SelfGasUsed == 0 || frame.SelfGasUsed+frame.Calls[0].GasUsed != frame.GasUsed {
+			t.Errorf("unexpected split of the gas of %x: %d self, %d total", frame.To, frame.SelfGasUsed, frame.GasUsed)
+		}
+	}
+}
+
+func TestCallTracerStipend(t *testing.T) {
+	var (
+		outer  = common.HexToAddress("0xaa")
+		middle = common.HexToAddress("0xbb")
+		leaf   = common.HexToAddress("0xcc")
+	)
+	tracer := NewCallTracer()
+	vmenv, s := newTestEVM(t, Config{Debug: true, Tracer: tracer})
+	// CALL(gas, 0xbb, 0, 0, 0, 0, 0)
+	s.SetCode(outer, []byte{byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0xbb, byte(GAS), byte(CALL), byte(STOP)})
+	// CALL(0, 0xcc, 1, 0, 0, 0, 0), leaving the callee with the stipend only
+	s.SetCode(middle, []byte{byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 1, byte(PUSH1), 0xcc, byte(PUSH1), 0, byte(CALL), byte(STOP)})
+	// SSTORE(0, 1), which needs more than the stipend
+	s.SetCode(leaf, []byte{byte(PUSH1), 1, byte(PUSH1), 0, byte(SSTORE)})
+	if _, _, err := vmenv.Call(AccountRef(common.Address{}), outer, nil, 1000000, new(uint256.Int), false /* bailout */); err != nil {
+		t.Fatal(err)
+	}
+	root := tracer.Result()
+	if len(root.Calls) != 1 || len(root.Calls[0].Calls) != 1 {
+		t.Fatalf("unexpected call tree %+v", root)
+	}
+	mid, failed := root.Calls[0], root.Calls[0].Calls[0]
+	if mid.Stipend != 0 {
+		t.Errorf("stipend %d reported for a call without value", mid.Stipend)
+	}
+	if failed.To != leaf || uint64(failed.Stipend) != params.CallStipend || uint64(failed.Gas) != params.CallStipend {
+		t.Errorf("unexpected stipend %d of %d gas", failed.Stipend, failed.Gas)
+	}
+	if failed.Error != ErrOutOfGas.Error() {
+		t.Errorf("unexpected error %q of the stipend-only frame", failed.Error)
+	}
+}
+
+func TestCallTracerEntryGas(t *testing.T) {
+	var (
+		outer  = common.HexToAddress("0xaa")
+		callee = common.HexToAddress("0xbb")
+	)
+	tracer := NewCallTracer()
+	vmenv, s := newTestEVM(t, Config{Debug: true, Tracer: tracer})
+	s.SetCode(outer, []byte{
+		// CALL(gas, 0xbb, 0, 0, 0, 0, 0), asking for more than can be forwarded
+		byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0xbb, byte(GAS), byte(CALL), byte(POP),
+		// CALL(1000, 0xbb, 1, 0, 0, 0, 0)
+		byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 1, byte(PUSH1), 0xbb, byte(PUSH2), 0x03, 0xe8, byte(CALL),
+		byte(STOP),
+	})
+	// MSTORE(0, 1), using a few gas
+	s.SetCode(callee, []byte{byte(PUSH1), 1, byte(PUSH1), 0, byte(MSTORE), byte(STOP)})
+	if _, _, err := vmenv.Call(AccountRef(common.Address{}), outer, nil, 100000, new(uint256.Int), false /* bailout */); err != nil {
+		t.Fatal(err)
+	}
+	root := tracer.Result()
+	if len(root.Calls) != 2 {
+		t.Fatalf("unexpected call tree %+v", root)
+	}
+	capped, small := root.Calls[0], root.Calls[1]
+	if capped.GasRequested == nil || capped.GasAvailable == nil {
+		t.Fatalf("gas arguments not recorded: %+v", capped)
+	}
+	// Only all but 1/64 of the available gas is forwarded
+	available := uint64(*capped.GasAvailable)
+	if uint64(*capped.GasRequested) <= available || uint64(capped.Gas) != available-available/64 {
+		t.Errorf("unexpected capped call gas %d, requested %d, available %d", capped.Gas, *capped.GasRequested, available)
+	}
+	if small.GasRequested == nil || *small.GasRequested != 1000 || uint64(small.Gas) != 1000+params.CallStipend {
+		t.Errorf("unexpected call gas %d, requested %v", small.Gas, small.GasRequested)
+	}
+	for _, frame := range []*CallFrame{root, &capped, &small} {
+		if frame.GasUsed == 0 || frame.GasLeft != frame.Gas-frame.GasUsed {
+			t.Errorf("unexpected gas left %d of %d, %d used", frame.GasLeft, frame.Gas, frame.GasUsed)
+		}
+	}
+	if root.GasRequested != nil || root.GasAvailable != nil {
+		t.Errorf("gas arguments recorded for the top-level frame")
+	}
+}
+
+func TestCallTracerGasStages(t *testing.T) {
+	var (
+		outer  = common.HexToAddress("0xaa")
+		callee = common.HexToAddress("0xbb")
+	)
+	// call performs op(5000, 0xbb, [value,] 0, 0, 0, 0)
+	call := func(op OpCode, value byte) []byte {
+		code := []byte{byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0}
+		if op == CALL || op == CALLCODE {
+			code = append(code, byte(PUSH1), value)
+		}
+		return append(code, byte(PUSH1), 0xbb, byte(PUSH2), 0x13, 0x88, byte(op), byte(POP))
+	}
+	var code []byte
+	for _, part := range [][]byte{call(CALL, 1), call(CALLCODE, 0), call(DELEGATECALL, 0), call(STATICCALL, 0)} {
+		code = append(code, part...)
+	}
+	tracer := NewCallTracer()
+	vmenv, s := newTestEVM(t, Config{Debug: true, Tracer: tracer})
+	s.SetCode(outer, code)
+	s.SetCode(callee, []byte{byte(PUSH1), 0, byte(POP), byte(STOP)})
+	if _, _, err := vmenv.Call(AccountRef(common.Address{}), outer, nil, 1000000, new(uint256.Int), false /* bailout */); err != nil {
+		t.Fatal(err)
+	}
+	root := tracer.Result()
+	if len(root.Calls) != 4 {
+		t.Fatalf("unexpected call tree %+v", root)
+	}
+	for i, want := range []struct {
+		typ     string
+		base    uint64
+		stipend uint64
+	}{
+		// The first access to the callee is cold, and the value transfer costs extra
+		{"CALL", params.ColdAccountAccessCostEIP2929 + params.CallValueTransferGas, params.CallStipend},
+		{"CALLCODE", params.WarmStorageReadCostEIP2929, 0},
+		{"DELEGATECALL", params.WarmStorageReadCostEIP2929, 0},
+		{"STATICCALL", params.WarmStorageReadCostEIP2929, 0},
+	} {
+		frame := root.Calls[i]
+		if frame.Type != want.typ || frame.GasBase == nil || uint64(*frame.GasBase) != want.base {
+			t.Errorf("%s: unexpected base gas %v of %s, want %d", want.typ, frame.GasBase, frame.Type, want.base)
+		}
+		if frame.GasRequested == nil || *frame.GasRequested != 5000 || uint64(frame.Stipend) != want.stipend || uint64(frame.Gas) != 5000+want.stipend {
+			t.Errorf("%s: unexpected forwarded gas %d, stipend %d", want.typ, frame.Gas, frame.Stipend)
+		}
+		if uint64(frame.GasUsed) != GasFastestStep+GasQuickStep || frame.GasLeft != frame.Gas-frame.GasUsed {
+			t.Errorf("%s: unexpected returned gas %d, used %d", want.typ, frame.GasLeft, frame.GasUsed)
+		}
+	}
+}
+
+func TestCallTracerABIs(t *testing.T) {
+	var (
+		token = common.HexToAddress("0xaa")
+		other = common.HexToAddress("0xbb")
+		owner = common.HexToAddress("0x0102")
+	)
+	tokenABI, err := abi.JSON(strings.NewReader(`[
+		{"type":"function","name":"balanceOf","inputs":[{"name":"owner","type":"address"}],"outputs":[{"name":"","type":"uint256"}]},
+		{"type":"function","name":"transfer","inputs":[{"name":"to","type":"address"},{"name":"amount","type":"uint256"}],"outputs":[{"name":"","type":"bool"}]}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	transfer := tokenABI.Methods["transfer"]
+	abis := &ABIRegistry{
+		Contracts: map[common.Address]abi.ABI{token: tokenABI},
+		Methods:   map[[4]byte]abi.Method{*(*[4]byte)(transfer.ID): transfer},
+	}
+	balanceOf, err := tokenABI.Pack("balanceOf", owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transferTo, err := tokenABI.Pack("transfer", owner, big.NewInt(7))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// RETURN(0, 32) of MSTORE(0, 1)
+	code := []byte{byte(PUSH1), 1, byte(PUSH1), 0, byte(MSTORE), byte(PUSH1), 32, byte(PUSH1), 0, byte(RETURN)}
+	trace := func(to common.Address, input []byte) *CallFrame {
+		tracer := NewCallTracer()
+		tracer.SetABIs(abis)
+		vmenv, s := newTestEVM(t, Config{Debug: true, Tracer: tracer})
+		s.SetCode(token, code)
+		s.SetCode(other, code)
+		if _, _, err := vmenv.Call(AccountRef(common.Address{}), to, input, 100000, new(uint256.Int), false /* bailout */); err != nil {
+			t.Fatal(err)
+		}
+		return tracer.Result()
+	}
+
+	// By the ABI of the called address
+	decoded := trace(token, balanceOf).Decoded
+	want := &DecodedCall{
+		Method:  "balanceOf(address)",
+		Inputs:  []DecodedValue{{Name: "owner", Type: "address", Value: owner}},
+		Outputs: []DecodedValue{{Type: "uint256", Value: big.NewInt(1)}},
+	}
+	if !reflect.DeepEqual(decoded, want) {
+		t.Errorf("have decoded balanceOf %+v, want %+v", decoded, want)
+	}
+	// By selector, for an unknown address
+	decoded = trace(other, transferTo).Decoded
+	want = &DecodedCall{
+		Method:  "transfer(address,uint256)",
+		Inputs:  []DecodedValue{{Name: "to", Type: "address", Value: owner}, {Name: "amount", Type: "uint256", Value: big.NewInt(7)}},
+		Outputs: []DecodedValue{{Type: "bool", Value: true}},
+	}
+	if !reflect.DeepEqual(decoded, want) {
+		t.Errorf("have decoded transfer %+v, want %+v", decoded, want)
+	}
+	// Truncated arguments, and unknown methods, are left undecoded
+	if frame := trace(token, balanceOf[:20]); frame.Decoded != nil || len(frame.Input) != 20 {
+		t.Errorf("unexpected decoding of truncated input %+v", frame.Decoded)
+	}
+	if frame := trace(other, balanceOf); frame.Decoded != nil {
+		t.Errorf("unexpected decoding of unknown method %+v", frame.Decoded)
+	}
+	if _, err := json.Marshal(trace(token, balanceOf)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCallTracerStackHeight(t *testing.T) {
+	var (
+		outer = common.HexToAddress("0xaa")
+		inner = common.HexToAddress("0xbb")
+	)
+	for _, enabled := range []bool{false, true} {
+		tracer := NewCallTracer()
+		vmenv, s := newTestEVM(t, Config{Debug: true, Tracer: tracer, EnableStackStats: enabled})
+		// CALL(gas, 0xbb, 0, 0, 0, 0, 0)
+		s.SetCode(outer, []byte{byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0xbb, byte(GAS), byte(CALL), byte(STOP)})
+		// Counts down from 1021 leaving every counter on the stack, which
+		// peaks at 1021+3 items right before the last JUMPI
+		s.SetCode(inner, []byte{byte(PUSH2), 0x03, 0xfd,
+			byte(JUMPDEST), byte(DUP1), byte(PUSH1), 1, byte(SWAP1), byte(SUB), byte(DUP1), byte(PUSH1), 3, byte(JUMPI),
+			byte(STOP)})
+		if _, _, err := vmenv.Call(AccountRef(common.Address{}), outer, nil, 1000000, new(uint256.Int), false /* bailout */); err != nil {
+			t.Fatal(err)
+		}
+		root := tracer.Result()
+		if len(root.Calls) != 1 || root.Calls[0].Error != "" {
+			t.Fatalf("unexpected calls %+v", root.Calls)
+		}
+		outerHeight, innerHeight := 0, 0
+		if enabled {
+			outerHeight, innerHeight = 7, int(params.StackLimit)
+		}
+		if root.MaxStackHeight != outerHeight {
+			t.Errorf("stats %t: have outer height %d, want %d", enabled, root.MaxStackHeight, outerHeight)
+		}
+		if have := root.Calls[0].MaxStackHeight; have != innerHeight {
+			t.Errorf("stats %t: have inner height %d, want %d", enabled, have, innerHeight)
+		}
+	}
+}
+
+type sstoreRecorder struct {
+	*CallTracer
+	storage, code []common.Address
+}
+
+func (r *sstoreRecorder) CaptureState(env *EVM, pc uint64, op OpCode, gas, cost uint64, scope *ScopeContext, rData []byte, depth int, err error) {
+	if op == SSTORE && err == nil {
+		r.storage = append(r.storage, scope.Address())
+		r.code = append(r.code, scope.CodeAddress())
+	}
+	r.CallTracer.CaptureState(env, pc, op, gas, cost, scope, rData, depth, err)
+}
+
+func TestCallTracerDelegateCall(t *testing.T) {
+	var (
+		proxy   = common.HexToAddress("0xaa")
+		library = common.HexToAddress("0xbb")
+	)
+	tracer := &sstoreRecorder{CallTracer: NewCallTracer()}
+	vmenv, s := newTestEVM(t, Config{Debug: true, Tracer: tracer})
+	// SSTORE(0, 1), DELEGATECALL(gas, 0xbb, 0, 0, 0, 0)
+	s.SetCode(proxy, []byte{byte(PUSH1), 1, byte(PUSH1), 0, byte(SSTORE),
+		byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0xbb, byte(GAS), byte(DELEGATECALL), byte(POP),
+		byte(STOP)})
+	// SSTORE(1, 42)
+	s.SetCode(library, []byte{byte(PUSH1), 42, byte(PUSH1), 1, byte(SSTORE), byte(STOP)})
+	s.AddAddressToAccessList(proxy)
+	if _, _, err := vmenv.Call(AccountRef(common.Address{}), proxy, nil, 100000, new(uint256.Int), false /* bailout */); err != nil {
+		t.Fatal(err)
+	}
+	// The library writes to the storage of the proxy
+	var value uint256.Int
+	slot := common.BigToHash(big.NewInt(1))
+	if s.GetState(proxy, &slot, &value); value.Uint64() != 42 {
+		t.Errorf("have proxy slot 1 %d, want 42", value.Uint64())
+	}
+	if s.GetState(library, &slot, &value); !value.IsZero() {
+		t.Errorf("have library slot 1 %d, want 0", value.Uint64())
+	}
+	if want := []common.Address{proxy, proxy}; !reflect.DeepEqual(tracer.storage, want) {
+		t.Errorf("have SSTOREs to the storage of %v, want %v", tracer.storage, want)
+	}
+	if want := []common.Address{proxy, library}; !reflect.DeepEqual(tracer.code, want) {
+		t.Errorf("have SSTOREs run by the code of %v, want %v", tracer.code, want)
+	}
+	root := tracer.Result()
+	if root.StorageAddress != nil {
+		t.Errorf("unexpected storage address %x of the top-level frame", *root.StorageAddress)
+	}
+	if len(root.Calls) != 1 {
+		t.Fatalf("unexpected calls %+v", root.Calls)
+	}
+	if call := root.Calls[0]; call.To != library || call.StorageAddress == nil || *call.StorageAddress != proxy {
+		t.Errorf("have delegate call to %x with storage %v, want %x and %x", call.To, call.StorageAddress, library, proxy)
+	}
+}
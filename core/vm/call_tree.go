@@ -0,0 +1,292 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/ledgerwatch/erigon/common"
+	"github.com/ledgerwatch/erigon/common/hexutil"
+	"github.com/ledgerwatch/erigon/params"
+)
+
+// ErrIncompleteTrace is returned by StructLogsToCallTree, along with the tree
+// rebuilt so far, when the steps end before the top-level frame halts.
+var ErrIncompleteTrace = errors.New("trace ends before the top-level frame halts")
+
+// errUnloggedFailure is the error of the frames the steps tell failed, but
+// not how, see StructLogsToCallTree.
+var errUnloggedFailure = errors.New("failed without a logged error")
+
+// StructLogsToCallTree rebuilds the call tree of a transaction from its steps
+// as recorded by the StructLogger, without executing it again. A frame is
+// entered by a step of the CALL or CREATE families followed by a step one
+// level deeper, and returns when the steps are back at a lower depth. Several
+// frames return at once when the steps in between are missing. If the steps
+// end before the top-level frame halts, the tree so far is returned along with
+// ErrIncompleteTrace.
+//
+// The steps carry less than the CaptureEnter and CaptureExit hooks, so the
+// tree is less complete than the one of the CallTracer:
+//   - the top-level frame is a CALL without addresses, input or value, and
+//     so its sub-calls have no From, nor StorageAddress;
+//   - the addresses, values and inputs of sub-calls are read from the stack
+//     and memory of the calling step, and are missing if those were not logged;
+//   - calls running no code, such as those into precompiles or accounts
+//     without code, can only be told apart from calls failing before entering
+//     their frame when they succeed, failed ones are left out. They have no
+//     gas figures, their gas is in the SelfGasUsed of the caller;
+//   - the outcome of a frame is read from the next step of its caller. The
+//     frames without one have it derived from their last step if it halts,
+//     and are left without outcome otherwise;
+//   - a frame failing after its last step was logged, e.g. on an invalid
+//     jump, reports errUnloggedFailure, or looks like it did not halt if its
+//     caller has no next step;
+//   - logs and self-destructs are not reported.
+//
+// The steps must be all those of a transaction: traces filtered with
+// LogConfig.Limit, LogConfig.OnlyStateChanges or Config.FocusAddress yield
+// partial trees or errors.
+func StructLogsToCallTree(logs []StructLog) (*CallFrame, error) {
+	if len(logs) == 0 {
+		return nil, errors.New("no steps")
+	}
+	var (
+		top   = logs[0].Depth
+		stack = []*treeFrame{{frame: CallFrame{Type: CALL.String(), Gas: hexutil.Uint64(logs[0].Gas)}, entry: -1}}
+	)
+	for i := range logs {
+		log := &logs[i]
+		level := log.Depth - top
+		switch {
+		case level < 0:
+			return nil, fmt.Errorf("step %d at depth %d above the top-level frame at depth %d", i, log.Depth, top)
+		case level > len(stack):
+			return nil, fmt.Errorf("step %d at depth %d enters more than one frame", i, log.Depth)
+		case level == len(stack):
+			if entry := &logs[i-1]; !entersFrame(entry.Op) || entry.Err != nil {
+				return nil, fmt.Errorf("step %d at depth %d entered by %v", i, log.Depth, entry.Op)
+			}
+			stack = append(stack, newTreeFrame(logs, i-1, stack[len(stack)-1].self, log.Gas))
+		}
+		for len(stack)-1 > level {
+			frame := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			var next *StructLog
+			if len(stack)-1 == level {
+				next = log
+			}
+			frame.finish(logs, next)
+			stack[len(stack)-1].frame.Calls = append(stack[len(stack)-1].frame.Calls, frame.frame)
+		}
+		current := stack[len(stack)-1]
+		// A call made by the previous step that ran no code
+		if i > 0 && current.last == i-1 && entersFrame(logs[i-1].Op) && logs[i-1].Err == nil {
+			if call, ok := codelessCall(&logs[i-1], current.self, log); ok {
+				current.frame.Calls = append(current.frame.Calls, call)
+			}
+		}
+		current.last = i
+	}
+	complete := len(stack) == 1 && halts(&logs[stack[0].last])
+	for len(stack) > 1 {
+		frame := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		frame.finish(logs, nil)
+		stack[len(stack)-1].frame.Calls = append(stack[len(stack)-1].frame.Calls, frame.frame)
+	}
+	stack[0].finish(logs, nil)
+	if !complete {
+		return &stack[0].frame, ErrIncompleteTrace
+	}
+	return &stack[0].frame, nil
+}
+
+// treeFrame is a frame being rebuilt by StructLogsToCallTree.
+type treeFrame struct {
+	frame CallFrame
+	self  common.Address // address whose storage the frame runs against, the From of its sub-calls
+	entry int            // index of the step entering the frame, -1 for the top-level one
+	last  int            // index of the last step of the frame so far
+}
+
+// newTreeFrame returns the frame entered by logs[entry], made by caller and
+// starting with gas.
+func newTreeFrame(logs []StructLog, entry int, caller common.Address, gas uint64) *treeFrame {
+	frame, self := stepCall(&logs[entry], caller)
+	frame.Gas = hexutil.Uint64(gas)
+	if frame.Value != nil && frame.Value.ToInt().Sign() != 0 && (frame.Type == CALL.String() || frame.Type == CALLCODE.String()) {
+		frame.Stipend = hexutil.Uint64(params.CallStipend)
+	}
+	return &treeFrame{frame: frame, self: self, entry: entry}
+}
+
+// finish fills in the outcome of the frame from next, the step of its caller
+// following its return, if known, or else from its last step.
+func (f *treeFrame) finish(logs []StructLog, next *StructLog) {
+	last := &logs[f.last]
+	var err error
+	switch {
+	case last.Err != nil:
+		err = last.Err
+	case last.Op == REVERT:
+		err = ErrExecutionReverted
+	}
+	create := f.frame.Type == CREATE.String() || f.frame.Type == CREATE2.String()
+	if next != nil && f.entry >= 0 {
+		entry := &logs[f.entry]
+		// The caller gets the gas left back, the CREATE family deducts the
+		// gas passed on when executed rather than in its cost
+		spent := entry.Gas - entry.GasCost
+		if create {
+			spent -= uint64(f.frame.Gas)
+		}
+		if next.Gas >= spent && next.Gas-spent <= uint64(f.frame.Gas) {
+			f.frame.processGas(uint64(f.frame.Gas) - (next.Gas - spent))
+		}
+		// The success flag of calls, the address of creates
+		if result := stackBack(next, 0); result != nil {
+			switch {
+			case result.Sign() == 0 && err == nil:
+				err = errUnloggedFailure
+			case result.Sign() != 0 && create:
+				f.frame.To = common.BigToAddress(result)
+				setCaller(f.frame.Calls, f.frame.To)
+			}
+		}
+		output := next.ReturnData
+		if create && err == nil {
+			// The deployed code is not returned to the caller
+			output = returnedData(last)
+		}
+		f.frame.processOutput(output, err)
+		return
+	}
+	if !halts(last) {
+		return
+	}
+	gasUsed := uint64(f.frame.Gas)
+	if err == nil || err == ErrExecutionReverted {
+		// What is left after the last step goes back
+		if left := last.Gas - last.GasCost; last.Gas >= last.GasCost && left <= gasUsed {
+			gasUsed -= left
+		}
+	}
+	f.frame.processGas(gasUsed)
+	f.frame.processOutput(returnedData(last), err)
+}
+
+// setCaller sets the From of the calls made by a created contract, whose
+// address is only known once it returns, and of the calls made on its behalf.
+func setCaller(calls []CallFrame, caller common.Address) {
+	for i := range calls {
+		if calls[i].From != (common.Address{}) {
+			continue
+		}
+		calls[i].From = caller
+		if calls[i].Type == DELEGATECALL.String() || calls[i].Type == CALLCODE.String() {
+			storage := caller
+			calls[i].StorageAddress = &storage
+			setCaller(calls[i].Calls, caller)
+		}
+	}
+}
+
+// codelessCall returns the call made by entry that ran no code, if next, the
+// following step of the caller, tells it succeeded.
+func codelessCall(entry *StructLog, caller common.Address, next *StructLog) (CallFrame, bool) {
+	result := stackBack(next, 0)
+	if result == nil || result.Sign() == 0 {
+		return CallFrame{}, false
+	}
+	frame, _ := stepCall(entry, caller)
+	if frame.Type == CREATE.String() || frame.Type == CREATE2.String() {
+		frame.To = common.BigToAddress(result)
+	}
+	frame.processOutput(next.ReturnData, nil)
+	return frame, true
+}
+
+// stepCall returns the frame entered by a step of the CALL or CREATE families,
+// without gas nor outcome, and the address whose storage it runs against.
+// Created frames have no address yet.
+func stepCall(step *StructLog, caller common.Address) (CallFrame, common.Address) {
+	frame := CallFrame{Type: step.Op.String(), From: caller}
+	var value, offset, size *big.Int
+	switch step.Op {
+	case CALL, CALLCODE:
+		value, offset, size = stackBack(step, 2), stackBack(step, 3), stackBack(step, 4)
+	case DELEGATECALL, STATICCALL:
+		offset, size = stackBack(step, 2), stackBack(step, 3)
+	case CREATE, CREATE2:
+		value, offset, size = stackBack(step, 0), stackBack(step, 1), stackBack(step, 2)
+	}
+	if value != nil {
+		frame.Value = (*hexutil.Big)(new(big.Int).Set(value))
+	}
+	frame.Input = memorySlice(step, offset, size)
+	if step.Op == CREATE || step.Op == CREATE2 {
+		return frame, common.Address{}
+	}
+	if addr := stackBack(step, 1); addr != nil {
+		frame.To = common.BigToAddress(addr)
+	}
+	if step.Op == DELEGATECALL || step.Op == CALLCODE {
+		if caller != (common.Address{}) {
+			frame.StorageAddress = &caller
+		}
+		return frame, caller
+	}
+	return frame, frame.To
+}
+
+// returnedData returns the output of a RETURN or REVERT step, or nil.
+func returnedData(step *StructLog) []byte {
+	if step.Op != RETURN && step.Op != REVERT {
+		return nil
+	}
+	return memorySlice(step, stackBack(step, 0), stackBack(step, 1))
+}
+
+// entersFrame tells whether op may enter a new frame.
+func entersFrame(op OpCode) bool {
+	switch op {
+	case CALL, CALLCODE, DELEGATECALL, STATICCALL, CREATE, CREATE2:
+		return true
+	}
+	return false
+}
+
+// halts tells whether the frame stops running at the step.
+func halts(step *StructLog) bool {
+	switch step.Op {
+	case STOP, RETURN, REVERT, SELFDESTRUCT:
+		return true
+	}
+	return step.Err != nil
+}
+
+// stackBack returns the n-th item from the top of the stack logged by the
+// step, or nil if not logged.
+func stackBack(step *StructLog, n int) *big.Int {
+	if n >= len(step.Stack) {
+		return nil
+	}
+	return step.Stack[len(step.Stack)-1-n]
+}
+
+// memorySlice returns a copy of the memory logged by the step at [offset,
+// offset+size), or nil if not logged.
+func memorySlice(step *StructLog, offset, size *big.Int) []byte {
+	if offset == nil || size == nil || !offset.IsUint64() || !size.IsUint64() {
+		return nil
+	}
+	if size.Sign() == 0 {
+		return []byte{}
+	}
+	end := offset.Uint64() + size.Uint64()
+	if end < offset.Uint64() || end > uint64(len(step.Memory)) {
+		return nil
+	}
+	return common.CopyBytes(step.Memory[offset.Uint64():end])
+}
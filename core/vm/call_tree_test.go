@@ -0,0 +1,121 @@
+package vm
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/holiman/uint256"
+
+	"github.com/ledgerwatch/erigon/common"
+	"github.com/ledgerwatch/erigon/common/hexutil"
+)
+
+func TestStructLogsToCallTree(t *testing.T) {
+	var (
+		outer    = common.HexToAddress("0xaa")
+		inner    = common.HexToAddress("0xbb")
+		leaf     = common.HexToAddress("0xcc")
+		reverter = common.HexToAddress("0xdd")
+	)
+	// MSTORE(0, 0x11223344), CALL(gas, 0xbb, 0, 28, 4, 0, 0),
+	// DELEGATECALL(gas, 0xdd, 0, 0, 0, 0), CALL(gas, 0x04, 0, 28, 4, 0, 0)
+	outerCode := []byte{byte(PUSH4), 0x11, 0x22, 0x33, 0x44, byte(PUSH1), 0, byte(MSTORE),
+		byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 4, byte(PUSH1), 28, byte(PUSH1), 0, byte(PUSH1), 0xbb, byte(GAS), byte(CALL), byte(POP),
+		byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0xdd, byte(GAS), byte(DELEGATECALL), byte(POP),
+		byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 4, byte(PUSH1), 28, byte(PUSH1), 0, byte(PUSH1), 4, byte(GAS), byte(CALL), byte(POP),
+		byte(STOP)}
+	// STATICCALL(gas, 0xcc, 0, 0, 0, 0), RETURN the return data
+	innerCode := []byte{byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0xcc, byte(GAS), byte(STATICCALL), byte(POP),
+		byte(RETURNDATASIZE), byte(PUSH1), 0, byte(PUSH1), 0, byte(RETURNDATACOPY),
+		byte(RETURNDATASIZE), byte(PUSH1), 0, byte(RETURN)}
+	// MSTORE8(0, 0x2a), RETURN(0, 1)
+	leafCode := []byte{byte(PUSH1), 0x2a, byte(PUSH1), 0, byte(MSTORE8), byte(PUSH1), 1, byte(PUSH1), 0, byte(RETURN)}
+	// REVERT(0, 1)
+	reverterCode := []byte{byte(PUSH1), 1, byte(PUSH1), 0, byte(REVERT)}
+
+	run := func(tracer Tracer) {
+		vmenv, s := newTestEVM(t, Config{Debug: true, Tracer: tracer})
+		s.SetCode(outer, outerCode)
+		s.SetCode(inner, innerCode)
+		s.SetCode(leaf, leafCode)
+		s.SetCode(reverter, reverterCode)
+		if _, _, err := vmenv.Call(AccountRef(common.Address{}), outer, nil, 100000, new(uint256.Int), false /* bailout */); err != nil {
+			t.Fatal(err)
+		}
+	}
+	logger := NewStructLogger(nil)
+	run(logger)
+	callTracer := NewCallTracer()
+	run(callTracer)
+
+	// The rebuilt tree does not know the top-level call, nor the gas of the
+	// call into the precompile
+	want := *callTracer.Result()
+	want.From, want.To, want.Value, want.Input = common.Address{}, common.Address{}, nil, nil
+	calls := make([]CallFrame, len(want.Calls))
+	copy(calls, want.Calls)
+	want.Calls = calls
+	for i := range want.Calls {
+		want.Calls[i].From, want.Calls[i].StorageAddress = common.Address{}, nil
+		want.Calls[i].GasBase, want.Calls[i].GasRequested, want.Calls[i].GasAvailable = nil, nil, nil
+		for j := range want.Calls[i].Calls {
+			want.Calls[i].Calls[j].GasBase, want.Calls[i].Calls[j].GasRequested, want.Calls[i].Calls[j].GasAvailable = nil, nil, nil
+		}
+	}
+	precompile := &want.Calls[2]
+	want.SelfGasUsed += precompile.GasUsed
+	precompile.Gas, precompile.GasUsed, precompile.GasLeft, precompile.SelfGasUsed = 0, 0, 0, 0
+
+	have, err := StructLogsToCallTree(logger.StructLogs())
+	if err != nil {
+		t.Fatal(err)
+	}
+	haveJSON, _ := json.Marshal(have)
+	wantJSON, _ := json.Marshal(want)
+	if !bytes.Equal(haveJSON, wantJSON) {
+		t.Errorf("have tree\n%s\nwant\n%s", haveJSON, wantJSON)
+	}
+
+	// From the STATICCALL right back to the top-level frame
+	var logs []StructLog
+	for i, log := range logger.StructLogs() {
+		if log.Depth == 2 && log.Op != STATICCALL && i > 0 && logger.StructLogs()[i-1].Depth != 1 {
+			continue
+		}
+		logs = append(logs, log)
+	}
+	have, err = StructLogsToCallTree(logs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(have.Calls) != 3 || have.Calls[0].To != inner || len(have.Calls[0].Calls) != 1 {
+		t.Fatalf("unexpected calls %+v", have.Calls)
+	}
+	// The inner frame has its outcome from the top-level frame, the leaf one
+	// from its RETURN
+	if call := have.Calls[0]; call.GasUsed != want.Calls[0].GasUsed || !reflect.DeepEqual(call.Output, want.Calls[0].Output) {
+		t.Errorf("have inner call %+v, want %+v", call, want.Calls[0])
+	}
+	if call := have.Calls[0].Calls[0]; call.GasUsed != want.Calls[0].Calls[0].GasUsed || !reflect.DeepEqual(call.Output, hexutil.Bytes{0x2a}) {
+		t.Errorf("have leaf call %+v, want %+v", call, want.Calls[0].Calls[0])
+	}
+
+	// Cut in the middle of the leaf frame
+	logs = logger.StructLogs()
+	for i := range logs {
+		if logs[i].Depth == 3 {
+			logs = logs[:i+1]
+			break
+		}
+	}
+	have, err = StructLogsToCallTree(logs)
+	if !errors.Is(err, ErrIncompleteTrace) {
+		t.Fatalf("have error %v, want %v", err, ErrIncompleteTrace)
+	}
+	if len(have.Calls) != 1 || len(have.Calls[0].Calls) != 1 || have.Calls[0].Calls[0].To != leaf || have.Calls[0].Calls[0].GasUsed != 0 {
+		t.Errorf("unexpected partial tree %+v", have)
+	}
+}
@@ -50,6 +50,24 @@ func calcMemSize64WithUint(off *uint256.Int, length64 uint64) (uint64, bool) {
 	return val, val < offset64
 }
 
+// calcMemSize64Max calculates the memory size required by two regions, such
+// as the input and output of a call, and returns the larger size and whether
+// either of them overflowed uint64
+func calcMemSize64Max(off1, l1, off2, l2 *uint256.Int) (uint64, bool) {
+	x, overflow := calcMemSize64(off1, l1)
+	if overflow {
+		return 0, true
+	}
+	y, overflow := calcMemSize64(off2, l2)
+	if overflow {
+		return 0, true
+	}
+	if x > y {
+		return x, false
+	}
+	return y, false
+}
+
 // getData returns a slice from the data based on the start and size and pads
 // up to size with zero's. This function is overflow safe.
 func getData(data []byte, start uint64, size uint64) []byte {
@@ -154,6 +154,19 @@ func (c *Contract) GetOp(n uint64) OpCode {
 	return OpCode(c.GetByte(n))
 }
 
+// OpCodeAt returns the opcode at pc, or STOP when pc is beyond the code, like
+// GetOp. Bytes of PUSH data are returned as they are, see HasJumpDest.
+func (c *Contract) OpCodeAt(pc uint64) OpCode {
+	return c.GetOp(pc)
+}
+
+// HasJumpDest reports whether pc is a valid jump destination: a JUMPDEST that
+// is not part of PUSH data, as decided by the analysis the interpreter uses.
+func (c *Contract) HasJumpDest(pc uint64) bool {
+	valid, _ := c.validJumpdest(new(uint256.Int).SetUint64(pc))
+	return valid
+}
+
 // GetByte returns the n'th byte in the contract's byte array
 func (c *Contract) GetByte(n uint64) byte {
 	if n < uint64(len(c.Code)) {
@@ -166,6 +166,32 @@ func ActivePrecompiles(rules *params.Rules) []common.Address {
 	}
 }
 
+// ActivePrecompilesWith returns the precompiles enabled with the current
+// configuration and the addresses of the custom ones, see Config.Precompiles.
+func ActivePrecompilesWith(rules *params.Rules, custom map[common.Address]PrecompiledContract) []common.Address {
+	active := ActivePrecompiles(rules)
+	if len(custom) == 0 {
+		return active
+	}
+	addrs := make([]common.Address, 0, len(active)+len(custom))
+	addrs = append(addrs, active...)
+	for addr := range custom {
+		if !containsAddress(active, addr) {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+func containsAddress(addrs []common.Address, addr common.Address) bool {
+	for _, a := range addrs {
+		if a == addr {
+			return true
+		}
+	}
+	return false
+}
+
 // RunPrecompiledContract runs and evaluates the output of a precompiled contract.
 // It returns
 // - the returned bytes,
@@ -181,6 +207,54 @@ func RunPrecompiledContract(p PrecompiledContract, input []byte, suppliedGas uin
 	return output, suppliedGas, err
 }
 
+// PrecompileName returns the common name of a precompiled contract, or an
+// empty string if it is not one of the known implementations.
+func PrecompileName(p PrecompiledContract) string {
+	switch p.(type) {
+	case *ecrecover:
+		return "ecrecover"
+	case *sha256hash:
+		return "sha256"
+	case *ripemd160hash:
+		return "ripemd160"
+	case *dataCopy:
+		return "identity"
+	case *bigModExp:
+		return "modexp"
+	case *bn256AddIstanbul, *bn256AddByzantium:
+		return "bn256Add"
+	case *bn256ScalarMulIstanbul, *bn256ScalarMulByzantium:
+		return "bn256ScalarMul"
+	case *bn256PairingIstanbul, *bn256PairingByzantium:
+		return "bn256Pairing"
+	case *blake2F:
+		return "blake2f"
+	case *bls12381G1Add:
+		return "bls12381G1Add"
+	case *bls12381G1Mul:
+		return "bls12381G1Mul"
+	case *bls12381G1MultiExp:
+		return "bls12381G1MultiExp"
+	case *bls12381G2Add:
+		return "bls12381G2Add"
+	case *bls12381G2Mul:
+		return "bls12381G2Mul"
+	case *bls12381G2MultiExp:
+		return "bls12381G2MultiExp"
+	case *bls12381Pairing:
+		return "bls12381Pairing"
+	case *bls12381MapG1:
+		return "bls12381MapG1"
+	case *bls12381MapG2:
+		return "bls12381MapG2"
+	case *tmHeaderValidate:
+		return "tmHeaderValidate"
+	case *iavlMerkleProofValidate:
+		return "iavlMerkleProofValidate"
+	}
+	return ""
+}
+
 // ECRECOVER implemented as a native contract.
 type ecrecover struct{}
 
@@ -315,13 +389,45 @@ func modexpMultComplexity(x *big.Int) *big.Int {
 	return x
 }
 
+// ModExpGas is the gas breakdown of a call into the modexp precompile, as
+// priced by EIP-198 or EIP-2565. Lengths missing from short inputs are zero.
+// Values too large for a uint64 are math.MaxUint64.
+type ModExpGas struct {
+	BaseLen        uint64 `json:"baseLen"`
+	ExpLen         uint64 `json:"expLen"`
+	ModLen         uint64 `json:"modLen"`
+	AdjExpLen      uint64 `json:"adjExpLen"`      // adjusted exponent length, from ExpLen and the head of the exponent
+	MultComplexity uint64 `json:"multComplexity"` // of max(BaseLen, ModLen)
+	EIP2565        bool   `json:"eip2565"`
+	Gas            uint64 `json:"gas"`
+}
+
+// saturatedUint64 returns x, or math.MaxUint64 if it does not fit.
+func saturatedUint64(x *big.Int) uint64 {
+	if x.BitLen() > 64 {
+		return math.MaxUint64
+	}
+	return x.Uint64()
+}
+
 // RequiredGas returns the gas required to execute the pre-compiled contract.
 func (c *bigModExp) RequiredGas(input []byte) uint64 {
+	return c.gas(input).Gas
+}
+
+// gas returns the gas breakdown of a call with the given input.
+func (c *bigModExp) gas(input []byte) ModExpGas {
 	var (
 		baseLen = new(big.Int).SetBytes(getData(input, 0, 32))
 		expLen  = new(big.Int).SetBytes(getData(input, 32, 32))
 		modLen  = new(big.Int).SetBytes(getData(input, 64, 32))
 	)
+	detail := ModExpGas{
+		BaseLen: saturatedUint64(baseLen),
+		ExpLen:  saturatedUint64(expLen),
+		ModLen:  saturatedUint64(modLen),
+		EIP2565: c.eip2565,
+	}
 	if len(input) > 96 {
 		input = input[96:]
 	} else {
@@ -349,6 +455,7 @@ func (c *bigModExp) RequiredGas(input []byte) uint64 {
 		adjExpLen.Mul(big8, adjExpLen)
 	}
 	adjExpLen.Add(adjExpLen, big.NewInt(int64(msb)))
+	detail.AdjExpLen = saturatedUint64(adjExpLen)
 	// Calculate the gas cost of the operation
 	gas := new(big.Int).Set(math.BigMax(modLen, baseLen))
 	if c.eip2565 {
@@ -363,27 +470,30 @@ func (c *bigModExp) RequiredGas(input []byte) uint64 {
 		gas = gas.Add(gas, big7)
 		gas = gas.Div(gas, big8)
 		gas.Mul(gas, gas)
+		detail.MultComplexity = saturatedUint64(gas)
 
 		gas.Mul(gas, math.BigMax(adjExpLen, big1))
 		// 2. Different divisor (`GQUADDIVISOR`) (3)
 		gas.Div(gas, big3)
 		if gas.BitLen() > 64 {
-			return math.MaxUint64
+			detail.Gas = math.MaxUint64
+			return detail
 		}
 		// 3. Minimum price of 200 gas
 		if gas.Uint64() < 200 {
-			return 200
+			detail.Gas = 200
+			return detail
 		}
-		return gas.Uint64()
+		detail.Gas = gas.Uint64()
+		return detail
 	}
 	gas = modexpMultComplexity(gas)
+	detail.MultComplexity = saturatedUint64(gas)
 	gas.Mul(gas, math.BigMax(adjExpLen, big1))
 	gas.Div(gas, big20)
 
-	if gas.BitLen() > 64 {
-		return math.MaxUint64
-	}
-	return gas.Uint64()
+	detail.Gas = saturatedUint64(gas)
+	return detail
 }
 
 func (c *bigModExp) Run(input []byte) ([]byte, error) {
@@ -19,12 +19,17 @@ package vm
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"reflect"
 	"testing"
 	"time"
 
+	"github.com/holiman/uint256"
+
 	"github.com/ledgerwatch/erigon/common"
+	"github.com/ledgerwatch/erigon/params"
 )
 
 // precompiledTest defines the input/output pairs for precompiled contract tests.
@@ -253,6 +258,44 @@ func TestPrecompiledModExpOOG(t *testing.T) {
 	}
 }
 
+func TestModExpGas(t *testing.T) {
+	var (
+		// EIP-198 example: 3 ** (2**256 - 2**32 - 978) % (2**256 - 2**32 - 977)
+		example = common.FromHex("0000000000000000000000000000000000000000000000000000000000000001" +
+			"0000000000000000000000000000000000000000000000000000000000000020" +
+			"0000000000000000000000000000000000000000000000000000000000000020" +
+			"03" +
+			"fffffffffffffffffffffffffffffffffffffffffffffffffffffffefffffc2e" +
+			"fffffffffffffffffffffffffffffffffffffffffffffffffffffffefffffc2f")
+		// The lengths of one byte operands, without the operands
+		short = common.FromHex("0000000000000000000000000000000000000000000000000000000000000001" +
+			"0000000000000000000000000000000000000000000000000000000000000001" +
+			"00000000000000000000000000000000000000000000000000000000000001")
+	)
+	for _, tt := range []struct {
+		name    string
+		eip2565 bool
+		input   []byte
+		want    ModExpGas
+	}{
+		{"example", false, example, ModExpGas{BaseLen: 1, ExpLen: 32, ModLen: 32, AdjExpLen: 255, MultComplexity: 1024, Gas: 13056}},
+		{"example", true, example, ModExpGas{BaseLen: 1, ExpLen: 32, ModLen: 32, AdjExpLen: 255, MultComplexity: 16, EIP2565: true, Gas: 1360}},
+		// The last byte of the modulus length is missing and taken as zero
+		{"short", false, short, ModExpGas{BaseLen: 1, ExpLen: 1, ModLen: 256, MultComplexity: 37888, Gas: 1894}},
+		{"short", true, short, ModExpGas{BaseLen: 1, ExpLen: 1, ModLen: 256, MultComplexity: 1024, EIP2565: true, Gas: 341}},
+		{"empty", false, nil, ModExpGas{}},
+		{"empty", true, nil, ModExpGas{EIP2565: true, Gas: 200}},
+	} {
+		p := &bigModExp{eip2565: tt.eip2565}
+		if have := p.gas(tt.input); have != tt.want {
+			t.Errorf("%s, eip2565 %t: have %+v, want %+v", tt.name, tt.eip2565, have, tt.want)
+		}
+		if have := p.RequiredGas(tt.input); have != tt.want.Gas {
+			t.Errorf("%s, eip2565 %t: have required gas %d, want %d", tt.name, tt.eip2565, have, tt.want.Gas)
+		}
+	}
+}
+
 // Tests the sample inputs from the elliptic curve scalar multiplication EIP 213.
 func TestPrecompiledBn256ScalarMul(t *testing.T)      { testJson("bn256ScalarMul", "07", t) }
 func BenchmarkPrecompiledBn256ScalarMul(b *testing.B) { benchJson("bn256ScalarMul", "07", b) }
@@ -391,3 +434,138 @@ func BenchmarkPrecompiledBLS12381G2MultiExpWorstCase(b *testing.B) {
 	}
 	benchmarkPrecompiled("0f", testcase, b)
 }
+
+type precompileRun struct {
+	addr    common.Address
+	name    string
+	input   []byte
+	output  []byte
+	gasUsed uint64
+	err     error
+}
+
+type precompileRecorder struct {
+	*CallTracer
+	runs []precompileRun
+}
+
+func (r *precompileRecorder) CapturePrecompile(addr common.Address, name string, input []byte, output []byte, gas uint64, gasUsed uint64, err error) {
+	r.runs = append(r.runs, precompileRun{addr, name, common.CopyBytes(input), common.CopyBytes(output), gasUsed, err})
+}
+
+func TestPrecompileTracer(t *testing.T) {
+	outer := common.HexToAddress("0xaa")
+	tracer := &precompileRecorder{CallTracer: NewCallTracer()}
+	vmenv, s := newTestEVM(t, Config{Debug: true, Tracer: tracer})
+	// staticCall performs a STATICCALL to the given precompile with the first
+	// 64 bytes of memory, all set to 0xff, as input and 32 bytes of output
+	staticCall := func(addr byte) []byte {
+		return []byte{byte(PUSH1), 32, byte(PUSH1), 64, byte(PUSH1), 64, byte(PUSH1), 0, byte(PUSH1), addr, byte(GAS), byte(STATICCALL), byte(POP)}
+	}
+	code := []byte{byte(PUSH1), 1, byte(PUSH1), 0, byte(SUB), byte(DUP1), byte(PUSH1), 0, byte(MSTORE), byte(PUSH1), 32, byte(MSTORE)}
+	code = append(code, staticCall(0x02)...)
+	// Not a valid curve point
+	code = append(code, staticCall(0x06)...)
+	s.SetCode(outer, append(code, byte(STOP)))
+
+	if _, _, err := vmenv.Call(AccountRef(common.Address{}), outer, nil, 1000000, new(uint256.Int), false /* bailout */); err != nil {
+		t.Fatal(err)
+	}
+	if len(tracer.runs) != 2 {
+		t.Fatalf("expected 2 precompile runs, got %d", len(tracer.runs))
+	}
+	sha, bn := tracer.runs[0], tracer.runs[1]
+	if sha.name != "sha256" || sha.addr != common.BytesToAddress([]byte{2}) || len(sha.input) != 64 || len(sha.output) != 32 || sha.err != nil {
+		t.Errorf("unexpected sha256 run %+v", sha)
+	}
+	if sha.gasUsed != params.Sha256BaseGas+2*params.Sha256PerWordGas {
+		t.Errorf("unexpected sha256 gas %d", sha.gasUsed)
+	}
+	if bn.name != "bn256Add" || bn.err == nil || bn.output != nil {
+		t.Errorf("unexpected bn256Add run %+v", bn)
+	}
+	// Both frames are part of the call tree, the failed one with its error
+	calls := tracer.Result().Calls
+	if len(calls) != 2 || calls[0].Error != "" || calls[1].Error != bn.err.Error() {
+		t.Errorf("unexpected precompile frames %+v", calls)
+	}
+}
+
+type modExpRecorder struct {
+	*precompileRecorder
+	gas     []uint64
+	details []ModExpGas
+}
+
+func (r *modExpRecorder) CaptureModExpGas(addr common.Address, gas uint64, detail ModExpGas) {
+	r.gas = append(r.gas, gas)
+	r.details = append(r.details, detail)
+}
+
+func TestModExpTracer(t *testing.T) {
+	// 3 ** 5 % 7
+	input := common.FromHex("0000000000000000000000000000000000000000000000000000000000000001" +
+		"0000000000000000000000000000000000000000000000000000000000000001" +
+		"0000000000000000000000000000000000000000000000000000000000000020" +
+		"0305" + "0000000000000000000000000000000000000000000000000000000000000007")
+	tracer := &modExpRecorder{precompileRecorder: &precompileRecorder{CallTracer: NewCallTracer()}}
+	vmenv, _ := newTestEVM(t, Config{Debug: true, Tracer: tracer})
+	modexp := common.BytesToAddress([]byte{5})
+	want := ModExpGas{BaseLen: 1, ExpLen: 1, ModLen: 32, AdjExpLen: 2, MultComplexity: 16, EIP2565: true, Gas: 200}
+	// Enough gas, then too little
+	for _, gas := range []uint64{1000, 100} {
+		if _, _, err := vmenv.Call(AccountRef(common.Address{}), modexp, input, gas, new(uint256.Int), false /* bailout */); (err != nil) != (gas < want.Gas) {
+			t.Fatalf("gas %d: unexpected error %v", gas, err)
+		}
+	}
+	if !reflect.DeepEqual(tracer.gas, []uint64{1000, 100}) || !reflect.DeepEqual(tracer.details, []ModExpGas{want, want}) {
+		t.Errorf("have gas breakdowns %v %+v, want %+v", tracer.gas, tracer.details, want)
+	}
+	// The runs themselves are reported as usual
+	if len(tracer.runs) != 2 || tracer.runs[0].gasUsed != want.Gas || tracer.runs[1].err != ErrOutOfGas {
+		t.Errorf("unexpected modexp runs %+v", tracer.runs)
+	}
+}
+
+// echoPrecompile returns its input reversed, for a fixed gas.
+type echoPrecompile struct{ gas uint64 }
+
+func (p *echoPrecompile) RequiredGas(input []byte) uint64 { return p.gas }
+
+func (p *echoPrecompile) Run(input []byte) ([]byte, error) {
+	out := make([]byte, len(input))
+	for i, b := range input {
+		out[len(input)-1-i] = b
+	}
+	return out, nil
+}
+
+func TestCustomPrecompiles(t *testing.T) {
+	var (
+		custom = common.HexToAddress("0x0100")
+		sha256 = common.BytesToAddress([]byte{2})
+	)
+	precompiles := map[common.Address]PrecompiledContract{
+		custom: &echoPrecompile{gas: 50},
+		sha256: &echoPrecompile{gas: 70}, // replaces the standard one
+	}
+	vmenv, _ := newTestEVM(t, Config{Precompiles: precompiles})
+	for addr, gas := range map[common.Address]uint64{custom: 50, sha256: 70} {
+		out, leftOver, err := vmenv.Call(AccountRef(common.Address{}), addr, []byte{1, 2, 3}, 1000, new(uint256.Int), false /* bailout */)
+		if err != nil {
+			t.Fatalf("%x: %v", addr, err)
+		}
+		if !bytes.Equal(out, []byte{3, 2, 1}) || leftOver != 1000-gas {
+			t.Errorf("%x: unexpected output %x, gas left %d", addr, out, leftOver)
+		}
+	}
+	// Not enough gas for the RequiredGas of the custom precompile
+	if _, _, err := vmenv.Call(AccountRef(common.Address{}), custom, nil, 49, new(uint256.Int), false /* bailout */); !errors.Is(err, ErrOutOfGas) {
+		t.Errorf("expected out of gas, got %v", err)
+	}
+	rules := vmenv.ChainRules()
+	active := ActivePrecompilesWith(rules, precompiles)
+	if len(active) != len(ActivePrecompiles(rules))+1 || active[len(active)-1] != custom {
+		t.Errorf("unexpected active precompiles %x", active)
+	}
+}
@@ -0,0 +1,117 @@
+package vm
+
+import (
+	"math/big"
+	"time"
+
+	"github.com/holiman/uint256"
+
+	"github.com/ledgerwatch/erigon/common"
+	"github.com/ledgerwatch/erigon/crypto"
+)
+
+var _ Tracer = (*CoverageTracer)(nil)
+
+// CoverageTracer is a native tracer recording which instructions of each code
+// were executed, keyed by code hash so that the coverage of a contract called
+// several times, at any address, is merged. It can be reused across
+// transactions to accumulate the coverage of a whole test suite.
+type CoverageTracer struct {
+	covered map[common.Hash]map[uint64]bool
+	sizes   map[common.Hash]int // number of instructions of each code
+	// initHashes caches the hashes of the init codes, which contracts don't
+	// carry while they run
+	initHashes map[*Contract]common.Hash
+}
+
+// NewCoverageTracer returns a new coverage tracer.
+func NewCoverageTracer() *CoverageTracer {
+	return &CoverageTracer{
+		covered:    make(map[common.Hash]map[uint64]bool),
+		sizes:      make(map[common.Hash]int),
+		initHashes: make(map[*Contract]common.Hash),
+	}
+}
+
+// codeHash returns the hash of the code run by the contract.
+func (t *CoverageTracer) codeHash(contract *Contract) common.Hash {
+	if contract.CodeHash != (common.Hash{}) {
+		return contract.CodeHash
+	}
+	hash, ok := t.initHashes[contract]
+	if !ok {
+		hash = crypto.Keccak256Hash(contract.Code)
+		t.initHashes[contract] = hash
+	}
+	return hash
+}
+
+func (t *CoverageTracer) CaptureStart(env *EVM, depth int, from common.Address, to common.Address, precompile bool, create bool, callType CallType, input []byte, gas uint64, value *big.Int, code []byte) {
+}
+
+func (t *CoverageTracer) CaptureEnter(typ OpCode, from common.Address, to common.Address, input []byte, gas uint64, value *uint256.Int) {
+}
+
+func (t *CoverageTracer) CaptureState(env *EVM, pc uint64, op OpCode, gas, cost uint64, scope *ScopeContext, rData []byte, depth int, err error) {
+	hash := t.codeHash(scope.Contract)
+	pcs, ok := t.covered[hash]
+	if !ok {
+		pcs = make(map[uint64]bool)
+		t.covered[hash] = pcs
+		// A PUSH cut short by the end of the code still counts as an instruction
+		instructions, _ := Disassemble(scope.Contract.Code)
+		t.sizes[hash] = len(instructions)
+	}
+	// Falling off the end of the code runs an implicit STOP, which is not one
+	// of the instructions
+	if pc < uint64(len(scope.Contract.Code)) {
+		pcs[pc] = true
+	}
+}
+
+func (t *CoverageTracer) CaptureFault(env *EVM, pc uint64, op OpCode, gas, cost uint64, scope *ScopeContext, depth int, err error) {
+}
+
+func (t *CoverageTracer) CaptureEnd(depth int, output []byte, startGas, endGas uint64, d time.Duration, err error) {
+	if depth == 0 {
+		t.initHashes = make(map[*Contract]common.Hash)
+	}
+}
+
+func (t *CoverageTracer) CaptureExit(output []byte, gasUsed uint64, err error) {
+}
+
+func (t *CoverageTracer) CaptureSelfDestruct(from common.Address, to common.Address, value *big.Int) {
+}
+
+func (t *CoverageTracer) CaptureAccountRead(account common.Address) error {
+	return nil
+}
+
+func (t *CoverageTracer) CaptureAccountWrite(account common.Address) error {
+	return nil
+}
+
+// Covered returns the program counters of the executed instructions of the
+// code with the given hash, nil if it never ran.
+func (t *CoverageTracer) Covered(codeHash common.Hash) map[uint64]bool {
+	return t.covered[codeHash]
+}
+
+// Coverage returns the percentage of the instructions of the code with the
+// given hash that were executed, 0 if it never ran.
+func (t *CoverageTracer) Coverage(codeHash common.Hash) float64 {
+	if t.sizes[codeHash] == 0 {
+		return 0
+	}
+	return 100 * float64(len(t.covered[codeHash])) / float64(t.sizes[codeHash])
+}
+
+// CodeHashes returns the hashes of all the codes that ran.
+func (t *CoverageTracer) CodeHashes() []common.Hash {
+	hashes := make([]common.Hash, 0, len(t.covered))
+	for hash := range t.covered {
+		hashes = append(hashes, hash)
+	}
+	return hashes
+}
@@ -0,0 +1,58 @@
+package vm
+
+import (
+	"testing"
+
+	"github.com/holiman/uint256"
+
+	"github.com/ledgerwatch/erigon/common"
+	"github.com/ledgerwatch/erigon/crypto"
+)
+
+func TestCoverageTracer(t *testing.T) {
+	var (
+		first  = common.HexToAddress("0xaa")
+		second = common.HexToAddress("0xbb")
+		// if calldata[0:32] != 0 { jump to 9 }
+		code = []byte{
+			byte(PUSH1), 0, byte(CALLDATALOAD), byte(PUSH1), 9, byte(JUMPI),
+			byte(PUSH1), 1, byte(STOP),
+			byte(JUMPDEST), byte(PUSH1), 2, byte(STOP),
+		}
+		hash = crypto.Keccak256Hash(code)
+	)
+	tracer := NewCoverageTracer()
+	vmenv, s := newTestEVM(t, Config{Debug: true, Tracer: tracer})
+	s.SetCode(first, code)
+	s.SetCode(second, code)
+
+	if _, _, err := vmenv.Call(AccountRef(common.Address{}), first, nil, 100000, new(uint256.Int), false /* bailout */); err != nil {
+		t.Fatal(err)
+	}
+	if got := tracer.Coverage(hash); got != 100*6.0/9 {
+		t.Errorf("unexpected coverage %v after the first call", got)
+	}
+	if tracer.Covered(hash)[9] {
+		t.Error("the jump destination was not executed yet")
+	}
+	// The other branch, through another address running the same code
+	input := common.BigToHash(common.Big1).Bytes()
+	if _, _, err := vmenv.Call(AccountRef(common.Address{}), second, input, 100000, new(uint256.Int), false /* bailout */); err != nil {
+		t.Fatal(err)
+	}
+	if got := tracer.Coverage(hash); got != 100 {
+		t.Errorf("unexpected merged coverage %v", got)
+	}
+	covered := tracer.Covered(hash)
+	for _, pc := range []uint64{0, 2, 3, 5, 6, 8, 9, 10, 12} {
+		if !covered[pc] {
+			t.Errorf("pc %d not covered", pc)
+		}
+	}
+	if len(covered) != 9 || len(tracer.CodeHashes()) != 1 {
+		t.Errorf("unexpected coverage %v of %v", covered, tracer.CodeHashes())
+	}
+	if tracer.Coverage(common.Hash{}) != 0 || tracer.Covered(common.Hash{}) != nil {
+		t.Error("unexpected coverage of code that never ran")
+	}
+}
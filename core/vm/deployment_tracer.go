@@ -0,0 +1,174 @@
+package vm
+
+import (
+	"encoding/json"
+	"math/big"
+	"time"
+
+	"github.com/holiman/uint256"
+
+	"github.com/ledgerwatch/erigon/common"
+	"github.com/ledgerwatch/erigon/common/hexutil"
+	"github.com/ledgerwatch/erigon/crypto"
+)
+
+// Deployment is a contract creation recorded by the DeploymentTracer. The code
+// hash and size are those of the runtime code returned by the init code, set
+// when the creation returns successfully.
+type Deployment struct {
+	Creator      common.Address `json:"creator"`
+	Address      common.Address `json:"address"`
+	Type         string         `json:"type"` // CREATE or CREATE2
+	CodeHash     common.Hash    `json:"codeHash,omitempty"`
+	CodeSize     hexutil.Uint64 `json:"codeSize"`
+	InitCodeHash common.Hash    `json:"initCodeHash"`
+	Depth        int            `json:"depth"`
+	Failed       bool           `json:"failed,omitempty"` // the creation, or an enclosing frame, failed
+	Error        string         `json:"error,omitempty"`  // of the creation itself
+}
+
+var _ Tracer = (*DeploymentTracer)(nil)
+
+// DeploymentTracer is a native tracer listing the contracts created by a
+// transaction, the transaction itself included, in the order the creations
+// start. Creations undone by their own failure or by that of an enclosing frame
+// are recorded as failed.
+type DeploymentTracer struct {
+	env         *EVM
+	deployments []Deployment
+	frames      []int // index of the deployment every open frame makes, or -1 for calls
+	starts      []int // index of the first deployment made in every open frame
+	truncated   bool  // output of the frame exiting next was cut, see CaptureOutputTruncated
+}
+
+// NewDeploymentTracer returns a new contract deployment tracer.
+func NewDeploymentTracer() *DeploymentTracer {
+	return &DeploymentTracer{}
+}
+
+// enter opens a frame, creating the given contract if typ is CREATE or CREATE2.
+func (t *DeploymentTracer) enter(typ OpCode, from, to common.Address, input []byte, depth int) {
+	t.starts = append(t.starts, len(t.deployments))
+	if typ != CREATE && typ != CREATE2 {
+		t.frames = append(t.frames, -1)
+		return
+	}
+	t.frames = append(t.frames, len(t.deployments))
+	t.deployments = append(t.deployments, Deployment{
+		Creator:      from,
+		Address:      to,
+		Type:         typ.String(),
+		InitCodeHash: crypto.Keccak256Hash(input),
+		Depth:        depth,
+	})
+}
+
+// exit closes the innermost frame, failing all the deployments made in it if
+// err is set.
+func (t *DeploymentTracer) exit(output []byte, err error) {
+	size := len(t.frames)
+	if size == 0 {
+		return
+	}
+	index, start := t.frames[size-1], t.starts[size-1]
+	t.frames, t.starts = t.frames[:size-1], t.starts[:size-1]
+	truncated := t.truncated
+	t.truncated = false
+	if err != nil {
+		for i := start; i < len(t.deployments); i++ {
+			t.deployments[i].Failed = true
+		}
+		if index >= 0 {
+			t.deployments[index].Error = err.Error()
+		}
+		return
+	}
+	if index < 0 {
+		return
+	}
+	deployment := &t.deployments[index]
+	if truncated {
+		// The code is stored by then, read it back in full
+		deployment.CodeHash = t.env.IntraBlockState().GetCodeHash(deployment.Address)
+		deployment.CodeSize = hexutil.Uint64(t.env.IntraBlockState().GetCodeSize(deployment.Address))
+		return
+	}
+	deployment.CodeHash = crypto.Keccak256Hash(output)
+	deployment.CodeSize = hexutil.Uint64(len(output))
+}
+
+func (t *DeploymentTracer) CaptureStart(env *EVM, depth int, from common.Address, to common.Address, precompile bool, create bool, callType CallType, input []byte, gas uint64, value *big.Int, code []byte) {
+	if depth != 0 {
+		return
+	}
+	t.env, t.deployments, t.frames, t.starts, t.truncated = env, nil, nil, nil, false
+	typ := CALL
+	switch callType {
+	case CREATET:
+		typ = CREATE
+	case CREATE2T:
+		typ = CREATE2
+	}
+	t.enter(typ, from, to, input, 0)
+}
+
+func (t *DeploymentTracer) CaptureEnter(typ OpCode, from common.Address, to common.Address, input []byte, gas uint64, value *uint256.Int) {
+	t.enter(typ, from, to, input, len(t.frames))
+}
+
+func (t *DeploymentTracer) CaptureState(env *EVM, pc uint64, op OpCode, gas, cost uint64, scope *ScopeContext, rData []byte, depth int, err error) {
+}
+
+func (t *DeploymentTracer) CaptureFault(env *EVM, pc uint64, op OpCode, gas, cost uint64, scope *ScopeContext, depth int, err error) {
+}
+
+func (t *DeploymentTracer) CaptureEnd(depth int, output []byte, startGas, endGas uint64, d time.Duration, err error) {
+	if depth == 0 {
+		t.exit(output, err)
+	}
+}
+
+func (t *DeploymentTracer) CaptureExit(output []byte, gasUsed uint64, err error) {
+	t.exit(output, err)
+}
+
+// CaptureOutputTruncated implements the OutputTruncationTracer interface.
+func (t *DeploymentTracer) CaptureOutputTruncated(depth int, size int) {
+	t.truncated = true
+}
+
+func (t *DeploymentTracer) CaptureSelfDestruct(from common.Address, to common.Address, value *big.Int) {
+}
+
+func (t *DeploymentTracer) CaptureAccountRead(account common.Address) error {
+	return nil
+}
+
+func (t *DeploymentTracer) CaptureAccountWrite(account common.Address) error {
+	return nil
+}
+
+// Deployments returns all the recorded creations, failed ones included.
+func (t *DeploymentTracer) Deployments() []Deployment {
+	return t.deployments
+}
+
+// Deployed returns the creations that succeeded and were not undone.
+func (t *DeploymentTracer) Deployed() []Deployment {
+	var deployed []Deployment
+	for _, deployment := range t.deployments {
+		if !deployment.Failed {
+			deployed = append(deployed, deployment)
+		}
+	}
+	return deployed
+}
+
+// GetResult returns all the recorded creations encoded as a JSON array.
+func (t *DeploymentTracer) GetResult() (json.RawMessage, error) {
+	deployments := t.deployments
+	if deployments == nil {
+		deployments = []Deployment{}
+	}
+	return json.Marshal(deployments)
+}
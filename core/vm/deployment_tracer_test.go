@@ -0,0 +1,72 @@
+package vm
+
+import (
+	"testing"
+
+	"github.com/holiman/uint256"
+
+	"github.com/ledgerwatch/erigon/common"
+	"github.com/ledgerwatch/erigon/crypto"
+)
+
+func TestDeploymentTracer(t *testing.T) {
+	var (
+		factory = common.HexToAddress("0xaa")
+		nested  = common.HexToAddress("0xbb")
+		// MSTORE8(0, 0xfe), RETURN(0, 1)
+		initCode = []byte{byte(PUSH1), 0xfe, byte(PUSH1), 0, byte(MSTORE8), byte(PUSH1), 1, byte(PUSH1), 0, byte(RETURN)}
+		// REVERT(0, 0)
+		revertCode = []byte{byte(PUSH1), 0, byte(PUSH1), 0, byte(REVERT)}
+	)
+	// create stores the init code at the end of the first memory word and runs
+	// CREATE(0, 32-len, len)
+	create := func(init []byte) []byte {
+		code := append([]byte{byte(PUSH1) + byte(len(init)) - 1}, init...)
+		return append(code, byte(PUSH1), 0, byte(MSTORE), byte(PUSH1), byte(len(init)), byte(PUSH1), byte(32-len(init)), byte(PUSH1), 0, byte(CREATE), byte(POP))
+	}
+	var code []byte
+	code = append(code, create(initCode)...)
+	// CREATE2(0, 27, 5, 0) of the reverting init code
+	code = append(code, byte(PUSH5))
+	code = append(code, revertCode...)
+	code = append(code, byte(PUSH1), 0, byte(MSTORE), byte(PUSH1), 0, byte(PUSH1), 5, byte(PUSH1), 27, byte(PUSH1), 0, byte(CREATE2), byte(POP))
+	// CALL(gas, 0xbb, 0, 0, 0, 0, 0)
+	code = append(code, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0xbb, byte(GAS), byte(CALL), byte(STOP))
+
+	tracer := NewDeploymentTracer()
+	vmenv, s := newTestEVM(t, Config{Debug: true, Tracer: tracer})
+	s.SetCode(factory, code)
+	// A nested factory whose deployment is undone by its REVERT(0, 0)
+	s.SetCode(nested, append(create(initCode), byte(PUSH1), 0, byte(PUSH1), 0, byte(REVERT)))
+	if _, _, err := vmenv.Call(AccountRef(common.Address{}), factory, nil, 1000000, new(uint256.Int), false /* bailout */); err != nil {
+		t.Fatal(err)
+	}
+	deployments := tracer.Deployments()
+	if len(deployments) != 3 {
+		t.Fatalf("expected 3 deployments, got %+v", deployments)
+	}
+	created, reverted, undone := deployments[0], deployments[1], deployments[2]
+	if created.Creator != factory || created.Address != crypto.CreateAddress(factory, 0) || created.Type != "CREATE" || created.Depth != 1 || created.Failed {
+		t.Errorf("unexpected deployment %+v", created)
+	}
+	if created.CodeSize != 1 || created.CodeHash != crypto.Keccak256Hash([]byte{0xfe}) || created.InitCodeHash != crypto.Keccak256Hash(initCode) {
+		t.Errorf("unexpected code of the deployment %+v", created)
+	}
+	revertHash := crypto.Keccak256Hash(revertCode)
+	if reverted.Address != crypto.CreateAddress2(factory, [32]byte{}, revertHash.Bytes()) || reverted.Type != "CREATE2" || !reverted.Failed || reverted.Error != ErrExecutionReverted.Error() || reverted.InitCodeHash != revertHash {
+		t.Errorf("unexpected reverted deployment %+v", reverted)
+	}
+	if undone.Creator != nested || undone.Depth != 2 || !undone.Failed || undone.Error != "" {
+		t.Errorf("unexpected undone deployment %+v", undone)
+	}
+	if deployed := tracer.Deployed(); len(deployed) != 1 || deployed[0] != created {
+		t.Errorf("unexpected successful deployments %+v", deployed)
+	}
+
+	// The creation by the transaction itself is recorded too
+	if _, addr, _, err := vmenv.Create(AccountRef(factory), initCode, 1000000, new(uint256.Int)); err != nil {
+		t.Fatal(err)
+	} else if deployments := tracer.Deployed(); len(deployments) != 1 || deployments[0].Address != addr || deployments[0].Depth != 0 || deployments[0].CodeSize != 1 {
+		t.Errorf("unexpected top-level deployment %+v", deployments)
+	}
+}
@@ -0,0 +1,58 @@
+package vm
+
+import (
+	"fmt"
+
+	"github.com/ledgerwatch/erigon/common/hexutil"
+)
+
+// Instruction is a single decoded instruction of EVM bytecode.
+type Instruction struct {
+	PC        uint64
+	Op        OpCode
+	Operand   []byte // immediate data of PUSH1..PUSH32, nil for other opcodes
+	Truncated bool   // code ends before the full PUSH operand, Operand holds what is left
+}
+
+func (ins Instruction) String() string {
+	return ins.Format(nil)
+}
+
+// Format is like String, with the opcode names overridden by names.
+func (ins Instruction) Format(names OpCodeNames) string {
+	if ins.Operand == nil && !ins.Truncated {
+		return fmt.Sprintf("%05d: %s", ins.PC, names.Name(ins.Op))
+	}
+	s := fmt.Sprintf("%05d: %s %s", ins.PC, names.Name(ins.Op), hexutil.Encode(ins.Operand))
+	if ins.Truncated {
+		s += " (truncated)"
+	}
+	return s
+}
+
+// Disassemble decodes the code into instructions, stepping over the immediate
+// data of PUSH opcodes the same way the JUMPDEST analysis does. A PUSH cut short
+// by the end of the code is returned with the remaining bytes and Truncated
+// set, along with an error describing it; the instruction list is complete
+// either way. Operands share the backing array of code.
+func Disassemble(code []byte) ([]Instruction, error) {
+	var (
+		instructions []Instruction
+		err          error
+	)
+	for pc := uint64(0); pc < uint64(len(code)); pc++ {
+		ins := Instruction{PC: pc, Op: OpCode(code[pc])}
+		if size := uint64(pushDataSize(ins.Op)); size > 0 {
+			end := pc + 1 + size
+			if end > uint64(len(code)) {
+				end = uint64(len(code))
+				ins.Truncated = true
+				err = fmt.Errorf("incomplete push instruction at %d", pc)
+			}
+			ins.Operand = code[pc+1 : end]
+			pc = end - 1
+		}
+		instructions = append(instructions, ins)
+	}
+	return instructions, err
+}
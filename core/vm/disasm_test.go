@@ -0,0 +1,66 @@
+package vm
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDisassemble(t *testing.T) {
+	code := []byte{byte(PUSH1), 0x2a, byte(PUSH2), 0x01, 0x02, byte(ADD), byte(JUMPDEST), byte(PUSH4), 0xaa, 0xbb}
+	instructions, err := Disassemble(code)
+	if err == nil {
+		t.Error("expected an error for the truncated PUSH4")
+	}
+	want := []Instruction{
+		{PC: 0, Op: PUSH1, Operand: []byte{0x2a}},
+		{PC: 2, Op: PUSH2, Operand: []byte{0x01, 0x02}},
+		{PC: 5, Op: ADD},
+		{PC: 6, Op: JUMPDEST},
+		{PC: 7, Op: PUSH4, Operand: []byte{0xaa, 0xbb}, Truncated: true},
+	}
+	if len(instructions) != len(want) {
+		t.Fatalf("expected %d instructions, got %d: %v", len(want), len(instructions), instructions)
+	}
+	for i, w := range want {
+		got := instructions[i]
+		if got.PC != w.PC || got.Op != w.Op || !bytes.Equal(got.Operand, w.Operand) || got.Truncated != w.Truncated {
+			t.Errorf("instruction %d: expected %v, got %v", i, w, got)
+		}
+	}
+	if s := instructions[4].String(); s != "00007: PUSH4 0xaabb (truncated)" {
+		t.Errorf("unexpected formatting %q", s)
+	}
+
+	if _, err := Disassemble(code[:7]); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	// Instructions and operands must agree with the JUMPDEST analysis
+	analysis := codeBitmap(code)
+	for _, ins := range instructions {
+		if !isCodeFromAnalysis(analysis, ins.PC) {
+			t.Errorf("instruction at %d classified as data", ins.PC)
+		}
+		for i := range ins.Operand {
+			if isCodeFromAnalysis(analysis, ins.PC+1+uint64(i)) {
+				t.Errorf("operand byte at %d classified as code", ins.PC+1+uint64(i))
+			}
+		}
+	}
+}
+
+func TestDisassembleCustomNames(t *testing.T) {
+	names := OpCodeNames{ADD: "PLUS", 0x0c: "CUSTOM"}
+	instructions, err := Disassemble([]byte{byte(PUSH1), 1, byte(ADD), 0x0c, 0x0d})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"00000: PUSH1 0x01", "00002: PLUS", "00003: CUSTOM", "00004: opcode 0xd not defined"}
+	for i, w := range want {
+		if s := instructions[i].Format(names); s != w {
+			t.Errorf("instruction %d: expected %q, got %q", i, w, s)
+		}
+	}
+	if s := instructions[1].String(); s != "00002: ADD" {
+		t.Errorf("unexpected default formatting %q", s)
+	}
+}
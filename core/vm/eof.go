@@ -0,0 +1,115 @@
+package vm
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/ledgerwatch/erigon/params"
+)
+
+// The EOF v1 container layout of EIP-3540: the magic and version, followed by
+// the section headers, a kind byte and a big-endian uint16 size each, ended by
+// a terminator, and then the section contents.
+const (
+	eofFormatByte = 0xEF
+	eofMagic      = 0x00
+	eofVersion1   = 0x01
+
+	eofKindTerminator = 0x00
+	eofKindCode       = 0x01
+	eofKindData       = 0x02
+
+	// eofInvalid is the designated INVALID opcode of EIP-141
+	eofInvalid OpCode = 0xfe
+)
+
+var (
+	ErrEOFInvalidMagic         = errors.New("invalid EOF magic")
+	ErrEOFInvalidVersion       = errors.New("invalid EOF version")
+	ErrEOFTruncatedHeader      = errors.New("truncated EOF header")
+	ErrEOFInvalidSection       = errors.New("invalid EOF section header")
+	ErrEOFMissingCode          = errors.New("missing EOF code section")
+	ErrEOFInvalidSize          = errors.New("EOF container size mismatch")
+	ErrEOFUndefinedInstruction = errors.New("undefined instruction in EOF code")
+	ErrEOFTruncatedImmediate   = errors.New("truncated PUSH data in EOF code")
+)
+
+// ValidateEOF checks that code is a valid EOF v1 container, as per EIP-3540:
+// the magic and version, a single non-empty code section optionally followed
+// by a single non-empty data section, and contents matching the sizes in the
+// header.
+//
+// From Shanghai on, the fork EOF was first scheduled for, the code section is
+// also validated as per EIP-3670 against the instruction set of rules: it must
+// not contain undefined opcodes nor end in the middle of PUSH data.
+func ValidateEOF(code []byte, rules params.Rules) error {
+	if len(code) < 2 || code[0] != eofFormatByte || code[1] != eofMagic {
+		return ErrEOFInvalidMagic
+	}
+	if len(code) < 3 {
+		return ErrEOFTruncatedHeader
+	}
+	if code[2] != eofVersion1 {
+		return fmt.Errorf("%w: %d", ErrEOFInvalidVersion, code[2])
+	}
+	var codeSize, dataSize int
+	pos := 3
+	for {
+		if pos >= len(code) {
+			return ErrEOFTruncatedHeader
+		}
+		kind := code[pos]
+		pos++
+		if kind == eofKindTerminator {
+			break
+		}
+		if pos+2 > len(code) {
+			return ErrEOFTruncatedHeader
+		}
+		size := int(binary.BigEndian.Uint16(code[pos:]))
+		pos += 2
+		switch {
+		case kind == eofKindCode && codeSize == 0:
+			codeSize = size
+		case kind == eofKindData && codeSize != 0 && dataSize == 0:
+			dataSize = size
+		case kind == eofKindData && codeSize == 0:
+			return fmt.Errorf("%w: data section before the code section", ErrEOFInvalidSection)
+		case kind == eofKindCode || kind == eofKindData:
+			return fmt.Errorf("%w: duplicate section kind %d", ErrEOFInvalidSection, kind)
+		default:
+			return fmt.Errorf("%w: unknown section kind %d", ErrEOFInvalidSection, kind)
+		}
+		if size == 0 {
+			return fmt.Errorf("%w: empty section kind %d", ErrEOFInvalidSection, kind)
+		}
+	}
+	if codeSize == 0 {
+		return ErrEOFMissingCode
+	}
+	if want := pos + codeSize + dataSize; len(code) != want {
+		return fmt.Errorf("%w: have %d bytes, want %d", ErrEOFInvalidSize, len(code), want)
+	}
+	if rules.IsShanghai {
+		return validateEOFCode(code[pos:pos+codeSize], instructionSetForRules(&rules))
+	}
+	return nil
+}
+
+// validateEOFCode rejects undefined opcodes and truncated PUSH data in an EOF
+// code section (EIP-3670). The designated INVALID opcode is allowed.
+func validateEOFCode(code []byte, jt *JumpTable) error {
+	for pc := 0; pc < len(code); pc++ {
+		op := OpCode(code[pc])
+		if jt[op] == nil && op != eofInvalid {
+			return fmt.Errorf("%w: %v at %d", ErrEOFUndefinedInstruction, op, pc)
+		}
+		if op.IsPush() {
+			if pc += int(op - PUSH1 + 1); pc >= len(code) {
+				return fmt.Errorf("%w: %v", ErrEOFTruncatedImmediate, op)
+			}
+		}
+	}
+	return nil
+}
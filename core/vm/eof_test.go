@@ -0,0 +1,47 @@
+package vm
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/ledgerwatch/erigon/common"
+	"github.com/ledgerwatch/erigon/params"
+)
+
+func TestValidateEOF(t *testing.T) {
+	var (
+		london   = *params.AllCliqueProtocolChanges.Rules(0)
+		shanghai = london
+	)
+	shanghai.IsShanghai = true
+	tests := []struct {
+		code  string
+		rules params.Rules
+		err   error
+	}{
+		{"ef00010100010000", shanghai, nil},                        // STOP
+		{"ef0001010002020002005f00aabb", shanghai, nil},            // PUSH0 STOP and two bytes of data
+		{"ef0001010002020002005f00aabb", london, nil},              // the code isn't validated before Shanghai
+		{"ef000101000100fe", shanghai, nil},                        // INVALID is defined
+		{"ef000101000100ef", shanghai, ErrEOFUndefinedInstruction}, // 0xEF is not
+		{"ef000101000100ef", london, nil},
+		{"ef00010100010060", shanghai, ErrEOFTruncatedImmediate},
+		{"ef000101000200600100", shanghai, ErrEOFInvalidSize},
+		{"ef01010100010000", shanghai, ErrEOFInvalidMagic},
+		{"6000", shanghai, ErrEOFInvalidMagic},
+		{"ef00", shanghai, ErrEOFTruncatedHeader},
+		{"ef000201000100", shanghai, ErrEOFInvalidVersion},
+		{"ef00010100", shanghai, ErrEOFTruncatedHeader},
+		{"ef0001010001", shanghai, ErrEOFTruncatedHeader},
+		{"ef000100", shanghai, ErrEOFMissingCode},
+		{"ef0001010000000000", shanghai, ErrEOFInvalidSection},         // empty code
+		{"ef00010200010100010000aa", shanghai, ErrEOFInvalidSection},   // data first
+		{"ef000101000101000100000000", shanghai, ErrEOFInvalidSection}, // two code sections
+		{"ef000103000100000000", shanghai, ErrEOFInvalidSection},       // unknown kind
+	}
+	for i, tt := range tests {
+		if err := ValidateEOF(common.FromHex(tt.code), tt.rules); !errors.Is(err, tt.err) {
+			t.Errorf("test %d: have %v, want %v", i, err, tt.err)
+		}
+	}
+}
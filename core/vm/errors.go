@@ -17,8 +17,13 @@
 package vm
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
+
+	"github.com/ledgerwatch/erigon/accounts/abi"
+	"github.com/ledgerwatch/erigon/common/hexutil"
+	"github.com/ledgerwatch/erigon/crypto"
 )
 
 // List evm execution errors
@@ -41,6 +46,37 @@ var (
 	ErrReturnStackExceeded      = errors.New("return stack limit reached")
 	ErrInvalidCode              = errors.New("invalid code")
 	ErrNonceUintOverflow        = errors.New("nonce uint64 overflow")
+
+	// ErrStepLimitReached is returned when Config.StepLimit is exceeded. It
+	// is imposed by the caller, unlike any of the consensus errors above.
+	ErrStepLimitReached = errors.New("step limit reached")
+	// ErrMemoryLimit is returned when an opcode would expand the memory beyond
+	// Config.MaxMemorySize.
+	ErrMemoryLimit = errors.New("memory limit reached")
+	// ErrSnapshotBeforeTx is returned by EVM.RevertToSnapshot for a snapshot
+	// older than the current top-level call.
+	ErrSnapshotBeforeTx = errors.New("snapshot predates the transaction")
+	// ErrExecutionCancelled is returned when the context set on the EVM is
+	// done before the execution completes.
+	ErrExecutionCancelled = errors.New("execution cancelled")
+	// ErrBreakpoint is returned when the execution reaches one of
+	// Config.Breakpoints.
+	ErrBreakpoint = errors.New("breakpoint reached")
+	// ErrContextRequired is returned by RunSingleOp for the opcodes that need
+	// the state or a call frame to run.
+	ErrContextRequired = errors.New("opcode requires a call context")
+	// ErrRulesSwapNotDebug is returned by EVM.SwapChainRules outside of Debug
+	// mode.
+	ErrRulesSwapNotDebug = errors.New("chain rules can only be swapped in debug mode")
+	// ErrPaused is returned once the top-level call frame stops before an
+	// opcode after EVM.Pause, see EVM.PausedState.
+	ErrPaused = errors.New("execution paused")
+	// ErrPauseNotDebug is returned by EVM.Pause and EVM.Resume outside of
+	// Debug mode.
+	ErrPauseNotDebug = errors.New("execution can only be paused in debug mode")
+	// ErrInvalidInterpreterState is returned by EVM.Resume for a snapshot the
+	// interpreter can't have taken.
+	ErrInvalidInterpreterState = errors.New("invalid interpreter state")
 )
 
 // ErrStackUnderflow wraps an evm error when the items on the stack less
@@ -71,3 +107,50 @@ type ErrInvalidOpCode struct {
 }
 
 func (e *ErrInvalidOpCode) Error() string { return fmt.Sprintf("invalid opcode: %s", e.opcode) }
+
+// errorStringSelector is the selector of the Solidity Error(string) revert.
+var errorStringSelector = crypto.Keccak256([]byte("Error(string)"))[:4]
+
+// RevertError is an ErrExecutionReverted annotated with the data returned by
+// the reverting frame. Reverts using the Solidity Error(string) convention have
+// their message decoded into Reason, for custom errors only the selector and
+// the raw data are available.
+type RevertError struct {
+	Reason   string  // decoded Error(string) message, empty if not available
+	Selector [4]byte // first four bytes of the revert data, zero if shorter
+	Data     []byte  // raw revert data
+}
+
+// NewRevertError decodes the output of a reverted call.
+func NewRevertError(output []byte) *RevertError {
+	e := &RevertError{Data: output}
+	if len(output) >= 4 {
+		copy(e.Selector[:], output[:4])
+	}
+	if reason, err := abi.UnpackRevert(output); err == nil {
+		e.Reason = reason
+	}
+	return e
+}
+
+// IsCustom returns whether the revert data does not follow the Error(string)
+// convention, but still carries a selector identifying a custom error.
+func (e *RevertError) IsCustom() bool {
+	return len(e.Data) >= 4 && !bytes.Equal(e.Selector[:], errorStringSelector)
+}
+
+func (e *RevertError) Error() string {
+	switch {
+	case e.Reason != "":
+		return fmt.Sprintf("%v: %s", ErrExecutionReverted, e.Reason)
+	case e.IsCustom():
+		return fmt.Sprintf("%v: custom error %s", ErrExecutionReverted, hexutil.Encode(e.Selector[:]))
+	default:
+		return ErrExecutionReverted.Error()
+	}
+}
+
+// Unwrap allows errors.Is(err, ErrExecutionReverted) to keep working.
+func (e *RevertError) Unwrap() error {
+	return ErrExecutionReverted
+}
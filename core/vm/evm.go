@@ -17,13 +17,18 @@
 package vm
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"math/big"
 	"sync/atomic"
 	"time"
 
 	"github.com/holiman/uint256"
+	"github.com/ledgerwatch/erigon/accounts/abi"
 	"github.com/ledgerwatch/erigon/common"
 	"github.com/ledgerwatch/erigon/common/u256"
+	"github.com/ledgerwatch/erigon/core/types"
 	"github.com/ledgerwatch/erigon/crypto"
 	"github.com/ledgerwatch/erigon/params"
 )
@@ -37,12 +42,21 @@ type (
 	CanTransferFunc func(IntraBlockState, common.Address, *uint256.Int) bool
 	// TransferFunc is the signature of a transfer function
 	TransferFunc func(IntraBlockState, common.Address, common.Address, *uint256.Int, bool)
+	// CanTransferWithGasFunc is a CanTransferFunc that is also given the gas
+	// supplied to the call and its depth
+	CanTransferWithGasFunc func(ibs IntraBlockState, sender common.Address, amount *uint256.Int, gas uint64, depth int) bool
+	// TransferWithGasFunc is a TransferFunc that is also given the gas supplied
+	// to the call and its depth
+	TransferWithGasFunc func(ibs IntraBlockState, sender, recipient common.Address, amount *uint256.Int, bailout bool, gas uint64, depth int)
 	// GetHashFunc returns the nth block hash in the blockchain
 	// and is used by the BLOCKHASH EVM op code.
 	GetHashFunc func(uint64) common.Hash
 )
 
 func (evm *EVM) precompile(addr common.Address) (PrecompiledContract, bool) {
+	if p, ok := evm.config.Precompiles[addr]; ok {
+		return p, true
+	}
 	var precompiles map[common.Address]PrecompiledContract
 	switch {
 	case evm.chainRules.IsBerlin:
@@ -75,6 +89,10 @@ type BlockContext struct {
 	CanTransfer CanTransferFunc
 	// Transfer transfers ether from one account to the other
 	Transfer TransferFunc
+	// CanTransferWithGas and TransferWithGas, if set, are used in place of
+	// CanTransfer and Transfer
+	CanTransferWithGas CanTransferWithGasFunc
+	TransferWithGas    TransferWithGasFunc
 	// GetHash returns the hash corresponding to n
 	GetHash GetHashFunc
 
@@ -95,7 +113,17 @@ type TxContext struct {
 	// Message information
 	TxHash   common.Hash
 	Origin   common.Address // Provides information for ORIGIN
-	GasPrice *big.Int       // Provides information for GASPRICE
+	GasPrice *big.Int       // Provides information for GASPRICE, the effective price under EIP-1559
+}
+
+// BlockOverrides replaces fields of the BlockContext of an EVM, nil fields
+// keep their original value.
+type BlockOverrides struct {
+	BlockNumber *uint64         // Overrides NUMBER
+	Time        *uint64         // Overrides TIMESTAMP
+	Coinbase    *common.Address // Overrides COINBASE
+	Difficulty  *big.Int        // Overrides DIFFICULTY, unless PREVRANDAO is set
+	BaseFee     *uint256.Int    // Overrides BASEFEE
 }
 
 // EVM is the Ethereum Virtual Machine base object and provides
@@ -133,6 +161,36 @@ type EVM struct {
 	// available gas is calculated in gasCall* according to the 63/64 rule and later
 	// applied in opCall*.
 	callGasTemp uint64
+	// txSnapshot is the state snapshot taken by the current top-level call
+	txSnapshot int
+	// coldAccess is set by the EIP-2929 gas functions when the current opcode
+	// warmed its target account or storage slot, for tracers reporting the access
+	coldAccess bool
+	// opcodeStats counts the executed opcodes when Config.EnableOpcodeStats is set
+	opcodeStats [256]uint64
+	// steps counts the opcodes executed in the current top-level call, for
+	// Config.StepLimit and the polling of ctx
+	steps uint64
+	// breakpointHit is set once a frame halted at one of Config.Breakpoints
+	breakpointHit bool
+	// ctx, if set, cancels the execution with ErrExecutionCancelled when done
+	ctx context.Context
+	// jumpDests caches the JUMPDEST analysis by code hash across all the calls
+	// made through this EVM
+	jumpDests map[common.Hash][]uint64
+	// frameRules replaces chainRules in the frames started after
+	// SwapChainRules, and unswappedRules are the rules in place before the
+	// outermost frame running under swapped rules, nil if none runs
+	frameRules     *params.Rules
+	unswappedRules *params.Rules
+	// pauseRequested is set by Pause until the top-level frame is paused,
+	// with its snapshot in paused, and resumed is the snapshot Resume restores
+	// the frame from. deploying tells that the top-level frame is a creation,
+	// which can't be paused
+	pauseRequested bool
+	paused         *InterpreterState
+	resumed        *InterpreterState
+	deploying      bool
 }
 
 // NewEVM returns a new EVM. The returned EVM is not thread safe and should
@@ -145,6 +203,7 @@ func NewEVM(blockCtx BlockContext, txCtx TxContext, state IntraBlockState, chain
 		config:          vmConfig,
 		chainConfig:     chainConfig,
 		chainRules:      chainConfig.Rules(blockCtx.BlockNumber),
+		jumpDests:       make(map[common.Hash][]uint64),
 	}
 
 	evm.interpreter = NewEVMInterpreter(evm, vmConfig)
@@ -154,9 +213,63 @@ func NewEVM(blockCtx BlockContext, txCtx TxContext, state IntraBlockState, chain
 
 // Reset resets the EVM with a new transaction context.Reset
 // This is not threadsafe and should only be done very cautiously.
+//
+// The block context, chain config and interpreter are kept, while the call
+// depth and the interpreter's per-call state are cleared in case the previous
+// execution was aborted. The JUMPDEST analysis cache is kept as well, since it
+// is keyed by code hash and doesn't depend on the state.
 func (evm *EVM) Reset(txCtx TxContext, ibs IntraBlockState) {
 	evm.txContext = txCtx
 	evm.intraBlockState = ibs
+	evm.depth = 0
+	evm.callGasTemp = 0
+	evm.steps = 0
+	if in, ok := evm.interpreter.(*EVMInterpreter); ok {
+		in.readOnly = false
+		in.returnData = nil
+	}
+}
+
+// SetTracer replaces the tracer for the following calls, enabling Debug if the
+// tracer is not nil and disabling it otherwise. It must not be called while
+// the EVM is running.
+func (evm *EVM) SetTracer(tracer Tracer) {
+	evm.setTracer(tracer, tracer != nil)
+}
+
+func (evm *EVM) setTracer(tracer Tracer, debug bool) {
+	evm.config.Tracer, evm.config.Debug = tracer, debug
+	if in, ok := evm.interpreter.(*EVMInterpreter); ok {
+		in.cfg.Tracer, in.cfg.Debug = tracer, debug
+	}
+}
+
+// snapshot takes a state snapshot for a call frame. The one of the top-level
+// frame marks the start of the transaction for RevertToSnapshot.
+func (evm *EVM) snapshot() int {
+	id := evm.intraBlockState.Snapshot()
+	if evm.depth == 0 {
+		evm.txSnapshot = id
+	}
+	return id
+}
+
+// Snapshot takes a snapshot of the state, for a tracer to speculatively run
+// code and then discard its effects with RevertToSnapshot.
+func (evm *EVM) Snapshot() int {
+	return evm.intraBlockState.Snapshot()
+}
+
+// RevertToSnapshot undoes all the state changes made since the given snapshot,
+// including the refund counter, transient storage, access list and logs. The
+// id must have been returned by Snapshot and not reverted yet. Snapshots taken
+// before the current top-level call are refused with ErrSnapshotBeforeTx.
+func (evm *EVM) RevertToSnapshot(id int) error {
+	if id < evm.txSnapshot {
+		return ErrSnapshotBeforeTx
+	}
+	evm.intraBlockState.RevertToSnapshot(id)
+	return nil
 }
 
 // Cancel cancels any running EVM operation. This may be called concurrently and
@@ -170,6 +283,144 @@ func (evm *EVM) Cancelled() bool {
 	return atomic.LoadInt32(&evm.abort) == 1
 }
 
+// SetContext makes all further executions abort with ErrExecutionCancelled
+// once ctx is done. The context is polled every few thousand opcodes and on
+// every call frame entry. A nil ctx removes the context.
+func (evm *EVM) SetContext(ctx context.Context) {
+	evm.ctx = ctx
+}
+
+// CallWithContext is like Call, but aborts with ErrExecutionCancelled once ctx
+// is done.
+func (evm *EVM) CallWithContext(ctx context.Context, caller ContractRef, addr common.Address, input []byte, gas uint64, value *uint256.Int, bailout bool) (ret []byte, leftOverGas uint64, err error) {
+	prev := evm.ctx
+	evm.ctx = ctx
+	defer func() { evm.ctx = prev }()
+	return evm.Call(caller, addr, input, gas, value, bailout)
+}
+
+// OpcodeStats returns the number of times each opcode has been executed by
+// this EVM. It is only populated when Config.EnableOpcodeStats is set.
+func (evm *EVM) OpcodeStats() map[OpCode]uint64 {
+	stats := make(map[OpCode]uint64)
+	for op, count := range evm.opcodeStats {
+		if count > 0 {
+			stats[OpCode(op)] = count
+		}
+	}
+	return stats
+}
+
+// UnpackRevert decodes the Error(string) reason from the output of a reverted
+// call. Custom errors can't be decoded without their ABI, use NewRevertError to
+// get hold of their selector.
+func (evm *EVM) UnpackRevert(output []byte) (string, error) {
+	return abi.UnpackRevert(output)
+}
+
+// newContract returns a new contract environment sharing the JUMPDEST analysis
+// cache of the EVM, so that code called repeatedly is only analysed once.
+func (evm *EVM) newContract(caller ContractRef, object ContractRef, value *uint256.Int, gas uint64) *Contract {
+	c := NewContract(caller, object, value, gas, evm.config.SkipAnalysis)
+	c.jumpdests = evm.jumpDests
+	return c
+}
+
+// traceOutput returns the part of a call's output handed to the tracer, which
+// is cut to Config.MaxTraceOutputSize bytes. The full length is reported to an
+// OutputTruncationTracer beforehand. The output returned to the caller is not
+// affected.
+func (evm *EVM) traceOutput(output []byte) []byte {
+	limit := evm.config.MaxTraceOutputSize
+	if limit <= 0 || len(output) <= limit {
+		return output
+	}
+	if tracer, ok := evm.config.Tracer.(OutputTruncationTracer); ok {
+		tracer.CaptureOutputTruncated(evm.depth, len(output))
+	}
+	return output[:limit:limit]
+}
+
+// canTransfer calls the transfer guard of the block context, the gas aware one
+// if set. depth is the one of the call being made.
+func (evm *EVM) canTransfer(sender common.Address, amount *uint256.Int, gas uint64) bool {
+	if evm.context.CanTransferWithGas != nil {
+		return evm.context.CanTransferWithGas(evm.intraBlockState, sender, amount, gas, evm.depth)
+	}
+	return evm.context.CanTransfer(evm.intraBlockState, sender, amount)
+}
+
+// transfer calls the transfer function of the block context, the gas aware one
+// if set. depth is the one of the call being made.
+func (evm *EVM) transfer(sender, recipient common.Address, amount *uint256.Int, bailout bool, gas uint64) {
+	if evm.context.TransferWithGas != nil {
+		evm.context.TransferWithGas(evm.intraBlockState, sender, recipient, amount, bailout, gas, evm.depth)
+		return
+	}
+	evm.context.Transfer(evm.intraBlockState, sender, recipient, amount, bailout)
+}
+
+// runPrecompile runs a precompiled contract and reports it to a PrecompileTracer,
+// and to a ModExpTracer for modexp.
+func (evm *EVM) runPrecompile(p PrecompiledContract, addr common.Address, input []byte, gas uint64) (ret []byte, remainingGas uint64, err error) {
+	if modexp, ok := p.(*bigModExp); ok && evm.config.Debug {
+		if tracer, ok := evm.config.Tracer.(ModExpTracer); ok {
+			tracer.CaptureModExpGas(addr, gas, modexp.gas(input))
+		}
+	}
+	ret, remainingGas, err = RunPrecompiledContract(p, input, gas)
+	if tracer, ok := evm.config.Tracer.(PrecompileTracer); ok && evm.config.Debug {
+		output := ret
+		if limit := evm.config.MaxTraceOutputSize; limit > 0 && len(output) > limit {
+			output = output[:limit:limit]
+		}
+		gasUsed := gas - remainingGas
+		if err != nil {
+			gasUsed = gas
+		}
+		tracer.CapturePrecompile(addr, PrecompileName(p), input, output, gas, gasUsed, err)
+	}
+	return ret, remainingGas, err
+}
+
+// interceptCall runs Config.InterceptCall for a sub-call to addr with the
+// given gas, returning its result and the gas left if it handled the call.
+func (evm *EVM) interceptCall(addr common.Address, input []byte, gas uint64) (handled bool, ret []byte, remainingGas uint64, err error) {
+	if evm.config.InterceptCall == nil || !evm.config.Debug || evm.depth == 0 {
+		return false, nil, gas, nil
+	}
+	handled, ret, gasUsed, err := evm.config.InterceptCall(addr, input)
+	if !handled {
+		return false, nil, gas, nil
+	}
+	if gasUsed > gas {
+		return true, nil, 0, ErrOutOfGas
+	}
+	if err != nil && err != ErrExecutionReverted {
+		// Like failing frames, no return data
+		ret = nil
+	}
+	return true, ret, gas - gasUsed, err
+}
+
+// maxCallDepth returns the call depth limit, which can be lowered but never
+// raised above the protocol limit through Config.MaxCallDepth.
+func (evm *EVM) maxCallDepth() int {
+	if evm.config.MaxCallDepth > 0 && evm.config.MaxCallDepth < int(params.CallCreateDepth) {
+		return evm.config.MaxCallDepth
+	}
+	return int(params.CallCreateDepth)
+}
+
+// sstoreSentryGas returns the gas that must be left for SSTORE to run, see
+// EIP-2200.
+func (evm *EVM) sstoreSentryGas() uint64 {
+	if evm.config.SstoreSentryGas > 0 {
+		return evm.config.SstoreSentryGas
+	}
+	return params.SstoreSentryGasEIP2200
+}
+
 // Interpreter returns the current interpreter
 func (evm *EVM) Interpreter() Interpreter {
 	return evm.interpreter
@@ -184,11 +435,14 @@ func (evm *EVM) Call(caller ContractRef, addr common.Address, input []byte, gas
 		return nil, gas, nil
 	}
 	// Fail if we're trying to execute above the call depth limit
-	if evm.depth > int(params.CallCreateDepth) {
+	if evm.depth > evm.maxCallDepth() {
 		return nil, gas, ErrDepth
 	}
+	if evm.config.ForceReadOnly && !value.IsZero() {
+		return nil, gas, ErrWriteProtection
+	}
 	// Fail if we're trying to transfer more than the available balance
-	if !value.IsZero() && !evm.context.CanTransfer(evm.intraBlockState, caller.Address(), value) {
+	if !value.IsZero() && !evm.canTransfer(caller.Address(), value, gas) {
 		if !bailout {
 			return nil, gas, ErrInsufficientBalance
 		}
@@ -201,25 +455,36 @@ func (evm *EVM) Call(caller ContractRef, addr common.Address, input []byte, gas
 	// Capture the tracer start/end events in debug mode
 	if evm.config.Debug {
 		evm.config.Tracer.CaptureStart(evm, evm.depth, caller.Address(), addr, isPrecompile, false /* create */, CALLT, input, gas, value.ToBig(), code)
+		if evm.depth > 0 {
+			evm.config.Tracer.CaptureEnter(CALL, caller.Address(), addr, input, gas, value)
+		}
 		defer func(startGas uint64, startTime time.Time) { // Lazy evaluation of the parameters
-			evm.config.Tracer.CaptureEnd(evm.depth, ret, startGas, gas, time.Since(startTime), err)
+			output := evm.traceOutput(ret)
+			if evm.depth > 0 {
+				evm.config.Tracer.CaptureExit(output, startGas-gas, err)
+			}
+			evm.config.Tracer.CaptureEnd(evm.depth, output, startGas, gas, time.Since(startTime), err)
 		}(gas, time.Now())
 	}
 
 	var (
 		to       = AccountRef(addr)
-		snapshot = evm.intraBlockState.Snapshot()
+		snapshot = evm.snapshot()
 	)
+	// Mocked accounts need not exist
+	intercepted, interceptedRet, interceptedGas, interceptedErr := evm.interceptCall(addr, input, gas)
 	if !evm.intraBlockState.Exist(addr) {
-		if !isPrecompile && evm.chainRules.IsSpuriousDragon && value.IsZero() {
+		if !isPrecompile && !intercepted && evm.chainRules.IsSpuriousDragon && value.IsZero() {
 			return nil, gas, nil
 		}
 		evm.intraBlockState.CreateAccount(addr, false)
 	}
-	evm.context.Transfer(evm.intraBlockState, caller.Address(), to.Address(), value, bailout)
+	evm.transfer(caller.Address(), to.Address(), value, bailout, gas)
 
-	if isPrecompile {
-		ret, gas, err = RunPrecompiledContract(p, input, gas)
+	if intercepted {
+		ret, gas, err = interceptedRet, interceptedGas, interceptedErr
+	} else if isPrecompile {
+		ret, gas, err = evm.runPrecompile(p, addr, input, gas)
 	} else {
 		// Initialise a new contract and set the code that is to be used by the EVM.
 		// The contract is a scoped environment for this execution context only.
@@ -231,7 +496,7 @@ func (evm *EVM) Call(caller ContractRef, addr common.Address, input []byte, gas
 			// The depth-check is already done, and precompiles handled above
 			codehash := evm.intraBlockState.GetCodeHash(addrCopy)
 
-			contract := NewContract(caller, AccountRef(addrCopy), value, gas, evm.config.SkipAnalysis)
+			contract := evm.newContract(caller, AccountRef(addrCopy), value, gas)
 			contract.SetCallCode(&addrCopy, codehash, code)
 			ret, err = run(evm, contract, input, false)
 			gas = contract.Gas
@@ -240,7 +505,7 @@ func (evm *EVM) Call(caller ContractRef, addr common.Address, input []byte, gas
 	// When an error was returned by the EVM or when setting the creation code
 	// above we revert to the snapshot and consume any gas remaining. Additionally
 	// when we're in homestead this also counts for code storage gas errors.
-	if err != nil {
+	if err != nil && err != ErrPaused {
 		evm.intraBlockState.RevertToSnapshot(snapshot)
 		if err != ErrExecutionReverted {
 			gas = 0
@@ -252,6 +517,45 @@ func (evm *EVM) Call(caller ContractRef, addr common.Address, input []byte, gas
 	return ret, gas, err
 }
 
+// EstimateCallGas finds the smallest amount of gas, up to gasCap, with which
+// Call succeeds, returning it along with the output of that call. Every probe
+// runs from the same state and its changes are reverted, so the EVM is left
+// as it was; tracers see all the probes. The gas covers the execution only,
+// not the intrinsic gas of a transaction.
+//
+// If the call fails with gasCap, the error is returned along with the revert
+// data, and running out of gas is reported as exceeding the allowance.
+func (evm *EVM) EstimateCallGas(caller ContractRef, addr common.Address, input []byte, value *uint256.Int, gasCap uint64) (uint64, []byte, error) {
+	txCtx, ibs := evm.txContext, evm.intraBlockState
+	probe := func(gas uint64) ([]byte, error) {
+		evm.Reset(txCtx, ibs)
+		id := ibs.Snapshot()
+		ret, _, err := evm.Call(caller, addr, input, gas, value, false /* bailout */)
+		ibs.RevertToSnapshot(id)
+		return ret, err
+	}
+	out, err := probe(gasCap)
+	if errors.Is(err, ErrOutOfGas) {
+		return 0, nil, fmt.Errorf("gas required exceeds allowance (%d): %w", gasCap, err)
+	} else if err != nil {
+		return 0, out, err
+	}
+	if ret, err := probe(0); err == nil {
+		return 0, ret, nil
+	}
+	// lo always fails and hi succeeds
+	lo, hi := uint64(0), gasCap
+	for lo+1 < hi {
+		mid := lo + (hi-lo)/2
+		if ret, err := probe(mid); err != nil {
+			lo = mid
+		} else {
+			hi, out = mid, ret
+		}
+	}
+	return hi, out, nil
+}
+
 // CallCode executes the contract associated with the addr with the given input
 // as parameters. It also handles any necessary value transfer required and takes
 // the necessary steps to create accounts and reverses the state in case of an
@@ -264,14 +568,14 @@ func (evm *EVM) CallCode(caller ContractRef, addr common.Address, input []byte,
 		return nil, gas, nil
 	}
 	// Fail if we're trying to execute above the call depth limit
-	if evm.depth > int(params.CallCreateDepth) {
+	if evm.depth > evm.maxCallDepth() {
 		return nil, gas, ErrDepth
 	}
 	// Fail if we're trying to transfer more than the available balance
 	// Note although it's noop to transfer X ether to caller itself. But
 	// if caller doesn't have enough balance, it would be an error to allow
 	// over-charging itself. So the check here is necessary.
-	if !evm.context.CanTransfer(evm.intraBlockState, caller.Address(), value) {
+	if !evm.canTransfer(caller.Address(), value, gas) {
 		return nil, gas, ErrInsufficientBalance
 	}
 	p, isPrecompile := evm.precompile(addr)
@@ -282,17 +586,26 @@ func (evm *EVM) CallCode(caller ContractRef, addr common.Address, input []byte,
 	// Capture the tracer start/end events in debug mode
 	if evm.config.Debug {
 		evm.config.Tracer.CaptureStart(evm, evm.depth, caller.Address(), addr, isPrecompile, false /* create */, CALLCODET, input, gas, value.ToBig(), code)
+		if evm.depth > 0 {
+			evm.config.Tracer.CaptureEnter(CALLCODE, caller.Address(), addr, input, gas, value)
+		}
 		defer func(startGas uint64, startTime time.Time) { // Lazy evaluation of the parameters
-			evm.config.Tracer.CaptureEnd(evm.depth, ret, startGas, gas, time.Since(startTime), err)
+			output := evm.traceOutput(ret)
+			if evm.depth > 0 {
+				evm.config.Tracer.CaptureExit(output, startGas-gas, err)
+			}
+			evm.config.Tracer.CaptureEnd(evm.depth, output, startGas, gas, time.Since(startTime), err)
 		}(gas, time.Now())
 	}
 	var (
-		snapshot = evm.intraBlockState.Snapshot()
+		snapshot = evm.snapshot()
 	)
 
 	// It is allowed to call precompiles, even via delegatecall
-	if isPrecompile {
-		ret, gas, err = RunPrecompiledContract(p, input, gas)
+	if intercepted, output, remainingGas, callErr := evm.interceptCall(addr, input, gas); intercepted {
+		ret, gas, err = output, remainingGas, callErr
+	} else if isPrecompile {
+		ret, gas, err = evm.runPrecompile(p, addr, input, gas)
 	} else {
 		addrCopy := addr
 		// Initialise a new contract and set the code that is to be used by the EVM.
@@ -301,13 +614,13 @@ func (evm *EVM) CallCode(caller ContractRef, addr common.Address, input []byte,
 		codeHash := evm.intraBlockState.GetCodeHash(addrCopy)
 
 		if err == nil {
-			contract := NewContract(caller, AccountRef(caller.Address()), value, gas, evm.config.SkipAnalysis)
+			contract := evm.newContract(caller, AccountRef(caller.Address()), value, gas)
 			contract.SetCallCode(&addrCopy, codeHash, code)
 			ret, err = run(evm, contract, input, false)
 			gas = contract.Gas
 		}
 	}
-	if err != nil {
+	if err != nil && err != ErrPaused {
 		evm.intraBlockState.RevertToSnapshot(snapshot)
 		if err != ErrExecutionReverted {
 			gas = 0
@@ -326,7 +639,7 @@ func (evm *EVM) DelegateCall(caller ContractRef, addr common.Address, input []by
 		return nil, gas, nil
 	}
 	// Fail if we're trying to execute above the call depth limit
-	if evm.depth > int(params.CallCreateDepth) {
+	if evm.depth > evm.maxCallDepth() {
 		return nil, gas, ErrDepth
 	}
 	p, isPrecompile := evm.precompile(addr)
@@ -337,28 +650,37 @@ func (evm *EVM) DelegateCall(caller ContractRef, addr common.Address, input []by
 	// Capture the tracer start/end events in debug mode
 	if evm.config.Debug {
 		evm.config.Tracer.CaptureStart(evm, evm.depth, caller.Address(), addr, isPrecompile, false /* create */, DELEGATECALLT, input, gas, big.NewInt(-1), code)
+		if evm.depth > 0 {
+			evm.config.Tracer.CaptureEnter(DELEGATECALL, caller.Address(), addr, input, gas, nil)
+		}
 		defer func(startGas uint64, startTime time.Time) { // Lazy evaluation of the parameters
-			evm.config.Tracer.CaptureEnd(evm.depth, ret, startGas, gas, time.Since(startTime), err)
+			output := evm.traceOutput(ret)
+			if evm.depth > 0 {
+				evm.config.Tracer.CaptureExit(output, startGas-gas, err)
+			}
+			evm.config.Tracer.CaptureEnd(evm.depth, output, startGas, gas, time.Since(startTime), err)
 		}(gas, time.Now())
 	}
-	snapshot := evm.intraBlockState.Snapshot()
+	snapshot := evm.snapshot()
 
 	// It is allowed to call precompiles, even via delegatecall
-	if isPrecompile {
-		ret, gas, err = RunPrecompiledContract(p, input, gas)
+	if intercepted, output, remainingGas, callErr := evm.interceptCall(addr, input, gas); intercepted {
+		ret, gas, err = output, remainingGas, callErr
+	} else if isPrecompile {
+		ret, gas, err = evm.runPrecompile(p, addr, input, gas)
 	} else {
 		addrCopy := addr
 		// Initialise a new contract and make initialise the delegate values
 		codeHash := evm.intraBlockState.GetCodeHash(addrCopy)
 
 		if err == nil {
-			contract := NewContract(caller, AccountRef(caller.Address()), nil, gas, evm.config.SkipAnalysis).AsDelegate()
+			contract := evm.newContract(caller, AccountRef(caller.Address()), nil, gas).AsDelegate()
 			contract.SetCallCode(&addrCopy, codeHash, code)
 			ret, err = run(evm, contract, input, false)
 			gas = contract.Gas
 		}
 	}
-	if err != nil {
+	if err != nil && err != ErrPaused {
 		evm.intraBlockState.RevertToSnapshot(snapshot)
 		if err != ErrExecutionReverted {
 			gas = 0
@@ -376,7 +698,7 @@ func (evm *EVM) StaticCall(caller ContractRef, addr common.Address, input []byte
 		return nil, gas, nil
 	}
 	// Fail if we're trying to execute above the call depth limit
-	if evm.depth > int(params.CallCreateDepth) {
+	if evm.depth > evm.maxCallDepth() {
 		return nil, gas, ErrDepth
 	}
 	p, isPrecompile := evm.precompile(addr)
@@ -387,8 +709,15 @@ func (evm *EVM) StaticCall(caller ContractRef, addr common.Address, input []byte
 	// Capture the tracer start/end events in debug mode
 	if evm.config.Debug {
 		evm.config.Tracer.CaptureStart(evm, evm.depth, caller.Address(), addr, isPrecompile, false, STATICCALLT, input, gas, big.NewInt(-2), code)
+		if evm.depth > 0 {
+			evm.config.Tracer.CaptureEnter(STATICCALL, caller.Address(), addr, input, gas, nil)
+		}
 		defer func(startGas uint64, startTime time.Time) { // Lazy evaluation of the parameters
-			evm.config.Tracer.CaptureEnd(evm.depth, ret, startGas, gas, time.Since(startTime), err)
+			output := evm.traceOutput(ret)
+			if evm.depth > 0 {
+				evm.config.Tracer.CaptureExit(output, startGas-gas, err)
+			}
+			evm.config.Tracer.CaptureEnd(evm.depth, output, startGas, gas, time.Since(startTime), err)
 		}(gas, time.Now())
 	}
 	// We take a snapshot here. This is a bit counter-intuitive, and could probably be skipped.
@@ -396,7 +725,7 @@ func (evm *EVM) StaticCall(caller ContractRef, addr common.Address, input []byte
 	// after all empty accounts were deleted, so this is not required. However, if we omit this,
 	// then certain tests start failing; stRevertTest/RevertPrecompiledTouchExactOOG.json.
 	// We could change this, but for now it's left for legacy reasons
-	var snapshot = evm.intraBlockState.Snapshot()
+	var snapshot = evm.snapshot()
 
 	// We do an AddBalance of zero here, just in order to trigger a touch.
 	// This doesn't matter on Mainnet, where all empties are gone at the time of Byzantium,
@@ -404,8 +733,10 @@ func (evm *EVM) StaticCall(caller ContractRef, addr common.Address, input []byte
 	// future scenarios
 	evm.intraBlockState.AddBalance(addr, u256.Num0)
 
-	if isPrecompile {
-		ret, gas, err = RunPrecompiledContract(p, input, gas)
+	if intercepted, output, remainingGas, callErr := evm.interceptCall(addr, input, gas); intercepted {
+		ret, gas, err = output, remainingGas, callErr
+	} else if isPrecompile {
+		ret, gas, err = evm.runPrecompile(p, addr, input, gas)
 	} else {
 		// At this point, we use a copy of address. If we don't, the go compiler will
 		// leak the 'contract' to the outer scope, and make allocation for 'contract'
@@ -416,7 +747,7 @@ func (evm *EVM) StaticCall(caller ContractRef, addr common.Address, input []byte
 		codeHash := evm.intraBlockState.GetCodeHash(addrCopy)
 
 		if err == nil {
-			contract := NewContract(caller, AccountRef(addrCopy), new(uint256.Int), gas, evm.config.SkipAnalysis)
+			contract := evm.newContract(caller, AccountRef(addrCopy), new(uint256.Int), gas)
 			contract.SetCallCode(&addrCopy, codeHash, code)
 			// When an error was returned by the EVM or when setting the creation code
 			// above we revert to the snapshot and consume any gas remaining. Additionally
@@ -425,7 +756,7 @@ func (evm *EVM) StaticCall(caller ContractRef, addr common.Address, input []byte
 			gas = contract.Gas
 		}
 	}
-	if err != nil {
+	if err != nil && err != ErrPaused {
 		evm.intraBlockState.RevertToSnapshot(snapshot)
 		if err != ErrExecutionReverted {
 			gas = 0
@@ -447,21 +778,49 @@ func (c *codeAndHash) Hash() common.Hash {
 }
 
 // create creates a new contract using code as deployment code.
-func (evm *EVM) create(caller ContractRef, codeAndHash *codeAndHash, gas uint64, value *uint256.Int, address common.Address, calltype CallType) ([]byte, common.Address, uint64, error) {
+// salt is only set for CREATE2 and is passed on to the tracer.
+func (evm *EVM) create(caller ContractRef, codeAndHash *codeAndHash, gas uint64, value *uint256.Int, address common.Address, calltype CallType, salt *uint256.Int) ([]byte, common.Address, uint64, error) {
 	var ret []byte
 	var err error
 	// Depth check execution. Fail if we're trying to execute above the
 	// limit.
-	if evm.depth > int(params.CallCreateDepth) {
+	if evm.depth > evm.maxCallDepth() {
 		return nil, common.Address{}, gas, ErrDepth
 	}
-	if !evm.context.CanTransfer(evm.intraBlockState, caller.Address(), value) {
+	if evm.config.ForceReadOnly {
+		return nil, common.Address{}, gas, ErrWriteProtection
+	}
+	if evm.depth == 0 {
+		evm.deploying = true
+		defer func() { evm.deploying = false }()
+	}
+	if !evm.canTransfer(caller.Address(), value, gas) {
 		return nil, common.Address{}, gas, ErrInsufficientBalance
 	}
 	if evm.config.Debug {
+		// Report the target address before anything can abort the creation,
+		// so that collisions can still be matched against the prediction.
+		if ct, ok := evm.config.Tracer.(CreateTracer); ok {
+			var initCodeHash common.Hash
+			if calltype == CREATE2T {
+				initCodeHash = codeAndHash.Hash()
+			}
+			ct.CaptureCreate(evm, evm.depth, caller.Address(), address, calltype, salt, initCodeHash)
+		}
 		evm.config.Tracer.CaptureStart(evm, evm.depth, caller.Address(), address, false /* precompile */, true /* create */, calltype, codeAndHash.code, gas, value.ToBig(), nil)
+		if evm.depth > 0 {
+			typ := CREATE
+			if calltype == CREATE2T {
+				typ = CREATE2
+			}
+			evm.config.Tracer.CaptureEnter(typ, caller.Address(), address, codeAndHash.code, gas, value)
+		}
 		defer func(startGas uint64, startTime time.Time) { // Lazy evaluation of the parameters
-			evm.config.Tracer.CaptureEnd(evm.depth, ret, startGas, gas, time.Since(startTime), err)
+			output := evm.traceOutput(ret)
+			if evm.depth > 0 {
+				evm.config.Tracer.CaptureExit(output, startGas-gas, err)
+			}
+			evm.config.Tracer.CaptureEnd(evm.depth, output, startGas, gas, time.Since(startTime), err)
 		}(gas, time.Now())
 	}
 	nonce := evm.intraBlockState.GetNonce(caller.Address())
@@ -478,19 +837,20 @@ func (evm *EVM) create(caller ContractRef, codeAndHash *codeAndHash, gas uint64,
 	contractHash := evm.intraBlockState.GetCodeHash(address)
 	if evm.intraBlockState.GetNonce(address) != 0 || (contractHash != (common.Hash{}) && contractHash != emptyCodeHash) {
 		err = ErrContractAddressCollision
+		gas = 0 // For the CaptureEnd/CaptureExit to report all gas as used
 		return nil, common.Address{}, 0, err
 	}
 	// Create a new account on the state
-	snapshot := evm.intraBlockState.Snapshot()
+	snapshot := evm.snapshot()
 	evm.intraBlockState.CreateAccount(address, true)
 	if evm.chainRules.IsSpuriousDragon {
 		evm.intraBlockState.SetNonce(address, 1)
 	}
-	evm.context.Transfer(evm.intraBlockState, caller.Address(), address, value, false /* bailout */)
+	evm.transfer(caller.Address(), address, value, false /* bailout */, gas)
 
 	// Initialise a new contract and set the code that is to be used by the EVM.
 	// The contract is a scoped environment for this execution context only.
-	contract := NewContract(caller, AccountRef(address), value, gas, evm.config.SkipAnalysis)
+	contract := evm.newContract(caller, AccountRef(address), value, gas)
 	contract.SetCodeOptionalHash(&address, codeAndHash)
 
 	if evm.config.NoRecursion && evm.depth > 0 {
@@ -540,11 +900,40 @@ func (evm *EVM) create(caller ContractRef, codeAndHash *codeAndHash, gas uint64,
 
 }
 
+// CreateAddress returns the address of the contract deployed by creator with
+// CREATE, or by a creation transaction, at the given nonce of the creator.
+func CreateAddress(creator common.Address, nonce uint64) common.Address {
+	return crypto.CreateAddress(creator, nonce)
+}
+
+// CreateAddress2 returns the address of the contract deployed by creator with
+// CREATE2, from the salt and the Keccak256 hash of the init code (EIP-1014).
+func CreateAddress2(creator common.Address, salt common.Hash, initCodeHash common.Hash) common.Address {
+	return crypto.CreateAddress2(creator, salt, initCodeHash.Bytes())
+}
+
 // Create creates a new contract using code as deployment code.
 // DESCRIBED: docs/programmers_guide/guide.md#nonce
 func (evm *EVM) Create(caller ContractRef, code []byte, gas uint64, value *uint256.Int) (ret []byte, contractAddr common.Address, leftOverGas uint64, err error) {
-	contractAddr = crypto.CreateAddress(caller.Address(), evm.intraBlockState.GetNonce(caller.Address()))
-	return evm.create(caller, &codeAndHash{code: code}, gas, value, contractAddr, CREATET)
+	contractAddr = CreateAddress(caller.Address(), evm.intraBlockState.GetNonce(caller.Address()))
+	return evm.create(caller, &codeAndHash{code: code}, gas, value, contractAddr, CREATET, nil /* salt */)
+}
+
+// CreateWithTrace runs the init code like Create, traced by the given tracer
+// instead of the configured one if it is not nil, and returns the runtime code
+// stored at the new address. The deployment fails with ErrMaxCodeSizeExceeded
+// if the runtime code is larger than EIP-170 allows, and with ErrInvalidCode
+// if it starts with 0xEF, rejected by EIP-3541; no code is returned then.
+func (evm *EVM) CreateWithTrace(caller ContractRef, code []byte, gas uint64, value *uint256.Int, tracer Tracer) (contractAddr common.Address, runtimeCode []byte, leftOverGas uint64, err error) {
+	if tracer != nil {
+		defer evm.setTracer(evm.config.Tracer, evm.config.Debug)
+		evm.SetTracer(tracer)
+	}
+	_, contractAddr, leftOverGas, err = evm.Create(caller, code, gas, value)
+	if err == nil {
+		runtimeCode = evm.intraBlockState.GetCode(contractAddr)
+	}
+	return contractAddr, runtimeCode, leftOverGas, err
 }
 
 // Create2 creates a new contract using code as deployment code.
@@ -554,8 +943,8 @@ func (evm *EVM) Create(caller ContractRef, code []byte, gas uint64, value *uint2
 // DESCRIBED: docs/programmers_guide/guide.md#nonce
 func (evm *EVM) Create2(caller ContractRef, code []byte, gas uint64, endowment *uint256.Int, salt *uint256.Int) (ret []byte, contractAddr common.Address, leftOverGas uint64, err error) {
 	codeAndHash := &codeAndHash{code: code}
-	contractAddr = crypto.CreateAddress2(caller.Address(), salt.Bytes32(), codeAndHash.Hash().Bytes())
-	return evm.create(caller, codeAndHash, gas, endowment, contractAddr, CREATE2T)
+	contractAddr = CreateAddress2(caller.Address(), salt.Bytes32(), codeAndHash.Hash())
+	return evm.create(caller, codeAndHash, gas, endowment, contractAddr, CREATE2T, salt)
 }
 
 // ChainConfig returns the environment's chain configuration
@@ -572,14 +961,122 @@ func (evm *EVM) ChainRules() *params.Rules {
 	return evm.chainRules
 }
 
+// SwapChainRules runs the frames started from now on under the given rules,
+// restoring the ones of the chain config if rules is nil, for observing the
+// behaviour of code at a fork boundary. The swap only happens at frame
+// boundaries: the frames already running keep their rules and instruction set
+// until they return, while the calls they make afterwards use the new ones.
+// The call itself, such as which precompiles are active, follows the rules of
+// the caller. It can be called from a tracer, or between calls, but only in
+// Debug mode since the results are not those of any chain.
+func (evm *EVM) SwapChainRules(rules *params.Rules) error {
+	if !evm.config.Debug {
+		return ErrRulesSwapNotDebug
+	}
+	if rules == nil {
+		// Only the frames started by a swapped frame need to swap back, the
+		// others run under the chain rules already
+		rules = evm.unswappedRules
+	}
+	evm.frameRules = rules
+	return nil
+}
+
+// PrepareAccessList warms up the sender, the destination, the precompiles and
+// the entries of the transaction access list before a call, as the state
+// transition does, so that traced calls are charged the same EIP-2929 gas. The
+// precompiles active under the chain rules are used if precompiles is nil.
+// Nothing is done before Berlin.
+func (evm *EVM) PrepareAccessList(sender common.Address, dest *common.Address, precompiles []common.Address, list types.AccessList) {
+	if !evm.chainRules.IsBerlin {
+		return
+	}
+	if precompiles == nil {
+		precompiles = ActivePrecompilesWith(evm.chainRules, evm.config.Precompiles)
+	}
+	evm.intraBlockState.PrepareAccessList(sender, dest, precompiles, list)
+}
+
 func (evm *EVM) Context() BlockContext {
 	return evm.context
 }
 
+// ApplyBlockOverrides replaces the given fields of the block context in place,
+// for what-if execution. The chain rules selected at construction are kept
+// even if the block number is overridden.
+func (evm *EVM) ApplyBlockOverrides(overrides BlockOverrides) {
+	if overrides.BlockNumber != nil {
+		evm.context.BlockNumber = *overrides.BlockNumber
+	}
+	if overrides.Time != nil {
+		evm.context.Time = *overrides.Time
+	}
+	if overrides.Coinbase != nil {
+		evm.context.Coinbase = *overrides.Coinbase
+	}
+	if overrides.Difficulty != nil {
+		evm.context.Difficulty = new(big.Int).Set(overrides.Difficulty)
+	}
+	if overrides.BaseFee != nil {
+		evm.context.BaseFee = new(uint256.Int).Set(overrides.BaseFee)
+	}
+}
+
 func (evm *EVM) TxContext() TxContext {
 	return evm.txContext
 }
 
+// Origin returns the sender of the current transaction, as seen by ORIGIN.
+func (evm *EVM) Origin() common.Address {
+	return evm.txContext.Origin
+}
+
+// GasPrice returns a copy of the gas price of the current transaction, as seen
+// by GASPRICE. Under EIP-1559 it is the effective price paid by the sender:
+// the base fee plus the tip, capped by the fee cap.
+func (evm *EVM) GasPrice() *big.Int {
+	if evm.txContext.GasPrice == nil {
+		return new(big.Int)
+	}
+	return new(big.Int).Set(evm.txContext.GasPrice)
+}
+
+// Refund returns the refund counter of the current transaction, and the part
+// of it the state transition gives back for gasUsed: at most gasUsed/2, or
+// gasUsed/5 since London (EIP-3529).
+func (evm *EVM) Refund(gasUsed uint64) (raw, capped uint64) {
+	quotient := params.RefundQuotient
+	if evm.chainRules.IsLondon {
+		quotient = params.RefundQuotientEIP3529
+	}
+	raw = evm.intraBlockState.GetRefund()
+	if capped = gasUsed / quotient; capped > raw {
+		capped = raw
+	}
+	return raw, capped
+}
+
+// FeeSplit returns how the fee paid for gasUsed splits between the base fee
+// burnt under EIP-1559 and the tip going to the coinbase, for a transaction
+// with the given fee cap and tip. Legacy transactions pay their gas price as
+// both. Before London nothing is burnt and the whole gas price is tipped.
+func (evm *EVM) FeeSplit(gasUsed uint64, feeCap, tip *uint256.Int) (burnt, tipped *uint256.Int) {
+	gas := new(uint256.Int).SetUint64(gasUsed)
+	baseFee := evm.context.BaseFee
+	if !evm.chainRules.IsLondon || baseFee == nil {
+		return new(uint256.Int), gas.Mul(gas, feeCap)
+	}
+	// The tip is capped by what the fee cap leaves above the base fee, and a
+	// fee cap below the base fee (only allowed with NoBaseFee) is all burnt
+	burntPrice, tipPrice := baseFee, new(uint256.Int)
+	if feeCap.Lt(baseFee) {
+		burntPrice = feeCap
+	} else if tipPrice.Sub(feeCap, baseFee); tip.Lt(tipPrice) {
+		tipPrice.Set(tip)
+	}
+	return new(uint256.Int).Mul(gas, burntPrice), gas.Mul(gas, tipPrice)
+}
+
 func (evm *EVM) IntraBlockState() IntraBlockState {
 	return evm.intraBlockState
 }
@@ -1,9 +1,19 @@
 package vm
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"math"
+	"math/big"
+	"reflect"
 	"testing"
+	"time"
 
+	"github.com/ledgerwatch/erigon/common"
+	"github.com/ledgerwatch/erigon/core/types"
+	"github.com/ledgerwatch/erigon/crypto"
 	"github.com/ledgerwatch/erigon/params"
 
 	"github.com/holiman/uint256"
@@ -399,3 +409,997 @@ func trace(isEVMSlice []bool, readOnlySlice []*readOnlyState) string {
 	}
 	return res
 }
+
+type frameEvent struct {
+	enter bool
+	typ   OpCode
+	to    common.Address
+	err   error
+}
+
+type testFrameTracer struct {
+	*StructLogger
+	events []frameEvent
+}
+
+func (ft *testFrameTracer) CaptureEnter(typ OpCode, from common.Address, to common.Address, input []byte, gas uint64, value *uint256.Int) {
+	ft.events = append(ft.events, frameEvent{enter: true, typ: typ, to: to})
+}
+
+func (ft *testFrameTracer) CaptureExit(output []byte, gasUsed uint64, err error) {
+	ft.events = append(ft.events, frameEvent{err: err})
+}
+
+func TestCaptureEnterExit(t *testing.T) {
+	var (
+		outer    = common.HexToAddress("0xaa")
+		middle   = common.HexToAddress("0xbb")
+		reverter = common.HexToAddress("0xcc")
+	)
+	// callCode performs a zero-value CALL to the given one-byte address.
+	callCode := func(op OpCode, addr byte) []byte {
+		code := []byte{byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0}
+		if op == CALL {
+			code = append(code, byte(PUSH1), 0) // value
+		}
+		return append(code, byte(PUSH1), addr, byte(GAS), byte(op), byte(POP))
+	}
+	tracer := &testFrameTracer{StructLogger: NewStructLogger(nil)}
+	vmenv, s := newTestEVM(t, Config{Debug: true, Tracer: tracer})
+	s.SetCode(outer, append(append(callCode(CALL, 0xbb), callCode(STATICCALL, 0xbb)...), byte(STOP)))
+	s.SetCode(middle, append(callCode(DELEGATECALL, 0xcc), byte(STOP)))
+	s.SetCode(reverter, []byte{byte(PUSH1), 0, byte(PUSH1), 0, byte(REVERT)})
+
+	if _, _, err := vmenv.Call(AccountRef(common.Address{}), outer, nil, 1000000, new(uint256.Int), false /* bailout */); err != nil {
+		t.Fatal(err)
+	}
+	want := []frameEvent{
+		{enter: true, typ: CALL, to: middle},
+		{enter: true, typ: DELEGATECALL, to: reverter},
+		{err: ErrExecutionReverted},
+		{},
+		{enter: true, typ: STATICCALL, to: middle},
+		{enter: true, typ: DELEGATECALL, to: reverter},
+		{err: ErrExecutionReverted},
+		{},
+	}
+	if len(tracer.events) != len(want) {
+		t.Fatalf("expected %d events, got %d: %+v", len(want), len(tracer.events), tracer.events)
+	}
+	for i, ev := range tracer.events {
+		if ev.enter != want[i].enter || ev.typ != want[i].typ || ev.to != want[i].to || !errors.Is(ev.err, want[i].err) {
+			t.Errorf("event %d: have %+v, want %+v", i, ev, want[i])
+		}
+	}
+}
+
+func TestOpcodeStats(t *testing.T) {
+	contract := common.HexToAddress("0xaa")
+	// Counts down from 3 to 0:
+	// PUSH1 3; JUMPDEST; PUSH1 1; SWAP1; SUB; DUP1; PUSH1 2; JUMPI; STOP
+	code := []byte{
+		byte(PUSH1), 3, byte(JUMPDEST), byte(PUSH1), 1, byte(SWAP1), byte(SUB),
+		byte(DUP1), byte(PUSH1), 2, byte(JUMPI), byte(STOP),
+	}
+	for _, enabled := range []bool{false, true} {
+		vmenv, s := newTestEVM(t, Config{EnableOpcodeStats: enabled})
+		s.SetCode(contract, code)
+		if _, _, err := vmenv.Call(AccountRef(common.Address{}), contract, nil, 100000, new(uint256.Int), false /* bailout */); err != nil {
+			t.Fatal(err)
+		}
+		stats := vmenv.OpcodeStats()
+		if !enabled {
+			if len(stats) != 0 {
+				t.Errorf("expected no stats when disabled, got %v", stats)
+			}
+			continue
+		}
+		want := map[OpCode]uint64{PUSH1: 7, JUMPDEST: 3, SWAP1: 3, SUB: 3, DUP1: 3, JUMPI: 3, STOP: 1}
+		if len(stats) != len(want) {
+			t.Errorf("expected %d distinct opcodes, got %v", len(want), stats)
+		}
+		for op, count := range want {
+			if stats[op] != count {
+				t.Errorf("opcode %v: expected %d executions, got %d", op, count, stats[op])
+			}
+		}
+	}
+}
+
+func TestCustomJumpTable(t *testing.T) {
+	contract := common.HexToAddress("0xaa")
+	const custom = OpCode(0x0c) // unassigned in every fork
+	// custom; PUSH1 0; MSTORE; PUSH1 32; PUSH1 0; RETURN
+	code := []byte{byte(custom), byte(PUSH1), 0, byte(MSTORE), byte(PUSH1), 32, byte(PUSH1), 0, byte(RETURN)}
+
+	jt := newLondonInstructionSet()
+	jt[custom] = &operation{
+		execute: func(pc *uint64, interpreter *EVMInterpreter, scope *ScopeContext) ([]byte, error) {
+			scope.Stack.Push(uint256.NewInt(42))
+			return nil, nil
+		},
+		constantGas: GasQuickStep,
+		minStack:    minStack(0, 1),
+		maxStack:    maxStack(0, 1),
+	}
+	vmenv, s := newTestEVM(t, Config{JumpTable: &jt})
+	s.SetCode(contract, code)
+	ret, _, err := vmenv.Call(AccountRef(common.Address{}), contract, nil, 100000, new(uint256.Int), false /* bailout */)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := new(uint256.Int).SetBytes(ret); got.Uint64() != 42 {
+		t.Errorf("expected custom opcode to push 42, got %v", got)
+	}
+
+	// A table with an entry that cannot be executed is rejected
+	broken := newLondonInstructionSet()
+	broken[custom] = &operation{constantGas: GasQuickStep}
+	vmenv, s = newTestEVM(t, Config{JumpTable: &broken})
+	s.SetCode(contract, code)
+	_, _, err = vmenv.Call(AccountRef(common.Address{}), contract, nil, 100000, new(uint256.Int), false /* bailout */)
+	var invalid *ErrInvalidOpCode
+	if !errors.As(err, &invalid) {
+		t.Errorf("expected the default table to be used, got err %v", err)
+	}
+}
+
+func TestRevertError(t *testing.T) {
+	// Error("boom")
+	reason := common.FromHex("0x08c379a0" +
+		"0000000000000000000000000000000000000000000000000000000000000020" +
+		"0000000000000000000000000000000000000000000000000000000000000004" +
+		"626f6f6d00000000000000000000000000000000000000000000000000000000")
+	custom := common.FromHex("0xdeadbeef0000000000000000000000000000000000000000000000000000000000000001")
+
+	vmenv, _ := newTestEVM(t, Config{})
+	if msg, err := vmenv.UnpackRevert(reason); err != nil || msg != "boom" {
+		t.Errorf("expected reason %q, got %q (err %v)", "boom", msg, err)
+	}
+	if _, err := vmenv.UnpackRevert(custom); err == nil {
+		t.Error("expected custom error to be rejected")
+	}
+
+	for _, tt := range []struct {
+		data     []byte
+		reason   string
+		isCustom bool
+		msg      string
+	}{
+		{reason, "boom", false, "execution reverted: boom"},
+		{custom, "", true, "execution reverted: custom error 0xdeadbeef"},
+		{nil, "", false, "execution reverted"},
+	} {
+		revert := NewRevertError(tt.data)
+		if revert.Reason != tt.reason || revert.IsCustom() != tt.isCustom || revert.Error() != tt.msg {
+			t.Errorf("unexpected decoding of %x: %+v (%q)", tt.data, revert, revert.Error())
+		}
+		if !errors.Is(revert, ErrExecutionReverted) {
+			t.Errorf("expected %v to match ErrExecutionReverted", revert)
+		}
+	}
+	if sel := NewRevertError(custom).Selector; sel != [4]byte{0xde, 0xad, 0xbe, 0xef} {
+		t.Errorf("unexpected selector %x", sel)
+	}
+}
+
+func TestMaxCallDepth(t *testing.T) {
+	contract := common.HexToAddress("0xaa")
+	// CALL(gas, ADDRESS, 0, 0, 0, 0, 0); POP; STOP
+	code := []byte{
+		byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0,
+		byte(ADDRESS), byte(GAS), byte(CALL), byte(POP), byte(STOP),
+	}
+	for _, tt := range []struct{ limit, frames int }{{3, 4}, {1, 2}} {
+		tracer := NewCallTracer()
+		vmenv, s := newTestEVM(t, Config{Debug: true, Tracer: tracer, MaxCallDepth: tt.limit})
+		s.SetCode(contract, code)
+		if _, _, err := vmenv.Call(AccountRef(common.Address{}), contract, nil, 1000000, new(uint256.Int), false /* bailout */); err != nil {
+			t.Fatal(err)
+		}
+		frames := 1
+		for frame := tracer.Result(); len(frame.Calls) > 0; frame = &frame.Calls[0] {
+			frames++
+		}
+		if frames != tt.frames {
+			t.Errorf("limit %d: expected %d nested frames, got %d", tt.limit, tt.frames, frames)
+		}
+	}
+	vmenv, _ := newTestEVM(t, Config{MaxCallDepth: 2 * int(params.CallCreateDepth)})
+	if vmenv.maxCallDepth() != int(params.CallCreateDepth) {
+		t.Errorf("call depth limit raised above the protocol maximum: %d", vmenv.maxCallDepth())
+	}
+}
+
+func BenchmarkJumpdestAnalysisCache(b *testing.B) {
+	contract := common.HexToAddress("0xaa")
+	// PUSH2 <end>; JUMP; <24k of padding>; JUMPDEST; STOP
+	code := make([]byte, params.MaxCodeSize)
+	end := len(code) - 2
+	code[0], code[1], code[2], code[3] = byte(PUSH2), byte(end>>8), byte(end), byte(JUMP)
+	code[end], code[end+1] = byte(JUMPDEST), byte(STOP)
+
+	run := func(b *testing.B, vmenv *EVM) {
+		if _, _, err := vmenv.Call(AccountRef(common.Address{}), contract, nil, 100000, new(uint256.Int), false /* bailout */); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.Run("fresh-evm", func(b *testing.B) {
+		vmenv, s := newTestEVM(b, Config{})
+		s.SetCode(contract, code)
+		for i := 0; i < b.N; i++ {
+			// a new EVM starts with an empty cache, like before it was shared
+			fresh := NewEVM(vmenv.Context(), vmenv.TxContext(), s, vmenv.ChainConfig(), Config{})
+			run(b, fresh)
+		}
+	})
+	b.Run("shared-evm", func(b *testing.B) {
+		vmenv, s := newTestEVM(b, Config{})
+		s.SetCode(contract, code)
+		for i := 0; i < b.N; i++ {
+			run(b, vmenv)
+		}
+	})
+}
+
+func TestEVMReset(t *testing.T) {
+	contract := common.HexToAddress("0xaa")
+	vmenv, s := newTestEVM(t, Config{})
+	// SSTORE(0, 1) fails with write protection while read-only
+	s.SetCode(contract, []byte{byte(PUSH1), 1, byte(PUSH1), 0, byte(SSTORE), byte(STOP)})
+	s.AddAddressToAccessList(contract)
+
+	// Leave the EVM in the state of an interrupted nested static call
+	vmenv.depth = 5
+	in := vmenv.interpreter.(*EVMInterpreter)
+	in.readOnly = true
+	in.returnData = []byte{0x01}
+
+	txCtx := TxContext{Origin: common.HexToAddress("0x01")}
+	vmenv.Reset(txCtx, s)
+	if vmenv.depth != 0 || in.readOnly || in.returnData != nil {
+		t.Fatalf("interpreter state not reset: depth %d, readOnly %v, returnData %x", vmenv.depth, in.readOnly, in.returnData)
+	}
+	if vmenv.TxContext().Origin != txCtx.Origin {
+		t.Errorf("transaction context not replaced")
+	}
+	if vmenv.interpreter != in {
+		t.Errorf("interpreter not reused")
+	}
+	if _, _, err := vmenv.Call(AccountRef(common.Address{}), contract, nil, 100000, new(uint256.Int), false /* bailout */); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestApplyBlockOverrides(t *testing.T) {
+	contract := common.HexToAddress("0xaa")
+	jt := newBerlinInstructionSet()
+	enable3198(&jt)
+	vmenv, s := newTestEVM(t, Config{JumpTable: &jt})
+	// Return TIMESTAMP, NUMBER, COINBASE, DIFFICULTY and BASEFEE as 5 words
+	var code []byte
+	for i, op := range []OpCode{TIMESTAMP, NUMBER, COINBASE, DIFFICULTY, BASEFEE} {
+		code = append(code, byte(op), byte(PUSH1), byte(i*32), byte(MSTORE))
+	}
+	code = append(code, byte(PUSH1), 5*32, byte(PUSH1), 0, byte(RETURN))
+	s.SetCode(contract, code)
+
+	var (
+		number    = uint64(1234)
+		timestamp = uint64(5678)
+		coinbase  = common.HexToAddress("0xc0ffee")
+	)
+	original := vmenv.Context()
+	vmenv.ApplyBlockOverrides(BlockOverrides{
+		BlockNumber: &number,
+		Time:        &timestamp,
+		Coinbase:    &coinbase,
+		Difficulty:  big.NewInt(9),
+		BaseFee:     uint256.NewInt(10),
+	})
+	ret, _, err := vmenv.Call(AccountRef(common.Address{}), contract, nil, 100000, new(uint256.Int), false /* bailout */)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*uint256.Int{uint256.NewInt(timestamp), uint256.NewInt(number), new(uint256.Int).SetBytes(coinbase.Bytes()), uint256.NewInt(9), uint256.NewInt(10)}
+	for i, w := range want {
+		if got := new(uint256.Int).SetBytes(ret[i*32 : (i+1)*32]); !got.Eq(w) {
+			t.Errorf("word %d: got %v, want %v", i, got, w)
+		}
+	}
+	// Unset fields keep their values
+	vmenv.ApplyBlockOverrides(BlockOverrides{})
+	if ctx := vmenv.Context(); ctx.GasLimit != original.GasLimit || ctx.BlockNumber != number {
+		t.Errorf("unexpected context after empty overrides: %+v", ctx)
+	}
+}
+
+func TestFocusAddress(t *testing.T) {
+	var (
+		outer  = common.HexToAddress("0xaa")
+		middle = common.HexToAddress("0xbb")
+		inner  = common.HexToAddress("0xcc")
+	)
+	// CALL(gas, addr, 0, 0, 0, 0, 0)
+	call := func(addr byte) []byte {
+		return []byte{byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), addr, byte(GAS), byte(CALL), byte(POP)}
+	}
+	tracer := &testFrameTracer{StructLogger: NewStructLogger(nil)}
+	vmenv, s := newTestEVM(t, Config{Debug: true, Tracer: tracer, FocusAddress: &middle})
+	s.SetCode(outer, append(call(0xbb), byte(STOP)))
+	s.SetCode(middle, append(call(0xcc), byte(STOP)))
+	s.SetCode(inner, []byte{byte(PUSH1), 1, byte(PUSH1), 0, byte(SSTORE)})
+
+	if _, _, err := vmenv.Call(AccountRef(common.Address{}), outer, nil, 1000000, new(uint256.Int), false /* bailout */); err != nil {
+		t.Fatal(err)
+	}
+	// Only the steps of 0xbb are logged, including the CALL into 0xcc
+	logs := tracer.StructLogs()
+	if len(logs) != 10 {
+		t.Fatalf("unexpected number of steps %d", len(logs))
+	}
+	for i, log := range logs {
+		if log.Depth != 2 {
+			t.Errorf("step %d: unexpected depth %d", i, log.Depth)
+		}
+	}
+	if logs[len(logs)-1].Op != STOP {
+		t.Errorf("unexpected last step %v", logs[len(logs)-1].Op)
+	}
+	if len(tracer.events) != 4 || tracer.events[0].to != middle || tracer.events[1].to != inner {
+		t.Errorf("unexpected frame events %+v", tracer.events)
+	}
+	// The skipped frames are still executed
+	var (
+		key   common.Hash
+		value uint256.Int
+	)
+	if s.GetState(inner, &key, &value); value.Uint64() != 1 {
+		t.Errorf("unexpected storage of the inner contract %v", &value)
+	}
+}
+
+type dryRunTracer struct {
+	*StructLogger
+	onStop func(env *EVM)
+}
+
+func (dt *dryRunTracer) CaptureState(env *EVM, pc uint64, op OpCode, gas, cost uint64, scope *ScopeContext, rData []byte, depth int, err error) {
+	if op == STOP {
+		dt.onStop(env)
+	}
+}
+
+func TestEVMSnapshot(t *testing.T) {
+	contract := common.HexToAddress("0xaa")
+	var (
+		key        = common.HexToHash("0x01")
+		value      uint256.Int
+		preTx      int
+		dryRunSeen uint64
+		revertErr  error
+		staleErr   error
+	)
+	tracer := &dryRunTracer{StructLogger: NewStructLogger(nil)}
+	vmenv, s := newTestEVM(t, Config{Debug: true, Tracer: tracer})
+	s.SetCode(contract, []byte{byte(PUSH1), 1, byte(PUSH1), 1, byte(SSTORE), byte(STOP)})
+	s.AddAddressToAccessList(contract)
+	tracer.onStop = func(env *EVM) {
+		ibs := env.IntraBlockState()
+		id := env.Snapshot()
+		ibs.SetState(contract, &key, *uint256.NewInt(5))
+		ibs.AddRefund(1000)
+		ibs.GetState(contract, &key, &value)
+		dryRunSeen = value.Uint64()
+		revertErr = env.RevertToSnapshot(id)
+		staleErr = env.RevertToSnapshot(preTx)
+	}
+	preTx = vmenv.Snapshot()
+	if _, _, err := vmenv.Call(AccountRef(common.Address{}), contract, nil, 100000, new(uint256.Int), false /* bailout */); err != nil {
+		t.Fatal(err)
+	}
+	if dryRunSeen != 5 || revertErr != nil {
+		t.Fatalf("dry run failed: saw %d, %v", dryRunSeen, revertErr)
+	}
+	if !errors.Is(staleErr, ErrSnapshotBeforeTx) {
+		t.Errorf("expected the pre-transaction snapshot to be refused, got %v", staleErr)
+	}
+	// The transaction's own writes survive, the dry run's are gone
+	if s.GetState(contract, &key, &value); value.Uint64() != 1 {
+		t.Errorf("unexpected storage %v", &value)
+	}
+	if refund := s.GetRefund(); refund != 0 {
+		t.Errorf("unexpected refund %d", refund)
+	}
+}
+
+func TestStepLimit(t *testing.T) {
+	var (
+		outer = common.HexToAddress("0xaa")
+		inner = common.HexToAddress("0xbb")
+		loop  = []byte{byte(JUMPDEST), byte(PUSH1), 0, byte(JUMP)}
+	)
+	vmenv, s := newTestEVM(t, Config{StepLimit: 100})
+	// CALL(gas, 0xbb, 0, 0, 0, 0, 0) once, then loop forever
+	s.SetCode(outer, []byte{
+		byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0,
+		byte(PUSH1), 0xbb, byte(GAS), byte(CALL), byte(POP),
+		byte(JUMPDEST), byte(PUSH1), 15, byte(JUMP),
+	})
+	s.SetCode(inner, loop)
+	s.AddAddressToAccessList(outer)
+	s.AddAddressToAccessList(inner)
+
+	for i, addr := range []common.Address{inner, outer} {
+		_, _, err := vmenv.Call(AccountRef(common.Address{}), addr, nil, 10000000, new(uint256.Int), false /* bailout */)
+		if !errors.Is(err, ErrStepLimitReached) || errors.Is(err, ErrOutOfGas) {
+			t.Fatalf("call %d: expected step limit error, got %v", i, err)
+		}
+		if vmenv.steps != 100 {
+			t.Errorf("call %d: %d steps executed, want 100", i, vmenv.steps)
+		}
+	}
+}
+
+func TestMaxMemorySize(t *testing.T) {
+	tests := []struct {
+		code []byte
+		fail bool
+	}{
+		// MSTORE(992, 0) fills the limit exactly
+		{[]byte{byte(PUSH1), 0, byte(PUSH2), 0x03, 0xe0, byte(MSTORE)}, false},
+		// MLOAD(1024)
+		{[]byte{byte(PUSH2), 0x04, 0x00, byte(MLOAD)}, true},
+		// MSTORE8(1024, 0)
+		{[]byte{byte(PUSH1), 0, byte(PUSH2), 0x04, 0x00, byte(MSTORE8)}, true},
+		// CODECOPY(0, 0, 2048)
+		{[]byte{byte(PUSH2), 0x08, 0x00, byte(PUSH1), 0, byte(PUSH1), 0, byte(CODECOPY)}, true},
+		// CALLDATACOPY(1000, 0, 32)
+		{[]byte{byte(PUSH1), 32, byte(PUSH1), 0, byte(PUSH2), 0x03, 0xe8, byte(CALLDATACOPY)}, true},
+		// RETURN(0, 4096)
+		{[]byte{byte(PUSH2), 0x10, 0x00, byte(PUSH1), 0, byte(RETURN)}, true},
+	}
+	addr := common.HexToAddress("0xaa")
+	for i, tt := range tests {
+		vmenv, s := newTestEVM(t, Config{MaxMemorySize: 1024})
+		s.SetCode(addr, tt.code)
+		_, _, err := vmenv.Call(AccountRef(common.Address{}), addr, nil, 10000000, new(uint256.Int), false /* bailout */)
+		if tt.fail != errors.Is(err, ErrMemoryLimit) {
+			t.Errorf("test %d: unexpected error %v", i, err)
+		}
+	}
+}
+
+func TestCallWithContext(t *testing.T) {
+	looper := common.HexToAddress("0xaa")
+	vmenv, s := newTestEVM(t, Config{})
+	s.SetCode(looper, []byte{byte(JUMPDEST), byte(PUSH1), 0, byte(JUMP)})
+
+	// The loop only ends with the deadline, long before running out of gas
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, _, err := vmenv.CallWithContext(ctx, AccountRef(common.Address{}), looper, nil, math.MaxUint64/2, new(uint256.Int), false /* bailout */)
+	if !errors.Is(err, ErrExecutionCancelled) {
+		t.Fatalf("expected cancellation, got %v", err)
+	}
+
+	// A done context stops the execution before the first opcode
+	if _, _, err = vmenv.CallWithContext(ctx, AccountRef(common.Address{}), looper, nil, 100000, new(uint256.Int), false /* bailout */); !errors.Is(err, ErrExecutionCancelled) {
+		t.Fatalf("expected cancellation, got %v", err)
+	}
+	if vmenv.steps != 0 {
+		t.Errorf("%d opcodes run with a done context", vmenv.steps)
+	}
+
+	// The context doesn't outlive the call
+	if _, _, err = vmenv.Call(AccountRef(common.Address{}), looper, nil, 100000, new(uint256.Int), false /* bailout */); !errors.Is(err, ErrOutOfGas) {
+		t.Errorf("expected out of gas without context, got %v", err)
+	}
+}
+
+func TestForceReadOnly(t *testing.T) {
+	var (
+		writer = common.HexToAddress("0xaa")
+		reader = common.HexToAddress("0xbb")
+		slot   = common.Hash{}
+	)
+	vmenv, s := newTestEVM(t, Config{ForceReadOnly: true})
+	// SSTORE(0, 1)
+	s.SetCode(writer, []byte{byte(PUSH1), 1, byte(PUSH1), 0, byte(SSTORE), byte(STOP)})
+	// RETURN(SLOAD(0))
+	s.SetCode(reader, []byte{byte(PUSH1), 0, byte(SLOAD), byte(PUSH1), 0, byte(MSTORE), byte(PUSH1), 32, byte(PUSH1), 0, byte(RETURN)})
+	s.SetState(reader, &slot, *uint256.NewInt(7))
+	s.AddAddressToAccessList(writer)
+	s.AddAddressToAccessList(reader)
+
+	caller := AccountRef(common.HexToAddress("0x01"))
+	if _, _, err := vmenv.Call(caller, writer, nil, 100000, new(uint256.Int), false /* bailout */); !errors.Is(err, ErrWriteProtection) {
+		t.Errorf("SSTORE: expected write protection, got %v", err)
+	}
+	var value uint256.Int
+	s.GetState(writer, &slot, &value)
+	if !value.IsZero() {
+		t.Errorf("slot written despite ForceReadOnly")
+	}
+	if _, _, err := vmenv.Call(caller, reader, nil, 100000, uint256.NewInt(1), false /* bailout */); !errors.Is(err, ErrWriteProtection) {
+		t.Errorf("value transfer: expected write protection, got %v", err)
+	}
+	if _, _, _, err := vmenv.Create(caller, []byte{byte(STOP)}, 100000, new(uint256.Int)); !errors.Is(err, ErrWriteProtection) {
+		t.Errorf("creation: expected write protection, got %v", err)
+	}
+	// Reads are unaffected
+	ret, _, err := vmenv.Call(caller, reader, nil, 100000, new(uint256.Int), false /* bailout */)
+	if err != nil || new(uint256.Int).SetBytes(ret).Uint64() != 7 {
+		t.Errorf("read: got %x, %v", ret, err)
+	}
+}
+
+func TestTransferWithGas(t *testing.T) {
+	var (
+		outer  = common.HexToAddress("0xaa")
+		callee = common.HexToAddress("0xbb")
+	)
+	type transfer struct {
+		to    common.Address
+		gas   uint64
+		depth int
+	}
+	var checks, transfers []transfer
+	vmenv, s := newTestEVM(t, Config{})
+	vmenv.context.CanTransferWithGas = func(_ IntraBlockState, _ common.Address, _ *uint256.Int, gas uint64, depth int) bool {
+		checks = append(checks, transfer{gas: gas, depth: depth})
+		return true
+	}
+	vmenv.context.TransferWithGas = func(_ IntraBlockState, _, to common.Address, _ *uint256.Int, _ bool, gas uint64, depth int) {
+		transfers = append(transfers, transfer{to, gas, depth})
+	}
+	// CALL(0x1234, 0xbb, 1, 0, 0, 0, 0)
+	s.SetCode(outer, []byte{
+		byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 1,
+		byte(PUSH1), 0xbb, byte(PUSH2), 0x12, 0x34, byte(CALL), byte(STOP),
+	})
+	s.AddAddressToAccessList(outer)
+	s.AddAddressToAccessList(callee)
+
+	if _, _, err := vmenv.Call(AccountRef(common.Address{}), outer, nil, 100000, uint256.NewInt(2), false /* bailout */); err != nil {
+		t.Fatal(err)
+	}
+	// The nested call gets the requested gas plus the value transfer stipend
+	want := []transfer{{outer, 100000, 0}, {callee, 0x1234 + params.CallStipend, 1}}
+	if len(transfers) != len(want) || len(checks) != len(want) {
+		t.Fatalf("unexpected transfers %+v, checks %+v", transfers, checks)
+	}
+	for i, w := range want {
+		if transfers[i] != w {
+			t.Errorf("transfer %d: got %+v, want %+v", i, transfers[i], w)
+		}
+		if checks[i].gas != w.gas || checks[i].depth != w.depth {
+			t.Errorf("check %d: got %+v, want %+v", i, checks[i], w)
+		}
+	}
+}
+
+func TestEVMRefund(t *testing.T) {
+	vmenv, s := newTestEVM(t, Config{})
+	s.AddRefund(30000)
+	london := *params.AllCliqueProtocolChanges.Rules(0)
+	for i, tt := range []struct {
+		london  bool
+		gasUsed uint64
+		capped  uint64
+	}{
+		{false, 100000, 30000}, // below the cap
+		{false, 50000, 25000},  // gasUsed / 2
+		{true, 200000, 30000},
+		{true, 100000, 20000}, // gasUsed / 5
+	} {
+		if tt.london {
+			vmenv.chainRules = &london
+		}
+		raw, capped := vmenv.Refund(tt.gasUsed)
+		if raw != 30000 || capped != tt.capped {
+			t.Errorf("test %d: have raw %d, capped %d, want 30000, %d", i, raw, capped, tt.capped)
+		}
+	}
+}
+
+func TestEstimateCallGas(t *testing.T) {
+	var (
+		contract = common.HexToAddress("0xaa")
+		reverter = common.HexToAddress("0xbb")
+	)
+	vmenv, s := newTestEVM(t, Config{})
+	// Revert unless GAS leaves at least 5000, return 42 otherwise
+	s.SetCode(contract, []byte{
+		byte(GAS), byte(PUSH2), 0x13, 0x88, byte(GT), byte(PUSH1), 18, byte(JUMPI),
+		byte(PUSH1), 42, byte(PUSH1), 0, byte(MSTORE), byte(PUSH1), 32, byte(PUSH1), 0, byte(RETURN),
+		byte(JUMPDEST), byte(PUSH1), 0, byte(PUSH1), 0, byte(REVERT),
+	})
+	// Always REVERT with the byte 0xde
+	s.SetCode(reverter, []byte{byte(PUSH1), 0xde, byte(PUSH1), 0, byte(MSTORE8), byte(PUSH1), 1, byte(PUSH1), 0, byte(REVERT)})
+
+	// GAS itself costs 2
+	gas, out, err := vmenv.EstimateCallGas(AccountRef(common.Address{}), contract, nil, new(uint256.Int), 100000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gas != 5002 || new(uint256.Int).SetBytes(out).Uint64() != 42 {
+		t.Errorf("unexpected estimate %d, output %x", gas, out)
+	}
+	if _, out, err = vmenv.EstimateCallGas(AccountRef(common.Address{}), reverter, nil, new(uint256.Int), 100000); !errors.Is(err, ErrExecutionReverted) || !bytes.Equal(out, []byte{0xde}) {
+		t.Errorf("expected the revert data, got %x, %v", out, err)
+	}
+	// Not even the first opcodes fit in the cap
+	if _, _, err = vmenv.EstimateCallGas(AccountRef(common.Address{}), contract, nil, new(uint256.Int), 10); !errors.Is(err, ErrOutOfGas) {
+		t.Errorf("expected out of gas at the cap, got %v", err)
+	}
+}
+
+func TestBreakpoints(t *testing.T) {
+	var (
+		outer = common.HexToAddress("0xaa")
+		inner = common.HexToAddress("0xbb")
+	)
+	tracer := NewStructLogger(nil)
+	vmenv, s := newTestEVM(t, Config{
+		Debug:       true,
+		Tracer:      tracer,
+		Breakpoints: map[common.Address]map[uint64]bool{inner: {7: true}},
+	})
+	// SSTORE(0, 1) then CALL(gas, 0xbb, 0, 0, 0, 0, 0) and SSTORE(1, 1)
+	s.SetCode(outer, []byte{
+		byte(PUSH1), 1, byte(PUSH1), 0, byte(SSTORE),
+		byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0xbb, byte(GAS), byte(CALL),
+		byte(PUSH1), 1, byte(PUSH1), 1, byte(SSTORE),
+	})
+	// MSTORE(0, 7), then PUSH1 9 and the breakpoint at the following PUSH1
+	s.SetCode(inner, []byte{byte(PUSH1), 7, byte(PUSH1), 0, byte(MSTORE), byte(PUSH1), 9, byte(PUSH1), 1, byte(SSTORE)})
+	s.AddAddressToAccessList(outer)
+	if _, _, err := vmenv.Call(AccountRef(common.Address{}), outer, nil, 1000000, new(uint256.Int), false /* bailout */); !errors.Is(err, ErrBreakpoint) {
+		t.Fatalf("expected the breakpoint to halt the call, got %v", err)
+	}
+	var hit *StructLog
+	for i := range tracer.StructLogs() {
+		if log := &tracer.StructLogs()[i]; log.Depth == 2 && errors.Is(log.Err, ErrBreakpoint) {
+			hit = log
+		}
+	}
+	if hit == nil || hit.Pc != 7 || len(hit.Stack) != 1 || hit.Stack[0].Uint64() != 9 || len(hit.Memory) != 32 || hit.Memory[31] != 7 {
+		t.Fatalf("unexpected breakpoint step %+v", hit)
+	}
+	// The outer frame didn't run any further and was reverted
+	if log := tracer.StructLogs()[len(tracer.StructLogs())-1]; log.Depth != 1 || log.Pc != 19 || !errors.Is(log.Err, ErrBreakpoint) {
+		t.Errorf("unexpected last step %+v", log)
+	}
+	var value uint256.Int
+	s.GetState(outer, &common.Hash{}, &value)
+	if !value.IsZero() {
+		t.Errorf("state changes were not reverted: %v", &value)
+	}
+}
+
+func TestCreateWithTrace(t *testing.T) {
+	london := *params.AllCliqueProtocolChanges.Rules(0)
+	// MSTORE8(0, b), RETURN(0, 1)
+	deploy := func(b byte) []byte {
+		return []byte{byte(PUSH1), b, byte(PUSH1), 0, byte(MSTORE8), byte(PUSH1), 1, byte(PUSH1), 0, byte(RETURN)}
+	}
+	// RETURN(0, MaxCodeSize+1)
+	tooLarge := []byte{byte(PUSH2), byte((params.MaxCodeSize + 1) >> 8), byte((params.MaxCodeSize + 1) & 0xff), byte(PUSH1), 0, byte(RETURN)}
+	for i, tt := range []struct {
+		code   []byte
+		london bool
+		want   []byte
+		err    error
+	}{
+		{deploy(0xfe), false, []byte{0xfe}, nil},
+		{deploy(0xef), false, []byte{0xef}, nil},
+		{deploy(0xef), true, nil, ErrInvalidCode},
+		{tooLarge, false, nil, ErrMaxCodeSizeExceeded},
+	} {
+		vmenv, _ := newTestEVM(t, Config{})
+		if tt.london {
+			vmenv.chainRules = &london
+		}
+		caller := common.HexToAddress("0xaa")
+		tracer := NewStructLogger(nil)
+		addr, code, _, err := vmenv.CreateWithTrace(AccountRef(caller), tt.code, 10000000, new(uint256.Int), tracer)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("test %d: have error %v, want %v", i, err, tt.err)
+		}
+		if !bytes.Equal(code, tt.want) {
+			t.Errorf("test %d: have code %x, want %x", i, code, tt.want)
+		}
+		if want := crypto.CreateAddress(caller, 0); addr != want {
+			t.Errorf("test %d: have address %x, want %x", i, addr, want)
+		}
+		if len(tracer.StructLogs()) == 0 {
+			t.Errorf("test %d: init code not traced", i)
+		}
+		if vmenv.Config().Debug || vmenv.Config().Tracer != nil {
+			t.Errorf("test %d: tracer not restored", i)
+		}
+	}
+}
+
+func TestPrepareAccessList(t *testing.T) {
+	var (
+		sender   = common.HexToAddress("0x01ff")
+		contract = common.HexToAddress("0xaa")
+		other    = common.HexToAddress("0xbb")
+		warm     = common.BigToHash(big.NewInt(1))
+	)
+	logger := NewStructLogger(&LogConfig{DisableStorage: true})
+	vmenv, s := newTestEVM(t, Config{Debug: true, Tracer: logger})
+	// SLOAD(1), SLOAD(2)
+	s.SetCode(contract, []byte{byte(PUSH1), 1, byte(SLOAD), byte(PUSH1), 2, byte(SLOAD), byte(STOP)})
+	vmenv.PrepareAccessList(sender, &contract, nil /* precompiles */, types.AccessList{
+		{Address: contract, StorageKeys: []common.Hash{warm}},
+		{Address: other},
+	})
+	for _, addr := range []common.Address{sender, contract, other, common.BytesToAddress([]byte{1})} {
+		if !s.AddressInAccessList(addr) {
+			t.Errorf("address %x not in the access list", addr)
+		}
+	}
+	if _, _, err := vmenv.Call(AccountRef(sender), contract, nil, 100000, new(uint256.Int), false /* bailout */); err != nil {
+		t.Fatal(err)
+	}
+	var costs []uint64
+	for _, log := range logger.StructLogs() {
+		if log.Op == SLOAD {
+			costs = append(costs, log.GasCost)
+		}
+	}
+	if want := []uint64{params.WarmStorageReadCostEIP2929, params.ColdSloadCostEIP2929}; len(costs) != 2 || costs[0] != want[0] || costs[1] != want[1] {
+		t.Errorf("have SLOAD costs %v, want %v", costs, want)
+	}
+}
+
+type rulesSwapTracer struct {
+	*StructLogger
+	env   *EVM
+	rules *params.Rules
+}
+
+func (rt *rulesSwapTracer) CaptureEnter(typ OpCode, from common.Address, to common.Address, input []byte, gas uint64, value *uint256.Int) {
+	if err := rt.env.SwapChainRules(rt.rules); err != nil {
+		panic(err)
+	}
+}
+
+func TestSwapChainRules(t *testing.T) {
+	var (
+		outer = common.HexToAddress("0xaa")
+		inner = common.HexToAddress("0xbb")
+	)
+	if err := NewEVM(BlockContext{}, TxContext{}, nil, params.TestChainConfig, Config{}).SwapChainRules(nil); !errors.Is(err, ErrRulesSwapNotDebug) {
+		t.Errorf("unexpected error %v outside of debug mode", err)
+	}
+	tracer := &rulesSwapTracer{StructLogger: NewStructLogger(&LogConfig{DisableStorage: true})}
+	vmenv, s := newTestEVM(t, Config{Debug: true, Tracer: tracer})
+	berlin := vmenv.ChainRules()
+	istanbul := *berlin
+	istanbul.IsBerlin = false
+	tracer.env, tracer.rules = vmenv, &istanbul
+	// SLOAD(1), CALL(gas, 0xbb, 0, 0, 0, 0, 0), SLOAD(3)
+	s.SetCode(outer, []byte{byte(PUSH1), 1, byte(SLOAD), byte(POP),
+		byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0xbb, byte(GAS), byte(CALL), byte(POP),
+		byte(PUSH1), 3, byte(SLOAD), byte(STOP)})
+	// SLOAD(2)
+	s.SetCode(inner, []byte{byte(PUSH1), 2, byte(SLOAD), byte(STOP)})
+	if _, _, err := vmenv.Call(AccountRef(common.Address{}), outer, nil, 100000, new(uint256.Int), false /* bailout */); err != nil {
+		t.Fatal(err)
+	}
+	var costs []uint64
+	for _, log := range tracer.StructLogs() {
+		if log.Op == SLOAD {
+			costs = append(costs, log.GasCost)
+		}
+	}
+	// The callee is priced by Istanbul, the caller keeps the Berlin pricing
+	want := []uint64{params.ColdSloadCostEIP2929, params.SloadGasEIP2200, params.ColdSloadCostEIP2929}
+	if !reflect.DeepEqual(costs, want) {
+		t.Errorf("have SLOAD costs %v, want %v", costs, want)
+	}
+	if vmenv.ChainRules() != berlin {
+		t.Errorf("chain rules not restored")
+	}
+	// Restoring the chain rules outside of a swapped frame leaves the next
+	// frames as they are
+	if err := vmenv.SwapChainRules(nil); err != nil {
+		t.Fatal(err)
+	}
+	if vmenv.frameRules != nil {
+		t.Errorf("frame rules left set")
+	}
+}
+
+func TestCreateAddress(t *testing.T) {
+	sender := common.HexToAddress("0x6ac7ea33f8831ea9dcc53393aaa88b25a785dbf0")
+	for nonce, want := range []string{
+		"0xcd234a471b72ba2f1ccf0a70fcaba648a5eecd8d",
+		"0x343c43a37d37dff08ae8c4a11544c718abb4fcf8",
+		"0xf778b86fa74e846c4f0a1fbd1335fe81c00a0c91",
+	} {
+		if have := CreateAddress(sender, uint64(nonce)); have != common.HexToAddress(want) {
+			t.Errorf("nonce %d: have %x, want %s", nonce, have, want)
+		}
+	}
+
+	// The examples of EIP-1014
+	for i, tt := range []struct {
+		creator, salt, initCode, want string
+	}{
+		{"0x0000000000000000000000000000000000000000", "0x00", "0x00", "0x4D1A2e2bB4F88F0250f26Ffff098B0b30B26BF38"},
+		{"0xdeadbeef00000000000000000000000000000000", "0x00", "0x00", "0xB928f69Bb1D91Cd65274e3c79d8986362984fDA3"},
+		{"0xdeadbeef00000000000000000000000000000000", "0x000000000000000000000000feed000000000000000000000000000000000000", "0x00", "0xD04116cDd17beBE565EB2422F2497E06cC1C9833"},
+		{"0x0000000000000000000000000000000000000000", "0x00", "0xdeadbeef", "0x70f2b2914A2a4b783FaEFb75f459A580616Fcb5e"},
+		{"0x00000000000000000000000000000000deadbeef", "0xcafebabe", "0xdeadbeef", "0x60f3f640a8508fC6a86d45DF051962668E1e8AC7"},
+		{"0x00000000000000000000000000000000deadbeef", "0xcafebabe", "0xdeadbeefdeadbeefdeadbeefdeadbeefdeadbeefdeadbeefdeadbeefdeadbeefdeadbeefdeadbeefdeadbeef", "0x1d8bfDC5D46DC4f61D6b6115972536eBE6A8854C"},
+		{"0x0000000000000000000000000000000000000000", "0x00", "0x", "0xE33C0C7F7df4809055C3ebA6c09CFe4BaF1BD9e0"},
+	} {
+		initCodeHash := crypto.Keccak256Hash(common.FromHex(tt.initCode))
+		if have := CreateAddress2(common.HexToAddress(tt.creator), common.HexToHash(tt.salt), initCodeHash); have != common.HexToAddress(tt.want) {
+			t.Errorf("example %d: have %x, want %s", i, have, tt.want)
+		}
+	}
+
+	// The EVM deploys to the predicted addresses
+	vmenv, _ := newTestEVM(t, Config{})
+	initCode := []byte{byte(STOP)}
+	if _, addr, _, err := vmenv.Create(AccountRef(sender), initCode, 100000, new(uint256.Int)); err != nil || addr != CreateAddress(sender, 0) {
+		t.Errorf("CREATE deployed to %x, %v", addr, err)
+	}
+	salt := uint256.NewInt(0xcafebabe)
+	if _, addr, _, err := vmenv.Create2(AccountRef(sender), initCode, 100000, new(uint256.Int), salt); err != nil || addr != CreateAddress2(sender, salt.Bytes32(), crypto.Keccak256Hash(initCode)) {
+		t.Errorf("CREATE2 deployed to %x, %v", addr, err)
+	}
+}
+
+func TestFeeSplit(t *testing.T) {
+	const gasUsed = 21000
+	vmenv, _ := newTestEVM(t, Config{})
+	vmenv.context.BaseFee = uint256.NewInt(7)
+	price := uint256.NewInt(10)
+	// Berlin: all of the legacy gas price is tipped
+	if burnt, tipped := vmenv.FeeSplit(gasUsed, price, price); !burnt.IsZero() || tipped.Uint64() != 10*gasUsed {
+		t.Errorf("berlin: have burnt %v and tipped %v", burnt, tipped)
+	}
+	london := *params.AllCliqueProtocolChanges.Rules(0)
+	vmenv.chainRules = &london
+	for i, tt := range []struct {
+		feeCap, tip   uint64
+		burnt, tipped uint64
+	}{
+		{10, 10, 7, 3}, // legacy
+		{20, 2, 7, 2},
+		{8, 5, 7, 1}, // tip capped by the fee cap
+		{5, 5, 5, 0}, // below the base fee, with NoBaseFee
+	} {
+		burnt, tipped := vmenv.FeeSplit(gasUsed, uint256.NewInt(tt.feeCap), uint256.NewInt(tt.tip))
+		if burnt.Uint64() != tt.burnt*gasUsed || tipped.Uint64() != tt.tipped*gasUsed {
+			t.Errorf("test %d: have burnt %v and tipped %v, want %d and %d", i, burnt, tipped, tt.burnt*gasUsed, tt.tipped*gasUsed)
+		}
+	}
+}
+
+func TestMaxCodeSize(t *testing.T) {
+	// RETURN(0, size)
+	deploy := func(size int) []byte {
+		return []byte{byte(PUSH2), byte(size >> 8), byte(size & 0xff), byte(PUSH1), 0, byte(RETURN)}
+	}
+	caller := common.HexToAddress("0xaa")
+	for _, tt := range []struct {
+		size int
+		err  error
+	}{
+		{params.MaxCodeSize, nil},
+		{params.MaxCodeSize + 1, ErrMaxCodeSizeExceeded},
+	} {
+		tracer := NewStructLogger(nil)
+		vmenv, s := newTestEVM(t, Config{Debug: true, Tracer: tracer})
+		_, addr, gas, err := vmenv.Create(AccountRef(caller), deploy(tt.size), 10000000, new(uint256.Int))
+		if !errors.Is(err, tt.err) || !errors.Is(tracer.Error(), tt.err) {
+			t.Errorf("size %d: have error %v, traced %v, want %v", tt.size, err, tracer.Error(), tt.err)
+		}
+		stored := s.GetCodeSize(addr)
+		if tt.err == nil && stored != tt.size {
+			t.Errorf("size %d: stored %d bytes of code", tt.size, stored)
+		}
+		if tt.err != nil && (stored != 0 || gas != 0) {
+			t.Errorf("size %d: stored %d bytes of code, %d gas left", tt.size, stored, gas)
+		}
+	}
+
+	// The failure of a nested CREATE is reported to its frame: the init code
+	// stored at the end of the first memory word runs CREATE(0, 26, 6)
+	tracer := NewCallTracer()
+	vmenv, s := newTestEVM(t, Config{Debug: true, Tracer: tracer})
+	initCode := deploy(params.MaxCodeSize + 1)
+	factory := append([]byte{byte(PUSH6)}, initCode...)
+	factory = append(factory, byte(PUSH1), 0, byte(MSTORE), byte(PUSH1), 6, byte(PUSH1), 26, byte(PUSH1), 0, byte(CREATE), byte(STOP))
+	s.SetCode(caller, factory)
+	if _, _, err := vmenv.Call(AccountRef(common.Address{}), caller, nil, 10000000, new(uint256.Int), false /* bailout */); err != nil {
+		t.Fatal(err)
+	}
+	if calls := tracer.Result().Calls; len(calls) != 1 || calls[0].Type != "CREATE" || calls[0].Error != ErrMaxCodeSizeExceeded.Error() {
+		t.Errorf("unexpected nested creation %+v", calls)
+	}
+}
+
+func TestInterceptCall(t *testing.T) {
+	var (
+		outer = common.HexToAddress("0xaa")
+		inner = common.HexToAddress("0xbb")
+		// CALL(gas, 0xbb, 0, 0, 4, 0, 0), MSTORE(0, success),
+		// RETURNDATACOPY(32, 0, RETURNDATASIZE), RETURN(0, 32+RETURNDATASIZE)
+		outerCode = []byte{byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 4, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0xbb, byte(GAS), byte(CALL),
+			byte(PUSH1), 0, byte(MSTORE),
+			byte(RETURNDATASIZE), byte(PUSH1), 0, byte(PUSH1), 32, byte(RETURNDATACOPY),
+			byte(RETURNDATASIZE), byte(PUSH1), 32, byte(ADD), byte(PUSH1), 0, byte(RETURN)}
+		// MSTORE8(0, 0x2a), RETURN(0, 1)
+		innerCode = []byte{byte(PUSH1), 0x2a, byte(PUSH1), 0, byte(MSTORE8), byte(PUSH1), 1, byte(PUSH1), 0, byte(RETURN)}
+	)
+	result := func(success bool, data ...byte) []byte {
+		ret := make([]byte, 32, 32+len(data))
+		if success {
+			ret[31] = 1
+		}
+		return append(ret, data...)
+	}
+	for _, tt := range []struct {
+		name    string
+		debug   bool
+		handled bool
+		output  []byte
+		gasUsed uint64
+		err     error
+		want    []byte
+	}{
+		{name: "handled", debug: true, handled: true, output: []byte("mock"), gasUsed: 100, want: result(true, []byte("mock")...)},
+		{name: "reverted", debug: true, handled: true, output: []byte("nope"), err: ErrExecutionReverted, want: result(false, []byte("nope")...)},
+		{name: "failed", debug: true, handled: true, output: []byte("nope"), err: ErrInvalidJump, want: result(false)},
+		{name: "out of gas", debug: true, handled: true, gasUsed: math.MaxUint64, want: result(false)},
+		{name: "not handled", debug: true, want: result(true, 0x2a)},
+		{name: "no debug", handled: true, output: []byte("mock"), want: result(true, 0x2a)},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls []common.Address
+			vmenv, s := newTestEVM(t, Config{Debug: tt.debug, Tracer: NewStructLogger(nil),
+				InterceptCall: func(addr common.Address, input []byte) (bool, []byte, uint64, error) {
+					if !bytes.Equal(input, make([]byte, 4)) {
+						t.Errorf("unexpected input %x", input)
+					}
+					calls = append(calls, addr)
+					return tt.handled, tt.output, tt.gasUsed, tt.err
+				}})
+			s.SetCode(outer, outerCode)
+			s.SetCode(inner, innerCode)
+			ret, _, err := vmenv.Call(AccountRef(common.Address{}), outer, nil, 100000, new(uint256.Int), false /* bailout */)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(ret, tt.want) {
+				t.Errorf("have output %x, want %x", ret, tt.want)
+			}
+			// The top-level call is never intercepted
+			if want := []common.Address{inner}; tt.debug && !reflect.DeepEqual(calls, want) {
+				t.Errorf("have intercepted %v, want %v", calls, want)
+			}
+		})
+	}
+	// Calls to accounts without code are intercepted as well
+	vmenv, s := newTestEVM(t, Config{Debug: true, Tracer: NewStructLogger(nil),
+		InterceptCall: func(addr common.Address, input []byte) (bool, []byte, uint64, error) {
+			return true, []byte("mock"), 0, nil
+		}})
+	s.SetCode(outer, outerCode)
+	ret, _, err := vmenv.Call(AccountRef(common.Address{}), outer, nil, 100000, new(uint256.Int), false /* bailout */)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := result(true, []byte("mock")...); !bytes.Equal(ret, want) {
+		t.Errorf("have output %x, want %x", ret, want)
+	}
+}
@@ -0,0 +1,94 @@
+package vm
+
+import (
+	"encoding/json"
+	"math/big"
+	"strconv"
+	"time"
+
+	"github.com/holiman/uint256"
+
+	"github.com/ledgerwatch/erigon/common"
+	"github.com/ledgerwatch/erigon/common/hexutil"
+)
+
+var _ Tracer = (*FourByteTracer)(nil)
+
+// FourByteTracer is a native tracer counting the function selectors called by
+// a transaction, keyed by "selector-size" where size is the length of the call
+// data after the selector. The transaction input and every message call are
+// counted; creations, calls to precompiles and inputs shorter than a selector
+// are skipped.
+type FourByteTracer struct {
+	env *EVM
+	ids map[string]int
+}
+
+// NewFourByteTracer returns a new 4-byte selector tracer.
+func NewFourByteTracer() *FourByteTracer {
+	return &FourByteTracer{ids: make(map[string]int)}
+}
+
+// store counts the selector of the input, if it has one.
+func (t *FourByteTracer) store(input []byte) {
+	if len(input) < 4 {
+		return
+	}
+	key := hexutil.Encode(input[:4]) + "-" + strconv.Itoa(len(input)-4)
+	t.ids[key]++
+}
+
+func (t *FourByteTracer) CaptureStart(env *EVM, depth int, from common.Address, to common.Address, precompile bool, create bool, callType CallType, input []byte, gas uint64, value *big.Int, code []byte) {
+	if depth != 0 {
+		return
+	}
+	t.env = env
+	if !create && !precompile {
+		t.store(input)
+	}
+}
+
+func (t *FourByteTracer) CaptureEnter(typ OpCode, from common.Address, to common.Address, input []byte, gas uint64, value *uint256.Int) {
+	switch typ {
+	case CALL, CALLCODE, DELEGATECALL, STATICCALL:
+	default:
+		return
+	}
+	if _, isPrecompile := t.env.precompile(to); isPrecompile {
+		return
+	}
+	t.store(input)
+}
+
+func (t *FourByteTracer) CaptureState(env *EVM, pc uint64, op OpCode, gas, cost uint64, scope *ScopeContext, rData []byte, depth int, err error) {
+}
+
+func (t *FourByteTracer) CaptureFault(env *EVM, pc uint64, op OpCode, gas, cost uint64, scope *ScopeContext, depth int, err error) {
+}
+
+func (t *FourByteTracer) CaptureEnd(depth int, output []byte, startGas, endGas uint64, d time.Duration, err error) {
+}
+
+func (t *FourByteTracer) CaptureExit(output []byte, gasUsed uint64, err error) {
+}
+
+func (t *FourByteTracer) CaptureSelfDestruct(from common.Address, to common.Address, value *big.Int) {
+}
+
+func (t *FourByteTracer) CaptureAccountRead(account common.Address) error {
+	return nil
+}
+
+func (t *FourByteTracer) CaptureAccountWrite(account common.Address) error {
+	return nil
+}
+
+// Result returns the number of calls per "selector-size" key.
+func (t *FourByteTracer) Result() map[string]int {
+	return t.ids
+}
+
+// GetResult returns the counts encoded in the 4byteTracer JSON format.
+func (t *FourByteTracer) GetResult() (json.RawMessage, error) {
+	return json.Marshal(t.ids)
+}
@@ -0,0 +1,56 @@
+package vm
+
+import (
+	"testing"
+
+	"github.com/holiman/uint256"
+
+	"github.com/ledgerwatch/erigon/common"
+)
+
+func TestFourByteTracer(t *testing.T) {
+	var (
+		outer  = common.HexToAddress("0xaa")
+		callee = common.HexToAddress("0xbb")
+	)
+	tracer := NewFourByteTracer()
+	vmenv, s := newTestEVM(t, Config{Debug: true, Tracer: tracer})
+	// callWith performs a zero-value op (CALL or STATICCALL) to addr with the
+	// first size bytes of memory as input, memory holding 0x11223344 at 0
+	callWith := func(op OpCode, addr, size byte) []byte {
+		code := []byte{byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), size, byte(PUSH1), 0}
+		if op == CALL {
+			code = append(code, byte(PUSH1), 0)
+		}
+		return append(code, byte(PUSH1), addr, byte(GAS), byte(op), byte(POP))
+	}
+	code := []byte{byte(PUSH4), 0x11, 0x22, 0x33, 0x44, byte(PUSH1), 0xe0, byte(SHL), byte(PUSH1), 0, byte(MSTORE)}
+	code = append(code, callWith(CALL, 0xbb, 4)...)
+	code = append(code, callWith(STATICCALL, 0xbb, 4)...)
+	code = append(code, callWith(CALL, 0xbb, 36)...)
+	// Too short for a selector
+	code = append(code, callWith(CALL, 0xbb, 3)...)
+	// Precompiles are not counted
+	code = append(code, callWith(STATICCALL, 0x02, 4)...)
+	s.SetCode(outer, append(code, byte(STOP)))
+	s.SetCode(callee, []byte{byte(STOP)})
+
+	input := []byte{0xde, 0xad, 0xbe, 0xef, 0x01}
+	if _, _, err := vmenv.Call(AccountRef(common.Address{}), outer, input, 1000000, new(uint256.Int), false /* bailout */); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int{
+		"0xdeadbeef-1":  1,
+		"0x11223344-0":  2,
+		"0x11223344-32": 1,
+	}
+	got := tracer.Result()
+	if len(got) != len(want) {
+		t.Errorf("unexpected selectors %v", got)
+	}
+	for key, count := range want {
+		if got[key] != count {
+			t.Errorf("%s: got %d calls, want %d", key, got[key], count)
+		}
+	}
+}
@@ -19,6 +19,7 @@ package vm
 import (
 	"errors"
 	"math"
+	"math/big"
 	"strconv"
 	"testing"
 
@@ -26,7 +27,9 @@ import (
 	"github.com/ledgerwatch/erigon-lib/kv/memdb"
 	"github.com/ledgerwatch/erigon/common"
 	"github.com/ledgerwatch/erigon/common/hexutil"
+	mathutil "github.com/ledgerwatch/erigon/common/math"
 	"github.com/ledgerwatch/erigon/core/state"
+	"github.com/ledgerwatch/erigon/core/vm/stack"
 	"github.com/ledgerwatch/erigon/params"
 )
 
@@ -50,6 +53,101 @@ func TestMemoryGasCost(t *testing.T) {
 	}
 }
 
+// TestMemoryGasCostOpcodes checks that every memory expanding opcode charges
+// and rejects the sizes at the edge of memoryGasCost the same way, whichever
+// of its arguments determine the size.
+func TestMemoryGasCostOpcodes(t *testing.T) {
+	type region struct {
+		off, len int    // stack positions, len is -1 for fixed size operations
+		fixed    uint64 // the size of fixed size operations
+	}
+	var (
+		copied = region{off: 0, len: 2}
+		data   = region{off: 0, len: 1}
+		create = region{off: 1, len: 2}
+		word   = region{off: 0, len: -1, fixed: 32}
+	)
+	regions := map[OpCode][]region{
+		SHA3:           {data},
+		CALLDATACOPY:   {copied},
+		CODECOPY:       {copied},
+		RETURNDATACOPY: {copied},
+		EXTCODECOPY:    {{off: 1, len: 3}},
+		MLOAD:          {word},
+		MSTORE:         {word},
+		MSTORE8:        {{off: 0, len: -1, fixed: 1}},
+		CREATE:         {create},
+		CREATE2:        {create},
+		CALL:           {{off: 3, len: 4}, {off: 5, len: 6}},
+		CALLCODE:       {{off: 3, len: 4}, {off: 5, len: 6}},
+		DELEGATECALL:   {{off: 2, len: 3}, {off: 4, len: 5}},
+		STATICCALL:     {{off: 2, len: 3}, {off: 4, len: 5}},
+		RETURN:         {data},
+		REVERT:         {data},
+		LOG0:           {data},
+		LOG1:           {data},
+		LOG2:           {data},
+		LOG3:           {data},
+		LOG4:           {data},
+	}
+	tests := []struct {
+		size     uint64
+		overflow bool
+	}{
+		{0x1fffffffe0, false},
+		{0x1fffffffe1, true},
+		{math.MaxUint64, true},
+	}
+	jt := newLondonInstructionSet()
+	for i, operation := range jt {
+		if operation == nil || operation.memorySize == nil {
+			continue
+		}
+		op := OpCode(i)
+		if _, ok := regions[op]; !ok {
+			t.Errorf("%v: memory expanding opcode not covered", op)
+		}
+	}
+	evm, _ := newTestEVM(t, Config{})
+	for op, regs := range regions {
+		operation := jt[op]
+		for _, reg := range regs {
+			for _, tt := range tests {
+				// Every offset and size is zero, but the ones of the region
+				args := make([]uint256.Int, 7)
+				if reg.len < 0 {
+					args[reg.off].SetUint64(tt.size - reg.fixed)
+				} else {
+					args[reg.len].SetUint64(tt.size)
+				}
+				st := stack.New()
+				for j := len(args) - 1; j >= 0; j-- {
+					st.Push(&args[j])
+				}
+				contract := NewContract(AccountRef(common.Address{1}), AccountRef(common.Address{2}), new(uint256.Int), math.MaxUint64, false)
+				memSize, overflow := operation.memorySize(st)
+				var (
+					memorySize uint64
+					gas        uint64
+					err        = ErrGasUintOverflow
+				)
+				if !overflow {
+					if memorySize, overflow = mathutil.SafeMul(toWordSize(memSize), 32); !overflow {
+						gas, err = operation.dynamicGas(evm, contract, st, &Memory{}, memorySize)
+					}
+				}
+				if tt.overflow {
+					if !errors.Is(err, ErrGasUintOverflow) {
+						t.Errorf("%v, size %#x at %d: have %v, want overflow", op, tt.size, reg.len, err)
+					}
+				} else if err != nil || gas < 36028809887088637 {
+					t.Errorf("%v, size %#x at %d: have gas %d, error %v", op, tt.size, reg.len, gas, err)
+				}
+			}
+		}
+	}
+}
+
 var eip2200Tests = []struct {
 	original byte
 	gaspool  uint64
@@ -114,3 +212,240 @@ func TestEIP2200(t *testing.T) {
 		})
 	}
 }
+
+func TestEIP2200SentryOverride(t *testing.T) {
+	tests := []struct {
+		sentry  uint64
+		gaspool uint64
+		used    uint64
+		failure error
+	}{
+		{0, 2307, 806, nil}, // protocol default of 2300
+		{3000, 2307, 2307, ErrOutOfGas},
+		{3000, 3006, 3006, ErrOutOfGas}, // 3000 sentry + 2xPUSH
+		{3000, 3007, 806, nil},          // 3001 sentry + 2xPUSH
+	}
+	for i, tt := range tests {
+		address := common.BytesToAddress([]byte("contract"))
+		_, tx := memdb.NewTestTx(t)
+
+		s := state.New(state.NewPlainStateReader(tx))
+		s.CreateAccount(address, true)
+		s.SetCode(address, hexutil.MustDecode("0x6001600055"))
+		s.SetState(address, &common.Hash{}, *uint256.NewInt(1))
+
+		_ = s.CommitBlock(params.AllEthashProtocolChanges.Rules(0), state.NewPlainStateWriter(tx, tx, 0))
+		vmctx := BlockContext{
+			CanTransfer: func(IntraBlockState, common.Address, *uint256.Int) bool { return true },
+			Transfer:    func(IntraBlockState, common.Address, common.Address, *uint256.Int, bool) {},
+		}
+		vmenv := NewEVM(vmctx, TxContext{}, s, params.AllEthashProtocolChanges, Config{ExtraEips: []int{2200}, SstoreSentryGas: tt.sentry})
+
+		_, gas, err := vmenv.Call(AccountRef(common.Address{}), address, nil, tt.gaspool, new(uint256.Int), false /* bailout */)
+		if !errors.Is(err, tt.failure) {
+			t.Errorf("test %d: failure mismatch: have %v, want %v", i, err, tt.failure)
+		}
+		if used := tt.gaspool - gas; used != tt.used {
+			t.Errorf("test %d: gas used mismatch: have %v, want %v", i, used, tt.used)
+		}
+	}
+}
+
+func TestEIP2200RefundChange(t *testing.T) {
+	var positive, negative bool
+	for i, tt := range eip2200Tests {
+		tt := tt
+		i := i
+
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			address := common.BytesToAddress([]byte("contract"))
+			_, tx := memdb.NewTestTx(t)
+
+			s := state.New(state.NewPlainStateReader(tx))
+			s.CreateAccount(address, true)
+			s.SetCode(address, hexutil.MustDecode(tt.input))
+			s.SetState(address, &common.Hash{}, *uint256.NewInt(uint64(tt.original)))
+
+			_ = s.CommitBlock(params.AllEthashProtocolChanges.Rules(0), state.NewPlainStateWriter(tx, tx, 0))
+			vmctx := BlockContext{
+				CanTransfer: func(IntraBlockState, common.Address, *uint256.Int) bool { return true },
+				Transfer:    func(IntraBlockState, common.Address, common.Address, *uint256.Int, bool) {},
+			}
+			logger := NewStructLogger(nil)
+			vmenv := NewEVM(vmctx, TxContext{}, s, params.AllEthashProtocolChanges, Config{ExtraEips: []int{2200}, Debug: true, Tracer: logger})
+
+			_, _, err := vmenv.Call(AccountRef(common.Address{}), address, nil, tt.gaspool, new(uint256.Int), false /* bailout */)
+			if !errors.Is(err, tt.failure) {
+				t.Errorf("test %d: failure mismatch: have %v, want %v", i, err, tt.failure)
+			}
+			var sum int64
+			for _, log := range logger.StructLogs() {
+				if log.RefundChange != 0 && log.Op != SSTORE {
+					t.Errorf("test %d: unexpected refund change %d by %v", i, log.RefundChange, log.Op)
+				}
+				positive = positive || log.RefundChange > 0
+				negative = negative || log.RefundChange < 0
+				sum += log.RefundChange
+			}
+			if sum != int64(tt.refund) {
+				t.Errorf("test %d: refund changes sum to %d, want %d", i, sum, tt.refund)
+			}
+		})
+	}
+	if !positive || !negative {
+		t.Errorf("expected both refund additions and removals, got positive=%v negative=%v", positive, negative)
+	}
+}
+
+// fuzzedGasFuncs are the gas functions covered by FuzzGasFunctions. extra, if
+// set, computes the exact cost on top of the memory expansion with big
+// integers, to catch overflows the function doesn't report.
+var fuzzedGasFuncs = []struct {
+	name   string
+	fn     gasFunc
+	memory bool // charges for the memory expansion to memorySize
+	call   bool // sets evm.callGasTemp
+	sentry bool // fails with at most the EIP-2200 reentrancy sentry gas left
+	extra  func(st *stack.Stack) *big.Int
+}{
+	{name: "sstore", fn: gasSStore},
+	{name: "sstoreEIP2200", fn: gasSStoreEIP2200, sentry: true},
+	{name: "sstoreEIP2929", fn: makeGasSStoreFunc(params.SstoreClearsScheduleRefundEIP2200), sentry: true},
+	{name: "call", fn: gasCall, memory: true, call: true},
+	{name: "callcode", fn: gasCallCode, memory: true, call: true},
+	{name: "delegatecall", fn: gasDelegateCall, memory: true, call: true},
+	{name: "staticcall", fn: gasStaticCall, memory: true, call: true},
+	{name: "expEIP160", fn: gasExpEIP160, extra: func(st *stack.Stack) *big.Int {
+		byteLen := big.NewInt(int64((st.Back(1).BitLen() + 7) / 8))
+		return byteLen.Add(byteLen.Mul(byteLen, new(big.Int).SetUint64(params.ExpByteEIP160)), new(big.Int).SetUint64(params.ExpGas))
+	}},
+	{name: "create2", fn: gasCreate2, memory: true, extra: func(st *stack.Stack) *big.Int {
+		return fuzzWordGas(st.Back(2), params.Sha3WordGas)
+	}},
+	{name: "sha3", fn: gasSha3, memory: true, extra: func(st *stack.Stack) *big.Int {
+		return fuzzWordGas(st.Back(1), params.Sha3WordGas)
+	}},
+	{name: "calldatacopy", fn: gasCallDataCopy, memory: true, extra: func(st *stack.Stack) *big.Int {
+		return fuzzWordGas(st.Back(2), params.CopyGas)
+	}},
+	{name: "log4", fn: makeGasLog(4), memory: true, extra: func(st *stack.Stack) *big.Int {
+		gas := new(big.Int).Mul(st.Back(1).ToBig(), new(big.Int).SetUint64(params.LogDataGas))
+		return gas.Add(gas, new(big.Int).SetUint64(params.LogGas+4*params.LogTopicGas))
+	}},
+	{name: "memory", fn: pureMemoryGascost, memory: true, extra: func(st *stack.Stack) *big.Int {
+		return new(big.Int)
+	}},
+}
+
+// fuzzWordGas returns the cost of size bytes at wordGas per 32-byte word. Sizes
+// beyond 64 bits are refused as an overflow even if their cost would fit.
+func fuzzWordGas(size *uint256.Int, wordGas uint64) *big.Int {
+	if !size.IsUint64() {
+		return new(big.Int).Lsh(common.Big1, 64)
+	}
+	words := new(big.Int).Add(size.ToBig(), big.NewInt(31))
+	words.Div(words, big.NewInt(32))
+	return words.Mul(words, new(big.Int).SetUint64(wordGas))
+}
+
+// fuzzMemoryFee returns the quadratic cost of words of memory.
+func fuzzMemoryFee(words uint64) uint64 {
+	return words*params.MemoryGas + words*words/params.QuadCoeffDiv
+}
+
+func FuzzGasFunctions(f *testing.F) {
+	// The boundaries of TestMemoryGasCost, and stack values around 2^64
+	maxUint64 := uint256.NewInt(math.MaxUint64).Bytes32()
+	nearMax := uint256.NewInt(math.MaxUint64 - 31).Bytes32()
+	beyond := new(uint256.Int).Lsh(uint256.NewInt(1), 64).Bytes32()
+	for fn := range fuzzedGasFuncs {
+		for _, memorySize := range []uint64{0, 32, 0x1fffffffe0, 0x1fffffffe1, math.MaxUint64} {
+			f.Add(uint8(fn), memorySize, uint16(0), uint64(math.MaxUint64), []byte{})
+			f.Add(uint8(fn), memorySize, uint16(4), uint64(params.SstoreSentryGasEIP2200), maxUint64[:])
+		}
+		for _, item := range [][32]byte{maxUint64, nearMax, beyond} {
+			stackData := append(append(append([]byte{}, item[:]...), item[:]...), item[:]...)
+			f.Add(uint8(fn), uint64(64), uint16(1), uint64(params.SstoreSentryGasEIP2200+1), stackData)
+		}
+	}
+	var (
+		caller  = common.HexToAddress("0xcc")
+		address = common.HexToAddress("0xaa")
+	)
+	vmenv, s := newTestEVM(f, Config{})
+	s.AddAddressToAccessList(address)
+
+	f.Fuzz(func(t *testing.T, fn uint8, memorySize uint64, memWords uint16, gas uint64, stackData []byte) {
+		gasFn := fuzzedGasFuncs[int(fn)%len(fuzzedGasFuncs)]
+		// Seven items are enough for every gas function, missing bytes are zero
+		st := stack.New()
+		defer stack.ReturnNormalStack(st)
+		for i := 6; i >= 0; i-- {
+			var item [32]byte
+			if i*32 < len(stackData) {
+				copy(item[:], stackData[i*32:])
+			}
+			st.Push(new(uint256.Int).SetBytes32(item[:]))
+		}
+		// The memory has already been expanded, and paid for, to memWords
+		mem := NewMemory()
+		words := uint64(memWords % 1024)
+		if _, err := memoryGasCost(mem, words*32); err != nil {
+			t.Fatal(err)
+		}
+		mem.Resize(words * 32)
+		contract := NewContract(AccountRef(caller), AccountRef(address), new(uint256.Int), gas, false /* skipAnalysis */)
+
+		cost, err := gasFn.fn(vmenv, contract, st, mem, memorySize)
+		if err != nil && !errors.Is(err, ErrGasUintOverflow) {
+			// The only other failure is the EIP-2200 reentrancy sentry
+			if !gasFn.sentry || gas > params.SstoreSentryGasEIP2200 {
+				t.Fatalf("%s: unexpected error %v", gasFn.name, err)
+			}
+			return
+		}
+		var memFee uint64
+		if gasFn.memory {
+			if memorySize > 0x1fffffffe0 {
+				if !errors.Is(err, ErrGasUintOverflow) {
+					t.Fatalf("%s: expected overflow for memory size %d, got cost %d", gasFn.name, memorySize, cost)
+				}
+				return
+			}
+			if newWords := toWordSize(memorySize); newWords > words {
+				memFee = fuzzMemoryFee(newWords) - fuzzMemoryFee(words)
+			}
+		}
+		if gasFn.extra != nil {
+			want := gasFn.extra(st)
+			want.Add(want, new(big.Int).SetUint64(memFee))
+			if !want.IsUint64() {
+				if !errors.Is(err, ErrGasUintOverflow) {
+					t.Fatalf("%s: expected overflow for cost %v, got %d", gasFn.name, want, cost)
+				}
+				return
+			}
+			if err != nil || cost != want.Uint64() {
+				t.Fatalf("%s: expected cost %v, got %d (%v)", gasFn.name, want, cost, err)
+			}
+			return
+		}
+		if err != nil {
+			if !gasFn.call {
+				t.Fatalf("%s: unexpected overflow", gasFn.name)
+			}
+			return
+		}
+		if gasFn.call {
+			// The cost is the forwarded gas on top of the call's own cost, which
+			// includes the memory expansion. The 63/64 rule only applies when
+			// the caller can afford the latter, otherwise the call runs out of gas.
+			if cost < vmenv.callGasTemp || cost-vmenv.callGasTemp < memFee {
+				t.Fatalf("%s: cost %d wrapped around, forwarded %d", gasFn.name, cost, vmenv.callGasTemp)
+			}
+			if base := cost - vmenv.callGasTemp; base <= gas && vmenv.callGasTemp > gas-base {
+				t.Fatalf("%s: forwarded %d out of %d", gasFn.name, vmenv.callGasTemp, gas-base)
+			}
+		}
+	})
+}
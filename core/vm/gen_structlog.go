@@ -5,6 +5,7 @@ package vm
 import (
 	"encoding/json"
 	"math/big"
+	"time"
 
 	"github.com/ledgerwatch/erigon/common"
 	"github.com/ledgerwatch/erigon/common/hexutil"
@@ -20,14 +21,21 @@ func (s StructLog) MarshalJSON() ([]byte, error) {
 		Op            OpCode                      `json:"op"`
 		Gas           math.HexOrDecimal64         `json:"gas"`
 		GasCost       math.HexOrDecimal64         `json:"gasCost"`
-		Memory        hexutil.Bytes               `json:"memory"`
+		DynamicGas    math.HexOrDecimal64         `json:"dynamicGas"`
+		ColdAccess    bool                        `json:"coldAccess,omitempty"`
+		Memory        structLogMemory             `json:"memory"`
 		MemorySize    int                         `json:"memSize"`
 		Stack         []*math.HexOrDecimal256     `json:"stack"`
-		ReturnStack   []math.HexOrDecimal64       `json:"returnStack"`
 		ReturnData    hexutil.Bytes               `json:"returnData"`
+		ReturnDataCut bool                        `json:"returnDataTruncated,omitempty"`
 		Storage       map[common.Hash]common.Hash `json:"-"`
+		Transient     map[common.Hash]common.Hash `json:"-"`
 		Depth         int                         `json:"depth"`
 		RefundCounter uint64                      `json:"refund"`
+		RefundChange  int64                       `json:"refundChange"`
+		Duration      time.Duration               `json:"duration,omitempty"`
+		CallPath      string                      `json:"callPath,omitempty"`
+		PushData      hexutil.Bytes               `json:"pushData,omitempty"`
 		Err           error                       `json:"-"`
 		OpName        string                      `json:"opName"`
 		ErrorString   string                      `json:"error"`
@@ -37,6 +45,8 @@ func (s StructLog) MarshalJSON() ([]byte, error) {
 	enc.Op = s.Op
 	enc.Gas = math.HexOrDecimal64(s.Gas)
 	enc.GasCost = math.HexOrDecimal64(s.GasCost)
+	enc.DynamicGas = math.HexOrDecimal64(s.DynamicGas)
+	enc.ColdAccess = s.ColdAccess
 	enc.Memory = s.Memory
 	enc.MemorySize = s.MemorySize
 	if s.Stack != nil {
@@ -46,9 +56,15 @@ func (s StructLog) MarshalJSON() ([]byte, error) {
 		}
 	}
 	enc.ReturnData = s.ReturnData
+	enc.ReturnDataCut = s.ReturnDataCut
 	enc.Storage = s.Storage
+	enc.Transient = s.Transient
 	enc.Depth = s.Depth
 	enc.RefundCounter = s.RefundCounter
+	enc.RefundChange = s.RefundChange
+	enc.Duration = s.Duration
+	enc.CallPath = s.CallPath
+	enc.PushData = s.PushData
 	enc.Err = s.Err
 	enc.OpName = s.OpName()
 	enc.ErrorString = s.ErrorString()
@@ -62,13 +78,21 @@ func (s *StructLog) UnmarshalJSON(input []byte) error {
 		Op            *OpCode                     `json:"op"`
 		Gas           *math.HexOrDecimal64        `json:"gas"`
 		GasCost       *math.HexOrDecimal64        `json:"gasCost"`
-		Memory        *hexutil.Bytes              `json:"memory"`
+		DynamicGas    *math.HexOrDecimal64        `json:"dynamicGas"`
+		ColdAccess    *bool                       `json:"coldAccess,omitempty"`
+		Memory        *structLogMemory            `json:"memory"`
 		MemorySize    *int                        `json:"memSize"`
 		Stack         []*math.HexOrDecimal256     `json:"stack"`
 		ReturnData    *hexutil.Bytes              `json:"returnData"`
+		ReturnDataCut *bool                       `json:"returnDataTruncated,omitempty"`
 		Storage       map[common.Hash]common.Hash `json:"-"`
+		Transient     map[common.Hash]common.Hash `json:"-"`
 		Depth         *int                        `json:"depth"`
 		RefundCounter *uint64                     `json:"refund"`
+		RefundChange  *int64                      `json:"refundChange"`
+		Duration      *time.Duration              `json:"duration,omitempty"`
+		CallPath      *string                     `json:"callPath,omitempty"`
+		PushData      *hexutil.Bytes              `json:"pushData,omitempty"`
 		Err           error                       `json:"-"`
 	}
 	var dec StructLog
@@ -87,6 +111,12 @@ func (s *StructLog) UnmarshalJSON(input []byte) error {
 	if dec.GasCost != nil {
 		s.GasCost = uint64(*dec.GasCost)
 	}
+	if dec.DynamicGas != nil {
+		s.DynamicGas = uint64(*dec.DynamicGas)
+	}
+	if dec.ColdAccess != nil {
+		s.ColdAccess = *dec.ColdAccess
+	}
 	if dec.Memory != nil {
 		s.Memory = *dec.Memory
 	}
@@ -102,15 +132,33 @@ func (s *StructLog) UnmarshalJSON(input []byte) error {
 	if dec.ReturnData != nil {
 		s.ReturnData = *dec.ReturnData
 	}
+	if dec.ReturnDataCut != nil {
+		s.ReturnDataCut = *dec.ReturnDataCut
+	}
 	if dec.Storage != nil {
 		s.Storage = dec.Storage
 	}
+	if dec.Transient != nil {
+		s.Transient = dec.Transient
+	}
 	if dec.Depth != nil {
 		s.Depth = *dec.Depth
 	}
 	if dec.RefundCounter != nil {
 		s.RefundCounter = *dec.RefundCounter
 	}
+	if dec.RefundChange != nil {
+		s.RefundChange = *dec.RefundChange
+	}
+	if dec.Duration != nil {
+		s.Duration = *dec.Duration
+	}
+	if dec.CallPath != nil {
+		s.CallPath = *dec.CallPath
+	}
+	if dec.PushData != nil {
+		s.PushData = *dec.PushData
+	}
 	if dec.Err != nil {
 		s.Err = dec.Err
 	}
@@ -0,0 +1,112 @@
+package vm
+
+import (
+	"bytes"
+	"encoding/json"
+	"math/big"
+	"sort"
+	"time"
+
+	"github.com/holiman/uint256"
+
+	"github.com/ledgerwatch/erigon/common"
+)
+
+// SlotAccess counts the accesses to a storage slot recorded by the
+// HotSlotTracer.
+type SlotAccess struct {
+	Address common.Address `json:"address"`
+	Slot    common.Hash    `json:"slot"`
+	Reads   uint64         `json:"reads"`  // SLOADs
+	Writes  uint64         `json:"writes"` // SSTOREs
+}
+
+type slotKey struct {
+	addr common.Address
+	slot common.Hash
+}
+
+var _ Tracer = (*HotSlotTracer)(nil)
+
+// HotSlotTracer is a native tracer counting the SLOADs and SSTOREs of every
+// storage slot, for finding the most accessed ones. Accesses made by frames
+// that fail later are counted too, but not the ones that fail themselves.
+type HotSlotTracer struct {
+	slots map[slotKey]*SlotAccess
+}
+
+// NewHotSlotTracer returns a new storage slot access tracer.
+func NewHotSlotTracer() *HotSlotTracer {
+	return &HotSlotTracer{slots: make(map[slotKey]*SlotAccess)}
+}
+
+func (t *HotSlotTracer) CaptureStart(env *EVM, depth int, from common.Address, to common.Address, precompile bool, create bool, callType CallType, input []byte, gas uint64, value *big.Int, code []byte) {
+}
+
+func (t *HotSlotTracer) CaptureEnter(typ OpCode, from common.Address, to common.Address, input []byte, gas uint64, value *uint256.Int) {
+}
+
+func (t *HotSlotTracer) CaptureState(env *EVM, pc uint64, op OpCode, gas, cost uint64, scope *ScopeContext, rData []byte, depth int, err error) {
+	if err != nil || (op != SLOAD && op != SSTORE) || scope.Stack.Len() < 1 {
+		return
+	}
+	key := slotKey{scope.Contract.Address(), common.Hash(scope.Stack.Back(0).Bytes32())}
+	access := t.slots[key]
+	if access == nil {
+		access = &SlotAccess{Address: key.addr, Slot: key.slot}
+		t.slots[key] = access
+	}
+	if op == SLOAD {
+		access.Reads++
+	} else {
+		access.Writes++
+	}
+}
+
+func (t *HotSlotTracer) CaptureFault(env *EVM, pc uint64, op OpCode, gas, cost uint64, scope *ScopeContext, depth int, err error) {
+}
+
+func (t *HotSlotTracer) CaptureEnd(depth int, output []byte, startGas, endGas uint64, d time.Duration, err error) {
+}
+
+func (t *HotSlotTracer) CaptureExit(output []byte, gasUsed uint64, err error) {
+}
+
+func (t *HotSlotTracer) CaptureSelfDestruct(from common.Address, to common.Address, value *big.Int) {
+}
+
+func (t *HotSlotTracer) CaptureAccountRead(account common.Address) error {
+	return nil
+}
+
+func (t *HotSlotTracer) CaptureAccountWrite(account common.Address) error {
+	return nil
+}
+
+// HottestSlots returns the n most accessed slots, reads and writes together,
+// in decreasing order, or all of them if n is not positive. Slots accessed as
+// often are ordered by address and slot.
+func (t *HotSlotTracer) HottestSlots(n int) []SlotAccess {
+	slots := make([]SlotAccess, 0, len(t.slots))
+	for _, access := range t.slots {
+		slots = append(slots, *access)
+	}
+	sort.Slice(slots, func(i, j int) bool {
+		if ci, cj := slots[i].Reads+slots[i].Writes, slots[j].Reads+slots[j].Writes; ci != cj {
+			return ci > cj
+		}
+		if c := bytes.Compare(slots[i].Address[:], slots[j].Address[:]); c != 0 {
+			return c < 0
+		}
+		return bytes.Compare(slots[i].Slot[:], slots[j].Slot[:]) < 0
+	})
+	if n > 0 && n < len(slots) {
+		slots = slots[:n]
+	}
+	return slots
+}
+
+// GetResult returns all the accessed slots, hottest first, as a JSON array.
+func (t *HotSlotTracer) GetResult() (json.RawMessage, error) {
+	return json.Marshal(t.HottestSlots(0))
+}
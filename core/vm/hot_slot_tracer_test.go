@@ -0,0 +1,62 @@
+package vm
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/holiman/uint256"
+
+	"github.com/ledgerwatch/erigon/common"
+)
+
+func TestHotSlotTracer(t *testing.T) {
+	var (
+		outer = common.HexToAddress("0xaa")
+		inner = common.HexToAddress("0xbb")
+	)
+	sload := func(slot byte) []byte { return []byte{byte(PUSH1), slot, byte(SLOAD), byte(POP)} }
+	sstore := func(slot byte) []byte { return []byte{byte(PUSH1), 1, byte(PUSH1), slot, byte(SSTORE)} }
+	var code []byte
+	for _, part := range [][]byte{sload(1), sload(1), sstore(1), sload(2), sstore(3), sstore(3)} {
+		code = append(code, part...)
+	}
+	// CALL(gas, 0xbb, 0, 0, 0, 0, 0)
+	code = append(code, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0xbb, byte(GAS), byte(CALL))
+
+	tracer := NewHotSlotTracer()
+	vmenv, s := newTestEVM(t, Config{Debug: true, Tracer: tracer})
+	s.SetCode(outer, code)
+	// The same slot in another contract is counted apart
+	s.SetCode(inner, sload(1))
+	s.AddAddressToAccessList(outer)
+	if _, _, err := vmenv.Call(AccountRef(common.Address{}), outer, nil, 1000000, new(uint256.Int), false /* bailout */); err != nil {
+		t.Fatal(err)
+	}
+	slot := func(n byte) common.Hash { return common.BytesToHash([]byte{n}) }
+	want := []SlotAccess{
+		{outer, slot(1), 2, 1},
+		{outer, slot(3), 0, 2},
+		{outer, slot(2), 1, 0},
+		{inner, slot(1), 1, 0},
+	}
+	have := tracer.HottestSlots(0)
+	if len(have) != len(want) {
+		t.Fatalf("expected %d slots, got %+v", len(want), have)
+	}
+	for i := range want {
+		if have[i] != want[i] {
+			t.Errorf("slot %d: have %+v, want %+v", i, have[i], want[i])
+		}
+	}
+	if top := tracer.HottestSlots(2); len(top) != 2 || top[1] != want[1] {
+		t.Errorf("unexpected top slots %+v", top)
+	}
+	res, err := tracer.GetResult()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded []SlotAccess
+	if err := json.Unmarshal(res, &decoded); err != nil || len(decoded) != len(want) {
+		t.Errorf("unexpected result %s: %v", res, err)
+	}
+}
@@ -18,6 +18,7 @@ package vm
 
 import (
 	"fmt"
+	"math"
 
 	"github.com/holiman/uint256"
 	"golang.org/x/crypto/sha3"
@@ -335,6 +336,9 @@ func opCallDataCopy(pc *uint64, interpreter *EVMInterpreter, scope *ScopeContext
 	memOffset64 := memOffset.Uint64()
 	length64 := length.Uint64()
 	scope.Memory.Set(memOffset64, length64, getData(scope.Contract.Input, dataOffset64, length64))
+	if interpreter.cfg.CaptureMemory != nil {
+		interpreter.captureMemory(*pc, scope.Memory, memOffset64, length64, true)
+	}
 	return nil, nil
 }
 
@@ -366,11 +370,17 @@ func opReturnDataCopy(pc *uint64, interpreter *EVMInterpreter, scope *ScopeConte
 		return nil, ErrReturnDataOutOfBounds
 	}
 	scope.Memory.Set(memOffset.Uint64(), length.Uint64(), interpreter.returnData[offset64:end64])
+	if interpreter.cfg.CaptureMemory != nil {
+		interpreter.captureMemory(*pc, scope.Memory, memOffset.Uint64(), length.Uint64(), true)
+	}
 	return nil, nil
 }
 
 func opExtCodeSize(pc *uint64, interpreter *EVMInterpreter, scope *ScopeContext) ([]byte, error) {
 	slot := scope.Stack.Peek()
+	if interpreter.cfg.Debug {
+		interpreter.captureCodeAccess(*pc, EXTCODESIZE, slot.Bytes20())
+	}
 	slot.SetUint64(uint64(interpreter.evm.IntraBlockState().GetCodeSize(slot.Bytes20())))
 	return nil, nil
 }
@@ -394,6 +404,9 @@ func opCodeCopy(pc *uint64, interpreter *EVMInterpreter, scope *ScopeContext) ([
 	}
 	codeCopy := getData(scope.Contract.Code, uint64CodeOffset, length.Uint64())
 	scope.Memory.Set(memOffset.Uint64(), length.Uint64(), codeCopy)
+	if interpreter.cfg.CaptureMemory != nil {
+		interpreter.captureMemory(*pc, scope.Memory, memOffset.Uint64(), length.Uint64(), true)
+	}
 	return nil, nil
 }
 
@@ -406,9 +419,15 @@ func opExtCodeCopy(pc *uint64, interpreter *EVMInterpreter, scope *ScopeContext)
 		length     = stack.Pop()
 	)
 	addr := common.Address(a.Bytes20())
+	if interpreter.cfg.Debug {
+		interpreter.captureCodeAccess(*pc, EXTCODECOPY, addr)
+	}
 	len64 := length.Uint64()
 	codeCopy := getDataBig(interpreter.evm.IntraBlockState().GetCode(addr), &codeOffset, len64)
 	scope.Memory.Set(memOffset.Uint64(), len64, codeCopy)
+	if interpreter.cfg.CaptureMemory != nil {
+		interpreter.captureMemory(*pc, scope.Memory, memOffset.Uint64(), len64, true)
+	}
 	return nil, nil
 }
 
@@ -448,6 +467,9 @@ func opExtCodeCopy(pc *uint64, interpreter *EVMInterpreter, scope *ScopeContext)
 func opExtCodeHash(pc *uint64, interpreter *EVMInterpreter, scope *ScopeContext) ([]byte, error) {
 	slot := scope.Stack.Peek()
 	address := common.Address(slot.Bytes20())
+	if interpreter.cfg.Debug {
+		interpreter.captureCodeAccess(*pc, EXTCODEHASH, address)
+	}
 	if interpreter.evm.IntraBlockState().Empty(address) {
 		slot.Clear()
 	} else {
@@ -470,6 +492,9 @@ func opBlockhash(pc *uint64, interpreter *EVMInterpreter, scope *ScopeContext) (
 	num64, overflow := num.Uint64WithOverflow()
 	if overflow {
 		num.Clear()
+		if interpreter.cfg.Debug {
+			interpreter.captureBlockHash(*pc, math.MaxUint64, common.Hash{})
+		}
 		return nil, nil
 	}
 	var upper, lower uint64
@@ -479,11 +504,16 @@ func opBlockhash(pc *uint64, interpreter *EVMInterpreter, scope *ScopeContext) (
 	} else {
 		lower = upper - 256
 	}
+	var hash common.Hash
 	if num64 >= lower && num64 < upper {
-		num.SetBytes(interpreter.evm.Context().GetHash(num64).Bytes())
+		hash = interpreter.evm.Context().GetHash(num64)
+		num.SetBytes(hash.Bytes())
 	} else {
 		num.Clear()
 	}
+	if interpreter.cfg.Debug {
+		interpreter.captureBlockHash(*pc, num64, hash)
+	}
 	return nil, nil
 }
 
@@ -537,6 +567,9 @@ func opPop(pc *uint64, interpreter *EVMInterpreter, scope *ScopeContext) ([]byte
 func opMload(pc *uint64, interpreter *EVMInterpreter, scope *ScopeContext) ([]byte, error) {
 	v := scope.Stack.Peek()
 	offset := v.Uint64()
+	if interpreter.cfg.CaptureMemory != nil {
+		interpreter.captureMemory(*pc, scope.Memory, offset, 32, false)
+	}
 	v.SetBytes(scope.Memory.GetPtr(offset, 32))
 	return nil, nil
 }
@@ -544,12 +577,18 @@ func opMload(pc *uint64, interpreter *EVMInterpreter, scope *ScopeContext) ([]by
 func opMstore(pc *uint64, interpreter *EVMInterpreter, scope *ScopeContext) ([]byte, error) {
 	mStart, val := scope.Stack.Pop(), scope.Stack.Pop()
 	scope.Memory.Set32(mStart.Uint64(), &val)
+	if interpreter.cfg.CaptureMemory != nil {
+		interpreter.captureMemory(*pc, scope.Memory, mStart.Uint64(), 32, true)
+	}
 	return nil, nil
 }
 
 func opMstore8(pc *uint64, interpreter *EVMInterpreter, scope *ScopeContext) ([]byte, error) {
 	off, val := scope.Stack.Pop(), scope.Stack.Pop()
 	scope.Memory.store[off.Uint64()] = byte(val.Uint64())
+	if interpreter.cfg.CaptureMemory != nil {
+		interpreter.captureMemory(*pc, scope.Memory, off.Uint64(), 1, true)
+	}
 	return nil, nil
 }
 
@@ -570,6 +609,9 @@ func opSstore(pc *uint64, interpreter *EVMInterpreter, scope *ScopeContext) ([]b
 
 func opJump(pc *uint64, interpreter *EVMInterpreter, scope *ScopeContext) ([]byte, error) {
 	pos := scope.Stack.Pop()
+	if interpreter.cfg.Debug {
+		interpreter.captureJump(*pc, scope.Contract, &pos, false, true)
+	}
 	if valid, usedBitmap := scope.Contract.validJumpdest(&pos); !valid {
 		if usedBitmap {
 			if interpreter.cfg.TraceJumpDest {
@@ -592,6 +634,9 @@ func opJump(pc *uint64, interpreter *EVMInterpreter, scope *ScopeContext) ([]byt
 
 func opJumpi(pc *uint64, interpreter *EVMInterpreter, scope *ScopeContext) ([]byte, error) {
 	pos, cond := scope.Stack.Pop(), scope.Stack.Pop()
+	if interpreter.cfg.Debug {
+		interpreter.captureJump(*pc, scope.Contract, &pos, true, !cond.IsZero())
+	}
 	if !cond.IsZero() {
 		if valid, usedBitmap := scope.Contract.validJumpdest(&pos); !valid {
 			if usedBitmap {
@@ -851,11 +896,24 @@ func opSuicide(pc *uint64, interpreter *EVMInterpreter, scope *ScopeContext) ([]
 	callerAddr := scope.Contract.Address()
 	beneficiaryAddr := common.Address(beneficiary.Bytes20())
 	balance := interpreter.evm.IntraBlockState().GetBalance(callerAddr)
-	if interpreter.evm.Config().Debug {
-		interpreter.evm.Config().Tracer.CaptureSelfDestruct(callerAddr, beneficiaryAddr, balance.ToBig())
+	if interpreter.cfg.Debug {
+		interpreter.cfg.Tracer.CaptureSelfDestruct(callerAddr, beneficiaryAddr, balance.ToBig())
+	}
+	var (
+		tracer      SelfDestructTracer
+		transferred *uint256.Int
+	)
+	if interpreter.cfg.Debug {
+		if tracer, _ = interpreter.cfg.Tracer.(SelfDestructTracer); tracer != nil {
+			// balance points into the state object, which is cleared by Suicide
+			transferred = balance.Clone()
+		}
 	}
 	interpreter.evm.IntraBlockState().AddBalance(beneficiaryAddr, balance)
-	interpreter.evm.IntraBlockState().Suicide(callerAddr)
+	removed := interpreter.evm.IntraBlockState().Suicide(callerAddr)
+	if tracer != nil {
+		tracer.CaptureSelfDestructResult(callerAddr, beneficiaryAddr, transferred, removed)
+	}
 	return nil, nil
 }
 
@@ -881,6 +939,11 @@ func makeLog(size int) executionFunc {
 			// core/state doesn't know the current block number.
 			BlockNumber: interpreter.evm.Context().BlockNumber,
 		})
+		if interpreter.cfg.Debug {
+			if tracer, ok := interpreter.cfg.Tracer.(LogTracer); ok {
+				tracer.CaptureLog(interpreter.evm.depth, *pc, scope.Contract.Address(), topics, d)
+			}
+		}
 
 		return nil, nil
 	}
@@ -20,8 +20,10 @@ package vm
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"reflect"
 	"testing"
 
 	"github.com/holiman/uint256"
@@ -107,7 +109,7 @@ func testTwoOperandOp(t *testing.T, tests []TwoOperandTestcase, opFn executionFu
 		expected := new(uint256.Int).SetBytes(common.Hex2Bytes(test.Expected))
 		stack.Push(x)
 		stack.Push(y)
-		opFn(&pc, evmInterpreter, &ScopeContext{nil, stack, nil})
+		opFn(&pc, evmInterpreter, &ScopeContext{Stack: stack})
 		if len(stack.Data) != 1 {
 			t.Errorf("Expected one item on stack after %v, got %d: ", name, len(stack.Data))
 		}
@@ -222,7 +224,7 @@ func TestAddMod(t *testing.T) {
 		stack.Push(z)
 		stack.Push(y)
 		stack.Push(x)
-		opAddmod(&pc, evmInterpreter, &ScopeContext{nil, stack, nil})
+		opAddmod(&pc, evmInterpreter, &ScopeContext{Stack: stack})
 		actual := stack.Pop()
 		if actual.Cmp(expected) != 0 {
 			t.Errorf("Testcase %d, expected  %x, got %x", i, expected, actual)
@@ -300,7 +302,7 @@ func opBenchmark(bench *testing.B, op executionFunc, args ...string) {
 			a.SetBytes(arg)
 			stack.Push(a)
 		}
-		op(&pc, evmInterpreter, &ScopeContext{nil, stack, nil})
+		op(&pc, evmInterpreter, &ScopeContext{Stack: stack})
 		stack.Pop()
 	}
 }
@@ -526,12 +528,12 @@ func TestOpMstore(t *testing.T) {
 	pc := uint64(0)
 	v := "abcdef00000000000000abba000000000deaf000000c0de00100000000133700"
 	stack.PushN(*new(uint256.Int).SetBytes(common.Hex2Bytes(v)), *new(uint256.Int))
-	opMstore(&pc, evmInterpreter, &ScopeContext{mem, stack, nil})
+	opMstore(&pc, evmInterpreter, &ScopeContext{Memory: mem, Stack: stack})
 	if got := common.Bytes2Hex(mem.GetCopy(0, 32)); got != v {
 		t.Fatalf("Mstore fail, got %v, expected %v", got, v)
 	}
 	stack.PushN(*new(uint256.Int).SetOne(), *new(uint256.Int))
-	opMstore(&pc, evmInterpreter, &ScopeContext{mem, stack, nil})
+	opMstore(&pc, evmInterpreter, &ScopeContext{Memory: mem, Stack: stack})
 	if common.Bytes2Hex(mem.GetCopy(0, 32)) != "0000000000000000000000000000000000000000000000000000000000000001" {
 		t.Fatalf("Mstore failed to overwrite previous value")
 	}
@@ -554,7 +556,7 @@ func BenchmarkOpMstore(bench *testing.B) {
 	bench.ResetTimer()
 	for i := 0; i < bench.N; i++ {
 		stack.PushN(*value, *memStart)
-		opMstore(&pc, evmInterpreter, &ScopeContext{mem, stack, nil})
+		opMstore(&pc, evmInterpreter, &ScopeContext{Memory: mem, Stack: stack})
 	}
 }
 
@@ -573,7 +575,7 @@ func BenchmarkOpSHA3(bench *testing.B) {
 	bench.ResetTimer()
 	for i := 0; i < bench.N; i++ {
 		stack.PushN(*uint256.NewInt(32), *start)
-		opSha3(&pc, evmInterpreter, &ScopeContext{mem, stack, nil})
+		opSha3(&pc, evmInterpreter, &ScopeContext{Memory: mem, Stack: stack})
 	}
 }
 
@@ -650,3 +652,244 @@ func TestCreate2Addreses(t *testing.T) {
 		}
 	}
 }
+
+func TestCaptureMemory(t *testing.T) {
+	type access struct {
+		depth        int
+		pc           uint64
+		offset, size uint64
+		data         []byte
+		isWrite      bool
+	}
+	var accesses []access
+	capture := func(depth int, pc uint64, offset, size uint64, data []byte, isWrite bool) {
+		accesses = append(accesses, access{depth, pc, offset, size, common.CopyBytes(data), isWrite})
+	}
+	contract := common.HexToAddress("0xaa")
+	code := []byte{
+		byte(PUSH1), 36, byte(PUSH1), 0, byte(PUSH1), 0, byte(CALLDATACOPY), // pc 6
+		byte(PUSH1), 4, byte(MLOAD), // pc 9
+		byte(PUSH1), 0xff, byte(PUSH1), 40, byte(MSTORE8), // pc 14
+		byte(STOP),
+	}
+	input := make([]byte, 36)
+	for i := range input {
+		input[i] = byte(i + 1)
+	}
+	vmenv, s := newTestEVM(t, Config{CaptureMemory: capture})
+	s.SetCode(contract, code)
+	if _, _, err := vmenv.Call(AccountRef(common.Address{}), contract, input, 100000, new(uint256.Int), false /* bailout */); err != nil {
+		t.Fatal(err)
+	}
+	want := []access{
+		{1, 6, 0, 36, input, true},
+		{1, 9, 4, 32, input[4:36], false},
+		{1, 14, 40, 1, []byte{0xff}, true},
+	}
+	if len(accesses) != len(want) {
+		t.Fatalf("expected %d memory accesses, got %d: %+v", len(want), len(accesses), accesses)
+	}
+	for i, w := range want {
+		got := accesses[i]
+		if got.depth != w.depth || got.pc != w.pc || got.offset != w.offset || got.size != w.size || got.isWrite != w.isWrite || !bytes.Equal(got.data, w.data) {
+			t.Errorf("access %d: expected %+v, got %+v", i, w, got)
+		}
+	}
+}
+
+type selfDestructRecord struct {
+	contract, beneficiary common.Address
+	balance               uint64
+	removed               bool
+}
+
+type testSelfDestructTracer struct {
+	*StructLogger
+	records []selfDestructRecord
+}
+
+func (st *testSelfDestructTracer) CaptureSelfDestructResult(contract common.Address, beneficiary common.Address, balance *uint256.Int, removed bool) {
+	st.records = append(st.records, selfDestructRecord{contract, beneficiary, balance.Uint64(), removed})
+}
+
+func TestSelfDestructTracer(t *testing.T) {
+	var (
+		contract    = common.HexToAddress("0xaa")
+		beneficiary = common.HexToAddress("0xee")
+	)
+	tracer := &testSelfDestructTracer{StructLogger: NewStructLogger(nil)}
+	vmenv, s := newTestEVM(t, Config{Debug: true, Tracer: tracer})
+	s.SetCode(contract, []byte{byte(PUSH1), 0xee, byte(SELFDESTRUCT)})
+	s.AddBalance(contract, uint256.NewInt(100))
+	if _, _, err := vmenv.Call(AccountRef(common.Address{}), contract, nil, 100000, new(uint256.Int), false /* bailout */); err != nil {
+		t.Fatal(err)
+	}
+	want := []selfDestructRecord{{contract, beneficiary, 100, true}}
+	if len(tracer.records) != 1 || tracer.records[0] != want[0] {
+		t.Errorf("expected %+v, got %+v", want, tracer.records)
+	}
+	if got := s.GetBalance(beneficiary).Uint64(); got != 100 {
+		t.Errorf("expected beneficiary to receive 100, got %d", got)
+	}
+}
+
+type codeAccessRecord struct {
+	pc   uint64
+	op   OpCode
+	addr common.Address
+	cold bool
+}
+
+type testCodeAccessTracer struct {
+	*StructLogger
+	records []codeAccessRecord
+}
+
+func (ct *testCodeAccessTracer) CaptureCodeAccess(depth int, pc uint64, op OpCode, addr common.Address, cold bool) {
+	ct.records = append(ct.records, codeAccessRecord{pc, op, addr, cold})
+}
+
+func TestCodeAccessTracer(t *testing.T) {
+	var (
+		contract = common.HexToAddress("0xaa")
+		first    = common.HexToAddress("0xbb")
+		second   = common.HexToAddress("0xcc")
+	)
+	tracer := &testCodeAccessTracer{StructLogger: NewStructLogger(nil)}
+	vmenv, s := newTestEVM(t, Config{Debug: true, Tracer: tracer})
+	s.SetCode(contract, []byte{
+		byte(PUSH1), 0xbb, byte(EXTCODESIZE), byte(POP),
+		byte(PUSH1), 0xbb, byte(EXTCODEHASH), byte(POP),
+		byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0xcc, byte(EXTCODECOPY),
+		byte(PUSH1), 0xcc, byte(EXTCODESIZE), byte(POP),
+	})
+	if _, _, err := vmenv.Call(AccountRef(common.Address{}), contract, nil, 100000, new(uint256.Int), false /* bailout */); err != nil {
+		t.Fatal(err)
+	}
+	want := []codeAccessRecord{
+		{2, EXTCODESIZE, first, true},
+		{6, EXTCODEHASH, first, false},
+		{16, EXTCODECOPY, second, true},
+		{19, EXTCODESIZE, second, false},
+	}
+	if len(tracer.records) != len(want) {
+		t.Fatalf("expected %d accesses, got %d", len(want), len(tracer.records))
+	}
+	// The cold flag must agree with the gas that was charged
+	costs := make(map[uint64]uint64)
+	for _, log := range tracer.StructLogs() {
+		costs[log.Pc] = log.GasCost
+	}
+	for i, w := range want {
+		if got := tracer.records[i]; got != w {
+			t.Errorf("access %d: expected %+v, got %+v", i, w, got)
+		}
+		wantCost := params.WarmStorageReadCostEIP2929
+		if w.cold {
+			wantCost = params.ColdAccountAccessCostEIP2929
+		}
+		if costs[w.pc] != wantCost {
+			t.Errorf("access %d: expected cost %d, got %d", i, wantCost, costs[w.pc])
+		}
+	}
+}
+
+type writeProtectionRecord struct {
+	depth int
+	pc    uint64
+	op    OpCode
+	addr  common.Address
+}
+
+type testWriteProtectionTracer struct {
+	*StructLogger
+	records []writeProtectionRecord
+}
+
+func (wt *testWriteProtectionTracer) CaptureWriteProtection(depth int, pc uint64, op OpCode, addr common.Address) {
+	wt.records = append(wt.records, writeProtectionRecord{depth, pc, op, addr})
+}
+
+func TestWriteProtectionTracer(t *testing.T) {
+	var (
+		outer = common.HexToAddress("0xaa")
+		inner = common.HexToAddress("0xbb")
+	)
+	tests := []struct {
+		code []byte
+		op   OpCode
+	}{
+		{[]byte{byte(PUSH1), 1, byte(PUSH1), 0, byte(SSTORE)}, SSTORE},
+		{[]byte{byte(PUSH1), 0, byte(PUSH1), 0, byte(LOG0)}, LOG0},
+		{[]byte{byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(CREATE)}, CREATE},
+		{[]byte{byte(PUSH1), 0xaa, byte(SELFDESTRUCT)}, SELFDESTRUCT},
+		{[]byte{byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 1, byte(PUSH1), 0xaa, byte(GAS), byte(CALL)}, CALL},
+	}
+	for i, tt := range tests {
+		tracer := &testWriteProtectionTracer{StructLogger: NewStructLogger(nil)}
+		vmenv, s := newTestEVM(t, Config{Debug: true, Tracer: tracer})
+		// STATICCALL(gas, 0xbb, 0, 0, 0, 0)
+		s.SetCode(outer, []byte{byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0xbb, byte(GAS), byte(STATICCALL)})
+		s.SetCode(inner, tt.code)
+		s.AddBalance(inner, uint256.NewInt(1))
+		if _, _, err := vmenv.Call(AccountRef(common.Address{}), outer, nil, 1000000, new(uint256.Int), false /* bailout */); err != nil {
+			t.Fatalf("test %d: %v", i, err)
+		}
+		want := writeProtectionRecord{2, uint64(len(tt.code) - 1), tt.op, inner}
+		if len(tracer.records) != 1 || tracer.records[0] != want {
+			t.Errorf("test %d: expected %+v, got %+v", i, want, tracer.records)
+		}
+		// The faulting step is the last one of the inner frame
+		var fault *StructLog
+		for j := range tracer.StructLogs() {
+			if log := &tracer.StructLogs()[j]; log.Depth == 2 {
+				fault = log
+			}
+		}
+		if fault == nil || fault.Op != tt.op || !errors.Is(fault.Err, ErrWriteProtection) {
+			t.Errorf("test %d: unexpected faulting step %+v", i, fault)
+		}
+	}
+}
+
+type jumpRecord struct {
+	depth                     int
+	from, to                  uint64
+	conditional, taken, valid bool
+}
+
+type testJumpTracer struct {
+	*StructLogger
+	records []jumpRecord
+}
+
+func (jt *testJumpTracer) CaptureJump(depth int, from, to uint64, conditional, taken, valid bool) {
+	jt.records = append(jt.records, jumpRecord{depth, from, to, conditional, taken, valid})
+}
+
+func TestJumpTracer(t *testing.T) {
+	contract := common.HexToAddress("0xaa")
+	code := []byte{
+		byte(PUSH1), 0, byte(PUSH1), 9, byte(JUMPI), // not taken
+		byte(PUSH1), 9, byte(JUMP),
+		byte(STOP),
+		byte(JUMPDEST), byte(PUSH1), 1, byte(PUSH1), 17, byte(JUMPI), // taken
+		byte(STOP), byte(STOP),
+		byte(JUMPDEST), byte(PUSH1), 3, byte(JUMP), // into PUSH data
+	}
+	tracer := &testJumpTracer{StructLogger: NewStructLogger(nil)}
+	vmenv, s := newTestEVM(t, Config{Debug: true, Tracer: tracer})
+	s.SetCode(contract, code)
+	if _, _, err := vmenv.Call(AccountRef(common.Address{}), contract, nil, 100000, new(uint256.Int), false /* bailout */); !errors.Is(err, ErrInvalidJump) {
+		t.Fatalf("expected an invalid jump, got %v", err)
+	}
+	want := []jumpRecord{
+		{1, 4, 9, true, false, true},
+		{1, 7, 9, false, true, true},
+		{1, 14, 17, true, true, true},
+		{1, 20, 3, false, true, false},
+	}
+	if !reflect.DeepEqual(tracer.records, want) {
+		t.Errorf("expected %+v, got %+v", want, tracer.records)
+	}
+}
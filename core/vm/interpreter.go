@@ -20,12 +20,19 @@ import (
 	"hash"
 	"sync/atomic"
 
+	"github.com/holiman/uint256"
+
 	"github.com/ledgerwatch/erigon/common"
 	"github.com/ledgerwatch/erigon/common/math"
 	"github.com/ledgerwatch/erigon/core/vm/stack"
+	"github.com/ledgerwatch/erigon/params"
 	"github.com/ledgerwatch/log/v3"
 )
 
+// ctxPollInterval is the number of opcodes between two checks of the context
+// set with EVM.SetContext.
+const ctxPollInterval = 4096
+
 // Config are the configuration options for the Interpreter
 type Config struct {
 	Debug         bool   // Enables debugging
@@ -37,7 +44,105 @@ type Config struct {
 	NoReceipts    bool   // Do not calculate receipts
 	ReadOnly      bool   // Do no perform any block finalisation
 
+	EnableOpcodeStats bool   // Count executed opcodes, see EVM.OpcodeStats
+	EnableStackStats  bool   // Report the highest stack of every frame to a StackHeightTracer, only honoured together with Debug
+	MaxCallDepth      int    // Lowers the call depth limit below params.CallCreateDepth (0 = protocol default)
+	SstoreSentryGas   uint64 // Replaces the EIP-2200 SSTORE sentry of params.SstoreSentryGasEIP2200 (0 = protocol default). NOT SAFE FOR CONSENSUS
+
+	// StepLimit aborts the execution with ErrStepLimitReached once that many
+	// opcodes have run in a top-level call, nested frames included (0 = no
+	// limit). It bounds traces of code looping with plenty of gas.
+	StepLimit uint64
+
+	// MaxMemorySize aborts the execution with ErrMemoryLimit before a frame's
+	// memory is expanded beyond that many bytes (0 = no limit). It protects
+	// the host from untrusted code with enough gas to allocate gigabytes.
+	MaxMemorySize uint64
+
+	// TimeSteps makes the StructLogger record the time from each step to the
+	// next one in StructLog.Duration, for profiling the interpreter. The time
+	// spent in the tracer is included.
+	TimeSteps bool
+
+	// OpCodeNames overrides the opcode names reported by the StructLogger, the
+	// JSON and EIP-3155 loggers.
+	OpCodeNames OpCodeNames
+
+	// FocusAddress, if set, limits CaptureState and CaptureFault to the frames
+	// running against that address, DELEGATECALLs made by it included. The
+	// other frames are executed as usual and are still entered and exited.
+	FocusAddress *common.Address
+
+	// Breakpoints halts the execution with ErrBreakpoint when the code of the
+	// given address is about to run the opcode at one of the set PCs. The
+	// step is reported to the tracer with the error and the stack and memory
+	// as they are, before the frames are unwound and reverted as failed.
+	Breakpoints map[common.Address]map[uint64]bool
+
+	// Precompiles adds precompiled contracts to those of the fork, or replaces
+	// them at the same addresses, for chains with precompiles of their own.
+	// Their addresses are warm in the access list, see ActivePrecompilesWith.
+	Precompiles map[common.Address]PrecompiledContract
+
+	// ForceReadOnly runs every frame as if it was entered with STATICCALL:
+	// state modifications fail with ErrWriteProtection, and so do top-level
+	// creations and value transfers.
+	ForceReadOnly bool
+
+	// MaxTraceOutputSize caps the length of the call outputs and return data
+	// recorded by tracers (0 = no limit). Execution itself is not affected.
+	MaxTraceOutputSize int
+
+	// NoGasMetering makes the interpreter skip gas deduction and out-of-gas
+	// checks, while still evaluating the gas functions so tracers see the
+	// costs. Only honoured together with Debug. NOT SAFE FOR CONSENSUS.
+	NoGasMetering bool
+
+	// CaptureMemory, if set, is called for every MLOAD, MSTORE and MSTORE8 and
+	// for the memory region written by CALLDATACOPY, CODECOPY, EXTCODECOPY and
+	// RETURNDATACOPY. data aliases the interpreter memory and must be copied if
+	// retained. It is independent of Debug, depth and pc match CaptureState.
+	CaptureMemory func(depth int, pc uint64, offset, size uint64, data []byte, isWrite bool)
+
+	// AdjustGas, if set, is given the gas available to the current frame before
+	// every opcode and returns the gas to continue with, for sensitivity
+	// analysis. Only honoured together with Debug, tracers see the adjusted
+	// value. NOT SAFE FOR CONSENSUS: the resulting gas usage and receipts are
+	// invalid.
+	AdjustGas func(pc uint64, op OpCode, available uint64) uint64
+
+	// SkipInvalidOpcodes makes the interpreter step over undefined opcodes,
+	// INVALID (0xfe) included, as no-ops costing no gas instead of failing the
+	// frame, for reachability analysis of fuzzed code. They are reported to an
+	// InvalidOpcodeTracer either way. Only honoured together with Debug. NOT
+	// SAFE FOR CONSENSUS.
+	SkipInvalidOpcodes bool
+
+	// ExtraGas, if set, returns gas the state transition charges up front
+	// along with the intrinsic gas, given the call data or init code of the
+	// transaction, for chains with costs outside of the EVM such as the L1
+	// data fee of L2s. It is reported apart in ExecutionResult.ExtraGas. nil
+	// keeps the mainnet gas model. NOT SAFE FOR CONSENSUS.
+	ExtraGas func(txCtx TxContext, data []byte) uint64
+
+	// InterceptCall, if set, is consulted before every sub-call made with
+	// CALL, CALLCODE, DELEGATECALL or STATICCALL, given the address whose code
+	// would run and the input. When it returns handled, the code is not run
+	// and the call returns output, charging gasUsed from the gas passed to it.
+	// A non-nil err fails the call: ErrExecutionReverted reverts it with
+	// output as the revert data, other errors consume all the gas as usual.
+	// Only honoured together with Debug, for mocking contracts in
+	// simulations. NOT SAFE FOR CONSENSUS.
+	InterceptCall func(addr common.Address, input []byte) (handled bool, output []byte, gasUsed uint64, err error)
+
 	ExtraEips []int // Additional EIPS that are to be enabled
+
+	// JumpTable, if set, replaces the instruction set derived from the chain
+	// rules. Gas accounting (constant, dynamic and memory expansion) and stack
+	// validation are still done by the interpreter from the table entries, and
+	// ExtraEips are applied on top of it. Tables failing validation are
+	// ignored in favour of the default one.
+	JumpTable *JumpTable
 }
 
 // Interpreter is used to run Ethereum based contracts and will utilise the
@@ -51,11 +156,84 @@ type Interpreter interface {
 }
 
 // ScopeContext contains the things that are per-call, such as stack and memory,
-// but not transients like pc and gas
+// but not transients like pc and gas. The exception is the gas breakdown of the
+// step being traced and the return data buffer, which the interpreter refreshes
+// before each CaptureState.
 type ScopeContext struct {
 	Memory   *Memory
 	Stack    *stack.Stack
 	Contract *Contract
+
+	DynamicGas   uint64 // dynamic portion of the current step's cost (memory expansion, SSTORE, calls etc.)
+	RefundChange int64  // change of the refund counter made by the current step's gas function
+	ColdAccess   bool   // whether the current step paid the EIP-2929 cold account or storage slot access cost
+	ReturnData   []byte // output of the last sub-call as seen by RETURNDATASIZE, nil when cleared
+
+	static bool // whether the frame runs in read-only mode
+}
+
+// StackLen returns the number of items on the stack.
+func (ctx *ScopeContext) StackLen() int {
+	return ctx.Stack.Len()
+}
+
+// StackBack returns the n'th item from the top of the stack, 0 being the top,
+// or nil if the stack is not that deep. The item is live: tracers must not
+// modify it.
+func (ctx *ScopeContext) StackBack(n int) *uint256.Int {
+	if n < 0 || n >= ctx.Stack.Len() {
+		return nil
+	}
+	return ctx.Stack.Back(n)
+}
+
+// CopyStackTop copies the topmost stack items into dst without allocating, see
+// stack.Stack.CopyTop.
+func (ctx *ScopeContext) CopyStackTop(dst []uint256.Int) int {
+	return ctx.Stack.CopyTop(dst)
+}
+
+// Address returns the address whose storage the current frame runs against,
+// which SLOAD and SSTORE access. It is the caller's for a DELEGATECALL or a
+// CALLCODE, see CodeAddress.
+func (ctx *ScopeContext) Address() common.Address {
+	return ctx.Contract.Address()
+}
+
+// CodeAddress returns the address the code of the current frame was loaded
+// from. It differs from Address for a DELEGATECALL or a CALLCODE, running the
+// code of a library against the caller's storage.
+func (ctx *ScopeContext) CodeAddress() common.Address {
+	if ctx.Contract.CodeAddr == nil {
+		return ctx.Contract.Address()
+	}
+	return *ctx.Contract.CodeAddr
+}
+
+// Caller returns the caller of the current frame, which is the caller's caller
+// for a DELEGATECALL.
+func (ctx *ScopeContext) Caller() common.Address {
+	return ctx.Contract.Caller()
+}
+
+// CallValue returns a copy of the value passed to the current frame.
+func (ctx *ScopeContext) CallValue() *uint256.Int {
+	if ctx.Contract.value == nil {
+		return new(uint256.Int)
+	}
+	return ctx.Contract.value.Clone()
+}
+
+// Static reports whether the current frame runs in read-only mode, either as
+// the target of a STATICCALL or as a frame nested below one.
+func (ctx *ScopeContext) Static() bool {
+	return ctx.static
+}
+
+// Input returns the call data of the current frame. The slice is live: tracers
+// must not modify it.
+func (ctx *ScopeContext) Input() []byte {
+	return ctx.Contract.Input
 }
 
 // keccakState wraps sha3.state. In addition to the usual hash methods, it also supports
@@ -88,32 +266,10 @@ type VM struct {
 
 // NewEVMInterpreter returns a new instance of the Interpreter.
 func NewEVMInterpreter(evm *EVM, cfg Config) *EVMInterpreter {
-	var jt *JumpTable
-	switch {
-	case evm.ChainRules().IsCancun:
-		jt = &cancunInstructionSet
-	case evm.ChainRules().IsShanghai:
-		jt = &shanghaiInstructionSet
-	case evm.ChainRules().IsLondon:
-		jt = &londonInstructionSet
-	case evm.ChainRules().IsBerlin:
-		jt = &berlinInstructionSet
-	case evm.ChainRules().IsIstanbul:
-		jt = &istanbulInstructionSet
-	case evm.ChainRules().IsConstantinople:
-		jt = &constantinopleInstructionSet
-	case evm.ChainRules().IsByzantium:
-		jt = &byzantiumInstructionSet
-	case evm.ChainRules().IsSpuriousDragon:
-		jt = &spuriousDragonInstructionSet
-	case evm.ChainRules().IsTangerineWhistle:
-		jt = &tangerineWhistleInstructionSet
-	case evm.ChainRules().IsHomestead:
-		jt = &homesteadInstructionSet
-	default:
-		jt = &frontierInstructionSet
-	}
+	jt := overrideJumpTable(instructionSetForRules(evm.ChainRules()), cfg)
 	if len(cfg.ExtraEips) > 0 {
+		// Don't pollute the shared fork tables with the extra EIPs
+		jt = copyJumpTable(jt)
 		for i, eip := range cfg.ExtraEips {
 			if err := EnableEIP(eip, jt); err != nil {
 				// Disable it, so caller can check if it's activated or not
@@ -133,32 +289,10 @@ func NewEVMInterpreter(evm *EVM, cfg Config) *EVMInterpreter {
 }
 
 func NewEVMInterpreterByVM(vm *VM) *EVMInterpreter {
-	var jt *JumpTable
-	switch {
-	case vm.evm.ChainRules().IsCancun:
-		jt = &cancunInstructionSet
-	case vm.evm.ChainRules().IsShanghai:
-		jt = &shanghaiInstructionSet
-	case vm.evm.ChainRules().IsLondon:
-		jt = &londonInstructionSet
-	case vm.evm.ChainRules().IsBerlin:
-		jt = &berlinInstructionSet
-	case vm.evm.ChainRules().IsIstanbul:
-		jt = &istanbulInstructionSet
-	case vm.evm.ChainRules().IsConstantinople:
-		jt = &constantinopleInstructionSet
-	case vm.evm.ChainRules().IsByzantium:
-		jt = &byzantiumInstructionSet
-	case vm.evm.ChainRules().IsSpuriousDragon:
-		jt = &spuriousDragonInstructionSet
-	case vm.evm.ChainRules().IsTangerineWhistle:
-		jt = &tangerineWhistleInstructionSet
-	case vm.evm.ChainRules().IsHomestead:
-		jt = &homesteadInstructionSet
-	default:
-		jt = &frontierInstructionSet
-	}
+	jt := overrideJumpTable(instructionSetForRules(vm.evm.ChainRules()), vm.cfg)
 	if len(vm.cfg.ExtraEips) > 0 {
+		// Don't pollute the shared fork tables with the extra EIPs
+		jt = copyJumpTable(jt)
 		for i, eip := range vm.cfg.ExtraEips {
 			if err := EnableEIP(eip, jt); err != nil {
 				// Disable it, so caller can check if it's activated or not
@@ -174,6 +308,75 @@ func NewEVMInterpreterByVM(vm *VM) *EVMInterpreter {
 	}
 }
 
+// swapRules switches the chain rules and the instruction set to the given
+// rules, returning a function switching back to the previous ones.
+func (in *EVMInterpreter) swapRules(rules *params.Rules) func() {
+	prevRules, prevJT, unswapped := in.evm.chainRules, in.jt, in.evm.unswappedRules
+	if unswapped == nil {
+		in.evm.unswappedRules = prevRules
+	}
+	jt := overrideJumpTable(instructionSetForRules(rules), in.cfg)
+	if len(in.cfg.ExtraEips) > 0 {
+		// The extra EIPs were already checked by NewEVMInterpreter
+		jt = copyJumpTable(jt)
+		for _, eip := range in.cfg.ExtraEips {
+			_ = EnableEIP(eip, jt)
+		}
+	}
+	in.evm.chainRules, in.jt = rules, jt
+	return func() {
+		in.evm.chainRules, in.jt, in.evm.unswappedRules = prevRules, prevJT, unswapped
+	}
+}
+
+// captureMemory reports an access to the memory region [offset, offset+size)
+// to Config.CaptureMemory.
+func (in *EVMInterpreter) captureMemory(pc uint64, mem *Memory, offset, size uint64, isWrite bool) {
+	in.cfg.CaptureMemory(in.evm.depth, pc, offset, size, mem.GetPtr(offset, size), isWrite)
+}
+
+// captureCodeAccess reports the account inspected by EXTCODESIZE, EXTCODEHASH
+// or EXTCODECOPY to a CodeAccessTracer.
+func (in *EVMInterpreter) captureCodeAccess(pc uint64, op OpCode, addr common.Address) {
+	if tracer, ok := in.cfg.Tracer.(CodeAccessTracer); ok {
+		tracer.CaptureCodeAccess(in.evm.depth, pc, op, addr, in.evm.coldAccess)
+	}
+}
+
+// captureJump reports a JUMP or JUMPI to dest to a JumpTracer.
+func (in *EVMInterpreter) captureJump(pc uint64, contract *Contract, dest *uint256.Int, conditional, taken bool) {
+	tracer, ok := in.cfg.Tracer.(JumpTracer)
+	if !ok {
+		return
+	}
+	to, overflow := dest.Uint64WithOverflow()
+	if overflow {
+		to = math.MaxUint64
+	}
+	valid, _ := contract.validJumpdest(dest)
+	tracer.CaptureJump(in.evm.depth, pc, to, conditional, taken, valid)
+}
+
+// captureBlockHash reports a BLOCKHASH to a BlockHashTracer.
+func (in *EVMInterpreter) captureBlockHash(pc uint64, number uint64, hash common.Hash) {
+	if tracer, ok := in.cfg.Tracer.(BlockHashTracer); ok {
+		tracer.CaptureBlockHash(in.evm.depth, pc, number, hash)
+	}
+}
+
+// overrideJumpTable returns the custom instruction set from the config if it is
+// set and valid, or the fork-derived default otherwise.
+func overrideJumpTable(jt *JumpTable, cfg Config) *JumpTable {
+	if cfg.JumpTable == nil {
+		return jt
+	}
+	if err := cfg.JumpTable.validate(); err != nil {
+		log.Error("Custom jump table rejected", "err", err)
+		return jt
+	}
+	return cfg.JumpTable
+}
+
 // Run loops and evaluates the contract's code with the given input data and returns
 // the return byte-slice and an error if one occurred.
 //
@@ -187,11 +390,25 @@ func (in *EVMInterpreter) Run(contract *Contract, input []byte, readOnly bool) (
 
 	// Make sure the readOnly is only set if we aren't in readOnly yet.
 	// This makes also sure that the readOnly flag isn't removed for child calls.
-	callback := in.setReadonly(readOnly)
+	callback := in.setReadonly(readOnly || in.cfg.ForceReadOnly)
 	defer func() {
 		callback()
 	}()
 
+	// Frames started after SwapChainRules run under the new rules
+	if rules := in.evm.frameRules; rules != nil && rules != in.evm.chainRules {
+		defer in.swapRules(rules)()
+	}
+
+	// The step limit and breakpoints apply to the whole top-level call
+	if in.evm.depth == 1 {
+		in.evm.steps = 0
+		in.evm.breakpointHit = false
+	}
+	if in.evm.ctx != nil && in.evm.ctx.Err() != nil {
+		return nil, ErrExecutionCancelled
+	}
+
 	// Reset the previous call's return data. It's unimportant to preserve the old buffer
 	// as every returning call will return new data anyway.
 	in.returnData = nil
@@ -201,14 +418,34 @@ func (in *EVMInterpreter) Run(contract *Contract, input []byte, readOnly bool) (
 		return nil, nil
 	}
 
+	var op OpCode // current opcode, the last one tells how the frame halted
+	if in.cfg.Debug {
+		if tracer, ok := in.cfg.Tracer.(HaltTracer); ok {
+			defer func() {
+				if err != ErrPaused {
+					tracer.CaptureHalt(in.evm.depth, haltReason(op, err), ret)
+				}
+			}()
+		}
+	}
+	var maxStack int // highest stack of the frame, see Config.EnableStackStats
+	if in.cfg.Debug && in.cfg.EnableStackStats {
+		if tracer, ok := in.cfg.Tracer.(StackHeightTracer); ok {
+			defer func() {
+				if err != ErrPaused {
+					tracer.CaptureStackHeight(in.evm.depth, maxStack)
+				}
+			}()
+		}
+	}
 	var (
-		op          OpCode        // current opcode
 		mem         = NewMemory() // bound memory
 		locStack    = stack.New()
 		callContext = &ScopeContext{
 			Memory:   mem,
 			Stack:    locStack,
 			Contract: contract,
+			static:   in.readOnly,
 		}
 		// For optimisation reason we're using uint64 as the program counter.
 		// It's theoretically possible to go above 2^64. The YP defines the PC
@@ -220,7 +457,20 @@ func (in *EVMInterpreter) Run(contract *Contract, input []byte, readOnly bool) (
 		gasCopy uint64 // for Tracer to log gas remaining before execution
 		logged  bool   // deferred Tracer should ignore already logged steps
 		res     []byte // result of the opcode execution function
+		// gas is not deducted when tracing with NoGasMetering
+		metered = !(in.cfg.Debug && in.cfg.NoGasMetering)
+		// steps are only reported while running the focused contract, if any
+		traceSteps = in.cfg.Debug && (in.cfg.FocusAddress == nil || contract.Address() == *in.cfg.FocusAddress)
+		// breakpoints set in the running code
+		breakpoints map[uint64]bool
 	)
+	if in.cfg.Breakpoints != nil {
+		codeAddr := contract.Address()
+		if contract.CodeAddr != nil {
+			codeAddr = *contract.CodeAddr
+		}
+		breakpoints = in.cfg.Breakpoints[codeAddr]
+	}
 	// Don't move this deferrred function, it's placed before the capturestate-deferred method,
 	// so that it get's executed _after_: the capturestate needs the stacks before
 	// they are returned to the pools
@@ -228,10 +478,19 @@ func (in *EVMInterpreter) Run(contract *Contract, input []byte, readOnly bool) (
 		stack.ReturnNormalStack(locStack)
 	}()
 	contract.Input = input
+	if st := in.evm.resumed; st != nil {
+		in.evm.resumed = nil
+		pc = st.restore(in, callContext)
+	}
 
-	if in.cfg.Debug {
+	if in.headless() {
+		return in.runHeadless(pc, contract, callContext)
+	}
+
+	if traceSteps {
 		defer func() {
-			if err != nil {
+			if err != nil && err != ErrPaused {
+				callContext.ReturnData = in.returnData
 				if !logged {
 					in.cfg.Tracer.CaptureState(in.evm, pcCopy, op, gasCopy, cost, callContext, in.returnData, in.evm.depth, err) //nolint:errcheck
 				} else {
@@ -254,13 +513,47 @@ func (in *EVMInterpreter) Run(contract *Contract, input []byte, readOnly bool) (
 			// Capture pre-execution values for tracing.
 			logged, pcCopy, gasCopy = false, pc, contract.Gas
 		}
+		if in.evm.pauseRequested && in.evm.depth == 1 && !in.evm.deploying {
+			in.evm.pauseRequested = false
+			in.evm.paused = in.exportState(pc, callContext)
+			return nil, ErrPaused
+		}
 
 		// Get the operation from the jump table and validate the stack to ensure there are
 		// enough stack items available to perform the operation.
 		op = contract.GetOp(pc)
 		operation := in.jt[op]
 
+		// Once a breakpoint is hit, the frames above it halt as well
+		if breakpoints[pc] {
+			in.evm.breakpointHit = true
+		}
+		if in.evm.breakpointHit {
+			return nil, ErrBreakpoint
+		}
+
+		if in.cfg.Debug && in.cfg.AdjustGas != nil {
+			contract.Gas = in.cfg.AdjustGas(pc, op, contract.Gas)
+			gasCopy = contract.Gas
+		}
+		if in.cfg.StepLimit != 0 && in.evm.steps >= in.cfg.StepLimit {
+			return nil, ErrStepLimitReached
+		}
+		in.evm.steps++
+		if in.evm.steps%ctxPollInterval == 0 && in.evm.ctx != nil && in.evm.ctx.Err() != nil {
+			return nil, ErrExecutionCancelled
+		}
+
 		if operation == nil {
+			if in.cfg.Debug {
+				if tracer, ok := in.cfg.Tracer.(InvalidOpcodeTracer); ok {
+					tracer.CaptureInvalidOpcode(in.evm.depth, pc, op, in.cfg.SkipInvalidOpcodes)
+				}
+				if in.cfg.SkipInvalidOpcodes {
+					pc++
+					continue
+				}
+			}
 			return nil, &ErrInvalidOpCode{opcode: op}
 		}
 		// Validate stack
@@ -277,12 +570,20 @@ func (in *EVMInterpreter) Run(contract *Contract, input []byte, readOnly bool) (
 			// account to the others means the state is modified and should also
 			// return with an error.
 			if operation.writes || (op == CALL && !locStack.Back(2).IsZero()) {
+				if in.cfg.Debug {
+					if tracer, ok := in.cfg.Tracer.(WriteProtectionTracer); ok {
+						tracer.CaptureWriteProtection(in.evm.depth, pc, op, contract.Address())
+					}
+				}
 				return nil, ErrWriteProtection
 			}
 		}
 		// Static portion of gas
 		cost = operation.constantGas // For tracing
-		if !contract.UseGas(operation.constantGas) {
+		callContext.DynamicGas = 0
+		callContext.RefundChange = 0
+		callContext.ColdAccess = false
+		if metered && !contract.UseGas(operation.constantGas) {
 			return nil, ErrOutOfGas
 		}
 
@@ -301,15 +602,30 @@ func (in *EVMInterpreter) Run(contract *Contract, input []byte, readOnly bool) (
 			if memorySize, overflow = math.SafeMul(toWordSize(memSize), 32); overflow {
 				return nil, ErrGasUintOverflow
 			}
+			if in.cfg.MaxMemorySize != 0 && memorySize > in.cfg.MaxMemorySize && memorySize > uint64(mem.Len()) {
+				return nil, ErrMemoryLimit
+			}
 		}
 		// Dynamic portion of gas
 		// consume the gas and return an error if not enough gas is available.
 		// cost is explicitly set so that the capture state defer method can get the proper cost
 		if operation.dynamicGas != nil {
-			var dynamicCost uint64
+			var (
+				dynamicCost  uint64
+				refundBefore uint64
+			)
+			if in.cfg.Debug {
+				refundBefore = in.evm.IntraBlockState().GetRefund()
+			}
+			in.evm.coldAccess = false
 			dynamicCost, err = operation.dynamicGas(in.evm, contract, locStack, mem, memorySize)
 			cost += dynamicCost // total cost, for debug tracing
-			if err != nil || !contract.UseGas(dynamicCost) {
+			callContext.DynamicGas = dynamicCost
+			callContext.ColdAccess = in.evm.coldAccess
+			if in.cfg.Debug {
+				callContext.RefundChange = int64(in.evm.IntraBlockState().GetRefund() - refundBefore)
+			}
+			if err != nil || (metered && !contract.UseGas(dynamicCost)) {
 				return nil, ErrOutOfGas
 			}
 		}
@@ -317,13 +633,21 @@ func (in *EVMInterpreter) Run(contract *Contract, input []byte, readOnly bool) (
 			mem.Resize(memorySize)
 		}
 
-		if in.cfg.Debug {
+		if traceSteps {
+			callContext.ReturnData = in.returnData
 			in.cfg.Tracer.CaptureState(in.evm, pc, op, gasCopy, cost, callContext, in.returnData, in.evm.depth, err) //nolint:errcheck
 			logged = true
 		}
 
+		if in.cfg.EnableOpcodeStats {
+			in.evm.opcodeStats[op]++
+		}
+
 		// execute the operation
 		res, err = operation.execute(&pc, in, callContext)
+		if in.cfg.EnableStackStats && locStack.Len() > maxStack {
+			maxStack = locStack.Len()
+		}
 		// if the operation clears the return data (e.g. it has returning data)
 		// set the last return to the result of the operation.
 		if operation.returns {
@@ -344,6 +668,91 @@ func (in *EVMInterpreter) Run(contract *Contract, input []byte, readOnly bool) (
 	return nil, nil
 }
 
+// headless tells whether none of the tracing or debugging options checked by
+// the main loop of Run are set, so that runHeadless can be used instead.
+func (in *EVMInterpreter) headless() bool {
+	return !in.cfg.Debug && in.cfg.Breakpoints == nil && in.cfg.StepLimit == 0 && in.cfg.MaxMemorySize == 0 && !in.cfg.EnableOpcodeStats
+}
+
+// runHeadless is the main loop of Run without the tracing and debugging
+// options, which are all off, starting at pc. It must behave exactly like the
+// full loop does in that case, and be kept in sync with it, which
+// TestHeadlessRun checks the options of.
+func (in *EVMInterpreter) runHeadless(pc uint64, contract *Contract, callContext *ScopeContext) ([]byte, error) {
+	var (
+		mem      = callContext.Memory
+		locStack = callContext.Stack
+		steps    = 0
+	)
+	for {
+		steps++
+		if steps%1000 == 0 && atomic.LoadInt32(&in.evm.abort) != 0 {
+			break
+		}
+		op := contract.GetOp(pc)
+		operation := in.jt[op]
+
+		in.evm.steps++
+		if in.evm.steps%ctxPollInterval == 0 && in.evm.ctx != nil && in.evm.ctx.Err() != nil {
+			return nil, ErrExecutionCancelled
+		}
+		if operation == nil {
+			return nil, &ErrInvalidOpCode{opcode: op}
+		}
+		if sLen := locStack.Len(); sLen < operation.minStack {
+			return nil, &ErrStackUnderflow{stackLen: sLen, required: operation.minStack}
+		} else if sLen > operation.maxStack {
+			return nil, &ErrStackOverflow{stackLen: sLen, limit: operation.maxStack}
+		}
+		if in.readOnly && in.evm.ChainRules().IsByzantium {
+			if operation.writes || (op == CALL && !locStack.Back(2).IsZero()) {
+				return nil, ErrWriteProtection
+			}
+		}
+		if !contract.UseGas(operation.constantGas) {
+			return nil, ErrOutOfGas
+		}
+
+		var memorySize uint64
+		if operation.memorySize != nil {
+			memSize, overflow := operation.memorySize(locStack)
+			if overflow {
+				return nil, ErrGasUintOverflow
+			}
+			if memorySize, overflow = math.SafeMul(toWordSize(memSize), 32); overflow {
+				return nil, ErrGasUintOverflow
+			}
+		}
+		if operation.dynamicGas != nil {
+			in.evm.coldAccess = false
+			dynamicCost, err := operation.dynamicGas(in.evm, contract, locStack, mem, memorySize)
+			if err != nil || !contract.UseGas(dynamicCost) {
+				return nil, ErrOutOfGas
+			}
+		}
+		if memorySize > 0 {
+			mem.Resize(memorySize)
+		}
+
+		res, err := operation.execute(&pc, in, callContext)
+		if operation.returns {
+			in.returnData = res
+		}
+
+		switch {
+		case err != nil:
+			return nil, err
+		case operation.reverts:
+			return res, ErrExecutionReverted
+		case operation.halts:
+			return res, nil
+		case !operation.jumps:
+			pc++
+		}
+	}
+	return nil, nil
+}
+
 func (vm *VM) setReadonly(outerReadonly bool) func() {
 	if outerReadonly && !vm.readOnly {
 		vm.readOnly = true
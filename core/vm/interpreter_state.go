@@ -0,0 +1,163 @@
+package vm
+
+import (
+	"math/big"
+	"time"
+
+	"github.com/holiman/uint256"
+
+	"github.com/ledgerwatch/erigon/common"
+	"github.com/ledgerwatch/erigon/common/hexutil"
+	"github.com/ledgerwatch/erigon/crypto"
+)
+
+// InterpreterState is a snapshot of the top-level call frame, taken when it is
+// paused with EVM.Pause, from which EVM.Resume carries on with the execution.
+// It holds everything the interpreter needs for the frame and can be encoded
+// to JSON in between, while the state changes made so far are kept by the
+// IntraBlockState. The code hash is checked against the code on resuming, as
+// the JUMPDEST analysis of the EVM is cached by code hash.
+type InterpreterState struct {
+	Caller   common.Address `json:"caller"`
+	Address  common.Address `json:"address"`  // address whose storage the frame runs against
+	CodeAddr common.Address `json:"codeAddr"` // address the code was loaded from
+	Value    *hexutil.Big   `json:"value"`
+	Input    hexutil.Bytes  `json:"input"`
+	Code     hexutil.Bytes  `json:"code"`
+	CodeHash common.Hash    `json:"codeHash"`
+	ReadOnly bool           `json:"readOnly,omitempty"`
+
+	Depth      int            `json:"depth"`
+	PC         uint64         `json:"pc"`    // of the opcode to run next
+	Gas        uint64         `json:"gas"`   // left before that opcode
+	Stack      []*hexutil.Big `json:"stack"` // bottom first
+	Memory     hexutil.Bytes  `json:"memory"`
+	ReturnData hexutil.Bytes  `json:"returnData"`
+	Steps      uint64         `json:"steps"` // opcodes run so far, for Config.StepLimit
+}
+
+// exportState takes the snapshot of the frame about to run the opcode at pc.
+func (in *EVMInterpreter) exportState(pc uint64, scope *ScopeContext) *InterpreterState {
+	contract := scope.Contract
+	st := &InterpreterState{
+		Caller:     contract.Caller(),
+		Address:    contract.Address(),
+		CodeAddr:   *contract.CodeAddr,
+		Value:      (*hexutil.Big)(scope.CallValue().ToBig()),
+		Input:      common.CopyBytes(contract.Input),
+		Code:       common.CopyBytes(contract.Code),
+		CodeHash:   contract.CodeHash,
+		ReadOnly:   in.readOnly,
+		Depth:      in.evm.depth,
+		PC:         pc,
+		Gas:        contract.Gas,
+		Stack:      make([]*hexutil.Big, scope.Stack.Len()),
+		Memory:     common.CopyBytes(scope.Memory.Data()),
+		ReturnData: common.CopyBytes(in.returnData),
+		Steps:      in.evm.steps,
+	}
+	for i := range st.Stack {
+		st.Stack[i] = (*hexutil.Big)(scope.Stack.Data[i].ToBig())
+	}
+	if st.Memory == nil {
+		st.Memory = []byte{}
+	}
+	return st
+}
+
+// validate checks that the snapshot can be restored by the interpreter.
+func (st *InterpreterState) validate() error {
+	if st.Depth != 1 || len(st.Code) == 0 || len(st.Stack) > 1024 || len(st.Memory)%32 != 0 {
+		return ErrInvalidInterpreterState
+	}
+	if crypto.Keccak256Hash(st.Code) != st.CodeHash {
+		return ErrInvalidInterpreterState
+	}
+	if st.Value != nil && (*big.Int)(st.Value).BitLen() > 256 {
+		return ErrInvalidInterpreterState
+	}
+	for _, v := range st.Stack {
+		if v == nil || (*big.Int)(v).Sign() < 0 || (*big.Int)(v).BitLen() > 256 {
+			return ErrInvalidInterpreterState
+		}
+	}
+	return nil
+}
+
+// restore loads the stack, memory and return data of the snapshot into the
+// frame, returning the pc to continue from.
+func (st *InterpreterState) restore(in *EVMInterpreter, scope *ScopeContext) uint64 {
+	for _, v := range st.Stack {
+		item, _ := uint256.FromBig((*big.Int)(v))
+		scope.Stack.Push(item)
+	}
+	if size := uint64(len(st.Memory)); size > 0 {
+		scope.Memory.Resize(size)
+		scope.Memory.Set(0, size, st.Memory)
+	}
+	in.returnData = common.CopyBytes(st.ReturnData)
+	in.evm.steps = st.Steps
+	return st.PC
+}
+
+// Pause makes the top-level call frame stop before its next opcode, with
+// ErrPaused returned by the EVM method that started it and its state kept
+// for PausedState. It can be called by a tracer in CaptureState, to stop
+// after the step, or before the call. A pause requested while a sub-call or a
+// creation runs takes effect once the top-level frame is back, which makes
+// stepping over them. Creations can't be paused. It fails with
+// ErrPauseNotDebug outside of Debug mode.
+func (evm *EVM) Pause() error {
+	if !evm.config.Debug {
+		return ErrPauseNotDebug
+	}
+	evm.pauseRequested = true
+	return nil
+}
+
+// PausedState returns the snapshot of the top-level frame taken by the last
+// pause, or nil if it wasn't paused.
+func (evm *EVM) PausedState() *InterpreterState {
+	return evm.paused
+}
+
+// Resume continues the execution of a top-level frame from its snapshot, as
+// returned by PausedState, against an IntraBlockState holding the state
+// changes made before the pause. The results are those of the EVM method that
+// started the frame, had it not been paused, and it may be paused again.
+// Tracers see the resumed frame as a new top-level call. If the frame fails,
+// only the state changes made since the resume are reverted, the state
+// snapshots taken before the pause may not exist in the IntraBlockState
+// resumed on.
+func (evm *EVM) Resume(st *InterpreterState) (ret []byte, leftOverGas uint64, err error) {
+	if !evm.config.Debug {
+		return nil, 0, ErrPauseNotDebug
+	}
+	if err := st.validate(); err != nil {
+		return nil, 0, err
+	}
+	value, _ := uint256.FromBig((*big.Int)(st.Value))
+	if value == nil {
+		value = new(uint256.Int)
+	}
+	gas := st.Gas
+	evm.config.Tracer.CaptureStart(evm, evm.depth, st.Caller, st.Address, false /* precompile */, false /* create */, CALLT, st.Input, gas, value.ToBig(), st.Code)
+	defer func(startGas uint64, startTime time.Time) {
+		evm.config.Tracer.CaptureEnd(evm.depth, evm.traceOutput(ret), startGas, gas, time.Since(startTime), err)
+	}(gas, time.Now())
+
+	snapshot := evm.snapshot()
+	codeAddr := st.CodeAddr
+	contract := evm.newContract(AccountRef(st.Caller), AccountRef(st.Address), value, gas)
+	contract.SetCallCode(&codeAddr, st.CodeHash, common.CopyBytes(st.Code))
+	evm.paused, evm.resumed = nil, st
+	ret, err = run(evm, contract, common.CopyBytes(st.Input), st.ReadOnly)
+	gas = contract.Gas
+	if err != nil && err != ErrPaused {
+		evm.intraBlockState.RevertToSnapshot(snapshot)
+		if err != ErrExecutionReverted {
+			gas = 0
+		}
+	}
+	return ret, gas, err
+}
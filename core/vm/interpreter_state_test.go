@@ -0,0 +1,158 @@
+package vm
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/holiman/uint256"
+
+	"github.com/ledgerwatch/erigon/common"
+	"github.com/ledgerwatch/erigon/crypto"
+	"github.com/ledgerwatch/erigon/params"
+)
+
+// pausingTracer pauses the execution after every step.
+type pausingTracer struct {
+	*StructLogger
+	env *EVM
+}
+
+func (t *pausingTracer) CaptureState(env *EVM, pc uint64, op OpCode, gas, cost uint64, scope *ScopeContext, rData []byte, depth int, err error) {
+	t.StructLogger.CaptureState(env, pc, op, gas, cost, scope, rData, depth, err)
+	if err := t.env.Pause(); err != nil {
+		panic(err)
+	}
+}
+
+func TestPauseResume(t *testing.T) {
+	var (
+		outer = common.HexToAddress("0xaa")
+		inner = common.HexToAddress("0xbb")
+	)
+	if err := NewEVM(BlockContext{}, TxContext{}, nil, params.TestChainConfig, Config{}).Pause(); !errors.Is(err, ErrPauseNotDebug) {
+		t.Errorf("unexpected error %v outside of debug mode", err)
+	}
+	run := func(pause bool) (ret []byte, gas uint64, logs []StructLog, pauses int) {
+		logger := NewStructLogger(nil)
+		pausing := &pausingTracer{StructLogger: logger}
+		var tracer Tracer = logger
+		if pause {
+			tracer = pausing
+		}
+		vmenv, s := newTestEVM(t, Config{Debug: true, Tracer: tracer})
+		pausing.env = vmenv
+		// MSTORE(0, 42), loop SSTORE(0, SLOAD(0)+1) while below 3,
+		// CALL(gas, 0xbb, 0, 0, 0, 0, 0), RETURN(0, 32)
+		s.SetCode(outer, []byte{byte(PUSH1), 42, byte(PUSH1), 0, byte(MSTORE),
+			byte(JUMPDEST), byte(PUSH1), 0, byte(SLOAD), byte(PUSH1), 1, byte(ADD), byte(DUP1), byte(PUSH1), 0, byte(SSTORE),
+			byte(PUSH1), 3, byte(GT), byte(PUSH1), 5, byte(JUMPI),
+			byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0xbb, byte(GAS), byte(CALL), byte(POP),
+			byte(PUSH1), 32, byte(PUSH1), 0, byte(RETURN)})
+		// SSTORE(1, 7)
+		s.SetCode(inner, []byte{byte(PUSH1), 7, byte(PUSH1), 1, byte(SSTORE), byte(STOP)})
+		s.AddAddressToAccessList(outer)
+		s.AddAddressToAccessList(inner)
+
+		ret, gas, err := vmenv.Call(AccountRef(common.Address{}), outer, nil, 100000, new(uint256.Int), false /* bailout */)
+		for errors.Is(err, ErrPaused) {
+			pauses++
+			// Round-trip the snapshot through JSON, as a debugger would
+			enc, jsonErr := json.Marshal(vmenv.PausedState())
+			if jsonErr != nil {
+				t.Fatal(jsonErr)
+			}
+			var st InterpreterState
+			if jsonErr = json.Unmarshal(enc, &st); jsonErr != nil {
+				t.Fatal(jsonErr)
+			}
+			ret, gas, err = vmenv.Resume(&st)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, addr := range []common.Address{outer, inner} {
+			key, value := common.Hash{31: byte(i)}, uint256.Int{}
+			if s.GetState(addr, &key, &value); value.IsZero() {
+				t.Errorf("slot %d of %x not stored", i, addr)
+			}
+		}
+		return ret, gas, logger.StructLogs(), pauses
+	}
+	wantRet, wantGas, wantLogs, _ := run(false)
+	ret, gas, logs, pauses := run(true)
+
+	var outerSteps int
+	for _, log := range wantLogs {
+		if log.Depth == 1 {
+			outerSteps++
+		}
+	}
+	// Pauses requested in the callee take effect once it returns
+	if pauses != outerSteps-1 {
+		t.Errorf("have %d pauses, want %d", pauses, outerSteps-1)
+	}
+	if !reflect.DeepEqual(ret, wantRet) || gas != wantGas {
+		t.Errorf("have output %x and gas %d, want %x and %d", ret, gas, wantRet, wantGas)
+	}
+	if !reflect.DeepEqual(logs, wantLogs) {
+		t.Errorf("resumed trace differs from the uninterrupted one")
+	}
+}
+
+func TestResumeInvalidState(t *testing.T) {
+	var (
+		first  = common.HexToAddress("0xaa")
+		second = common.HexToAddress("0xbb")
+	)
+	pausing := &pausingTracer{StructLogger: NewStructLogger(nil)}
+	vmenv, s := newTestEVM(t, Config{Debug: true, Tracer: pausing})
+	pausing.env = vmenv
+	// JUMP(3), JUMPDEST, STOP
+	s.SetCode(first, []byte{byte(PUSH1), 3, byte(JUMP), byte(JUMPDEST), byte(STOP)})
+	// JUMP(7) over a PUSH1 whose operand is at pc 3, STOP, JUMPDEST, STOP
+	s.SetCode(second, []byte{byte(PUSH1), 7, byte(PUSH1), 0, byte(POP), byte(JUMP), byte(STOP), byte(JUMPDEST), byte(STOP)})
+	if _, _, err := vmenv.Call(AccountRef(common.Address{}), second, nil, 100000, new(uint256.Int), false /* bailout */); !errors.Is(err, ErrPaused) {
+		t.Fatalf("expected pause, got %v", err)
+	}
+	// A snapshot claiming the code hash of another contract is refused, and
+	// doesn't spoil the JUMPDEST analysis of that contract
+	st := *vmenv.PausedState()
+	st.CodeHash = crypto.Keccak256Hash(s.GetCode(first))
+	vmenv.setTracer(NewStructLogger(nil), true)
+	if _, _, err := vmenv.Resume(&st); !errors.Is(err, ErrInvalidInterpreterState) {
+		t.Errorf("unexpected error %v for a mismatching code hash", err)
+	}
+	if _, _, err := vmenv.Call(AccountRef(common.Address{}), first, nil, 100000, new(uint256.Int), false /* bailout */); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestResumeOnNewState(t *testing.T) {
+	contract := common.HexToAddress("0xaa")
+	// SSTORE(0, 1), REVERT(0, 0)
+	code := []byte{byte(PUSH1), 1, byte(PUSH1), 0, byte(SSTORE), byte(PUSH1), 0, byte(PUSH1), 0, byte(REVERT)}
+	pausing := &pausingTracer{StructLogger: NewStructLogger(nil)}
+	vmenv, s := newTestEVM(t, Config{Debug: true, Tracer: pausing})
+	pausing.env = vmenv
+	s.SetCode(contract, code)
+	s.AddAddressToAccessList(contract)
+	if _, _, err := vmenv.Call(AccountRef(common.Address{}), contract, nil, 100000, new(uint256.Int), false /* bailout */); !errors.Is(err, ErrPaused) {
+		t.Fatalf("expected pause, got %v", err)
+	}
+	st := vmenv.PausedState()
+
+	// The frame is resumed by another EVM, on a state without the snapshots
+	// of the first one
+	vmenv, s = newTestEVM(t, Config{Debug: true, Tracer: NewStructLogger(nil)})
+	s.SetCode(contract, code)
+	s.AddAddressToAccessList(contract)
+	if _, _, err := vmenv.Resume(st); !errors.Is(err, ErrExecutionReverted) {
+		t.Fatalf("unexpected error %v", err)
+	}
+	key, value := common.Hash{}, uint256.Int{}
+	if s.GetState(contract, &key, &value); !value.IsZero() {
+		t.Errorf("store not reverted")
+	}
+}
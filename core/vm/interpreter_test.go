@@ -0,0 +1,160 @@
+package vm
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/holiman/uint256"
+
+	"github.com/ledgerwatch/erigon/common"
+)
+
+// countingLoop counts from 0 to n with ADD, DUP1, GT and JUMPI.
+func countingLoop(n uint16) []byte {
+	return []byte{
+		byte(PUSH1), 0,
+		byte(JUMPDEST), // 2
+		byte(PUSH1), 1, byte(ADD),
+		byte(DUP1), byte(PUSH2), byte(n >> 8), byte(n), byte(GT),
+		byte(PUSH1), 2, byte(JUMPI),
+		byte(STOP),
+	}
+}
+
+// generalPath is a config without tracing that still runs the full loop of
+// Run, as any of the options checked in it does.
+var generalPath = Config{StepLimit: math.MaxUint64}
+
+func TestHeadlessRun(t *testing.T) {
+	var (
+		contract = common.HexToAddress("0xaa")
+		callee   = common.HexToAddress("0xbb")
+	)
+	// RETURN(0, 32) of the memory word 0x2a, from the callee
+	returner := []byte{byte(PUSH1), 0x2a, byte(PUSH1), 0, byte(MSTORE), byte(PUSH1), 32, byte(PUSH1), 0, byte(RETURN)}
+	for i, code := range [][]byte{
+		countingLoop(1000),
+		// SSTORE(1, 2), SSTORE(1, 0) for a refund, SLOAD(1)
+		{byte(PUSH1), 2, byte(PUSH1), 1, byte(SSTORE), byte(PUSH1), 0, byte(PUSH1), 1, byte(SSTORE), byte(PUSH1), 1, byte(SLOAD), byte(STOP)},
+		returner,
+		{byte(PUSH1), 0x2a, byte(PUSH1), 0, byte(MSTORE8), byte(PUSH1), 1, byte(PUSH1), 0, byte(REVERT)},
+		// CALL(gas, 0xbb, 0, 0, 0, 0, 0), RETURNDATACOPY(0, 0, 32), RETURN(0, 32)
+		{byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0xbb, byte(GAS), byte(CALL),
+			byte(PUSH1), 32, byte(PUSH1), 0, byte(PUSH1), 0, byte(RETURNDATACOPY), byte(PUSH1), 32, byte(PUSH1), 0, byte(RETURN)},
+		{byte(JUMPDEST), byte(PUSH1), 0, byte(JUMP)}, // out of gas
+		{byte(PUSH1), 3, byte(JUMP)},                 // invalid jump
+		{byte(ADD)},                                  // stack underflow
+		{0xfe},
+	} {
+		run := func(cfg Config) string {
+			vmenv, s := newTestEVM(t, cfg)
+			s.SetCode(contract, code)
+			s.SetCode(callee, returner)
+			s.AddAddressToAccessList(contract)
+			ret, gas, err := vmenv.Call(AccountRef(common.Address{}), contract, nil, 100000, new(uint256.Int), false /* bailout */)
+			var slot uint256.Int
+			key := common.BigToHash(uint256.NewInt(1).ToBig())
+			s.GetState(contract, &key, &slot)
+			return fmt.Sprintf("ret %x, gas %d, err %v, slot %v, refund %d", ret, gas, err, &slot, s.GetRefund())
+		}
+		if headless, general := run(Config{}), run(generalPath); headless != general {
+			t.Errorf("test %d: headless run differs:\nhave %s\nwant %s", i, headless, general)
+		}
+	}
+
+	// Whether each option of Config keeps Run off the headless loop. Options
+	// read by the full loop whatever Debug is must leave it, the others are
+	// only honoured in Debug mode, or outside of the loop.
+	leaves := map[string]bool{
+		"Debug":             true,
+		"StepLimit":         true,
+		"MaxMemorySize":     true,
+		"EnableOpcodeStats": true,
+		"Breakpoints":       true,
+
+		"Tracer":             false,
+		"NoRecursion":        false,
+		"NoBaseFee":          false,
+		"SkipAnalysis":       false,
+		"TraceJumpDest":      false,
+		"NoReceipts":         false,
+		"ReadOnly":           false,
+		"EnableStackStats":   false,
+		"MaxCallDepth":       false,
+		"SstoreSentryGas":    false,
+		"TimeSteps":          false,
+		"OpCodeNames":        false,
+		"FocusAddress":       false,
+		"Precompiles":        false,
+		"ForceReadOnly":      false,
+		"MaxTraceOutputSize": false,
+		"NoGasMetering":      false,
+		"CaptureMemory":      false,
+		"AdjustGas":          false,
+		"SkipInvalidOpcodes": false,
+		"ExtraGas":           false,
+		"InterceptCall":      false,
+		"ExtraEips":          false,
+		"JumpTable":          false,
+	}
+	typ := reflect.TypeOf(Config{})
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		want, ok := leaves[field.Name]
+		if !ok {
+			t.Errorf("Config.%s is not known to leave the headless loop or not, see runHeadless", field.Name)
+			continue
+		}
+		var cfg Config
+		value := reflect.ValueOf(&cfg).Elem().Field(i)
+		switch field.Type.Kind() {
+		case reflect.Bool:
+			value.SetBool(true)
+		case reflect.Int:
+			value.SetInt(1)
+		case reflect.Uint64:
+			value.SetUint(1)
+		case reflect.Ptr:
+			value.Set(reflect.New(field.Type.Elem()))
+		case reflect.Map:
+			value.Set(reflect.MakeMap(field.Type))
+		case reflect.Slice:
+			value.Set(reflect.MakeSlice(field.Type, 1, 1))
+		case reflect.Func:
+			value.Set(reflect.MakeFunc(field.Type, func([]reflect.Value) []reflect.Value { return nil }))
+		case reflect.Interface:
+			value.Set(reflect.ValueOf(NewStructLogger(nil)))
+		default:
+			t.Fatalf("Config.%s of unexpected kind %v", field.Name, field.Type.Kind())
+		}
+		in := &EVMInterpreter{VM: &VM{cfg: cfg}}
+		if in.headless() == want {
+			t.Errorf("Config.%s: headless %v", field.Name, !want)
+		}
+	}
+}
+
+func BenchmarkInterpreterLoop(b *testing.B) {
+	contract := common.HexToAddress("0xaa")
+	code := countingLoop(10000)
+	for _, bench := range []struct {
+		name string
+		cfg  Config
+	}{
+		{"headless", Config{}},
+		{"general", generalPath},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			vmenv, s := newTestEVM(b, bench.cfg)
+			s.SetCode(contract, code)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, _, err := vmenv.Call(AccountRef(common.Address{}), contract, nil, 10000000, new(uint256.Int), false /* bailout */); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
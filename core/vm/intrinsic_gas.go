@@ -0,0 +1,95 @@
+// Copyright 2014 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package vm
+
+import (
+	"math/bits"
+
+	"github.com/ledgerwatch/erigon/core/types"
+	"github.com/ledgerwatch/erigon/params"
+)
+
+// IntrinsicGas computes the 'intrinsic gas' for a message with the given data
+// under the given rules: the base cost of a call or creation, the calldata cost
+// (EIP-2028 from Istanbul) and, from Berlin, the access list cost (EIP-2930).
+func IntrinsicGas(data []byte, accessList types.AccessList, isContractCreation bool, rules params.Rules) (uint64, error) {
+	// Set the starting gas for the raw transaction
+	var gas uint64
+	if isContractCreation && rules.IsHomestead {
+		gas = params.TxGasContractCreation
+	} else {
+		gas = params.TxGas
+	}
+
+	// Auxiliary variables for overflow protection
+	var product, overflow uint64
+
+	// Bump the required gas by the amount of transactional data
+	if len(data) > 0 {
+		// Zero and non-zero bytes are priced differently
+		var nz uint64
+		for _, byt := range data {
+			if byt != 0 {
+				nz++
+			}
+		}
+		// Make sure we don't exceed uint64 for all data combinations
+		nonZeroGas := params.TxDataNonZeroGasFrontier
+		if rules.IsIstanbul {
+			nonZeroGas = params.TxDataNonZeroGasEIP2028
+		}
+
+		overflow, product = bits.Mul64(nz, nonZeroGas)
+		if overflow != 0 {
+			return 0, ErrGasUintOverflow
+		}
+		gas, overflow = bits.Add64(gas, product, 0)
+		if overflow != 0 {
+			return 0, ErrGasUintOverflow
+		}
+
+		z := uint64(len(data)) - nz
+		overflow, product = bits.Mul64(z, params.TxDataZeroGas)
+		if overflow != 0 {
+			return 0, ErrGasUintOverflow
+		}
+		gas, overflow = bits.Add64(gas, product, 0)
+		if overflow != 0 {
+			return 0, ErrGasUintOverflow
+		}
+	}
+	if accessList != nil && rules.IsBerlin {
+		overflow, product = bits.Mul64(uint64(len(accessList)), params.TxAccessListAddressGas)
+		if overflow != 0 {
+			return 0, ErrGasUintOverflow
+		}
+		gas, overflow = bits.Add64(gas, product, 0)
+		if overflow != 0 {
+			return 0, ErrGasUintOverflow
+		}
+
+		overflow, product = bits.Mul64(uint64(accessList.StorageKeys()), params.TxAccessListStorageKeyGas)
+		if overflow != 0 {
+			return 0, ErrGasUintOverflow
+		}
+		gas, overflow = bits.Add64(gas, product, 0)
+		if overflow != 0 {
+			return 0, ErrGasUintOverflow
+		}
+	}
+	return gas, nil
+}
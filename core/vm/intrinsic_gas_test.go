@@ -0,0 +1,49 @@
+package vm
+
+import (
+	"testing"
+
+	"github.com/ledgerwatch/erigon/common"
+	"github.com/ledgerwatch/erigon/core/types"
+	"github.com/ledgerwatch/erigon/params"
+)
+
+func TestIntrinsicGas(t *testing.T) {
+	var (
+		frontier = params.Rules{}
+		istanbul = params.Rules{IsHomestead: true, IsIstanbul: true}
+		berlin   = params.Rules{IsHomestead: true, IsIstanbul: true, IsBerlin: true}
+		list     = types.AccessList{
+			{Address: common.HexToAddress("0x01"), StorageKeys: []common.Hash{{0x01}, {0x02}}},
+			{Address: common.HexToAddress("0x02")},
+		}
+		listGas = 2*params.TxAccessListAddressGas + 2*params.TxAccessListStorageKeyGas
+	)
+	for i, tt := range []struct {
+		data       []byte
+		accessList types.AccessList
+		create     bool
+		rules      params.Rules
+		want       uint64
+	}{
+		{data: nil, rules: berlin, want: params.TxGas},
+		{data: nil, create: true, rules: berlin, want: params.TxGasContractCreation},
+		// Creations only cost more from Homestead
+		{data: nil, create: true, rules: frontier, want: params.TxGas},
+		{data: make([]byte, 10), rules: berlin, want: params.TxGas + 10*params.TxDataZeroGas},
+		{data: []byte{0, 1, 2}, rules: frontier, want: params.TxGas + params.TxDataZeroGas + 2*params.TxDataNonZeroGasFrontier},
+		{data: []byte{0, 1, 2}, rules: istanbul, want: params.TxGas + params.TxDataZeroGas + 2*params.TxDataNonZeroGasEIP2028},
+		{data: nil, accessList: list, rules: berlin, want: params.TxGas + listGas},
+		{data: nil, accessList: types.AccessList{}, rules: berlin, want: params.TxGas},
+		// Access lists are free before Berlin
+		{data: nil, accessList: list, rules: istanbul, want: params.TxGas},
+	} {
+		got, err := IntrinsicGas(tt.data, tt.accessList, tt.create, tt.rules)
+		if err != nil {
+			t.Fatalf("test %d: %v", i, err)
+		}
+		if got != tt.want {
+			t.Errorf("test %d: got %d, want %d", i, got, tt.want)
+		}
+	}
+}
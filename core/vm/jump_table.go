@@ -17,6 +17,8 @@
 package vm
 
 import (
+	"fmt"
+
 	"github.com/ledgerwatch/erigon/core/vm/stack"
 	"github.com/ledgerwatch/erigon/params"
 )
@@ -72,11 +74,99 @@ var (
 // JumpTable contains the EVM opcodes supported at a given fork.
 type JumpTable [256]*operation
 
+// instructionSetForRules returns the instruction set of the latest fork active
+// under the given chain rules.
+func instructionSetForRules(rules *params.Rules) *JumpTable {
+	switch {
+	case rules.IsCancun:
+		return &cancunInstructionSet
+	case rules.IsShanghai:
+		return &shanghaiInstructionSet
+	case rules.IsLondon:
+		return &londonInstructionSet
+	case rules.IsBerlin:
+		return &berlinInstructionSet
+	case rules.IsIstanbul:
+		return &istanbulInstructionSet
+	case rules.IsConstantinople:
+		return &constantinopleInstructionSet
+	case rules.IsByzantium:
+		return &byzantiumInstructionSet
+	case rules.IsSpuriousDragon:
+		return &spuriousDragonInstructionSet
+	case rules.IsTangerineWhistle:
+		return &tangerineWhistleInstructionSet
+	case rules.IsHomestead:
+		return &homesteadInstructionSet
+	default:
+		return &frontierInstructionSet
+	}
+}
+
+// OperationGasCost reports the constant gas of op under the given chain rules,
+// and whether the op charges additional gas depending on its operands, memory
+// expansion or state access.
+func OperationGasCost(op OpCode, rules params.Rules) (constant uint64, hasDynamic bool, err error) {
+	operation := instructionSetForRules(&rules)[op]
+	if operation == nil {
+		return 0, false, &ErrInvalidOpCode{opcode: op}
+	}
+	return operation.constantGas, operation.dynamicGas != nil, nil
+}
+
+// ValidOpcodes returns the opcodes defined under the given chain rules, those
+// the interpreter runs instead of failing with ErrInvalidOpCode. Config.ExtraEips
+// and custom instruction sets are not taken into account.
+func ValidOpcodes(rules params.Rules) map[OpCode]bool {
+	jt := instructionSetForRules(&rules)
+	valid := make(map[OpCode]bool)
+	for op, operation := range jt {
+		if operation != nil {
+			valid[OpCode(op)] = true
+		}
+	}
+	return valid
+}
+
+// copyJumpTable returns a deep copy of the table, which can be modified without
+// affecting the source.
+func copyJumpTable(source *JumpTable) *JumpTable {
+	dest := *source
+	for i, op := range source {
+		if op != nil {
+			opCopy := *op
+			dest[i] = &opCopy
+		}
+	}
+	return &dest
+}
+
+// validate checks that every populated entry of the table can be dispatched by
+// the interpreter. Empty entries are fine, they are treated as invalid opcodes.
+func (jt *JumpTable) validate() error {
+	for i, op := range jt {
+		if op == nil {
+			continue
+		}
+		if op.execute == nil {
+			return fmt.Errorf("op %v has no execute function", OpCode(i))
+		}
+		if op.memorySize != nil && op.dynamicGas == nil {
+			return fmt.Errorf("op %v has dynamic memory but no dynamic gas", OpCode(i))
+		}
+		if op.minStack > op.maxStack {
+			return fmt.Errorf("op %v requires %d stack items but allows at most %d", OpCode(i), op.minStack, op.maxStack)
+		}
+	}
+	return nil
+}
+
 // newCancunInstructionSet returns the frontier, homestead, byzantium,
 // constantinople, istanbul, petersburg, berlin, london, paris, shanghai,
 // and cancun instructions.
 func newCancunInstructionSet() JumpTable {
 	instructionSet := newShanghaiInstructionSet()
+	enable1153(&instructionSet) // Transient storage opcodes https://eips.ethereum.org/EIPS/eip-1153
 	return instructionSet
 }
 
@@ -0,0 +1,99 @@
+package vm
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/holiman/uint256"
+
+	"github.com/ledgerwatch/erigon/common"
+	"github.com/ledgerwatch/erigon/params"
+)
+
+func TestOperationGasCost(t *testing.T) {
+	var (
+		frontier   = params.Rules{}
+		tangerine  = params.Rules{IsHomestead: true, IsTangerineWhistle: true}
+		istanbul   = params.Rules{IsHomestead: true, IsTangerineWhistle: true, IsSpuriousDragon: true, IsByzantium: true, IsConstantinople: true, IsPetersburg: true, IsIstanbul: true}
+		berlin     = params.Rules{IsHomestead: true, IsTangerineWhistle: true, IsSpuriousDragon: true, IsByzantium: true, IsConstantinople: true, IsPetersburg: true, IsIstanbul: true, IsBerlin: true}
+		shanghai   = params.Rules{IsHomestead: true, IsTangerineWhistle: true, IsSpuriousDragon: true, IsByzantium: true, IsConstantinople: true, IsPetersburg: true, IsIstanbul: true, IsBerlin: true, IsLondon: true, IsShanghai: true}
+		errInvalid *ErrInvalidOpCode
+	)
+	for _, tt := range []struct {
+		name       string
+		op         OpCode
+		rules      params.Rules
+		constant   uint64
+		hasDynamic bool
+		invalid    bool
+	}{
+		{"ADD", ADD, frontier, GasFastestStep, false, false},
+		{"MSTORE", MSTORE, frontier, GasFastestStep, true, false},
+		{"SLOAD frontier", SLOAD, frontier, params.SloadGasFrontier, false, false},
+		{"SLOAD tangerine whistle", SLOAD, tangerine, params.SloadGasEIP150, false, false},
+		{"SLOAD istanbul", SLOAD, istanbul, params.SloadGasEIP1884, false, false},
+		{"SLOAD berlin", SLOAD, berlin, 0, true, false},
+		{"BALANCE istanbul", BALANCE, istanbul, params.BalanceGasEIP1884, false, false},
+		{"BALANCE berlin", BALANCE, berlin, params.WarmStorageReadCostEIP2929, true, false},
+		{"SHL before constantinople", SHL, tangerine, 0, false, true},
+		{"PUSH0 berlin", PUSH0, berlin, 0, false, true},
+		{"PUSH0 shanghai", PUSH0, shanghai, GasQuickStep, false, false},
+	} {
+		constant, hasDynamic, err := OperationGasCost(tt.op, tt.rules)
+		if tt.invalid {
+			if !errors.As(err, &errInvalid) {
+				t.Errorf("%s: expected invalid opcode error, got %v", tt.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+			continue
+		}
+		if constant != tt.constant || hasDynamic != tt.hasDynamic {
+			t.Errorf("%s: have constant=%d dynamic=%v, want constant=%d dynamic=%v", tt.name, constant, hasDynamic, tt.constant, tt.hasDynamic)
+		}
+	}
+}
+
+func TestValidOpcodes(t *testing.T) {
+	var (
+		berlin   = params.Rules{IsHomestead: true, IsTangerineWhistle: true, IsSpuriousDragon: true, IsByzantium: true, IsConstantinople: true, IsPetersburg: true, IsIstanbul: true, IsBerlin: true}
+		london   = params.Rules{IsHomestead: true, IsTangerineWhistle: true, IsSpuriousDragon: true, IsByzantium: true, IsConstantinople: true, IsPetersburg: true, IsIstanbul: true, IsBerlin: true, IsLondon: true}
+		shanghai = params.Rules{IsHomestead: true, IsTangerineWhistle: true, IsSpuriousDragon: true, IsByzantium: true, IsConstantinople: true, IsPetersburg: true, IsIstanbul: true, IsBerlin: true, IsLondon: true, IsShanghai: true}
+	)
+	for _, tt := range []struct {
+		name  string
+		op    OpCode
+		rules params.Rules
+		valid bool
+	}{
+		{"SHL frontier", SHL, params.Rules{}, false},
+		{"SHL berlin", SHL, berlin, true},
+		{"BASEFEE berlin", BASEFEE, berlin, false},
+		{"BASEFEE london", BASEFEE, london, true},
+		{"PUSH0 london", PUSH0, london, false},
+		{"PUSH0 shanghai", PUSH0, shanghai, true},
+		{"INVALID shanghai", 0xfe, shanghai, false},
+	} {
+		if valid := ValidOpcodes(tt.rules)[tt.op]; valid != tt.valid {
+			t.Errorf("%s: have valid %v, want %v", tt.name, valid, tt.valid)
+		}
+	}
+
+	// The interpreter rejects exactly the opcodes left out
+	contract := common.HexToAddress("0xaa")
+	vmenv, s := newTestEVM(t, Config{})
+	vmenv.context.Difficulty, vmenv.context.BaseFee = new(big.Int), new(uint256.Int)
+	vmenv.txContext.GasPrice = new(big.Int)
+	valid := ValidOpcodes(*vmenv.ChainRules())
+	var errInvalid *ErrInvalidOpCode
+	for op := 0; op < 256; op++ {
+		s.SetCode(contract, []byte{byte(op)})
+		_, _, err := vmenv.Call(AccountRef(common.Address{}), contract, nil, 100000, new(uint256.Int), false /* bailout */)
+		if errors.As(err, &errInvalid) == valid[OpCode(op)] {
+			t.Errorf("opcode %#x: valid %v, but the interpreter returned %v", op, valid[OpCode(op)], err)
+		}
+	}
+}
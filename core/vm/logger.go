@@ -24,6 +24,8 @@ import (
 	"io"
 	"math/big"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -49,18 +51,78 @@ func (s Storage) Copy() Storage {
 	return cpy
 }
 
+// SortedKeys returns the storage slots in ascending order, for output that is
+// identical across runs.
+func (s Storage) SortedKeys() common.Hashes {
+	keys := make(common.Hashes, 0, len(s))
+	for key := range s {
+		keys = append(keys, key)
+	}
+	sort.Sort(keys)
+	return keys
+}
+
 // LogConfig are the configuration options for structured logger the EVM
 type LogConfig struct {
 	DisableMemory     bool // disable memory capture
 	DisableStack      bool // disable stack capture
 	DisableStorage    bool // disable storage capture
 	DisableReturnData bool // disable return data capture
+	TransientStorage  bool // capture TLOAD/TSTORE slots, kept apart from persistent storage
 	Debug             bool // print output during capture end
 	Limit             int  // maximum length of output, but zero means unlimited
+	CallPath          bool // record the call path of every step, see StructLog.CallPath
+	PushData          bool // record the immediate operand of PUSH1-PUSH32, see StructLog.PushData
+	StackTop          int  // maximum number of stack items captured, from the top, but zero means unlimited
+	OnlyStateChanges  bool // only log the steps changing the state, see stateChanging
+	// MemoryAtBoundariesOnly limits the memory capture to the steps entering
+	// or leaving a frame: the CALL and CREATE families, RETURN and REVERT
+	MemoryAtBoundariesOnly bool
 	// Chain overrides, can be used to execute a trace using future fork rules
 	Overrides *params.ChainConfig `json:"overrides,omitempty"`
 }
 
+// stackTop returns the items of the stack to capture, the topmost StackTop ones
+// or all of them, bottom first.
+func (cfg *LogConfig) stackTop(data []uint256.Int) []uint256.Int {
+	if cfg.StackTop > 0 && cfg.StackTop < len(data) {
+		return data[len(data)-cfg.StackTop:]
+	}
+	return data
+}
+
+// captureMemory tells whether the memory is captured at a step running op.
+// It is captured after the expansion to the region op accesses, so the CALL
+// and CREATE families see their input as it is read.
+func (cfg *LogConfig) captureMemory(op OpCode) bool {
+	if cfg.DisableMemory {
+		return false
+	}
+	if !cfg.MemoryAtBoundariesOnly {
+		return true
+	}
+	switch op {
+	case CALL, CALLCODE, DELEGATECALL, STATICCALL, CREATE, CREATE2, RETURN, REVERT:
+		return true
+	}
+	return false
+}
+
+// stateChanging tells whether the step changes the state or has an effect
+// visible outside of the transaction: SSTORE, TSTORE, LOG0-LOG4, CREATE,
+// CREATE2, SELFDESTRUCT and CALL with value. Combined with CallPath it places
+// the effects in the call tree.
+func stateChanging(op OpCode, scope *ScopeContext) bool {
+	switch op {
+	case SSTORE, TSTORE, LOG0, LOG1, LOG2, LOG3, LOG4, CREATE, CREATE2, SELFDESTRUCT:
+		return true
+	case CALL:
+		value := scope.StackBack(2)
+		return value != nil && !value.IsZero()
+	}
+	return false
+}
+
 //go:generate gencodec -type StructLog -field-override structLogMarshaling -out gen_structlog.go
 
 // StructLog is emitted to the EVM each cycle and lists information about the current internal state
@@ -70,14 +132,24 @@ type StructLog struct {
 	Op            OpCode                      `json:"op"`
 	Gas           uint64                      `json:"gas"`
 	GasCost       uint64                      `json:"gasCost"`
+	DynamicGas    uint64                      `json:"dynamicGas"`
+	ColdAccess    bool                        `json:"coldAccess,omitempty"` // whether DynamicGas includes the EIP-2929 cold access cost
 	Memory        []byte                      `json:"memory"`
 	MemorySize    int                         `json:"memSize"`
 	Stack         []*big.Int                  `json:"stack"`
 	ReturnData    []byte                      `json:"returnData"`
+	ReturnDataCut bool                        `json:"returnDataTruncated,omitempty"`
 	Storage       map[common.Hash]common.Hash `json:"-"`
+	Transient     map[common.Hash]common.Hash `json:"-"`
 	Depth         int                         `json:"depth"`
 	RefundCounter uint64                      `json:"refund"`
+	RefundChange  int64                       `json:"refundChange"`
+	Duration      time.Duration               `json:"duration,omitempty"` // time until the next step, see Config.TimeSteps
+	CallPath      string                      `json:"callPath,omitempty"` // dotted child indexes of the frame, see LogConfig.CallPath
+	PushData      []byte                      `json:"pushData,omitempty"` // immediate operand of PUSH1-PUSH32, see LogConfig.PushData
 	Err           error                       `json:"-"`
+
+	name string // custom name of Op, see Config.OpCodeNames
 }
 
 // overrides for gencodec
@@ -85,14 +157,35 @@ type structLogMarshaling struct {
 	Stack       []*math.HexOrDecimal256
 	Gas         math.HexOrDecimal64
 	GasCost     math.HexOrDecimal64
-	Memory      hexutil.Bytes
+	DynamicGas  math.HexOrDecimal64
+	Memory      structLogMemory
 	ReturnData  hexutil.Bytes
+	PushData    hexutil.Bytes
 	OpName      string `json:"opName"` // adds call to OpName() in MarshalJSON
 	ErrorString string `json:"error"`  // adds call to ErrorString() in MarshalJSON
 }
 
+// structLogMemory is the JSON encoding of StructLog.Memory: null if the memory
+// was not captured and hex otherwise, even if empty. The stack is null if not
+// captured as well, so both survive a JSON round trip.
+type structLogMemory []byte
+
+func (m structLogMemory) MarshalJSON() ([]byte, error) {
+	if m == nil {
+		return []byte("null"), nil
+	}
+	return json.Marshal(hexutil.Bytes(m))
+}
+
+func (m *structLogMemory) UnmarshalJSON(input []byte) error {
+	return (*hexutil.Bytes)(m).UnmarshalJSON(input)
+}
+
 // OpName formats the operand name in a human-readable format.
 func (s *StructLog) OpName() string {
+	if s.name != "" {
+		return s.name
+	}
 	return s.Op.String()
 }
 
@@ -118,13 +211,18 @@ const (
 // Tracer is used to collect execution traces from an EVM transaction
 // execution. CaptureState is called for each step of the VM with the
 // current VM state.
+// CaptureEnter and CaptureExit bracket every nested call frame (depth > 0),
+// strictly nested and always in pairs, also when the inner frame fails. The
+// top-level frame is only reported through CaptureStart and CaptureEnd.
 // Note that reference types are actual VM data structures; make copies
 // if you need to retain them beyond the current call.
 type Tracer interface {
 	CaptureStart(env *EVM, depth int, from common.Address, to common.Address, precompile bool, create bool, callType CallType, input []byte, gas uint64, value *big.Int, code []byte)
+	CaptureEnter(typ OpCode, from common.Address, to common.Address, input []byte, gas uint64, value *uint256.Int)
 	CaptureState(env *EVM, pc uint64, op OpCode, gas, cost uint64, scope *ScopeContext, rData []byte, depth int, err error)
 	CaptureFault(env *EVM, pc uint64, op OpCode, gas, cost uint64, scope *ScopeContext, depth int, err error)
 	CaptureEnd(depth int, output []byte, startGas, endGas uint64, t time.Duration, err error)
+	CaptureExit(output []byte, gasUsed uint64, err error)
 	CaptureSelfDestruct(from common.Address, to common.Address, value *big.Int)
 	CaptureAccountRead(account common.Address) error
 	CaptureAccountWrite(account common.Address) error
@@ -137,18 +235,201 @@ type FlushableTracer interface {
 	Flush(tx types.Transaction)
 }
 
+// CreateTracer is a Tracer extension that is told which address a CREATE or
+// CREATE2 is about to deploy to, right before CaptureStart of the new frame.
+// For CREATE2 the salt and init code hash used to derive the address are
+// reported as well; for CREATE salt is nil and initCodeHash is empty.
+type CreateTracer interface {
+	Tracer
+	CaptureCreate(env *EVM, depth int, creator common.Address, address common.Address, callType CallType, salt *uint256.Int, initCodeHash common.Hash)
+}
+
+// SelfDestructTracer is a Tracer that also wants the outcome of a SELFDESTRUCT,
+// reported after CaptureSelfDestruct once the balance has been moved to the
+// beneficiary. removed tells whether the account was actually marked for
+// deletion, which is not the case if it had already been destroyed. EIP-6780
+// is not implemented, so removed is always true on the first SELFDESTRUCT of
+// an account, whether or not it was created in the same transaction.
+type SelfDestructTracer interface {
+	Tracer
+	CaptureSelfDestructResult(contract common.Address, beneficiary common.Address, balance *uint256.Int, removed bool)
+}
+
+// OutputTruncationTracer is a Tracer that is told when the output about to be
+// passed to CaptureExit and CaptureEnd is cut to Config.MaxTraceOutputSize.
+// It is called with the depth of the returning frame and the full output size.
+type OutputTruncationTracer interface {
+	Tracer
+	CaptureOutputTruncated(depth int, size int)
+}
+
+// PrecompileTracer is a Tracer that is told about every run of a precompiled
+// contract, between the CaptureEnter and CaptureExit (or CaptureStart and
+// CaptureEnd) of the call into it. name is the one given by PrecompileName,
+// gasUsed includes all the supplied gas when the precompile fails.
+type PrecompileTracer interface {
+	Tracer
+	CapturePrecompile(addr common.Address, name string, input []byte, output []byte, gas uint64, gasUsed uint64, err error)
+}
+
+// ModExpTracer is a Tracer that is told the gas breakdown of every run of the
+// modexp precompile, parsed from its input before it runs and so before its
+// CapturePrecompile. The run fails if detail.Gas exceeds gas.
+type ModExpTracer interface {
+	Tracer
+	CaptureModExpGas(addr common.Address, gas uint64, detail ModExpGas)
+}
+
+// LogTracer is a Tracer that is told about every LOG0-LOG4 as it is emitted,
+// interleaved with the other events. A log is not final at that point: it is
+// discarded if its frame, or any of the enclosing ones, later fails, which the
+// err of CaptureExit and CaptureEnd tells.
+type LogTracer interface {
+	Tracer
+	CaptureLog(depth int, pc uint64, addr common.Address, topics []common.Hash, data []byte)
+}
+
+// WriteProtectionTracer is a Tracer that is told about every opcode failing with
+// ErrWriteProtection because it modifies the state in a read-only frame: SSTORE,
+// TSTORE, LOGn, CREATE, CREATE2, SELFDESTRUCT or a CALL transferring value.
+// It is called before the CaptureState reporting the error.
+type WriteProtectionTracer interface {
+	Tracer
+	CaptureWriteProtection(depth int, pc uint64, op OpCode, addr common.Address)
+}
+
+// CodeAccessTracer is a Tracer that is told about the account inspected by every
+// EXTCODESIZE, EXTCODEHASH and EXTCODECOPY. cold is true if the opcode paid
+// the EIP-2929 cold account access cost, it is always false before Berlin.
+type CodeAccessTracer interface {
+	Tracer
+	CaptureCodeAccess(depth int, pc uint64, op OpCode, addr common.Address, cold bool)
+}
+
+// JumpTracer is a Tracer that is told about every JUMP and JUMPI, for building
+// control flow graphs. to is the destination taken from the stack, or
+// math.MaxUint64 if it doesn't fit in 64 bits, and valid whether it is a
+// JUMPDEST. taken is false for a JUMPI whose condition is zero, and the hook
+// fires before ErrInvalidJump is returned for an invalid destination.
+type JumpTracer interface {
+	Tracer
+	CaptureJump(depth int, from, to uint64, conditional, taken, valid bool)
+}
+
+// BlockHashTracer is a Tracer that is told about every BLOCKHASH, with the block
+// number taken from the stack, or math.MaxUint64 if it doesn't fit in 64 bits,
+// and the hash pushed in its place. The hash is zero for the blocks outside of
+// the window of the 256 most recent ones, the current and future blocks
+// included; BlockContext.GetHash is only asked for the others.
+type BlockHashTracer interface {
+	Tracer
+	CaptureBlockHash(depth int, pc uint64, number uint64, hash common.Hash)
+}
+
+// InvalidOpcodeTracer is a Tracer that is told about every undefined opcode the
+// interpreter runs into, before the frame fails with ErrInvalidOpCode, or
+// before it is skipped if skipped is set, see Config.SkipInvalidOpcodes. The
+// failing step is still reported by CaptureState, a skipped one is not.
+type InvalidOpcodeTracer interface {
+	Tracer
+	CaptureInvalidOpcode(depth int, pc uint64, op OpCode, skipped bool)
+}
+
+// TxEndTracer is a Tracer that is told about the end of the transaction, after
+// CaptureEnd of the top-level frame, once the state transition has applied
+// the refund. restGas is the gas returned to the sender, refund included, and
+// refund the part of the refund counter given back: at most gasUsed/2, or
+// gasUsed/5 since London (EIP-3529). It is zero when the transaction failed,
+// as the counter is reverted along with the state, or refunds are disabled.
+type TxEndTracer interface {
+	Tracer
+	CaptureTxEnd(restGas uint64, refund uint64)
+}
+
+// HaltReason tells how the code of a frame stopped running, see HaltTracer.
+type HaltReason int
+
+const (
+	HaltStop         HaltReason = iota // STOP, or the end of the code
+	HaltReturn                         // RETURN
+	HaltRevert                         // REVERT
+	HaltSelfDestruct                   // SELFDESTRUCT
+	HaltOutOfGas                       // ErrOutOfGas
+	HaltInvalid                        // an undefined opcode or INVALID (0xfe)
+	HaltError                          // any other error, such as a stack underflow or an invalid jump
+)
+
+var haltReasonNames = [...]string{
+	HaltStop:         "STOP",
+	HaltReturn:       "RETURN",
+	HaltRevert:       "REVERT",
+	HaltSelfDestruct: "SELFDESTRUCT",
+	HaltOutOfGas:     "out of gas",
+	HaltInvalid:      "invalid opcode",
+	HaltError:        "error",
+}
+
+func (r HaltReason) String() string {
+	if r < 0 || int(r) >= len(haltReasonNames) {
+		return fmt.Sprintf("HaltReason(%d)", int(r))
+	}
+	return haltReasonNames[r]
+}
+
+// haltReason classifies the end of a frame from the last opcode and the error
+// it ended with.
+func haltReason(op OpCode, err error) HaltReason {
+	var invalid *ErrInvalidOpCode
+	switch {
+	case err == nil && op == RETURN:
+		return HaltReturn
+	case err == nil && op == SELFDESTRUCT:
+		return HaltSelfDestruct
+	case err == nil:
+		return HaltStop
+	case errors.Is(err, ErrExecutionReverted):
+		return HaltRevert
+	case errors.Is(err, ErrOutOfGas):
+		return HaltOutOfGas
+	case errors.As(err, &invalid):
+		return HaltInvalid
+	default:
+		return HaltError
+	}
+}
+
+// HaltTracer is a Tracer that is told how the code of every frame, the
+// top-level one included, stopped running, before its CaptureExit or
+// CaptureEnd. data is the output of RETURN or REVERT, and nil otherwise.
+// Calls into precompiles, or into accounts without code, don't run any code
+// and are not reported.
+type HaltTracer interface {
+	Tracer
+	CaptureHalt(depth int, reason HaltReason, data []byte)
+}
+
+// StackHeightTracer is a Tracer that is told the highest number of items the
+// stack of every frame running code held, before its CaptureExit or
+// CaptureEnd, when Config.EnableStackStats is set. The limit is
+// params.StackLimit (1024).
+type StackHeightTracer interface {
+	Tracer
+	CaptureStackHeight(depth int, maxHeight int)
+}
+
 // StructLogRes stores a structured log emitted by the EVM while replaying a
 // transaction in debug mode
 type StructLogRes struct {
-	Pc      uint64             `json:"pc"`
-	Op      string             `json:"op"`
-	Gas     uint64             `json:"gas"`
-	GasCost uint64             `json:"gasCost"`
-	Depth   int                `json:"depth"`
-	Error   error              `json:"error,omitempty"`
-	Stack   *[]string          `json:"stack,omitempty"`
-	Memory  *[]string          `json:"memory,omitempty"`
-	Storage *map[string]string `json:"storage,omitempty"`
+	Pc       uint64             `json:"pc"`
+	Op       string             `json:"op"`
+	Gas      uint64             `json:"gas"`
+	GasCost  uint64             `json:"gasCost"`
+	Depth    int                `json:"depth"`
+	CallPath string             `json:"callPath,omitempty"`
+	Error    error              `json:"error,omitempty"`
+	Stack    *[]string          `json:"stack,omitempty"`
+	Memory   *[]string          `json:"memory,omitempty"`
+	Storage  *map[string]string `json:"storage,omitempty"`
 }
 
 // StructLogger is an EVM state logger and implements Tracer.
@@ -159,16 +440,33 @@ type StructLogRes struct {
 type StructLogger struct {
 	cfg LogConfig
 
-	storage map[common.Address]Storage
-	logs    []StructLog
-	output  []byte
-	err     error
+	storage   map[common.Address]Storage
+	transient map[common.Address]Storage
+	logs      []StructLog
+	output    []byte
+	outputCut bool
+	err       error
+
+	gasByOp   map[OpCode]uint64
+	countByOp map[OpCode]uint64
+
+	stepStart time.Time // capture time of the last logged step, see Config.TimeSteps
+	timing    bool      // whether the last logged step waits for its duration
+
+	// The index of every open frame among its siblings and the number of
+	// children it has entered so far, see LogConfig.CallPath
+	frames   []int
+	children []int
+	callPath string
 }
 
 // NewStructLogger returns a new logger
 func NewStructLogger(cfg *LogConfig) *StructLogger {
 	logger := &StructLogger{
-		storage: make(map[common.Address]Storage),
+		storage:   make(map[common.Address]Storage),
+		transient: make(map[common.Address]Storage),
+		gasByOp:   make(map[OpCode]uint64),
+		countByOp: make(map[OpCode]uint64),
 	}
 	if cfg != nil {
 		logger.cfg = *cfg
@@ -178,35 +476,69 @@ func NewStructLogger(cfg *LogConfig) *StructLogger {
 
 // CaptureStart implements the Tracer interface to initialize the tracing operation.
 func (l *StructLogger) CaptureStart(evm *EVM, depth int, from common.Address, to common.Address, precompile bool, create bool, calltype CallType, input []byte, gas uint64, value *big.Int, code []byte) {
+	if depth == 0 && len(l.transient) > 0 {
+		// transient storage doesn't survive the previous transaction
+		l.transient = make(map[common.Address]Storage)
+	}
+	if l.cfg.CallPath {
+		if depth == 0 {
+			l.frames, l.children = l.frames[:0], l.children[:0]
+			l.frames = append(l.frames, 0)
+		} else {
+			last := len(l.children) - 1
+			l.frames = append(l.frames, l.children[last])
+			l.children[last]++
+		}
+		l.children = append(l.children, 0)
+		l.updateCallPath()
+	}
+}
+
+// updateCallPath formats the path of the current frame, as the indexes of the
+// frames leading to it starting with the root: "0.2.1" is the second child of
+// the third child of the root.
+func (l *StructLogger) updateCallPath() {
+	path := make([]string, len(l.frames))
+	for i, index := range l.frames {
+		path[i] = strconv.Itoa(index)
+	}
+	l.callPath = strings.Join(path, ".")
+}
+
+// CaptureEnter implements the Tracer interface.
+func (l *StructLogger) CaptureEnter(typ OpCode, from common.Address, to common.Address, input []byte, gas uint64, value *uint256.Int) {
 }
 
 // CaptureState logs a new structured log message and pushes it out to the environment
 //
-// CaptureState also tracks SLOAD/SSTORE ops to track storage change.
+// CaptureState also tracks SLOAD/SSTORE ops to track storage change, and
+// TLOAD/TSTORE ops for transient storage if enabled.
 func (l *StructLogger) CaptureState(env *EVM, pc uint64, op OpCode, gas, cost uint64, scope *ScopeContext, rData []byte, depth int, err error) {
 	memory := scope.Memory
 	stack := scope.Stack
 	contract := scope.Contract
 
+	if env.config.TimeSteps {
+		l.endStep()
+	}
+
+	// The summary covers all the steps, regardless of the limit. The gas
+	// forwarded by the CALL family is left to the callee's opcodes.
+	l.countByOp[op]++
+	ownCost := cost
+	switch op {
+	case CALL, CALLCODE, DELEGATECALL, STATICCALL:
+		if err == nil && cost >= env.callGasTemp {
+			ownCost -= env.callGasTemp
+		}
+	}
+	l.gasByOp[op] += ownCost
+
 	// check if already accumulated the specified number of logs
 	if l.cfg.Limit != 0 && l.cfg.Limit <= len(l.logs) {
 		return
 	}
 
-	// Copy a snapshot of the current memory state to a new buffer
-	var mem []byte
-	if !l.cfg.DisableMemory {
-		mem = make([]byte, len(memory.Data()))
-		copy(mem, memory.Data())
-	}
-	// Copy a snapshot of the current stack state to a new buffer
-	var stck []*big.Int
-	if !l.cfg.DisableStack {
-		stck = make([]*big.Int, len(stack.Data))
-		for i, item := range stack.Data {
-			stck[i] = new(big.Int).Set(item.ToBig())
-		}
-	}
 	// Copy a snapshot of the current storage to a new container
 	var storage Storage
 	if !l.cfg.DisableStorage {
@@ -234,14 +566,108 @@ func (l *StructLogger) CaptureState(env *EVM, pc uint64, op OpCode, gas, cost ui
 		}
 		storage = l.storage[contract.Address()].Copy()
 	}
-	var rdata []byte
+	// Transient storage is tracked the same way in its own container
+	var transient Storage
+	if l.cfg.TransientStorage {
+		if l.transient[contract.Address()] == nil {
+			l.transient[contract.Address()] = make(Storage)
+		}
+		if op == TLOAD && stack.Len() >= 1 {
+			address := common.Hash(stack.Data[stack.Len()-1].Bytes32())
+			value := env.IntraBlockState().GetTransientState(contract.Address(), address)
+			l.transient[contract.Address()][address] = value.Bytes32()
+		}
+		if op == TSTORE && stack.Len() >= 2 {
+			var (
+				value   = common.Hash(stack.Data[stack.Len()-2].Bytes32())
+				address = common.Hash(stack.Data[stack.Len()-1].Bytes32())
+			)
+			l.transient[contract.Address()][address] = value
+		}
+		transient = l.transient[contract.Address()].Copy()
+	}
+	// The storage read so far is tracked above even for the steps left out
+	if l.cfg.OnlyStateChanges && !stateChanging(op, scope) {
+		return
+	}
+	// Copy a snapshot of the current memory state to a new buffer
+	var mem []byte
+	if l.cfg.captureMemory(op) {
+		mem = make([]byte, len(memory.Data()))
+		copy(mem, memory.Data())
+	}
+	// Copy a snapshot of the current stack state to a new buffer
+	var stck []*big.Int
+	if !l.cfg.DisableStack {
+		items := l.cfg.stackTop(stack.Data)
+		stck = make([]*big.Int, len(items))
+		for i, item := range items {
+			stck[i] = new(big.Int).Set(item.ToBig())
+		}
+	}
+	var (
+		rdata []byte
+		rcut  bool
+	)
 	if !l.cfg.DisableReturnData {
+		if limit := env.Config().MaxTraceOutputSize; limit > 0 && len(rData) > limit {
+			rData, rcut = rData[:limit], true
+		}
 		rdata = make([]byte, len(rData))
 		copy(rdata, rData)
 	}
 	// create a new snapshot of the EVM.
-	log := StructLog{pc, op, gas, cost, mem, memory.Len(), stck, rdata, storage, depth, env.IntraBlockState().GetRefund(), err}
+	log := StructLog{
+		Pc:            pc,
+		Op:            op,
+		Gas:           gas,
+		GasCost:       cost,
+		DynamicGas:    scope.DynamicGas,
+		ColdAccess:    scope.ColdAccess,
+		Memory:        mem,
+		MemorySize:    memory.Len(),
+		Stack:         stck,
+		ReturnData:    rdata,
+		ReturnDataCut: rcut,
+		Storage:       storage,
+		Transient:     transient,
+		Depth:         depth,
+		RefundCounter: env.IntraBlockState().GetRefund(),
+		RefundChange:  scope.RefundChange,
+		CallPath:      l.callPath,
+		Err:           err,
+		name:          env.config.OpCodeNames[op],
+	}
+	if l.cfg.PushData {
+		log.PushData = pushData(contract.Code, pc, op)
+	}
 	l.logs = append(l.logs, log)
+	if env.config.TimeSteps {
+		l.stepStart, l.timing = time.Now(), true
+	}
+}
+
+// pushData returns a copy of the immediate operand of the PUSH at pc, or nil
+// for other opcodes. Like in Disassemble, only the bytes left are returned if
+// the code ends before the full operand.
+func pushData(code []byte, pc uint64, op OpCode) []byte {
+	size := uint64(pushDataSize(op))
+	if size == 0 || pc >= uint64(len(code)) {
+		return nil
+	}
+	end := pc + 1 + size
+	if end > uint64(len(code)) {
+		end = uint64(len(code))
+	}
+	return common.CopyBytes(code[pc+1 : end])
+}
+
+// endStep sets the duration of the last logged step, if it is being timed.
+func (l *StructLogger) endStep() {
+	if l.timing {
+		l.logs[len(l.logs)-1].Duration = time.Since(l.stepStart)
+		l.timing = false
+	}
 }
 
 // CaptureFault implements the Tracer interface to trace an execution fault
@@ -251,9 +677,14 @@ func (l *StructLogger) CaptureFault(env *EVM, pc uint64, op OpCode, gas, cost ui
 
 // CaptureEnd is called after the call finishes to finalize the tracing.
 func (l *StructLogger) CaptureEnd(depth int, output []byte, startGas, endGas uint64, t time.Duration, err error) {
+	if l.cfg.CallPath && len(l.frames) > 0 {
+		l.frames, l.children = l.frames[:len(l.frames)-1], l.children[:len(l.children)-1]
+		l.updateCallPath()
+	}
 	if depth != 0 {
 		return
 	}
+	l.endStep()
 	l.output = output
 	l.err = err
 	if l.cfg.Debug {
@@ -264,6 +695,17 @@ func (l *StructLogger) CaptureEnd(depth int, output []byte, startGas, endGas uin
 	}
 }
 
+// CaptureOutputTruncated implements the OutputTruncationTracer interface.
+func (l *StructLogger) CaptureOutputTruncated(depth int, size int) {
+	if depth == 0 {
+		l.outputCut = true
+	}
+}
+
+// CaptureExit implements the Tracer interface.
+func (l *StructLogger) CaptureExit(output []byte, gasUsed uint64, err error) {
+}
+
 func (l *StructLogger) CaptureSelfDestruct(from common.Address, to common.Address, value *big.Int) {
 }
 
@@ -284,6 +726,25 @@ func (l *StructLogger) Error() error { return l.err }
 // Output returns the VM return value captured by the trace.
 func (l *StructLogger) Output() []byte { return l.output }
 
+// OutputTruncated returns whether Output was cut to Config.MaxTraceOutputSize.
+func (l *StructLogger) OutputTruncated() bool { return l.outputCut }
+
+// GasByOpcode returns the gas charged by each opcode over all the traced steps,
+// including memory expansion but not the gas forwarded to sub-calls.
+func (l *StructLogger) GasByOpcode() map[OpCode]uint64 { return l.gasByOp }
+
+// GasByCategory returns the gas used per opcode category, as in GasByOpcode.
+func (l *StructLogger) GasByCategory() map[OpCategory]uint64 {
+	gas := make(map[OpCategory]uint64)
+	for op, cost := range l.gasByOp {
+		gas[op.Category()] += cost
+	}
+	return gas
+}
+
+// CountByOpcode returns how many times each opcode was executed.
+func (l *StructLogger) CountByOpcode() map[OpCode]uint64 { return l.countByOp }
+
 func (l *StructLogger) Flush(tx types.Transaction) {
 	w, err1 := os.Create(fmt.Sprintf("txtrace_%x.txt", tx.Hash()))
 	if err1 != nil {
@@ -304,12 +765,13 @@ func FormatLogs(logs []StructLog) []StructLogRes {
 	formatted := make([]StructLogRes, len(logs))
 	for index, trace := range logs {
 		formatted[index] = StructLogRes{
-			Pc:      trace.Pc,
-			Op:      trace.Op.String(),
-			Gas:     trace.Gas,
-			GasCost: trace.GasCost,
-			Depth:   trace.Depth,
-			Error:   trace.Err,
+			Pc:       trace.Pc,
+			Op:       trace.OpName(),
+			Gas:      trace.Gas,
+			GasCost:  trace.GasCost,
+			Depth:    trace.Depth,
+			CallPath: trace.CallPath,
+			Error:    trace.Err,
 		}
 		if trace.Stack != nil {
 			stack := make([]string, len(trace.Stack))
@@ -326,6 +788,7 @@ func FormatLogs(logs []StructLog) []StructLogRes {
 			formatted[index].Memory = &memory
 		}
 		if trace.Storage != nil {
+			// encoding/json writes map keys in sorted order
 			storage := make(map[string]string)
 			for i, storageValue := range trace.Storage {
 				storage[fmt.Sprintf("%x", i)] = fmt.Sprintf("%x", storageValue)
@@ -339,7 +802,10 @@ func FormatLogs(logs []StructLog) []StructLogRes {
 // WriteTrace writes a formatted trace to the given writer
 func WriteTrace(writer io.Writer, logs []StructLog) {
 	for _, log := range logs {
-		fmt.Fprintf(writer, "%-16spc=%08d gas=%v cost=%v", log.Op, log.Pc, log.Gas, log.GasCost)
+		fmt.Fprintf(writer, "%-16spc=%08d gas=%v cost=%v dynamic=%v", log.OpName(), log.Pc, log.Gas, log.GasCost, log.DynamicGas)
+		if log.ColdAccess {
+			fmt.Fprint(writer, " cold")
+		}
 		if log.Err != nil {
 			fmt.Fprintf(writer, " ERROR: %v", log.Err)
 		}
@@ -357,8 +823,14 @@ func WriteTrace(writer io.Writer, logs []StructLog) {
 		}
 		if len(log.Storage) > 0 {
 			fmt.Fprintln(writer, "Storage:")
-			for h, item := range log.Storage {
-				fmt.Fprintf(writer, "%x: %x\n", h, item)
+			for _, h := range Storage(log.Storage).SortedKeys() {
+				fmt.Fprintf(writer, "%x: %x\n", h, log.Storage[h])
+			}
+		}
+		if len(log.Transient) > 0 {
+			fmt.Fprintln(writer, "Transient storage:")
+			for _, h := range Storage(log.Transient).SortedKeys() {
+				fmt.Fprintf(writer, "%x: %x\n", h, log.Transient[h])
 			}
 		}
 		if len(log.ReturnData) > 0 {
@@ -415,15 +887,21 @@ func (t *mdLogger) CaptureStart(env *EVM, _ int, from common.Address, to common.
 `)
 }
 
+func (t *mdLogger) CaptureEnter(typ OpCode, from common.Address, to common.Address, input []byte, gas uint64, value *uint256.Int) {
+}
+
 func (t *mdLogger) CaptureState(env *EVM, pc uint64, op OpCode, gas, cost uint64, scope *ScopeContext, rData []byte, depth int, err error) {
 	stack := scope.Stack
+	if t.cfg.OnlyStateChanges && !stateChanging(op, scope) {
+		return
+	}
 
 	fmt.Fprintf(t.out, "| %4d  | %10v  |  %3d |", pc, op, cost)
 
 	if !t.cfg.DisableStack {
 		// format stack
 		var a []string
-		for _, elem := range stack.Data {
+		for _, elem := range t.cfg.stackTop(stack.Data) {
 			a = append(a, fmt.Sprintf("%v", elem.String()))
 		}
 		b := fmt.Sprintf("[%v]", strings.Join(a, ","))
@@ -445,6 +923,9 @@ func (t *mdLogger) CaptureEnd(_ int, output []byte, startGas, endGas uint64, tm
 		output, startGas-endGas, err)
 }
 
+func (t *mdLogger) CaptureExit(output []byte, gasUsed uint64, err error) {
+}
+
 func (t *mdLogger) CaptureSelfDestruct(from common.Address, to common.Address, value *big.Int) {
 }
 
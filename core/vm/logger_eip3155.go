@@ -0,0 +1,139 @@
+package vm
+
+import (
+	"encoding/json"
+	"io"
+	"math/big"
+	"time"
+
+	"github.com/holiman/uint256"
+
+	"github.com/ledgerwatch/erigon/common"
+	"github.com/ledgerwatch/erigon/common/hexutil"
+)
+
+// eip3155Step is a single line of an EIP-3155 trace, in the field order of
+// the specification.
+type eip3155Step struct {
+	Pc         uint64         `json:"pc"`
+	Op         byte           `json:"op"`
+	Gas        hexutil.Uint64 `json:"gas"`
+	GasCost    hexutil.Uint64 `json:"gasCost"`
+	Memory     *hexutil.Bytes `json:"memory,omitempty"`
+	MemSize    int            `json:"memSize"`
+	Stack      []string       `json:"stack"`
+	ReturnData *hexutil.Bytes `json:"returnData,omitempty"`
+	Depth      int            `json:"depth"`
+	Refund     hexutil.Uint64 `json:"refund"`
+	OpName     string         `json:"opName"`
+	Error      string         `json:"error,omitempty"`
+}
+
+// eip3155Summary is the last line of an EIP-3155 trace.
+type eip3155Summary struct {
+	StateRoot common.Hash    `json:"stateRoot"`
+	Output    hexutil.Bytes  `json:"output"`
+	GasUsed   hexutil.Uint64 `json:"gasUsed"`
+	Pass      bool           `json:"pass"`
+	Time      int64          `json:"time,omitempty"`
+	Error     string         `json:"error,omitempty"`
+}
+
+var _ Tracer = (*EIP3155Logger)(nil)
+
+// EIP3155Logger writes the execution steps in the newline-delimited format of
+// EIP-3155, for comparing traces with other clients. The summary line needs
+// the post-state root, which is only known once the transaction has been
+// finalised, so it is written by WriteSummary rather than by CaptureEnd.
+type EIP3155Logger struct {
+	encoder *json.Encoder
+	cfg     *LogConfig
+	summary eip3155Summary
+}
+
+// NewEIP3155Logger creates a new EIP-3155 tracer writing into the provided
+// stream. Memory and return data are included unless disabled by cfg.
+func NewEIP3155Logger(cfg *LogConfig, writer io.Writer) *EIP3155Logger {
+	l := &EIP3155Logger{encoder: json.NewEncoder(writer), cfg: cfg}
+	if l.cfg == nil {
+		l.cfg = &LogConfig{}
+	}
+	return l
+}
+
+func (l *EIP3155Logger) CaptureStart(env *EVM, depth int, from common.Address, to common.Address, precompile bool, create bool, callType CallType, input []byte, gas uint64, value *big.Int, code []byte) {
+}
+
+func (l *EIP3155Logger) CaptureEnter(typ OpCode, from common.Address, to common.Address, input []byte, gas uint64, value *uint256.Int) {
+}
+
+// CaptureState writes the step as a line of the trace.
+func (l *EIP3155Logger) CaptureState(env *EVM, pc uint64, op OpCode, gas, cost uint64, scope *ScopeContext, rData []byte, depth int, err error) {
+	step := eip3155Step{
+		Pc:      pc,
+		Op:      byte(op),
+		Gas:     hexutil.Uint64(gas),
+		GasCost: hexutil.Uint64(cost),
+		MemSize: scope.Memory.Len(),
+		Stack:   make([]string, len(scope.Stack.Data)),
+		Depth:   depth,
+		Refund:  hexutil.Uint64(env.IntraBlockState().GetRefund()),
+		OpName:  env.config.OpCodeNames.Name(op),
+	}
+	// Stack items are hex quantities, without leading zeros
+	for i := range scope.Stack.Data {
+		step.Stack[i] = scope.Stack.Data[i].Hex()
+	}
+	if l.cfg.captureMemory(op) {
+		memory := hexutil.Bytes(scope.Memory.Data())
+		step.Memory = &memory
+	}
+	if !l.cfg.DisableReturnData && len(rData) > 0 {
+		returnData := hexutil.Bytes(rData)
+		step.ReturnData = &returnData
+	}
+	if err != nil {
+		step.Error = err.Error()
+	}
+	_ = l.encoder.Encode(step)
+}
+
+func (l *EIP3155Logger) CaptureFault(env *EVM, pc uint64, op OpCode, gas, cost uint64, scope *ScopeContext, depth int, err error) {
+}
+
+// CaptureEnd records the outcome of the execution for the summary.
+func (l *EIP3155Logger) CaptureEnd(depth int, output []byte, startGas, endGas uint64, t time.Duration, err error) {
+	if depth != 0 {
+		return
+	}
+	l.summary = eip3155Summary{
+		Output:  common.CopyBytes(output),
+		GasUsed: hexutil.Uint64(startGas - endGas),
+		Pass:    err == nil,
+		Time:    t.Nanoseconds(),
+	}
+	if err != nil {
+		l.summary.Error = err.Error()
+	}
+}
+
+func (l *EIP3155Logger) CaptureExit(output []byte, gasUsed uint64, err error) {
+}
+
+func (l *EIP3155Logger) CaptureSelfDestruct(from common.Address, to common.Address, value *big.Int) {
+}
+
+func (l *EIP3155Logger) CaptureAccountRead(account common.Address) error {
+	return nil
+}
+
+func (l *EIP3155Logger) CaptureAccountWrite(account common.Address) error {
+	return nil
+}
+
+// WriteSummary writes the summary line of the trace, with the given post-state
+// root and the outcome of the traced execution.
+func (l *EIP3155Logger) WriteSummary(stateRoot common.Hash) error {
+	l.summary.StateRoot = stateRoot
+	return l.encoder.Encode(l.summary)
+}
@@ -0,0 +1,46 @@
+package vm
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/holiman/uint256"
+
+	"github.com/ledgerwatch/erigon/common"
+)
+
+func TestEIP3155Logger(t *testing.T) {
+	var (
+		contract = common.HexToAddress("0xaa")
+		out      bytes.Buffer
+		logger   = NewEIP3155Logger(&LogConfig{DisableMemory: true}, &out)
+	)
+	vmenv, s := newTestEVM(t, Config{Debug: true, Tracer: logger})
+	// PUSH1 0x2a; PUSH1 0; STOP
+	s.SetCode(contract, []byte{byte(PUSH1), 0x2a, byte(PUSH1), 0, byte(STOP)})
+	if _, _, err := vmenv.Call(AccountRef(common.Address{}), contract, nil, 100000, new(uint256.Int), false /* bailout */); err != nil {
+		t.Fatal(err)
+	}
+	root := common.HexToHash("0x1234")
+	if err := logger.WriteSummary(root); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("expected 3 steps and a summary, got:\n%s", out.String())
+	}
+	want := `{"pc":4,"op":0,"gas":"0x1869a","gasCost":"0x0","memSize":0,"stack":["0x2a","0x0"],"depth":1,"refund":"0x0","opName":"STOP"}`
+	if lines[2] != want {
+		t.Errorf("unexpected step\n got: %s\nwant: %s", lines[2], want)
+	}
+	var summary map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[3]), &summary); err != nil {
+		t.Fatal(err)
+	}
+	if summary["stateRoot"] != root.Hex() || summary["gasUsed"] != "0x6" || summary["pass"] != true || summary["output"] != "0x" {
+		t.Errorf("unexpected summary %s", lines[3])
+	}
+}
@@ -22,30 +22,65 @@ import (
 	"math/big"
 	"time"
 
+	"github.com/holiman/uint256"
 	"github.com/ledgerwatch/erigon/common"
 	"github.com/ledgerwatch/erigon/common/math"
 )
 
+// JSONLogger streams the execution steps as newline-delimited JSON, one line per
+// step and a summary line at the end. Nothing is kept in memory, and the output
+// written so far stays valid if the execution is aborted.
 type JSONLogger struct {
 	encoder *json.Encoder
+	writer  io.Writer
 	cfg     *LogConfig
 }
 
 // NewJSONLogger creates a new EVM tracer that prints execution steps as JSON objects
-// into the provided stream.
+// into the provided stream. Buffered writers are flushed after every object.
 func NewJSONLogger(cfg *LogConfig, writer io.Writer) *JSONLogger {
-	l := &JSONLogger{json.NewEncoder(writer), cfg}
+	l := &JSONLogger{json.NewEncoder(writer), writer, cfg}
 	if l.cfg == nil {
 		l.cfg = &LogConfig{}
 	}
 	return l
 }
 
+// encode writes a single line and flushes it through writers such as
+// bufio.Writer or http.Flusher.
+func (l *JSONLogger) encode(v interface{}) {
+	if err := l.encoder.Encode(v); err != nil {
+		return
+	}
+	switch w := l.writer.(type) {
+	case interface{ Flush() error }:
+		_ = w.Flush()
+	case interface{ Flush() }:
+		w.Flush()
+	}
+}
+
 func (l *JSONLogger) CaptureStart(env *EVM, depth int, from common.Address, to common.Address, precompile bool, create bool, calltype CallType, input []byte, gas uint64, value *big.Int, code []byte) {
 }
 
+func (l *JSONLogger) CaptureEnter(typ OpCode, from common.Address, to common.Address, input []byte, gas uint64, value *uint256.Int) {
+}
+
 // CaptureState outputs state information on the logger.
 func (l *JSONLogger) CaptureState(env *EVM, pc uint64, op OpCode, gas, cost uint64, scope *ScopeContext, rData []byte, depth int, err error) {
+	if log, ok := l.cfg.streamedStep(env, pc, op, gas, cost, scope, rData, depth, err); ok {
+		l.encode(log)
+	}
+}
+
+// streamedStep returns the step written by the JSONLogger and the
+// MsgpackLogger, which share it so that both formats are interchangeable, or
+// false if the step is not logged. The step refers to the memory and return
+// data of the interpreter, and must be written out before it goes on.
+func (cfg *LogConfig) streamedStep(env *EVM, pc uint64, op OpCode, gas, cost uint64, scope *ScopeContext, rData []byte, depth int, err error) (StructLog, bool) {
+	if cfg.OnlyStateChanges && !stateChanging(op, scope) {
+		return StructLog{}, false
+	}
 	memory := scope.Memory
 	stack := scope.Stack
 
@@ -54,24 +89,41 @@ func (l *JSONLogger) CaptureState(env *EVM, pc uint64, op OpCode, gas, cost uint
 		Op:            op,
 		Gas:           gas,
 		GasCost:       cost,
+		DynamicGas:    scope.DynamicGas,
+		ColdAccess:    scope.ColdAccess,
 		MemorySize:    memory.Len(),
 		Storage:       nil,
 		Depth:         depth,
 		RefundCounter: env.IntraBlockState().GetRefund(),
+		RefundChange:  scope.RefundChange,
 		Err:           err,
+		name:          env.config.OpCodeNames[op],
+	}
+	if cfg.captureMemory(op) {
+		// Empty but captured, as opposed to disabled
+		if log.Memory = memory.Data(); log.Memory == nil {
+			log.Memory = []byte{}
+		}
 	}
-	if !l.cfg.DisableMemory {
-		log.Memory = memory.Data()
+	if cfg.PushData {
+		log.PushData = pushData(scope.Contract.Code, pc, op)
 	}
-	if !l.cfg.DisableStack {
+	if !cfg.DisableStack {
 		//TODO(@holiman) improve this
-		logstack := make([]*big.Int, len(stack.Data))
-		for i, item := range stack.Data {
+		items := cfg.stackTop(stack.Data)
+		logstack := make([]*big.Int, len(items))
+		for i, item := range items {
 			logstack[i] = item.ToBig()
 		}
 		log.Stack = logstack
 	}
-	_ = l.encoder.Encode(log)
+	if !cfg.DisableReturnData {
+		if limit := env.Config().MaxTraceOutputSize; limit > 0 && len(rData) > limit {
+			rData, log.ReturnDataCut = rData[:limit], true
+		}
+		log.ReturnData = rData
+	}
+	return log, true
 }
 
 // CaptureFault outputs state information on the logger.
@@ -83,6 +135,7 @@ func (l *JSONLogger) CaptureEnd(depth int, output []byte, startGas, endGas uint6
 	type endLog struct {
 		Output  string              `json:"output"`
 		GasUsed math.HexOrDecimal64 `json:"gasUsed"`
+		Failed  bool                `json:"failed"`
 		Time    time.Duration       `json:"time"`
 		Err     string              `json:"error,omitempty"`
 	}
@@ -93,7 +146,10 @@ func (l *JSONLogger) CaptureEnd(depth int, output []byte, startGas, endGas uint6
 	if err != nil {
 		errMsg = err.Error()
 	}
-	_ = l.encoder.Encode(endLog{common.Bytes2Hex(output), math.HexOrDecimal64(startGas - endGas), t, errMsg})
+	l.encode(endLog{common.Bytes2Hex(output), math.HexOrDecimal64(startGas - endGas), err != nil, t, errMsg})
+}
+
+func (l *JSONLogger) CaptureExit(output []byte, gasUsed uint64, err error) {
 }
 
 func (l *JSONLogger) CaptureSelfDestruct(from common.Address, to common.Address, value *big.Int) {
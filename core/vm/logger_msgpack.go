@@ -0,0 +1,279 @@
+package vm
+
+import (
+	"errors"
+	"io"
+	"math/big"
+	"time"
+
+	"github.com/holiman/uint256"
+	"github.com/ugorji/go/codec"
+
+	"github.com/ledgerwatch/erigon/common"
+)
+
+// msgpackStructLog is the MessagePack encoding of a StructLog. It is written as
+// an array, so fields may only be appended.
+type msgpackStructLog struct {
+	_struct       bool `codec:",toarray"` //nolint:structcheck,unused
+	Pc            uint64
+	Op            OpCode
+	Gas           uint64
+	GasCost       uint64
+	DynamicGas    uint64
+	Memory        []byte
+	MemorySize    int
+	Stack         [][]byte // big-endian, without leading zeros
+	ReturnData    []byte
+	ReturnDataCut bool
+	Depth         int
+	RefundCounter uint64
+	RefundChange  int64
+	Duration      time.Duration
+	OpName        string // only if it differs from Op.String()
+	Err           string
+	CallPath      string
+	PushData      []byte
+	ColdAccess    bool
+}
+
+func newMsgpackHandle() *codec.MsgpackHandle {
+	var handle codec.MsgpackHandle
+	handle.WriteExt = true // distinguish strings from byte slices
+	return &handle
+}
+
+// EncodeMsgpack writes the step as a MessagePack array, see
+// MsgpackLogDecoder for reading it back.
+func (s *StructLog) EncodeMsgpack(enc *codec.Encoder) error {
+	log := msgpackStructLog{
+		Pc:            s.Pc,
+		Op:            s.Op,
+		Gas:           s.Gas,
+		GasCost:       s.GasCost,
+		DynamicGas:    s.DynamicGas,
+		Memory:        s.Memory,
+		MemorySize:    s.MemorySize,
+		ReturnData:    s.ReturnData,
+		ReturnDataCut: s.ReturnDataCut,
+		Depth:         s.Depth,
+		RefundCounter: s.RefundCounter,
+		RefundChange:  s.RefundChange,
+		Duration:      s.Duration,
+		Err:           s.ErrorString(),
+		CallPath:      s.CallPath,
+		PushData:      s.PushData,
+		ColdAccess:    s.ColdAccess,
+	}
+	if s.name != s.Op.String() {
+		log.OpName = s.name
+	}
+	if s.Stack != nil {
+		log.Stack = make([][]byte, len(s.Stack))
+		for i, item := range s.Stack {
+			log.Stack[i] = item.Bytes()
+		}
+	}
+	return enc.Encode(&log)
+}
+
+// MsgpackLogSummary is the record ending the stream of a MsgpackLogger, with
+// the same fields as the summary line of the JSONLogger. It is written as a
+// map, so that it can be told apart from the steps.
+type MsgpackLogSummary struct {
+	Output  []byte
+	GasUsed uint64
+	Failed  bool
+	Time    time.Duration
+	Err     string
+}
+
+// MsgpackLogger streams the execution steps encoded as MessagePack, with the same
+// fields as the JSONLogger but about half the size, and a MsgpackLogSummary at
+// the end. The stream can be read back with a MsgpackLogDecoder.
+type MsgpackLogger struct {
+	encoder *codec.Encoder
+	writer  io.Writer
+	cfg     *LogConfig
+}
+
+// NewMsgpackLogger creates a new EVM tracer that writes execution steps as
+// MessagePack into the provided stream, with the default configuration.
+func NewMsgpackLogger(writer io.Writer) *MsgpackLogger {
+	return NewMsgpackLoggerWithConfig(nil, writer)
+}
+
+// NewMsgpackLoggerWithConfig creates a new EVM tracer that writes execution
+// steps as MessagePack into the provided stream, captured as configured like
+// those of the JSONLogger. Buffered writers are flushed after every step.
+func NewMsgpackLoggerWithConfig(cfg *LogConfig, writer io.Writer) *MsgpackLogger {
+	l := &MsgpackLogger{codec.NewEncoder(writer, newMsgpackHandle()), writer, cfg}
+	if l.cfg == nil {
+		l.cfg = &LogConfig{}
+	}
+	return l
+}
+
+// flush flushes the records written so far through writers such as
+// bufio.Writer or http.Flusher.
+func (l *MsgpackLogger) flush() {
+	switch w := l.writer.(type) {
+	case interface{ Flush() error }:
+		_ = w.Flush()
+	case interface{ Flush() }:
+		w.Flush()
+	}
+}
+
+func (l *MsgpackLogger) CaptureStart(env *EVM, depth int, from common.Address, to common.Address, precompile bool, create bool, calltype CallType, input []byte, gas uint64, value *big.Int, code []byte) {
+}
+
+func (l *MsgpackLogger) CaptureEnter(typ OpCode, from common.Address, to common.Address, input []byte, gas uint64, value *uint256.Int) {
+}
+
+// CaptureState outputs state information on the logger.
+func (l *MsgpackLogger) CaptureState(env *EVM, pc uint64, op OpCode, gas, cost uint64, scope *ScopeContext, rData []byte, depth int, err error) {
+	log, ok := l.cfg.streamedStep(env, pc, op, gas, cost, scope, rData, depth, err)
+	if !ok {
+		return
+	}
+	if err := log.EncodeMsgpack(l.encoder); err != nil {
+		return
+	}
+	l.flush()
+}
+
+// CaptureFault outputs state information on the logger.
+func (l *MsgpackLogger) CaptureFault(env *EVM, pc uint64, op OpCode, gas, cost uint64, scope *ScopeContext, depth int, err error) {
+}
+
+// CaptureEnd is triggered at end of execution.
+func (l *MsgpackLogger) CaptureEnd(depth int, output []byte, startGas, endGas uint64, t time.Duration, err error) {
+	if depth != 0 {
+		return
+	}
+	summary := MsgpackLogSummary{Output: output, GasUsed: startGas - endGas, Failed: err != nil, Time: t}
+	if err != nil {
+		summary.Err = err.Error()
+	}
+	if err := l.encoder.Encode(&summary); err != nil {
+		return
+	}
+	l.flush()
+}
+
+func (l *MsgpackLogger) CaptureExit(output []byte, gasUsed uint64, err error) {
+}
+
+func (l *MsgpackLogger) CaptureSelfDestruct(from common.Address, to common.Address, value *big.Int) {
+}
+
+func (l *MsgpackLogger) CaptureAccountRead(account common.Address) error {
+	return nil
+}
+
+func (l *MsgpackLogger) CaptureAccountWrite(account common.Address) error {
+	return nil
+}
+
+// MsgpackLogDecoder reads back the steps written by a MsgpackLogger.
+type MsgpackLogDecoder struct {
+	handle  *codec.MsgpackHandle
+	decoder *codec.Decoder
+	summary *MsgpackLogSummary
+}
+
+// NewMsgpackLogDecoder returns a decoder reading steps from the provided stream.
+func NewMsgpackLogDecoder(reader io.Reader) *MsgpackLogDecoder {
+	handle := newMsgpackHandle()
+	return &MsgpackLogDecoder{handle: handle, decoder: codec.NewDecoder(reader, handle)}
+}
+
+// Decode reads the next step into s. It returns io.EOF at the end of the
+// stream, or once the summary is read, see Summary. Errors are restored as
+// plain errors with the same message.
+func (d *MsgpackLogDecoder) Decode(s *StructLog) error {
+	if d.summary != nil {
+		return io.EOF
+	}
+	var raw codec.Raw
+	if err := d.decoder.Decode(&raw); err != nil {
+		return err
+	}
+	record := codec.NewDecoderBytes(raw, d.handle)
+	if isMsgpackMap(raw) {
+		var summary MsgpackLogSummary
+		if err := record.Decode(&summary); err != nil {
+			return err
+		}
+		d.summary = &summary
+		return io.EOF
+	}
+	var log msgpackStructLog
+	if err := record.Decode(&log); err != nil {
+		return err
+	}
+	*s = StructLog{
+		Pc:            log.Pc,
+		Op:            log.Op,
+		Gas:           log.Gas,
+		GasCost:       log.GasCost,
+		DynamicGas:    log.DynamicGas,
+		Memory:        log.Memory,
+		MemorySize:    log.MemorySize,
+		ReturnData:    log.ReturnData,
+		ReturnDataCut: log.ReturnDataCut,
+		Depth:         log.Depth,
+		RefundCounter: log.RefundCounter,
+		RefundChange:  log.RefundChange,
+		Duration:      log.Duration,
+		CallPath:      log.CallPath,
+		PushData:      log.PushData,
+		ColdAccess:    log.ColdAccess,
+		name:          log.OpName,
+	}
+	if log.Stack != nil {
+		s.Stack = make([]*big.Int, len(log.Stack))
+		for i, item := range log.Stack {
+			s.Stack[i] = new(big.Int).SetBytes(item)
+		}
+	}
+	if log.Err != "" {
+		s.Err = errors.New(log.Err)
+	}
+	return nil
+}
+
+// Summary returns the summary ending the stream, or nil if it was not read yet
+// or the stream has none.
+func (d *MsgpackLogDecoder) Summary() *MsgpackLogSummary {
+	return d.summary
+}
+
+// isMsgpackMap tells whether the encoded value is a map, as the summary is,
+// rather than an array, as the steps are.
+func isMsgpackMap(raw codec.Raw) bool {
+	if len(raw) == 0 {
+		return false
+	}
+	return raw[0]&0xf0 == 0x80 || raw[0] == 0xde || raw[0] == 0xdf
+}
+
+// DecodeMsgpackLogs reads all the steps written by a MsgpackLogger, leaving out
+// the summary.
+func DecodeMsgpackLogs(reader io.Reader) ([]StructLog, error) {
+	var (
+		decoder = NewMsgpackLogDecoder(reader)
+		logs    []StructLog
+	)
+	for {
+		var log StructLog
+		if err := decoder.Decode(&log); err != nil {
+			if errors.Is(err, io.EOF) {
+				return logs, nil
+			}
+			return logs, err
+		}
+		logs = append(logs, log)
+	}
+}
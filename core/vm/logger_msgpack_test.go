@@ -0,0 +1,127 @@
+package vm
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/big"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/holiman/uint256"
+
+	"github.com/ledgerwatch/erigon/common"
+	"github.com/ledgerwatch/erigon/common/math"
+)
+
+func TestMsgpackLoggerRoundTrip(t *testing.T) {
+	contract := common.HexToAddress("0xaa")
+	// MSTORE(0, 0xff), SSTORE(0, 1), then RETURN(0, 32)
+	code := []byte{
+		byte(PUSH1), 0xff, byte(PUSH1), 0, byte(MSTORE),
+		byte(PUSH1), 1, byte(PUSH1), 0, byte(SSTORE),
+		byte(PUSH1), 32, byte(PUSH1), 0, byte(RETURN),
+	}
+	run := func(tracer Tracer) {
+		vmenv, s := newTestEVM(t, Config{Debug: true, Tracer: tracer, OpCodeNames: OpCodeNames{MSTORE: "MSTORE256"}})
+		s.SetCode(contract, code)
+		s.AddAddressToAccessList(contract)
+		if _, _, err := vmenv.Call(AccountRef(common.Address{}), contract, nil, 100000, new(uint256.Int), false /* bailout */); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, cfg := range []*LogConfig{
+		nil,
+		{StackTop: 1, PushData: true, MemoryAtBoundariesOnly: true, DisableReturnData: true},
+		{OnlyStateChanges: true, DisableMemory: true, DisableStack: true},
+	} {
+		var packed, lines bytes.Buffer
+		run(NewMsgpackLoggerWithConfig(cfg, &packed))
+		run(NewJSONLogger(cfg, &lines))
+
+		decoder := NewMsgpackLogDecoder(&packed)
+		var logs []StructLog
+		for {
+			var log StructLog
+			if err := decoder.Decode(&log); errors.Is(err, io.EOF) {
+				break
+			} else if err != nil {
+				t.Fatalf("config %d: %v", i, err)
+			}
+			logs = append(logs, log)
+		}
+		// The decoded steps encode to the same JSON as the JSON logger wrote,
+		// and the summary has the same fields as its summary line.
+		want := strings.Split(strings.TrimSuffix(lines.String(), "\n"), "\n")
+		want, end := want[:len(want)-1], want[len(want)-1]
+		if len(logs) != len(want) {
+			t.Fatalf("config %d: expected %d steps, got %d", i, len(want), len(logs))
+		}
+		for j := range logs {
+			have, err := json.Marshal(logs[j])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(have) != want[j] {
+				t.Errorf("config %d, step %d:\nhave %s\nwant %s", i, j, have, want[j])
+			}
+		}
+		var summary struct {
+			Output  string              `json:"output"`
+			GasUsed math.HexOrDecimal64 `json:"gasUsed"`
+			Failed  bool                `json:"failed"`
+			Err     string              `json:"error"`
+		}
+		if err := json.Unmarshal([]byte(end), &summary); err != nil {
+			t.Fatal(err)
+		}
+		if have := decoder.Summary(); have == nil {
+			t.Errorf("config %d: no summary", i)
+		} else if common.Bytes2Hex(have.Output) != summary.Output || have.GasUsed != uint64(summary.GasUsed) || have.Failed != summary.Failed || have.Err != summary.Err {
+			t.Errorf("config %d: have summary %+v, want %s", i, have, end)
+		}
+		switch i {
+		case 0:
+			if name := logs[2].OpName(); name != "MSTORE256" {
+				t.Errorf("expected custom name, got %s", name)
+			}
+		case 2:
+			if len(logs) != 1 || logs[0].Op != SSTORE {
+				t.Errorf("expected the SSTORE step only, got %d steps", len(logs))
+			}
+		}
+	}
+
+	log := StructLog{
+		Pc:            3,
+		Op:            SSTORE,
+		Gas:           1000,
+		GasCost:       20000,
+		Stack:         []*big.Int{big.NewInt(0), new(big.Int).Lsh(big.NewInt(1), 255)},
+		ReturnData:    []byte{1, 2},
+		ReturnDataCut: true,
+		Depth:         2,
+		RefundChange:  -4800,
+		Err:           ErrOutOfGas,
+	}
+	var buf bytes.Buffer
+	if err := log.EncodeMsgpack(NewMsgpackLogger(&buf).encoder); err != nil {
+		t.Fatal(err)
+	}
+	var decoded StructLog
+	if err := NewMsgpackLogDecoder(&buf).Decode(&decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Err == nil || decoded.Err.Error() != ErrOutOfGas.Error() {
+		t.Errorf("unexpected error %v", decoded.Err)
+	}
+	decoded.Err, log.Err = nil, nil
+	if !reflect.DeepEqual(decoded, log) {
+		t.Errorf("have %+v, want %+v", decoded, log)
+	}
+	if err := NewMsgpackLogDecoder(&buf).Decode(&decoded); !errors.Is(err, io.EOF) {
+		t.Errorf("expected EOF, got %v", err)
+	}
+}
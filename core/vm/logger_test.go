@@ -17,13 +17,27 @@
 package vm
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"math/big"
+	"reflect"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/holiman/uint256"
+	"github.com/ledgerwatch/erigon-lib/kv/memdb"
 
 	"github.com/ledgerwatch/erigon/common"
+	"github.com/ledgerwatch/erigon/common/hexutil"
+	"github.com/ledgerwatch/erigon/common/math"
+	"github.com/ledgerwatch/erigon/core/state"
 	"github.com/ledgerwatch/erigon/core/vm/stack"
+	"github.com/ledgerwatch/erigon/crypto"
 	"github.com/ledgerwatch/erigon/params"
 )
 
@@ -52,3 +66,1072 @@ func TestStoreCapture(t *testing.T) {
 		t.Errorf("expected %x, got %x", exp, logger.storage[contract.Address()][index])
 	}
 }
+
+// newTestEVM returns an EVM on top of an empty in-memory state, with value
+// transfers stubbed out.
+func newTestEVM(t testing.TB, vmConfig Config) (*EVM, *state.IntraBlockState) {
+	_, tx := memdb.NewTestTx(t)
+	s := state.New(state.NewPlainStateReader(tx))
+	vmctx := BlockContext{
+		CanTransfer: func(IntraBlockState, common.Address, *uint256.Int) bool { return true },
+		Transfer:    func(IntraBlockState, common.Address, common.Address, *uint256.Int, bool) {},
+	}
+	return NewEVM(vmctx, TxContext{}, s, params.AllEthashProtocolChanges, vmConfig), s
+}
+
+func TestStructLoggerDynamicGas(t *testing.T) {
+	address := common.BytesToAddress([]byte("contract"))
+	logger := NewStructLogger(nil)
+	vmenv, s := newTestEVM(t, Config{Debug: true, Tracer: logger})
+	s.CreateAccount(address, true)
+	// PUSH1 1, PUSH1 0, MSTORE, STOP
+	s.SetCode(address, []byte{byte(PUSH1), 1, byte(PUSH1), 0, byte(MSTORE), byte(STOP)})
+
+	if _, _, err := vmenv.Call(AccountRef(common.Address{}), address, nil, 100000, new(uint256.Int), false /* bailout */); err != nil {
+		t.Fatal(err)
+	}
+	logs := logger.StructLogs()
+	if len(logs) != 4 {
+		t.Fatalf("expected 4 logs, got %d", len(logs))
+	}
+	for i, want := range []struct {
+		op      OpCode
+		cost    uint64
+		dynamic uint64
+	}{
+		{PUSH1, GasFastestStep, 0},
+		{PUSH1, GasFastestStep, 0},
+		{MSTORE, GasFastestStep + params.MemoryGas, params.MemoryGas}, // one word of memory expansion
+		{STOP, 0, 0},
+	} {
+		if logs[i].Op != want.op || logs[i].GasCost != want.cost || logs[i].DynamicGas != want.dynamic {
+			t.Errorf("log %d: have %v cost=%d dynamic=%d, want %v cost=%d dynamic=%d",
+				i, logs[i].Op, logs[i].GasCost, logs[i].DynamicGas, want.op, want.cost, want.dynamic)
+		}
+	}
+}
+
+type createRecord struct {
+	address      common.Address
+	callType     CallType
+	salt         *uint256.Int
+	initCodeHash common.Hash
+	err          error
+}
+
+type testCreateTracer struct {
+	*StructLogger
+	creates []createRecord
+}
+
+func (ct *testCreateTracer) CaptureCreate(env *EVM, depth int, creator common.Address, address common.Address, callType CallType, salt *uint256.Int, initCodeHash common.Hash) {
+	ct.creates = append(ct.creates, createRecord{address: address, callType: callType, salt: salt, initCodeHash: initCodeHash})
+}
+
+func (ct *testCreateTracer) CaptureEnd(depth int, output []byte, startGas, endGas uint64, t time.Duration, err error) {
+	ct.creates[len(ct.creates)-1].err = err
+}
+
+func TestCreate2Capture(t *testing.T) {
+	tracer := &testCreateTracer{StructLogger: NewStructLogger(nil)}
+	vmenv, _ := newTestEVM(t, Config{Debug: true, Tracer: tracer})
+
+	var (
+		caller   = AccountRef(common.HexToAddress("0xdeadbeef"))
+		initCode = []byte{byte(STOP)}
+		salt     = uint256.NewInt(42)
+		codeHash = crypto.Keccak256Hash(initCode)
+		expected = crypto.CreateAddress2(caller.Address(), salt.Bytes32(), codeHash.Bytes())
+	)
+	_, addr, _, err := vmenv.Create2(caller, initCode, 100000, new(uint256.Int), salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr != expected {
+		t.Fatalf("unexpected address: have %x, want %x", addr, expected)
+	}
+	// The second deployment collides with the first one and has to abort,
+	// but the tracer must still see the predicted address.
+	if _, _, _, err = vmenv.Create2(caller, initCode, 100000, new(uint256.Int), salt); !errors.Is(err, ErrContractAddressCollision) {
+		t.Fatalf("expected collision, got %v", err)
+	}
+	if len(tracer.creates) != 2 {
+		t.Fatalf("expected 2 creates, got %d", len(tracer.creates))
+	}
+	for i, c := range tracer.creates {
+		if c.address != expected || c.callType != CREATE2T || c.salt.Cmp(salt) != 0 || c.initCodeHash != codeHash {
+			t.Errorf("create %d: unexpected capture %+v", i, c)
+		}
+	}
+	if tracer.creates[0].err != nil {
+		t.Errorf("first create: unexpected error %v", tracer.creates[0].err)
+	}
+	if !errors.Is(tracer.creates[1].err, ErrContractAddressCollision) {
+		t.Errorf("second create: expected collision, got %v", tracer.creates[1].err)
+	}
+}
+
+func TestNoGasMetering(t *testing.T) {
+	address := common.BytesToAddress([]byte("contract"))
+	// SSTORE(1, 1); SSTORE(2, 1); STOP, costing well above the provided gas
+	code := []byte{
+		byte(PUSH1), 1, byte(PUSH1), 1, byte(SSTORE),
+		byte(PUSH1), 1, byte(PUSH1), 2, byte(SSTORE),
+		byte(STOP),
+	}
+	const gas = 5000
+	for _, tt := range []struct {
+		debug bool
+		err   error
+	}{
+		{debug: true},
+		{debug: false, err: ErrOutOfGas}, // ignored outside of tracing
+	} {
+		logger := NewStructLogger(nil)
+		vmenv, s := newTestEVM(t, Config{Debug: tt.debug, Tracer: logger, NoGasMetering: true})
+		s.CreateAccount(address, true)
+		s.SetCode(address, code)
+		s.AddAddressToAccessList(address)
+		_, leftOver, err := vmenv.Call(AccountRef(common.Address{}), address, nil, gas, new(uint256.Int), false /* bailout */)
+		if !errors.Is(err, tt.err) {
+			t.Fatalf("debug=%v: expected error %v, got %v", tt.debug, tt.err, err)
+		}
+		if !tt.debug {
+			continue
+		}
+		if leftOver != gas {
+			t.Errorf("expected no gas to be used, %d left", leftOver)
+		}
+		var total uint64
+		for _, log := range logger.StructLogs() {
+			if log.Gas != gas {
+				t.Errorf("%v: expected gas to stay at %d, got %d", log.Op, gas, log.Gas)
+			}
+			total += log.GasCost
+		}
+		if total <= gas {
+			t.Errorf("expected the reported costs to exceed the gas limit, got %d", total)
+		}
+	}
+}
+
+func TestStructLoggerTransientStorage(t *testing.T) {
+	address := common.BytesToAddress([]byte("contract"))
+	// TSTORE(1, 0x2a); SSTORE(2, 3); PUSH1 1; TLOAD; STOP
+	code := []byte{
+		byte(PUSH1), 0x2a, byte(PUSH1), 1, byte(TSTORE),
+		byte(PUSH1), 3, byte(PUSH1), 2, byte(SSTORE),
+		byte(PUSH1), 1, byte(TLOAD),
+		byte(STOP),
+	}
+	jt := newBerlinInstructionSet()
+	enable1153(&jt)
+	logger := NewStructLogger(&LogConfig{TransientStorage: true})
+	vmenv, s := newTestEVM(t, Config{Debug: true, Tracer: logger, JumpTable: &jt})
+	s.CreateAccount(address, true)
+	s.SetCode(address, code)
+	s.AddAddressToAccessList(address)
+	if _, _, err := vmenv.Call(AccountRef(common.Address{}), address, nil, 100000, new(uint256.Int), false /* bailout */); err != nil {
+		t.Fatal(err)
+	}
+	var (
+		slot1 = common.BigToHash(big.NewInt(1))
+		slot2 = common.BigToHash(big.NewInt(2))
+	)
+	logs := logger.StructLogs()
+	last := logs[len(logs)-1]
+	if len(last.Transient) != 1 || last.Transient[slot1] != common.BigToHash(big.NewInt(0x2a)) {
+		t.Errorf("unexpected transient storage %v", last.Transient)
+	}
+	if len(last.Storage) != 1 || last.Storage[slot2] != common.BigToHash(big.NewInt(3)) {
+		t.Errorf("unexpected persistent storage %v", last.Storage)
+	}
+
+	// The next transaction starts with empty transient storage
+	s.Prepare(common.Hash{0x01}, common.Hash{}, 1)
+	s.SetCode(address, []byte{byte(PUSH1), 1, byte(TLOAD), byte(STOP)})
+	if _, _, err := vmenv.Call(AccountRef(common.Address{}), address, nil, 100000, new(uint256.Int), false /* bailout */); err != nil {
+		t.Fatal(err)
+	}
+	logs = logger.StructLogs()
+	last = logs[len(logs)-1]
+	if last.Transient[slot1] != (common.Hash{}) {
+		t.Errorf("expected transient slot to be cleared, got %x", last.Transient[slot1])
+	}
+	if last.Storage[slot2] != common.BigToHash(big.NewInt(3)) {
+		t.Errorf("expected persistent slot to survive, got %x", last.Storage[slot2])
+	}
+}
+
+type returnDataTracer struct {
+	*StructLogger
+	returnData map[uint64][]byte // by pc of the outermost frame
+}
+
+func (rt *returnDataTracer) CaptureState(env *EVM, pc uint64, op OpCode, gas, cost uint64, scope *ScopeContext, rData []byte, depth int, err error) {
+	if depth == 1 {
+		rt.returnData[pc] = common.CopyBytes(scope.ReturnData)
+	}
+}
+
+func TestScopeReturnData(t *testing.T) {
+	var (
+		outer    = common.HexToAddress("0xaa")
+		returner = common.HexToAddress("0xbb")
+		stopper  = common.HexToAddress("0xcc")
+	)
+	// callCode performs a zero-value CALL to the given one-byte address.
+	callCode := func(addr byte) []byte {
+		return []byte{byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), addr, byte(GAS), byte(CALL)}
+	}
+	code := append(callCode(0xbb), byte(POP)) // POP at pc 14
+	code = append(code, callCode(0xcc)...)
+	code = append(code, byte(STOP)) // STOP at pc 29
+	tracer := &returnDataTracer{StructLogger: NewStructLogger(nil), returnData: make(map[uint64][]byte)}
+	vmenv, s := newTestEVM(t, Config{Debug: true, Tracer: tracer})
+	s.SetCode(outer, code)
+	// RETURN the two bytes 0xbeef
+	s.SetCode(returner, []byte{byte(PUSH2), 0xbe, 0xef, byte(PUSH1), 0, byte(MSTORE), byte(PUSH1), 2, byte(PUSH1), 30, byte(RETURN)})
+	s.SetCode(stopper, []byte{byte(STOP)})
+	if _, _, err := vmenv.Call(AccountRef(common.Address{}), outer, nil, 100000, new(uint256.Int), false /* bailout */); err != nil {
+		t.Fatal(err)
+	}
+	if rd := tracer.returnData[13]; len(rd) != 0 {
+		t.Errorf("expected no return data before the first call, got %x", rd)
+	}
+	if rd := tracer.returnData[14]; !bytes.Equal(rd, []byte{0xbe, 0xef}) {
+		t.Errorf("expected the first call's output after it returned, got %x", rd)
+	}
+	if rd := tracer.returnData[29]; len(rd) != 0 {
+		t.Errorf("expected the return data to be cleared by the second call, got %x", rd)
+	}
+}
+
+func TestMaxTraceOutputSize(t *testing.T) {
+	var (
+		outer    = common.HexToAddress("0xaa")
+		returner = common.HexToAddress("0xbb")
+	)
+	// RETURN 64 bytes of memory holding 0x2a at the end of the first word
+	returnCode := []byte{byte(PUSH1), 0x2a, byte(PUSH1), 0, byte(MSTORE), byte(PUSH1), 64, byte(PUSH1), 0, byte(RETURN)}
+	// CALL(gas, 0xbb, 0, 0, 0, 0, 0); POP; RETURNDATACOPY(0, 0, 64); RETURN(0, 64)
+	code := []byte{
+		byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0,
+		byte(PUSH1), 0xbb, byte(GAS), byte(CALL), byte(POP),
+		byte(PUSH1), 64, byte(PUSH1), 0, byte(PUSH1), 0, byte(RETURNDATACOPY),
+		byte(PUSH1), 64, byte(PUSH1), 0, byte(RETURN),
+	}
+	logger := NewStructLogger(nil)
+	vmenv, s := newTestEVM(t, Config{Debug: true, Tracer: logger, MaxTraceOutputSize: 8})
+	s.SetCode(outer, code)
+	s.SetCode(returner, returnCode)
+	ret, _, err := vmenv.Call(AccountRef(common.Address{}), outer, nil, 100000, new(uint256.Int), false /* bailout */)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ret) != 64 || ret[31] != 0x2a {
+		t.Fatalf("execution output affected by the trace limit: %x", ret)
+	}
+	if len(logger.Output()) != 8 || !logger.OutputTruncated() {
+		t.Errorf("expected traced output to be cut to 8 bytes, got %x (truncated %v)", logger.Output(), logger.OutputTruncated())
+	}
+	var checked bool
+	for _, log := range logger.StructLogs() {
+		if log.Depth == 1 && log.Op == RETURNDATACOPY {
+			checked = true
+			if len(log.ReturnData) != 8 || !log.ReturnDataCut {
+				t.Errorf("expected return data to be cut to 8 bytes, got %x (truncated %v)", log.ReturnData, log.ReturnDataCut)
+			}
+		}
+	}
+	if !checked {
+		t.Error("RETURNDATACOPY not traced")
+	}
+
+	// Outputs within the limit are untouched
+	logger = NewStructLogger(nil)
+	vmenv, s = newTestEVM(t, Config{Debug: true, Tracer: logger, MaxTraceOutputSize: 64})
+	s.SetCode(returner, returnCode)
+	if _, _, err := vmenv.Call(AccountRef(common.Address{}), returner, nil, 100000, new(uint256.Int), false /* bailout */); err != nil {
+		t.Fatal(err)
+	}
+	if len(logger.Output()) != 64 || logger.OutputTruncated() {
+		t.Errorf("expected the full output to be traced, got %d bytes (truncated %v)", len(logger.Output()), logger.OutputTruncated())
+	}
+}
+
+func TestScopeStackAccessors(t *testing.T) {
+	st := stack.New()
+	defer stack.ReturnNormalStack(st)
+	for i := uint64(1); i <= 3; i++ {
+		st.Push(uint256.NewInt(i))
+	}
+	scope := &ScopeContext{Stack: st}
+	if scope.StackLen() != 3 {
+		t.Fatalf("unexpected stack length %d", scope.StackLen())
+	}
+	if top := scope.StackBack(0); top == nil || top.Uint64() != 3 {
+		t.Errorf("unexpected top of stack %v", top)
+	}
+	if bottom := scope.StackBack(2); bottom == nil || bottom.Uint64() != 1 {
+		t.Errorf("unexpected bottom of stack %v", bottom)
+	}
+	if item := scope.StackBack(3); item != nil {
+		t.Errorf("expected nil beyond the stack, got %v", item)
+	}
+	if item := scope.StackBack(-1); item != nil {
+		t.Errorf("expected nil for a negative depth, got %v", item)
+	}
+
+	dst := make([]uint256.Int, 2)
+	if n := scope.CopyStackTop(dst); n != 2 || dst[0].Uint64() != 3 || dst[1].Uint64() != 2 {
+		t.Errorf("unexpected copy of the top 2 items: %d %v", n, dst)
+	}
+	// The number of copied items is clamped to the stack height
+	dst = make([]uint256.Int, 5)
+	if n := scope.CopyStackTop(dst); n != 3 || dst[2].Uint64() != 1 || !dst[3].IsZero() {
+		t.Errorf("unexpected copy of the whole stack: %d %v", n, dst)
+	}
+	if allocs := testing.AllocsPerRun(10, func() { scope.CopyStackTop(dst) }); allocs != 0 {
+		t.Errorf("CopyStackTop allocated %v times", allocs)
+	}
+}
+
+func TestScopeFrameAccessors(t *testing.T) {
+	var (
+		caller = common.HexToAddress("0xaa")
+		self   = common.HexToAddress("0xbb")
+	)
+	contract := NewContract(AccountRef(caller), AccountRef(self), uint256.NewInt(7), 0, false /* skipAnalysis */)
+	contract.Input = []byte{1, 2, 3}
+	scope := &ScopeContext{Contract: contract}
+	if scope.Address() != self || scope.Caller() != caller || !bytes.Equal(scope.Input(), contract.Input) {
+		t.Errorf("unexpected frame %x %x %x", scope.Address(), scope.Caller(), scope.Input())
+	}
+	// Mutating the returned value must not change the contract's
+	scope.CallValue().SetUint64(8)
+	if v := scope.CallValue(); v.Uint64() != 7 || contract.Value().Uint64() != 7 {
+		t.Errorf("call value was modified: %v", v)
+	}
+}
+
+type staticTracer struct {
+	*StructLogger
+	static map[int]bool // by depth
+}
+
+func (st *staticTracer) CaptureState(env *EVM, pc uint64, op OpCode, gas, cost uint64, scope *ScopeContext, rData []byte, depth int, err error) {
+	st.static[depth] = scope.Static()
+}
+
+func TestScopeStatic(t *testing.T) {
+	var (
+		outer  = common.HexToAddress("0xaa")
+		static = common.HexToAddress("0xbb")
+		nested = common.HexToAddress("0xcc")
+	)
+	// STATICCALL(gas, 0xbb, 0, 0, 0, 0)
+	s0 := []byte{byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0xbb, byte(GAS), byte(STATICCALL), byte(STOP)}
+	// CALL(gas, 0xcc, 0, 0, 0, 0, 0)
+	s1 := []byte{byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0xcc, byte(GAS), byte(CALL), byte(STOP)}
+	tracer := &staticTracer{StructLogger: NewStructLogger(nil), static: make(map[int]bool)}
+	vmenv, s := newTestEVM(t, Config{Debug: true, Tracer: tracer})
+	s.SetCode(outer, s0)
+	s.SetCode(static, s1)
+	s.SetCode(nested, []byte{byte(STOP)})
+	if _, _, err := vmenv.Call(AccountRef(common.Address{}), outer, nil, 100000, new(uint256.Int), false /* bailout */); err != nil {
+		t.Fatal(err)
+	}
+	if len(tracer.static) != 3 {
+		t.Fatalf("expected 3 frames, got %v", tracer.static)
+	}
+	// The regular CALL made below the STATICCALL inherits read-only mode
+	if tracer.static[1] || !tracer.static[2] || !tracer.static[3] {
+		t.Errorf("unexpected read-only frames %v", tracer.static)
+	}
+}
+
+func TestJSONLoggerStreaming(t *testing.T) {
+	var (
+		contract = common.HexToAddress("0xaa")
+		out      bytes.Buffer
+		buffered = bufio.NewWriterSize(&out, 1<<20)
+	)
+	vmenv, s := newTestEVM(t, Config{Debug: true, Tracer: NewJSONLogger(nil, buffered)})
+	// REVERT(0, 0) after a few steps
+	s.SetCode(contract, []byte{byte(PUSH1), 0, byte(PUSH1), 0, byte(REVERT)})
+	if _, _, err := vmenv.Call(AccountRef(common.Address{}), contract, nil, 100000, new(uint256.Int), false /* bailout */); !errors.Is(err, ErrExecutionReverted) {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if buffered.Buffered() != 0 {
+		t.Errorf("%d bytes left in the buffered writer", buffered.Buffered())
+	}
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("expected 3 steps and a summary, got %d lines:\n%s", len(lines), out.String())
+	}
+	for i, line := range lines[:3] {
+		var step map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &step); err != nil {
+			t.Fatalf("step %d: %v", i, err)
+		}
+		if _, ok := step["pc"]; !ok {
+			t.Errorf("step %d without pc: %s", i, line)
+		}
+	}
+	var summary struct {
+		GasUsed math.HexOrDecimal64 `json:"gasUsed"`
+		Failed  bool                `json:"failed"`
+		Err     string              `json:"error"`
+	}
+	if err := json.Unmarshal([]byte(lines[3]), &summary); err != nil {
+		t.Fatal(err)
+	}
+	if !summary.Failed || summary.GasUsed == 0 || summary.Err != ErrExecutionReverted.Error() {
+		t.Errorf("unexpected summary %s", lines[3])
+	}
+}
+
+func TestStructLoggerOpcodeSummary(t *testing.T) {
+	var (
+		outer = common.HexToAddress("0xaa")
+		inner = common.HexToAddress("0xbb")
+	)
+	logger := NewStructLogger(&LogConfig{Limit: 1})
+	vmenv, s := newTestEVM(t, Config{Debug: true, Tracer: logger})
+	// MLOAD(64) expands the memory to 3 words, then CALL(gas, 0xbb, 0, 0, 0, 0, 0)
+	s.SetCode(outer, []byte{
+		byte(PUSH1), 64, byte(MLOAD), byte(POP),
+		byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0xbb, byte(GAS), byte(CALL), byte(POP),
+	})
+	s.SetCode(inner, []byte{byte(PUSH1), 1, byte(PUSH1), 2, byte(ADD)})
+
+	const gas = 100000
+	_, left, err := vmenv.Call(AccountRef(common.Address{}), outer, nil, gas, new(uint256.Int), false /* bailout */)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts, costs := logger.CountByOpcode(), logger.GasByOpcode()
+	if counts[PUSH1] != 9 || counts[POP] != 2 || counts[ADD] != 1 || counts[CALL] != 1 {
+		t.Errorf("unexpected counts %v", counts)
+	}
+	if costs[MLOAD] != GasFastestStep+3*params.MemoryGas {
+		t.Errorf("unexpected MLOAD gas %d", costs[MLOAD])
+	}
+	if costs[PUSH1] != 9*GasFastestStep {
+		t.Errorf("unexpected PUSH1 gas %d", costs[PUSH1])
+	}
+	// Without the forwarded gas, the opcodes add up to the gas used
+	var total uint64
+	for _, cost := range costs {
+		total += cost
+	}
+	if total != gas-left {
+		t.Errorf("opcodes cost %d, %d gas used", total, gas-left)
+	}
+}
+
+func TestStructLoggerOpCodeNames(t *testing.T) {
+	contract := common.HexToAddress("0xaa")
+	logger := NewStructLogger(nil)
+	vmenv, s := newTestEVM(t, Config{Debug: true, Tracer: logger, OpCodeNames: OpCodeNames{ADD: "PLUS", 0x0c: "CUSTOM"}})
+	s.SetCode(contract, []byte{byte(PUSH1), 1, byte(DUP1), byte(ADD), 0x0c})
+	if _, _, err := vmenv.Call(AccountRef(common.Address{}), contract, nil, 100000, new(uint256.Int), false /* bailout */); err == nil {
+		t.Fatal("expected the undefined opcode to fail")
+	}
+	logs := logger.StructLogs()
+	if len(logs) != 4 {
+		t.Fatalf("expected 4 steps, got %d", len(logs))
+	}
+	for i, want := range []string{"PUSH1", "DUP1", "PLUS", "CUSTOM"} {
+		if name := logs[i].OpName(); name != want {
+			t.Errorf("step %d: expected %s, got %s", i, want, name)
+		}
+	}
+	if res := FormatLogs(logs); res[2].Op != "PLUS" {
+		t.Errorf("unexpected formatted name %s", res[2].Op)
+	}
+	enc, err := json.Marshal(logs[3])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(enc), `"opName":"CUSTOM"`) {
+		t.Errorf("custom name missing from %s", enc)
+	}
+}
+
+func TestStructLoggerTimeSteps(t *testing.T) {
+	contract := common.HexToAddress("0xaa")
+	// Hash 1KB of memory a few times
+	code := []byte{}
+	for i := 0; i < 8; i++ {
+		code = append(code, byte(PUSH2), 0x04, 0x00, byte(PUSH1), 0, byte(SHA3), byte(POP))
+	}
+	for _, timed := range []bool{false, true} {
+		logger := NewStructLogger(&LogConfig{DisableMemory: true})
+		vmenv, s := newTestEVM(t, Config{Debug: true, Tracer: logger, TimeSteps: timed})
+		s.SetCode(contract, code)
+		start := time.Now()
+		if _, _, err := vmenv.Call(AccountRef(common.Address{}), contract, nil, 1000000, new(uint256.Int), false /* bailout */); err != nil {
+			t.Fatal(err)
+		}
+		elapsed := time.Since(start)
+
+		var total time.Duration
+		for i, log := range logger.StructLogs() {
+			if !timed && log.Duration != 0 {
+				t.Fatalf("step %d: unexpected duration %v without TimeSteps", i, log.Duration)
+			}
+			if log.Duration < 0 {
+				t.Fatalf("step %d: negative duration %v", i, log.Duration)
+			}
+			// The cumulative time never decreases and stays within the call
+			if total+log.Duration < total || total+log.Duration > elapsed {
+				t.Fatalf("step %d: cumulative duration %v, call took %v", i, total+log.Duration, elapsed)
+			}
+			total += log.Duration
+		}
+		if timed && total == 0 {
+			t.Error("no durations recorded")
+		}
+	}
+}
+
+func TestStructLoggerDisableCapture(t *testing.T) {
+	var (
+		env        = NewEVM(BlockContext{}, TxContext{}, &dummyStatedb{}, params.TestChainConfig, Config{})
+		mem        = NewMemory()
+		emptyStack = stack.New()
+		stack      = stack.New()
+		contract   = NewContract(&dummyContractRef{}, &dummyContractRef{}, new(uint256.Int), 0, false /* skipAnalysis */)
+		scope      = &ScopeContext{Memory: mem, Stack: stack, Contract: contract}
+	)
+	mem.Resize(1024)
+	stack.Push(uint256.NewInt(1))
+	stack.Push(uint256.NewInt(0))
+
+	for _, cfg := range []LogConfig{
+		{DisableMemory: true},
+		{DisableStack: true},
+		{DisableStorage: true},
+		{DisableMemory: true, DisableStack: true, DisableStorage: true},
+	} {
+		logger := NewStructLogger(&cfg)
+		logger.CaptureState(env, 0, SSTORE, 0, 0, scope, nil, 1, nil)
+		log := logger.StructLogs()[0]
+		if (log.Memory == nil) != cfg.DisableMemory || (log.Stack == nil) != cfg.DisableStack || (log.Storage == nil) != cfg.DisableStorage {
+			t.Errorf("config %+v: memory %v, stack %v, storage %v", cfg, log.Memory != nil, log.Stack != nil, log.Storage != nil)
+		}
+		if log.MemorySize != 1024 {
+			t.Errorf("config %+v: memory size %d", cfg, log.MemorySize)
+		}
+		enc, err := json.Marshal(&log)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var fields map[string]interface{}
+		if err := json.Unmarshal(enc, &fields); err != nil {
+			t.Fatal(err)
+		}
+		if (fields["memory"] == nil) != cfg.DisableMemory || (fields["stack"] == nil) != cfg.DisableStack {
+			t.Errorf("config %+v: unexpected memory or stack in %s", cfg, enc)
+		}
+		var decoded StructLog
+		if err := json.Unmarshal(enc, &decoded); err != nil {
+			t.Fatal(err)
+		}
+		if (decoded.Memory == nil) != cfg.DisableMemory || (decoded.Stack == nil) != cfg.DisableStack {
+			t.Errorf("config %+v: memory %v, stack %v after a JSON round trip", cfg, decoded.Memory != nil, decoded.Stack != nil)
+		}
+	}
+
+	// An empty memory and stack still encode when captured, and can be told
+	// apart from disabled ones
+	logger := NewStructLogger(nil)
+	logger.CaptureState(env, 0, STOP, 0, 0, &ScopeContext{Memory: NewMemory(), Stack: emptyStack, Contract: contract}, nil, 1, nil)
+	enc, err := json.Marshal(logger.StructLogs()[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(enc), `"memory":"0x"`) || !strings.Contains(string(enc), `"stack":[]`) {
+		t.Errorf("empty memory or stack left out of %s", enc)
+	}
+	var decoded StructLog
+	if err := json.Unmarshal(enc, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Memory == nil || decoded.Stack == nil {
+		t.Errorf("empty memory or stack decoded as disabled")
+	}
+
+	// With everything disabled the memory, stack and storage are not copied
+	logger = NewStructLogger(&LogConfig{DisableMemory: true, DisableStack: true, DisableStorage: true})
+	logger.logs = make([]StructLog, 0, 1000)
+	allocs := testing.AllocsPerRun(100, func() {
+		logger.CaptureState(env, 0, SSTORE, 0, 0, scope, nil, 1, nil)
+	})
+	if allocs != 0 {
+		t.Errorf("CaptureState allocated %v times with all capture disabled", allocs)
+	}
+}
+
+func TestStructLogStorageOrder(t *testing.T) {
+	storage, transient := make(Storage), make(Storage)
+	for i := int64(64); i > 0; i-- {
+		storage[common.BigToHash(big.NewInt(i))] = common.BigToHash(big.NewInt(i * 2))
+		transient[common.BigToHash(big.NewInt(i*3))] = common.Hash{0x01}
+	}
+	logs := []StructLog{{Op: SSTORE, Storage: storage, Transient: transient}}
+
+	var first, second bytes.Buffer
+	WriteTrace(&first, logs)
+	WriteTrace(&second, logs)
+	if !bytes.Equal(first.Bytes(), second.Bytes()) {
+		t.Fatalf("trace output differs between runs")
+	}
+	// Slots are listed in ascending order, in both sections
+	prev := -1
+	for i := int64(1); i <= 64; i++ {
+		pos := strings.Index(first.String(), common.BigToHash(big.NewInt(i)).Hex()[2:]+": ")
+		if pos <= prev {
+			t.Fatalf("slot %d out of order", i)
+		}
+		prev = pos
+	}
+	if keys := transient.SortedKeys(); len(keys) != 64 || !sort.IsSorted(keys) {
+		t.Errorf("transient keys not sorted")
+	}
+
+	enc1, err := json.Marshal(FormatLogs(logs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc2, _ := json.Marshal(FormatLogs(logs))
+	if !bytes.Equal(enc1, enc2) {
+		t.Errorf("JSON output differs between runs")
+	}
+}
+
+func TestStructLoggerCallPath(t *testing.T) {
+	var (
+		root   = common.HexToAddress("0xaa")
+		leaf   = common.HexToAddress("0xbb")
+		middle = common.HexToAddress("0xcc")
+	)
+	// CALL(gas, addr, 0, 0, 0, 0, 0)
+	call := func(addr common.Address) []byte {
+		return []byte{byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), addr[19], byte(GAS), byte(CALL), byte(POP)}
+	}
+	for _, enabled := range []bool{false, true} {
+		logger := NewStructLogger(&LogConfig{CallPath: enabled})
+		vmenv, s := newTestEVM(t, Config{Debug: true, Tracer: logger})
+		s.SetCode(root, append(call(leaf), call(middle)...))
+		s.SetCode(middle, call(leaf))
+		s.SetCode(leaf, []byte{byte(STOP)})
+		if _, _, err := vmenv.Call(AccountRef(common.Address{}), root, nil, 1000000, new(uint256.Int), false /* bailout */); err != nil {
+			t.Fatal(err)
+		}
+		var paths []string
+		for _, log := range logger.StructLogs() {
+			if len(paths) == 0 || paths[len(paths)-1] != log.CallPath {
+				paths = append(paths, log.CallPath)
+			}
+		}
+		want := []string{"0", "0.0", "0", "0.1", "0.1.0", "0.1", "0"}
+		if !enabled {
+			want = []string{""}
+		}
+		if !reflect.DeepEqual(paths, want) {
+			t.Errorf("call path enabled %v: have %v, want %v", enabled, paths, want)
+		}
+	}
+}
+
+type haltTracer struct {
+	*StructLogger
+	halts []haltEvent
+}
+
+type haltEvent struct {
+	depth  int
+	reason HaltReason
+	data   []byte
+}
+
+func (ht *haltTracer) CaptureHalt(depth int, reason HaltReason, data []byte) {
+	ht.halts = append(ht.halts, haltEvent{depth, reason, common.CopyBytes(data)})
+}
+
+func (ht *haltTracer) CaptureEnd(depth int, output []byte, startGas, endGas uint64, t time.Duration, err error) {
+	ht.halts = append(ht.halts, haltEvent{depth: -1})
+}
+
+func TestHaltTracer(t *testing.T) {
+	contract := common.HexToAddress("0xaa")
+	// MSTORE8(0, 0x2a) and the memory range of the single byte
+	withData := func(op OpCode) []byte {
+		return []byte{byte(PUSH1), 0x2a, byte(PUSH1), 0, byte(MSTORE8), byte(PUSH1), 1, byte(PUSH1), 0, byte(op)}
+	}
+	for i, tt := range []struct {
+		code   []byte
+		reason HaltReason
+		data   []byte
+	}{
+		{[]byte{byte(STOP)}, HaltStop, nil},
+		{[]byte{byte(PUSH1), 1}, HaltStop, nil},
+		{withData(RETURN), HaltReturn, []byte{0x2a}},
+		{withData(REVERT), HaltRevert, []byte{0x2a}},
+		{[]byte{byte(PUSH1), 0xee, byte(SELFDESTRUCT)}, HaltSelfDestruct, nil},
+		{[]byte{byte(JUMPDEST), byte(PUSH1), 0, byte(JUMP)}, HaltOutOfGas, nil},
+		{[]byte{0xfe}, HaltInvalid, nil},
+		{[]byte{byte(ADD)}, HaltError, nil},
+	} {
+		tracer := &haltTracer{StructLogger: NewStructLogger(nil)}
+		vmenv, s := newTestEVM(t, Config{Debug: true, Tracer: tracer})
+		s.SetCode(contract, tt.code)
+		vmenv.Call(AccountRef(common.Address{}), contract, nil, 100000, new(uint256.Int), false /* bailout */) //nolint:errcheck
+		want := []haltEvent{{1, tt.reason, tt.data}, {depth: -1}}
+		if !reflect.DeepEqual(tracer.halts, want) {
+			t.Errorf("test %d: have %v, want %v", i, tracer.halts, want)
+		}
+	}
+
+	// The nested frame halts first
+	tracer := &haltTracer{StructLogger: NewStructLogger(nil)}
+	vmenv, s := newTestEVM(t, Config{Debug: true, Tracer: tracer})
+	// CALL(gas, 0xbb, 0, 0, 0, 0, 0), then RETURN(0, 0)
+	s.SetCode(contract, []byte{byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0xbb, byte(GAS), byte(CALL),
+		byte(PUSH1), 0, byte(PUSH1), 0, byte(RETURN)})
+	s.SetCode(common.HexToAddress("0xbb"), withData(REVERT))
+	if _, _, err := vmenv.Call(AccountRef(common.Address{}), contract, nil, 100000, new(uint256.Int), false /* bailout */); err != nil {
+		t.Fatal(err)
+	}
+	want := []haltEvent{{2, HaltRevert, []byte{0x2a}}, {depth: -1}, {1, HaltReturn, nil}, {depth: -1}}
+	if !reflect.DeepEqual(tracer.halts, want) {
+		t.Errorf("have %v, want %v", tracer.halts, want)
+	}
+	if HaltOutOfGas.String() != "out of gas" || HaltReturn.String() != "RETURN" {
+		t.Errorf("unexpected names %v, %v", HaltOutOfGas, HaltReturn)
+	}
+}
+
+func TestStructLoggerPushData(t *testing.T) {
+	contract := common.HexToAddress("0xaa")
+	// PUSH1 0x2a, PUSH2 0x0102, ADD, and a PUSH3 cut short by the end of the code
+	code := []byte{byte(PUSH1), 0x2a, byte(PUSH2), 0x01, 0x02, byte(ADD), byte(PUSH3), 0xaa}
+	for _, enabled := range []bool{false, true} {
+		logger := NewStructLogger(&LogConfig{PushData: enabled})
+		vmenv, s := newTestEVM(t, Config{Debug: true, Tracer: logger})
+		s.SetCode(contract, code)
+		if _, _, err := vmenv.Call(AccountRef(common.Address{}), contract, nil, 100000, new(uint256.Int), false /* bailout */); err != nil {
+			t.Fatal(err)
+		}
+		logs := logger.StructLogs()
+		want := [][]byte{{0x2a}, {0x01, 0x02}, nil, {0xaa}, nil}
+		if len(logs) != len(want) {
+			t.Fatalf("expected %d steps, got %d", len(want), len(logs))
+		}
+		for i, log := range logs {
+			if !enabled {
+				want[i] = nil
+			}
+			if !bytes.Equal(log.PushData, want[i]) || (log.PushData == nil) != (want[i] == nil) {
+				t.Errorf("push data enabled %v, step %d: have %x, want %x", enabled, i, log.PushData, want[i])
+			}
+			enc, err := json.Marshal(&log)
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantField := ""
+			if want[i] != nil {
+				wantField = `"pushData":"` + hexutil.Encode(want[i]) + `"`
+			}
+			if strings.Contains(string(enc), "pushData") != (wantField != "") || !strings.Contains(string(enc), wantField) {
+				t.Errorf("push data enabled %v, step %d: unexpected encoding %s", enabled, i, enc)
+			}
+		}
+	}
+}
+
+type invalidOpcodeTracer struct {
+	*StructLogger
+	invalid []string
+}
+
+func (it *invalidOpcodeTracer) CaptureInvalidOpcode(depth int, pc uint64, op OpCode, skipped bool) {
+	it.invalid = append(it.invalid, fmt.Sprintf("%d:%d:%#x:%v", depth, pc, byte(op), skipped))
+}
+
+func TestSkipInvalidOpcodes(t *testing.T) {
+	contract := common.HexToAddress("0xaa")
+	// 1 + 2 around two undefined opcodes, then RETURN(0, 32) of the sum
+	code := []byte{byte(PUSH1), 1, 0x0c, 0xfe, byte(PUSH1), 2, byte(ADD), byte(PUSH1), 0, byte(MSTORE), byte(PUSH1), 32, byte(PUSH1), 0, byte(RETURN)}
+	for _, tt := range []struct {
+		debug, skip bool
+		invalid     []string
+	}{
+		{true, false, []string{"1:2:0xc:false"}},
+		{true, true, []string{"1:2:0xc:true", "1:3:0xfe:true"}},
+		{false, true, nil}, // only honoured with Debug
+	} {
+		tracer := &invalidOpcodeTracer{StructLogger: NewStructLogger(nil)}
+		vmenv, s := newTestEVM(t, Config{Debug: tt.debug, Tracer: tracer, SkipInvalidOpcodes: tt.skip})
+		s.SetCode(contract, code)
+		ret, _, err := vmenv.Call(AccountRef(common.Address{}), contract, nil, 100000, new(uint256.Int), false /* bailout */)
+		if !reflect.DeepEqual(tracer.invalid, tt.invalid) {
+			t.Errorf("debug %v, skip %v: have events %v, want %v", tt.debug, tt.skip, tracer.invalid, tt.invalid)
+		}
+		var errInvalid *ErrInvalidOpCode
+		if skipped := tt.debug && tt.skip; skipped {
+			if err != nil || new(uint256.Int).SetBytes(ret).Uint64() != 3 {
+				t.Errorf("debug %v, skip %v: have %x, %v, want 3", tt.debug, tt.skip, ret, err)
+			}
+		} else if !errors.As(err, &errInvalid) {
+			t.Errorf("debug %v, skip %v: expected invalid opcode error, got %v", tt.debug, tt.skip, err)
+		}
+	}
+}
+
+func TestAdjustGas(t *testing.T) {
+	address := common.BytesToAddress([]byte("contract"))
+	// SSTORE(1, 1); STOP, costing well above the provided gas
+	code := []byte{byte(PUSH1), 1, byte(PUSH1), 1, byte(SSTORE), byte(STOP)}
+	const gas, injected = 1000, 100000
+	adjust := func(pc uint64, op OpCode, available uint64) uint64 {
+		if op == SSTORE {
+			return available + injected
+		}
+		return available
+	}
+	for _, tt := range []struct {
+		debug bool
+		err   error
+	}{
+		{debug: true},
+		{debug: false, err: ErrOutOfGas}, // ignored outside of tracing
+	} {
+		logger := NewStructLogger(nil)
+		vmenv, s := newTestEVM(t, Config{Debug: tt.debug, Tracer: logger, AdjustGas: adjust})
+		s.SetCode(address, code)
+		s.AddAddressToAccessList(address)
+		_, leftOver, err := vmenv.Call(AccountRef(common.Address{}), address, nil, gas, new(uint256.Int), false /* bailout */)
+		if !errors.Is(err, tt.err) {
+			t.Fatalf("debug=%v: expected error %v, got %v", tt.debug, tt.err, err)
+		}
+		if !tt.debug {
+			continue
+		}
+		logs := logger.StructLogs()
+		if len(logs) != 4 || logs[2].Op != SSTORE {
+			t.Fatalf("unexpected steps %v", logs)
+		}
+		// The injected gas is visible to the tracer from the adjusted step on
+		if logs[2].Gas != logs[1].Gas-logs[1].GasCost+injected {
+			t.Errorf("SSTORE traced with %d gas", logs[2].Gas)
+		}
+		if want := logs[3].Gas; leftOver != want {
+			t.Errorf("expected %d gas left, got %d", want, leftOver)
+		}
+	}
+}
+
+type blockHashTracer struct {
+	*StructLogger
+	numbers []uint64
+	hashes  []common.Hash
+}
+
+func (bt *blockHashTracer) CaptureBlockHash(depth int, pc uint64, number uint64, hash common.Hash) {
+	bt.numbers = append(bt.numbers, number)
+	bt.hashes = append(bt.hashes, hash)
+}
+
+func TestBlockHashTracer(t *testing.T) {
+	address := common.HexToAddress("0xaa")
+	tracer := &blockHashTracer{StructLogger: NewStructLogger(nil)}
+	vmenv, s := newTestEVM(t, Config{Debug: true, Tracer: tracer})
+	vmenv.context.BlockNumber = 300
+	var queried []uint64
+	vmenv.context.GetHash = func(n uint64) common.Hash {
+		queried = append(queried, n)
+		return common.BigToHash(new(big.Int).SetUint64(n + 1))
+	}
+	numbers := []uint64{299, 44, 43, 300, 301}
+	var code []byte
+	for _, n := range numbers {
+		code = append(code, byte(PUSH2), byte(n>>8), byte(n), byte(BLOCKHASH), byte(POP))
+	}
+	// BLOCKHASH(2^64)
+	code = append(code, byte(PUSH9), 1, 0, 0, 0, 0, 0, 0, 0, 0, byte(BLOCKHASH), byte(STOP))
+	s.SetCode(address, code)
+	if _, _, err := vmenv.Call(AccountRef(common.Address{}), address, nil, 100000, new(uint256.Int), false /* bailout */); err != nil {
+		t.Fatal(err)
+	}
+	wantNumbers := append(numbers, math.MaxUint64)
+	wantHashes := []common.Hash{common.BigToHash(big.NewInt(300)), common.BigToHash(big.NewInt(45)), {}, {}, {}, {}}
+	if !reflect.DeepEqual(tracer.numbers, wantNumbers) || !reflect.DeepEqual(tracer.hashes, wantHashes) {
+		t.Errorf("have %v %x, want %v %x", tracer.numbers, tracer.hashes, wantNumbers, wantHashes)
+	}
+	// Only the blocks in the window are looked up
+	if !reflect.DeepEqual(queried, []uint64{299, 44}) {
+		t.Errorf("looked up hashes of %v", queried)
+	}
+	logs := tracer.StructLogs()
+	if last := logs[len(logs)-1]; last.Op != STOP || last.Stack[0].Sign() != 0 {
+		t.Errorf("unexpected result of BLOCKHASH(2^64)")
+	}
+}
+
+func TestStructLoggerStackTop(t *testing.T) {
+	address := common.HexToAddress("0xaa")
+	for _, top := range []int{0, 2, 10} {
+		logger := NewStructLogger(&LogConfig{StackTop: top})
+		vmenv, s := newTestEVM(t, Config{Debug: true, Tracer: logger})
+		// PUSH1 1, PUSH1 2, PUSH1 3, PUSH1 4, STOP
+		s.SetCode(address, []byte{byte(PUSH1), 1, byte(PUSH1), 2, byte(PUSH1), 3, byte(PUSH1), 4, byte(STOP)})
+		if _, _, err := vmenv.Call(AccountRef(common.Address{}), address, nil, 100000, new(uint256.Int), false /* bailout */); err != nil {
+			t.Fatal(err)
+		}
+		for i, log := range logger.StructLogs() {
+			// The stack holds 1..i before step i
+			want := make([]*big.Int, 0, i)
+			for item := 1; item <= i; item++ {
+				if top == 0 || item > i-top {
+					want = append(want, big.NewInt(int64(item)))
+				}
+			}
+			if len(log.Stack) != len(want) || (len(want) > 0 && !reflect.DeepEqual(log.Stack, want)) {
+				t.Errorf("stack top %d, step %d: have %v, want %v", top, i, log.Stack, want)
+			}
+		}
+	}
+}
+
+func TestStructLoggerOnlyStateChanges(t *testing.T) {
+	var (
+		outer = common.HexToAddress("0xaa")
+		inner = common.HexToAddress("0xbb")
+	)
+	logger := NewStructLogger(&LogConfig{OnlyStateChanges: true, CallPath: true})
+	vmenv, s := newTestEVM(t, Config{Debug: true, Tracer: logger})
+	// SSTORE(0, 1), LOG0(0, 0), CALL(gas, 0xbb, 0, 0, 0, 0, 0),
+	// CALL(gas, 0xbb, 1, 0, 0, 0, 0)
+	s.SetCode(outer, []byte{byte(PUSH1), 1, byte(PUSH1), 0, byte(SSTORE), byte(PUSH1), 0, byte(PUSH1), 0, byte(LOG0),
+		byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0xbb, byte(GAS), byte(CALL), byte(POP),
+		byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 1, byte(PUSH1), 0xbb, byte(GAS), byte(CALL), byte(POP),
+		byte(STOP)})
+	// SSTORE(0, 1)
+	s.SetCode(inner, []byte{byte(PUSH1), 1, byte(PUSH1), 0, byte(SSTORE), byte(STOP)})
+	s.AddAddressToAccessList(outer)
+	s.AddAddressToAccessList(inner)
+	if _, _, err := vmenv.Call(AccountRef(common.Address{}), outer, nil, 1000000, new(uint256.Int), false /* bailout */); err != nil {
+		t.Fatal(err)
+	}
+	var have []string
+	for _, log := range logger.StructLogs() {
+		if log.Gas == 0 || log.GasCost == 0 {
+			t.Errorf("missing gas of %v", log.Op)
+		}
+		have = append(have, fmt.Sprintf("%v@%d:%s", log.Op, log.Depth, log.CallPath))
+	}
+	// The CALL without value is left out, but not the effects of its callee
+	want := []string{"SSTORE@1:0", "LOG0@1:0", "SSTORE@2:0.0", "CALL@1:0", "SSTORE@2:0.1"}
+	if !reflect.DeepEqual(have, want) {
+		t.Errorf("have steps %v, want %v", have, want)
+	}
+	// The summary still covers every step
+	if count := logger.CountByOpcode()[PUSH1]; count != 20 {
+		t.Errorf("counted %d PUSH1, want 20", count)
+	}
+
+	// The slots read by the steps left out are still in the storage of the
+	// next logged step: SLOAD(5), then SSTORE(0, 1)
+	logger = NewStructLogger(&LogConfig{OnlyStateChanges: true})
+	vmenv, s = newTestEVM(t, Config{Debug: true, Tracer: logger})
+	s.SetCode(outer, []byte{byte(PUSH1), 5, byte(SLOAD), byte(POP), byte(PUSH1), 1, byte(PUSH1), 0, byte(SSTORE), byte(STOP)})
+	slot, value := common.BigToHash(big.NewInt(5)), uint256.NewInt(7)
+	s.SetState(outer, &slot, *value)
+	s.AddAddressToAccessList(outer)
+	if _, _, err := vmenv.Call(AccountRef(common.Address{}), outer, nil, 100000, new(uint256.Int), false /* bailout */); err != nil {
+		t.Fatal(err)
+	}
+	logs := logger.StructLogs()
+	if len(logs) != 1 || logs[0].Op != SSTORE {
+		t.Fatalf("expected the SSTORE step only, got %d steps", len(logs))
+	}
+	wantStorage := map[common.Hash]common.Hash{slot: common.BigToHash(big.NewInt(7)), {}: common.BigToHash(big.NewInt(1))}
+	if !reflect.DeepEqual(logs[0].Storage, wantStorage) {
+		t.Errorf("have storage %v, want %v", logs[0].Storage, wantStorage)
+	}
+}
+
+func TestStructLoggerColdAccess(t *testing.T) {
+	address := common.HexToAddress("0xaa")
+	logger := NewStructLogger(nil)
+	vmenv, s := newTestEVM(t, Config{Debug: true, Tracer: logger})
+	// SLOAD(0), SLOAD(0), BALANCE(0xbb), BALANCE(0xbb), SSTORE(1, 1)
+	s.SetCode(address, []byte{byte(PUSH1), 0, byte(SLOAD), byte(POP), byte(PUSH1), 0, byte(SLOAD), byte(POP),
+		byte(PUSH1), 0xbb, byte(BALANCE), byte(POP), byte(PUSH1), 0xbb, byte(BALANCE), byte(POP),
+		byte(PUSH1), 1, byte(PUSH1), 1, byte(SSTORE), byte(STOP)})
+	s.AddAddressToAccessList(address)
+	if _, _, err := vmenv.Call(AccountRef(common.Address{}), address, nil, 100000, new(uint256.Int), false /* bailout */); err != nil {
+		t.Fatal(err)
+	}
+	type access struct {
+		op         OpCode
+		cold       bool
+		dynamicGas uint64
+	}
+	var have []access
+	for _, log := range logger.StructLogs() {
+		if log.Op == SLOAD || log.Op == BALANCE || log.Op == SSTORE {
+			have = append(have, access{log.Op, log.ColdAccess, log.DynamicGas})
+		}
+		enc, err := json.Marshal(log)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if log.ColdAccess != strings.Contains(string(enc), `"coldAccess":true`) {
+			t.Errorf("step %d: coldAccess %t not marshalled", log.Pc, log.ColdAccess)
+		}
+	}
+	want := []access{
+		{SLOAD, true, params.ColdSloadCostEIP2929},
+		{SLOAD, false, params.WarmStorageReadCostEIP2929},
+		{BALANCE, true, params.ColdAccountAccessCostEIP2929 - params.WarmStorageReadCostEIP2929},
+		{BALANCE, false, 0},
+		{SSTORE, true, params.ColdSloadCostEIP2929 + params.SstoreSetGasEIP2200},
+	}
+	if !reflect.DeepEqual(have, want) {
+		t.Errorf("have accesses %v, want %v", have, want)
+	}
+}
+
+func TestStructLoggerMemoryAtBoundariesOnly(t *testing.T) {
+	address := common.HexToAddress("0xaa")
+	logger := NewStructLogger(&LogConfig{MemoryAtBoundariesOnly: true})
+	vmenv, s := newTestEVM(t, Config{Debug: true, Tracer: logger})
+	// MSTORE(0, 1), CALL(gas, 0xbb, 0, 64, 32, 0, 0), RETURN(0, 32)
+	s.SetCode(address, []byte{byte(PUSH1), 1, byte(PUSH1), 0, byte(MSTORE),
+		byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 32, byte(PUSH1), 64, byte(PUSH1), 0, byte(PUSH1), 0xbb, byte(GAS), byte(CALL), byte(POP),
+		byte(PUSH1), 32, byte(PUSH1), 0, byte(RETURN)})
+	if _, _, err := vmenv.Call(AccountRef(common.Address{}), address, nil, 100000, new(uint256.Int), false /* bailout */); err != nil {
+		t.Fatal(err)
+	}
+	var captured []OpCode
+	for _, log := range logger.StructLogs() {
+		if log.Memory == nil {
+			continue
+		}
+		captured = append(captured, log.Op)
+		// The CALL sees the memory expanded to its input
+		want := make([]byte, 96)
+		want[31] = 1
+		if !bytes.Equal(log.Memory, want) {
+			t.Errorf("%v: have memory %x, want %x", log.Op, log.Memory, want)
+		}
+	}
+	if want := []OpCode{CALL, RETURN}; !reflect.DeepEqual(captured, want) {
+		t.Errorf("have memory captured at %v, want %v", captured, want)
+	}
+}
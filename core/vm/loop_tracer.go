@@ -0,0 +1,141 @@
+package vm
+
+import (
+	"bytes"
+	"encoding/json"
+	"math/big"
+	"sort"
+	"time"
+
+	"github.com/holiman/uint256"
+
+	"github.com/ledgerwatch/erigon/common"
+	"github.com/ledgerwatch/erigon/crypto"
+)
+
+// Loop is a loop suspected by the LoopTracer to run unusually often.
+type Loop struct {
+	CodeHash   common.Hash    `json:"codeHash"`
+	Address    common.Address `json:"address"` // the code was first seen looping at
+	Header     uint64         `json:"header"`  // pc of the JUMPDEST the back-edges jump to
+	Iterations uint64         `json:"iterations"`
+}
+
+type loopKey struct {
+	codeHash common.Hash
+	header   uint64
+}
+
+var _ Tracer = (*LoopTracer)(nil)
+
+// LoopTracer is a native tracer counting the back-edges of the code run by a
+// transaction: JUMPs, and JUMPIs taken, to a lower pc, which is the header of
+// the loop. Loops iterating more than a threshold across the transaction are
+// reported, as they may be made to run out of gas by growing their input.
+// Code is identified by its hash, so that the iterations of a contract are
+// summed up over all the calls to it.
+type LoopTracer struct {
+	threshold  uint64
+	loops      map[loopKey]*Loop
+	initHashes map[*Contract]common.Hash // hashes of the init code run, computed once per frame
+}
+
+// NewLoopTracer returns a new loop tracer reporting the loops iterating more
+// than threshold times.
+func NewLoopTracer(threshold uint64) *LoopTracer {
+	return &LoopTracer{threshold: threshold, loops: make(map[loopKey]*Loop), initHashes: make(map[*Contract]common.Hash)}
+}
+
+func (t *LoopTracer) CaptureStart(env *EVM, depth int, from common.Address, to common.Address, precompile bool, create bool, callType CallType, input []byte, gas uint64, value *big.Int, code []byte) {
+	if depth != 0 {
+		return
+	}
+	t.loops = make(map[loopKey]*Loop)
+	t.initHashes = make(map[*Contract]common.Hash)
+}
+
+func (t *LoopTracer) CaptureEnter(typ OpCode, from common.Address, to common.Address, input []byte, gas uint64, value *uint256.Int) {
+}
+
+func (t *LoopTracer) CaptureState(env *EVM, pc uint64, op OpCode, gas, cost uint64, scope *ScopeContext, rData []byte, depth int, err error) {
+	if err != nil {
+		return
+	}
+	switch op {
+	case JUMP:
+	case JUMPI:
+		if scope.Stack.Len() < 2 || scope.Stack.Back(1).IsZero() {
+			return
+		}
+	default:
+		return
+	}
+	dest := scope.Stack.Back(0)
+	if !dest.IsUint64() || dest.Uint64() >= pc || !scope.Contract.HasJumpDest(dest.Uint64()) {
+		return
+	}
+	codeHash := scope.Contract.CodeHash
+	if codeHash == (common.Hash{}) {
+		// Init code
+		var ok bool
+		if codeHash, ok = t.initHashes[scope.Contract]; !ok {
+			codeHash = crypto.Keccak256Hash(scope.Contract.Code)
+			t.initHashes[scope.Contract] = codeHash
+		}
+	}
+	key := loopKey{codeHash, dest.Uint64()}
+	loop := t.loops[key]
+	if loop == nil {
+		loop = &Loop{CodeHash: codeHash, Address: scope.Contract.Address(), Header: key.header}
+		t.loops[key] = loop
+	}
+	loop.Iterations++
+}
+
+func (t *LoopTracer) CaptureFault(env *EVM, pc uint64, op OpCode, gas, cost uint64, scope *ScopeContext, depth int, err error) {
+}
+
+func (t *LoopTracer) CaptureEnd(depth int, output []byte, startGas, endGas uint64, d time.Duration, err error) {
+}
+
+func (t *LoopTracer) CaptureExit(output []byte, gasUsed uint64, err error) {
+}
+
+func (t *LoopTracer) CaptureSelfDestruct(from common.Address, to common.Address, value *big.Int) {
+}
+
+func (t *LoopTracer) CaptureAccountRead(account common.Address) error {
+	return nil
+}
+
+func (t *LoopTracer) CaptureAccountWrite(account common.Address) error {
+	return nil
+}
+
+// HotLoops returns the loops iterating more than the threshold, the most
+// iterated first. Loops iterating as often are ordered by code hash and
+// header.
+func (t *LoopTracer) HotLoops() []Loop {
+	loops := make([]Loop, 0)
+	for _, loop := range t.loops {
+		if loop.Iterations > t.threshold {
+			loops = append(loops, *loop)
+		}
+	}
+	sort.Slice(loops, func(i, j int) bool {
+		if loops[i].Iterations != loops[j].Iterations {
+			return loops[i].Iterations > loops[j].Iterations
+		}
+		if c := bytes.Compare(loops[i].CodeHash[:], loops[j].CodeHash[:]); c != 0 {
+			return c < 0
+		}
+		return loops[i].Header < loops[j].Header
+	})
+	return loops
+}
+
+// GetResult returns the loops iterating more than the threshold as a JSON
+// array.
+func (t *LoopTracer) GetResult() (json.RawMessage, error) {
+	return json.Marshal(t.HotLoops())
+}
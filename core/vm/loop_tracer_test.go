@@ -0,0 +1,66 @@
+package vm
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/holiman/uint256"
+
+	"github.com/ledgerwatch/erigon/common"
+	"github.com/ledgerwatch/erigon/crypto"
+)
+
+func TestLoopTracer(t *testing.T) {
+	// loop counts down from n with JUMPI to the JUMPDEST at pc 2, then runs a
+	// second loop of 3 iterations with JUMPI to the JUMPDEST at pc 14
+	loop := func(n byte) []byte {
+		return []byte{byte(PUSH1), n,
+			byte(JUMPDEST), byte(PUSH1), 1, byte(SWAP1), byte(SUB), byte(DUP1), byte(PUSH1), 2, byte(JUMPI), byte(POP),
+			byte(PUSH1), 3,
+			byte(JUMPDEST), byte(PUSH1), 1, byte(SWAP1), byte(SUB), byte(DUP1), byte(PUSH1), 14, byte(JUMPI),
+			byte(STOP)}
+	}
+	// call makes a CALL to every address in turn
+	call := func(addrs ...common.Address) []byte {
+		var code []byte
+		for _, addr := range addrs {
+			code = append(code, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH20))
+			code = append(code, addr.Bytes()...)
+			code = append(code, byte(GAS), byte(CALL), byte(POP))
+		}
+		return append(code, byte(STOP))
+	}
+	var (
+		first  = common.HexToAddress("0xaa")
+		second = common.HexToAddress("0xbb")
+		caller = common.HexToAddress("0xcc")
+		code   = loop(10)
+		hash   = crypto.Keccak256Hash(code)
+	)
+	tracer := NewLoopTracer(5)
+	vmenv, s := newTestEVM(t, Config{Debug: true, Tracer: tracer})
+	s.SetCode(first, code)
+	s.SetCode(second, code)
+	s.SetCode(caller, call(first, second))
+	// Both calls run the same code, their iterations add up
+	if _, _, err := vmenv.Call(AccountRef(common.Address{}), caller, nil, 100000, new(uint256.Int), false /* bailout */); err != nil {
+		t.Fatal(err)
+	}
+	// The first loop jumps back 9 times per call, the second one 2 times and
+	// stays below the threshold
+	want := []Loop{{CodeHash: hash, Address: first, Header: 2, Iterations: 18}}
+	if have := tracer.HotLoops(); !reflect.DeepEqual(have, want) {
+		t.Errorf("have loops %+v, want %+v", have, want)
+	}
+	// The loops are counted afresh for the next transaction
+	if _, _, err := vmenv.Call(AccountRef(common.Address{}), second, nil, 100000, new(uint256.Int), false /* bailout */); err != nil {
+		t.Fatal(err)
+	}
+	want = []Loop{{CodeHash: hash, Address: second, Header: 2, Iterations: 9}}
+	if have := tracer.HotLoops(); !reflect.DeepEqual(have, want) {
+		t.Errorf("have loops %+v, want %+v", have, want)
+	}
+	if loops := NewLoopTracer(1).HotLoops(); loops == nil || len(loops) != 0 {
+		t.Errorf("unexpected loops %v", loops)
+	}
+}
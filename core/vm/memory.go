@@ -18,6 +18,7 @@ package vm
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/holiman/uint256"
 )
@@ -107,6 +108,22 @@ func (m *Memory) Data() []byte {
 	return m.store
 }
 
+// Hexdump formats the memory as 32-byte words, one per line, each prefixed by
+// its offset in hex. It returns an empty string for empty memory.
+func (m *Memory) Hexdump() string {
+	var b strings.Builder
+	// offset, colon, space, two digits per byte and newline
+	b.Grow((len(m.store) + 31) / 32 * (8 + 2 + 64 + 1))
+	for offset := 0; offset < len(m.store); offset += 32 {
+		end := offset + 32
+		if end > len(m.store) {
+			end = len(m.store)
+		}
+		fmt.Fprintf(&b, "%08x: %x\n", offset, m.store[offset:end])
+	}
+	return b.String()
+}
+
 // Print dumps the content of the memory.
 func (m *Memory) Print() {
 	fmt.Printf("### mem %d bytes ###\n", len(m.store))
@@ -59,47 +59,15 @@ func memoryCreate2(stack *stack.Stack) (uint64, bool) {
 }
 
 func memoryCall(stack *stack.Stack) (uint64, bool) {
-	x, overflow := calcMemSize64(stack.Back(5), stack.Back(6))
-	if overflow {
-		return 0, true
-	}
-	y, overflow := calcMemSize64(stack.Back(3), stack.Back(4))
-	if overflow {
-		return 0, true
-	}
-	if x > y {
-		return x, false
-	}
-	return y, false
+	return calcMemSize64Max(stack.Back(5), stack.Back(6), stack.Back(3), stack.Back(4))
 }
+
 func memoryDelegateCall(stack *stack.Stack) (uint64, bool) {
-	x, overflow := calcMemSize64(stack.Back(4), stack.Back(5))
-	if overflow {
-		return 0, true
-	}
-	y, overflow := calcMemSize64(stack.Back(2), stack.Back(3))
-	if overflow {
-		return 0, true
-	}
-	if x > y {
-		return x, false
-	}
-	return y, false
+	return calcMemSize64Max(stack.Back(4), stack.Back(5), stack.Back(2), stack.Back(3))
 }
 
 func memoryStaticCall(stack *stack.Stack) (uint64, bool) {
-	x, overflow := calcMemSize64(stack.Back(4), stack.Back(5))
-	if overflow {
-		return 0, true
-	}
-	y, overflow := calcMemSize64(stack.Back(2), stack.Back(3))
-	if overflow {
-		return 0, true
-	}
-	if x > y {
-		return x, false
-	}
-	return y, false
+	return calcMemSize64Max(stack.Back(4), stack.Back(5), stack.Back(2), stack.Back(3))
 }
 
 func memoryReturn(stack *stack.Stack) (uint64, bool) {
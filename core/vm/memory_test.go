@@ -0,0 +1,22 @@
+package vm
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/holiman/uint256"
+)
+
+func TestMemoryHexdump(t *testing.T) {
+	mem := NewMemory()
+	if dump := mem.Hexdump(); dump != "" {
+		t.Errorf("expected an empty dump, got %q", dump)
+	}
+	mem.Resize(64)
+	mem.Set32(32, uint256.NewInt(0xbeef))
+	want := "00000000: " + strings.Repeat("00", 32) + "\n" +
+		"00000020: " + strings.Repeat("00", 30) + "beef\n"
+	if dump := mem.Hexdump(); dump != want {
+		t.Errorf("unexpected dump\nhave %q\nwant %q", dump, want)
+	}
+}
@@ -0,0 +1,79 @@
+package vm
+
+// OpCategory is a class of opcodes, for breaking the gas of a trace down by
+// the kind of work done.
+type OpCategory uint8
+
+const (
+	OpCategoryOther       OpCategory = iota // undefined opcodes
+	OpCategoryArithmetic                    // arithmetic, comparison, bitwise and SHA3
+	OpCategoryStack                         // POP, PUSHn, DUPn and SWAPn
+	OpCategoryMemory                        // memory access and the copies into memory
+	OpCategoryStorage                       // persistent and transient storage
+	OpCategoryEnvironment                   // transaction, block and account information
+	OpCategoryControlFlow                   // jumps and the ends of a frame
+	OpCategoryCall                          // calls, creations and SELFDESTRUCT
+	OpCategoryLog                           // LOGn
+)
+
+var opCategoryNames = map[OpCategory]string{
+	OpCategoryOther:       "other",
+	OpCategoryArithmetic:  "arithmetic",
+	OpCategoryStack:       "stack",
+	OpCategoryMemory:      "memory",
+	OpCategoryStorage:     "storage",
+	OpCategoryEnvironment: "environment",
+	OpCategoryControlFlow: "control-flow",
+	OpCategoryCall:        "call",
+	OpCategoryLog:         "log",
+}
+
+func (c OpCategory) String() string {
+	if name, ok := opCategoryNames[c]; ok {
+		return name
+	}
+	return "other"
+}
+
+// OpCategories maps every opcode to its category. It may be changed to
+// reclassify opcodes, before it is used concurrently.
+var OpCategories = newOpCategories()
+
+func newOpCategories() (c [256]OpCategory) {
+	set := func(category OpCategory, ops ...OpCode) {
+		for _, op := range ops {
+			c[op] = category
+		}
+	}
+	set(OpCategoryArithmetic, ADD, MUL, SUB, DIV, SDIV, MOD, SMOD, ADDMOD, MULMOD, EXP, SIGNEXTEND,
+		LT, GT, SLT, SGT, EQ, ISZERO, AND, OR, XOR, NOT, BYTE, SHL, SHR, SAR, SHA3)
+	set(OpCategoryStack, POP, PUSH0)
+	for op := PUSH1; op <= SWAP16; op++ {
+		set(OpCategoryStack, op)
+	}
+	set(OpCategoryMemory, MLOAD, MSTORE, MSTORE8, MSIZE, CALLDATACOPY, CODECOPY, RETURNDATACOPY)
+	set(OpCategoryStorage, SLOAD, SSTORE, TLOAD, TSTORE)
+	set(OpCategoryEnvironment, ADDRESS, BALANCE, ORIGIN, CALLER, CALLVALUE, CALLDATALOAD, CALLDATASIZE,
+		CODESIZE, GASPRICE, EXTCODESIZE, EXTCODECOPY, RETURNDATASIZE, EXTCODEHASH, BLOCKHASH, COINBASE,
+		TIMESTAMP, NUMBER, DIFFICULTY, GASLIMIT, CHAINID, SELFBALANCE, BASEFEE, GAS)
+	set(OpCategoryControlFlow, STOP, JUMP, JUMPI, PC, JUMPDEST, RETURN, REVERT)
+	set(OpCategoryCall, CREATE, CALL, CALLCODE, DELEGATECALL, CREATE2, STATICCALL, SELFDESTRUCT)
+	set(OpCategoryLog, LOG0, LOG1, LOG2, LOG3, LOG4)
+	return c
+}
+
+// Category returns the category of op in OpCategories.
+func (op OpCode) Category() OpCategory {
+	return OpCategories[op]
+}
+
+// GasByCategory sums the GasCost of the logs per category. Like GasCost, the
+// cost of a call includes the gas handed to the callee, which is also counted
+// in the steps of the callee: StructLogger.GasByCategory doesn't.
+func GasByCategory(logs []StructLog) map[OpCategory]uint64 {
+	gas := make(map[OpCategory]uint64)
+	for i := range logs {
+		gas[logs[i].Op.Category()] += logs[i].GasCost
+	}
+	return gas
+}
@@ -0,0 +1,54 @@
+package vm
+
+import (
+	"testing"
+
+	"github.com/holiman/uint256"
+
+	"github.com/ledgerwatch/erigon/common"
+	"github.com/ledgerwatch/erigon/params"
+)
+
+func TestOpCategories(t *testing.T) {
+	// Every opcode of the latest fork is classified
+	for i, operation := range newCancunInstructionSet() {
+		if op := OpCode(i); operation != nil && op.Category() == OpCategoryOther {
+			t.Errorf("%v is not classified", op)
+		}
+	}
+	if c := OpCode(0xef).Category(); c != OpCategoryOther {
+		t.Errorf("undefined opcode classified as %v", c)
+	}
+}
+
+func TestGasByCategory(t *testing.T) {
+	contract := common.HexToAddress("0xaa")
+	logger := NewStructLogger(nil)
+	vmenv, s := newTestEVM(t, Config{Debug: true, Tracer: logger})
+	// SSTORE(0, 1), then MSTORE(0, 1)
+	s.SetCode(contract, []byte{byte(PUSH1), 1, byte(PUSH1), 0, byte(SSTORE), byte(PUSH1), 1, byte(PUSH1), 0, byte(MSTORE)})
+	s.AddAddressToAccessList(contract)
+	if _, _, err := vmenv.Call(AccountRef(common.Address{}), contract, nil, 100000, new(uint256.Int), false /* bailout */); err != nil {
+		t.Fatal(err)
+	}
+	want := map[OpCategory]uint64{
+		OpCategoryStack:   4 * GasFastestStep,
+		OpCategoryStorage: params.SstoreSetGasEIP2200 + params.ColdSloadCostEIP2929,
+		OpCategoryMemory:  GasFastestStep + params.MemoryGas,
+		// the implicit STOP at the end of the code
+		OpCategoryControlFlow: 0,
+	}
+	for name, gas := range map[string]map[OpCategory]uint64{
+		"logs":   GasByCategory(logger.StructLogs()),
+		"logger": logger.GasByCategory(),
+	} {
+		if len(gas) != len(want) {
+			t.Errorf("%s: unexpected categories %v", name, gas)
+		}
+		for c, g := range want {
+			if gas[c] != g {
+				t.Errorf("%s: %v gas mismatch: have %d, want %d", name, c, gas[c], g)
+			}
+		}
+	}
+}
@@ -120,6 +120,8 @@ const (
 	MSIZE    OpCode = 0x59
 	GAS      OpCode = 0x5a
 	JUMPDEST OpCode = 0x5b
+	TLOAD    OpCode = 0x5c
+	TSTORE   OpCode = 0x5d
 	PUSH0    OpCode = 0x5f
 )
 
@@ -299,6 +301,8 @@ var opCodeToString = map[OpCode]string{
 	MSIZE:    "MSIZE",
 	GAS:      "GAS",
 	JUMPDEST: "JUMPDEST",
+	TLOAD:    "TLOAD",
+	TSTORE:   "TSTORE",
 	PUSH0:    "PUSH0",
 
 	// 0x60 range - push.
@@ -399,6 +403,18 @@ func (op OpCode) String() string {
 	return str
 }
 
+// OpCodeNames overrides the names of opcodes, for chains which add or
+// repurpose some of them. Opcodes missing from it keep their default name.
+type OpCodeNames map[OpCode]string
+
+// Name returns the custom name of op if there is one, or op.String().
+func (names OpCodeNames) Name(op OpCode) string {
+	if name, ok := names[op]; ok {
+		return name
+	}
+	return op.String()
+}
+
 var stringToOp = map[string]OpCode{
 	"STOP":           STOP,
 	"ADD":            ADD,
@@ -466,6 +482,8 @@ var stringToOp = map[string]OpCode{
 	"MSIZE":          MSIZE,
 	"GAS":            GAS,
 	"JUMPDEST":       JUMPDEST,
+	"TLOAD":          TLOAD,
+	"TSTORE":         TSTORE,
 	"PUSH0":          PUSH0,
 	"PUSH1":          PUSH1,
 	"PUSH2":          PUSH2,
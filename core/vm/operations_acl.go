@@ -29,7 +29,7 @@ import (
 func makeGasSStoreFunc(clearingRefund uint64) gasFunc {
 	return func(evm *EVM, contract *Contract, stack *stack.Stack, mem *Memory, memorySize uint64) (uint64, error) {
 		// If we fail the minimum gas availability invariant, fail (0)
-		if contract.Gas <= params.SstoreSentryGasEIP2200 {
+		if contract.Gas <= evm.sstoreSentryGas() {
 			return 0, errors.New("not enough gas for reentrancy sentry")
 		}
 		// Gas sentry honoured, do the actual gas calculation based on the stored value
@@ -45,6 +45,7 @@ func makeGasSStoreFunc(clearingRefund uint64) gasFunc {
 			cost = params.ColdSloadCostEIP2929
 			// If the caller cannot afford the cost, this change will be rolled back
 			evm.IntraBlockState().AddSlotToAccessList(contract.Address(), slot)
+			evm.coldAccess = true
 			if !addrPresent {
 				// Once we're done with YOLOv2 and schedule this for mainnet, might
 				// be good to remove this panic here, which is just really a
@@ -114,6 +115,7 @@ func gasSLoadEIP2929(evm *EVM, contract *Contract, stack *stack.Stack, mem *Memo
 		// If the caller cannot afford the cost, this change will be rolled back
 		// If he does afford it, we can skip checking the same thing later on, during execution
 		evm.IntraBlockState().AddSlotToAccessList(contract.Address(), slot)
+		evm.coldAccess = true
 		return params.ColdSloadCostEIP2929, nil
 	}
 	return params.WarmStorageReadCostEIP2929, nil
@@ -134,6 +136,7 @@ func gasExtCodeCopyEIP2929(evm *EVM, contract *Contract, stack *stack.Stack, mem
 	// Check slot presence in the access list
 	if !evm.IntraBlockState().AddressInAccessList(addr) {
 		evm.IntraBlockState().AddAddressToAccessList(addr)
+		evm.coldAccess = true
 		var overflow bool
 		// We charge (cold-warm), since 'warm' is already charged as constantGas
 		if gas, overflow = math.SafeAdd(gas, params.ColdAccountAccessCostEIP2929-params.WarmStorageReadCostEIP2929); overflow {
@@ -157,6 +160,7 @@ func gasEip2929AccountCheck(evm *EVM, contract *Contract, stack *stack.Stack, me
 	if !evm.IntraBlockState().AddressInAccessList(addr) {
 		// If the caller cannot afford the cost, this change will be rolled back
 		evm.IntraBlockState().AddAddressToAccessList(addr)
+		evm.coldAccess = true
 		// The warm storage read cost is already charged as constantGas
 		return params.ColdAccountAccessCostEIP2929 - params.WarmStorageReadCostEIP2929, nil
 	}
@@ -173,6 +177,7 @@ func makeCallVariantGasCallEIP2929(oldCalculator gasFunc) gasFunc {
 		coldCost := params.ColdAccountAccessCostEIP2929 - params.WarmStorageReadCostEIP2929
 		if !warmAccess {
 			evm.IntraBlockState().AddAddressToAccessList(addr)
+			evm.coldAccess = true
 			// Charge the remaining difference here already, to correctly calculate available
 			// gas for call
 			if !contract.UseGas(coldCost) {
@@ -235,6 +240,7 @@ func makeSelfdestructGasFn(refundsEnabled bool) gasFunc {
 		if !evm.IntraBlockState().AddressInAccessList(address) {
 			// If the caller cannot afford the cost, this change will be rolled back
 			evm.IntraBlockState().AddAddressToAccessList(address)
+			evm.coldAccess = true
 			gas = params.ColdAccountAccessCostEIP2929
 		}
 		// if empty and transfers value
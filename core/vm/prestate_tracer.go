@@ -0,0 +1,216 @@
+package vm
+
+import (
+	"encoding/json"
+	"errors"
+	"math/big"
+	"time"
+
+	"github.com/holiman/uint256"
+
+	"github.com/ledgerwatch/erigon/common"
+	"github.com/ledgerwatch/erigon/common/hexutil"
+)
+
+// PrestateAccount is the state of an account as recorded by the PrestateTracer.
+// In the post state of the diff mode only the modified fields are set.
+type PrestateAccount struct {
+	Balance *hexutil.Big                `json:"balance,omitempty"`
+	Nonce   uint64                      `json:"nonce,omitempty"`
+	Code    hexutil.Bytes               `json:"code,omitempty"`
+	Storage map[common.Hash]common.Hash `json:"storage,omitempty"`
+}
+
+// PrestateMap is the state of a set of accounts, keyed by address.
+type PrestateMap map[common.Address]*PrestateAccount
+
+var _ Tracer = (*PrestateTracer)(nil)
+
+// PrestateTracer is a native tracer collecting the accounts and storage slots a
+// transaction touches, with their values before the execution: the minimal
+// state needed to replay it in isolation. In diff mode it also records the
+// value after the execution of everything that was modified, and drops what
+// was only read.
+//
+// Accounts are read when they are first touched, at which point the sender
+// has already paid for the gas of the transaction. Its nonce is restored to
+// the value before the transaction.
+type PrestateTracer struct {
+	env      *EVM
+	diffMode bool
+	pre      PrestateMap
+	post     PrestateMap
+	missing  map[common.Address]struct{} // touched accounts that didn't exist before
+}
+
+// NewPrestateTracer returns a new prestate tracer, in diff mode if requested.
+func NewPrestateTracer(diffMode bool) *PrestateTracer {
+	return &PrestateTracer{
+		diffMode: diffMode,
+		pre:      make(PrestateMap),
+		post:     make(PrestateMap),
+		missing:  make(map[common.Address]struct{}),
+	}
+}
+
+// lookupAccount records the account if it has not been touched yet.
+func (t *PrestateTracer) lookupAccount(addr common.Address) {
+	if _, ok := t.pre[addr]; ok {
+		return
+	}
+	ibs := t.env.IntraBlockState()
+	if !ibs.Exist(addr) {
+		t.missing[addr] = struct{}{}
+	}
+	t.pre[addr] = &PrestateAccount{
+		Balance: (*hexutil.Big)(ibs.GetBalance(addr).ToBig()),
+		Nonce:   ibs.GetNonce(addr),
+		Code:    common.CopyBytes(ibs.GetCode(addr)),
+		Storage: make(map[common.Hash]common.Hash),
+	}
+}
+
+// lookupStorage records the storage slot if it has not been touched yet. The
+// account must have been looked up already.
+func (t *PrestateTracer) lookupStorage(addr common.Address, key common.Hash) {
+	if _, ok := t.pre[addr].Storage[key]; ok {
+		return
+	}
+	var value uint256.Int
+	t.env.IntraBlockState().GetState(addr, &key, &value)
+	t.pre[addr].Storage[key] = value.Bytes32()
+}
+
+func (t *PrestateTracer) CaptureStart(env *EVM, depth int, from common.Address, to common.Address, precompile bool, create bool, callType CallType, input []byte, gas uint64, value *big.Int, code []byte) {
+	if depth != 0 {
+		return
+	}
+	t.env = env
+	t.lookupAccount(from)
+	t.lookupAccount(to)
+	t.lookupAccount(env.Context().Coinbase)
+	if !create && t.pre[from].Nonce > 0 {
+		// the nonce of the sender is bumped before calls, but not before creations
+		t.pre[from].Nonce--
+	}
+}
+
+func (t *PrestateTracer) CaptureEnter(typ OpCode, from common.Address, to common.Address, input []byte, gas uint64, value *uint256.Int) {
+	t.lookupAccount(to)
+}
+
+// CaptureState looks up the accounts and storage slots accessed by the opcode
+// before it is executed.
+func (t *PrestateTracer) CaptureState(env *EVM, pc uint64, op OpCode, gas, cost uint64, scope *ScopeContext, rData []byte, depth int, err error) {
+	if err != nil {
+		return
+	}
+	stack := scope.Stack
+	size := stack.Len()
+	switch {
+	case size >= 1 && (op == SLOAD || op == SSTORE):
+		t.lookupStorage(scope.Contract.Address(), stack.Data[size-1].Bytes32())
+	case size >= 1 && (op == BALANCE || op == EXTCODESIZE || op == EXTCODECOPY || op == EXTCODEHASH || op == SELFDESTRUCT):
+		t.lookupAccount(stack.Data[size-1].Bytes20())
+	case size >= 2 && (op == CALL || op == CALLCODE || op == DELEGATECALL || op == STATICCALL):
+		t.lookupAccount(stack.Data[size-2].Bytes20())
+	}
+}
+
+func (t *PrestateTracer) CaptureFault(env *EVM, pc uint64, op OpCode, gas, cost uint64, scope *ScopeContext, depth int, err error) {
+}
+
+func (t *PrestateTracer) CaptureEnd(depth int, output []byte, startGas, endGas uint64, d time.Duration, err error) {
+	if depth != 0 || !t.diffMode {
+		return
+	}
+	t.processDiffState()
+}
+
+func (t *PrestateTracer) CaptureExit(output []byte, gasUsed uint64, err error) {
+}
+
+func (t *PrestateTracer) CaptureSelfDestruct(from common.Address, to common.Address, value *big.Int) {
+}
+
+func (t *PrestateTracer) CaptureAccountRead(account common.Address) error {
+	return nil
+}
+
+func (t *PrestateTracer) CaptureAccountWrite(account common.Address) error {
+	return nil
+}
+
+// processDiffState compares the touched accounts with their current state and
+// keeps the modified ones only.
+func (t *PrestateTracer) processDiffState() {
+	ibs := t.env.IntraBlockState()
+	for addr, pre := range t.pre {
+		if !ibs.Exist(addr) || ibs.HasSuicided(addr) {
+			// the account is gone, which the absence from post reflects
+			continue
+		}
+		var (
+			post     = &PrestateAccount{}
+			modified bool
+		)
+		if balance := ibs.GetBalance(addr).ToBig(); balance.Cmp(pre.Balance.ToInt()) != 0 {
+			post.Balance, modified = (*hexutil.Big)(balance), true
+		}
+		if nonce := ibs.GetNonce(addr); nonce != pre.Nonce {
+			post.Nonce, modified = nonce, true
+		}
+		if code := ibs.GetCode(addr); string(code) != string(pre.Code) {
+			post.Code, modified = common.CopyBytes(code), true
+		}
+		for key, prev := range pre.Storage {
+			var value uint256.Int
+			ibs.GetState(addr, &key, &value)
+			if current := common.Hash(value.Bytes32()); current != prev {
+				if post.Storage == nil {
+					post.Storage = make(map[common.Hash]common.Hash)
+				}
+				post.Storage[key], modified = current, true
+			} else {
+				// only the modified slots are of interest
+				delete(pre.Storage, key)
+			}
+		}
+		if modified {
+			t.post[addr] = post
+		} else {
+			delete(t.pre, addr)
+		}
+	}
+	// Accounts created by the transaction had no pre state
+	for addr := range t.missing {
+		delete(t.pre, addr)
+	}
+}
+
+// Pre returns the state of the touched accounts before the execution. In diff
+// mode only the modified accounts are included.
+func (t *PrestateTracer) Pre() PrestateMap {
+	return t.pre
+}
+
+// Post returns the modified fields of the accounts touched by the execution, it
+// is only populated in diff mode.
+func (t *PrestateTracer) Post() PrestateMap {
+	return t.post
+}
+
+// GetResult returns the pre state encoded in the prestateTracer JSON format,
+// or both pre and post state in diff mode.
+func (t *PrestateTracer) GetResult() (json.RawMessage, error) {
+	if t.env == nil {
+		return nil, errors.New("no transaction traced")
+	}
+	if !t.diffMode {
+		return json.Marshal(t.pre)
+	}
+	return json.Marshal(struct {
+		Post PrestateMap `json:"post"`
+		Pre  PrestateMap `json:"pre"`
+	}{t.post, t.pre})
+}
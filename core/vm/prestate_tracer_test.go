@@ -0,0 +1,84 @@
+package vm
+
+import (
+	"encoding/json"
+	"math/big"
+	"testing"
+
+	"github.com/holiman/uint256"
+
+	"github.com/ledgerwatch/erigon/common"
+)
+
+func TestPrestateTracer(t *testing.T) {
+	var (
+		caller  = common.HexToAddress("0x01")
+		outer   = common.HexToAddress("0xaa")
+		queried = common.HexToAddress("0xbb")
+	)
+	code := []byte{
+		// SSTORE(1, SLOAD(0) + 1)
+		byte(PUSH1), 0, byte(SLOAD), byte(PUSH1), 1, byte(ADD), byte(PUSH1), 1, byte(SSTORE),
+		// BALANCE(0xbb)
+		byte(PUSH1), 0xbb, byte(BALANCE), byte(POP),
+		byte(STOP),
+	}
+	for _, diffMode := range []bool{false, true} {
+		tracer := NewPrestateTracer(diffMode)
+		vmenv, s := newTestEVM(t, Config{Debug: true, Tracer: tracer})
+		s.SetCode(outer, code)
+		s.SetState(outer, &common.Hash{}, *uint256.NewInt(41))
+		s.AddBalance(queried, uint256.NewInt(7))
+		s.AddAddressToAccessList(outer)
+
+		if _, _, err := vmenv.Call(AccountRef(caller), outer, nil, 1000000, new(uint256.Int), false /* bailout */); err != nil {
+			t.Fatal(err)
+		}
+		pre, post := tracer.Pre(), tracer.Post()
+		slot0, slot1 := common.Hash{}, common.BigToHash(common.Big1)
+		if !diffMode {
+			acc := pre[outer]
+			if acc == nil || string(acc.Code) != string(code) {
+				t.Fatalf("missing code of the called account: %+v", acc)
+			}
+			if acc.Storage[slot0] != common.BigToHash(big.NewInt(41)) || acc.Storage[slot1] != (common.Hash{}) || len(acc.Storage) != 2 {
+				t.Errorf("unexpected pre storage %v", acc.Storage)
+			}
+			if acc := pre[queried]; acc == nil || acc.Balance.ToInt().Uint64() != 7 {
+				t.Errorf("unexpected balance of the queried account: %+v", acc)
+			}
+			if _, ok := pre[caller]; !ok {
+				t.Error("sender missing from the pre state")
+			}
+			if len(post) != 0 {
+				t.Errorf("post state recorded outside of diff mode: %v", post)
+			}
+			continue
+		}
+		// Only the written slot of the called account was modified
+		if len(pre) != 1 || len(post) != 1 {
+			t.Fatalf("expected a single modified account, got pre %v post %v", pre, post)
+		}
+		if acc := pre[outer]; acc == nil || len(acc.Storage) != 1 || acc.Storage[slot1] != (common.Hash{}) {
+			t.Errorf("unexpected pre state %+v", acc)
+		}
+		acc := post[outer]
+		if acc == nil || acc.Balance != nil || acc.Code != nil || len(acc.Storage) != 1 || acc.Storage[slot1] != common.BigToHash(big.NewInt(42)) {
+			t.Errorf("unexpected post state %+v", acc)
+		}
+		res, err := tracer.GetResult()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decoded map[string]json.RawMessage
+		if err := json.Unmarshal(res, &decoded); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := decoded["pre"]; !ok {
+			t.Errorf("pre missing from %s", res)
+		}
+		if _, ok := decoded["post"]; !ok {
+			t.Errorf("post missing from %s", res)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package vm
+
+import (
+	"encoding/json"
+	"math/big"
+	"time"
+
+	"github.com/holiman/uint256"
+
+	"github.com/ledgerwatch/erigon/common"
+)
+
+// Reentrancy is a call into a contract which already has a frame running
+// further up the call stack, recorded by the ReentrancyTracer.
+type Reentrancy struct {
+	Address    common.Address `json:"address"` // contract entered again
+	Caller     common.Address `json:"caller"`
+	Type       string         `json:"type"`               // CALL or STATICCALL
+	Depth      int            `json:"depth"`              // of the reentrant frame
+	CallPC     uint64         `json:"callPc"`             // of the reentrant call in its caller
+	OuterDepth int            `json:"outerDepth"`         // of the innermost earlier frame of the contract
+	OuterPC    uint64         `json:"outerPc"`            // of the call that frame is waiting on
+	ReadOnly   bool           `json:"readOnly,omitempty"` // the reentrant frame is static and can't change the state
+}
+
+// reentrancyFrame is an open call frame of the ReentrancyTracer.
+type reentrancyFrame struct {
+	address common.Address // whose storage the frame runs against
+	pc      uint64         // of the last step of the frame
+	static  bool
+}
+
+var _ Tracer = (*ReentrancyTracer)(nil)
+
+// ReentrancyTracer is a native tracer flagging reentrancy: calls into a
+// contract made while an earlier frame of the same contract is still on the
+// call stack. Frames are identified by the address whose storage they run
+// against, so DELEGATECALL and CALLCODE, which keep that of their caller,
+// never reenter, and frames created by CREATE and CREATE2 are new contracts.
+// The top-level frame has depth 0.
+type ReentrancyTracer struct {
+	frames       []reentrancyFrame
+	reentrancies []Reentrancy
+}
+
+// NewReentrancyTracer returns a new reentrancy tracer.
+func NewReentrancyTracer() *ReentrancyTracer {
+	return &ReentrancyTracer{}
+}
+
+func (t *ReentrancyTracer) CaptureStart(env *EVM, depth int, from common.Address, to common.Address, precompile bool, create bool, callType CallType, input []byte, gas uint64, value *big.Int, code []byte) {
+	if depth != 0 {
+		return
+	}
+	t.frames = []reentrancyFrame{{address: to, static: callType == STATICCALLT}}
+	t.reentrancies = nil
+}
+
+func (t *ReentrancyTracer) CaptureEnter(typ OpCode, from common.Address, to common.Address, input []byte, gas uint64, value *uint256.Int) {
+	size := len(t.frames)
+	if size == 0 {
+		return
+	}
+	caller := t.frames[size-1]
+	frame := reentrancyFrame{address: to, static: caller.static || typ == STATICCALL}
+	switch typ {
+	case DELEGATECALL, CALLCODE:
+		frame.address = caller.address
+	case CALL, STATICCALL:
+		for i := size - 1; i >= 0; i-- {
+			if t.frames[i].address != to {
+				continue
+			}
+			t.reentrancies = append(t.reentrancies, Reentrancy{
+				Address:    to,
+				Caller:     from,
+				Type:       typ.String(),
+				Depth:      size,
+				CallPC:     caller.pc,
+				OuterDepth: i,
+				OuterPC:    t.frames[i].pc,
+				ReadOnly:   frame.static,
+			})
+			break
+		}
+	}
+	t.frames = append(t.frames, frame)
+}
+
+// CaptureState keeps track of the pc of the current frame, for the calls it
+// makes.
+func (t *ReentrancyTracer) CaptureState(env *EVM, pc uint64, op OpCode, gas, cost uint64, scope *ScopeContext, rData []byte, depth int, err error) {
+	if size := len(t.frames); size > 0 {
+		t.frames[size-1].pc = pc
+	}
+}
+
+func (t *ReentrancyTracer) CaptureFault(env *EVM, pc uint64, op OpCode, gas, cost uint64, scope *ScopeContext, depth int, err error) {
+}
+
+func (t *ReentrancyTracer) CaptureEnd(depth int, output []byte, startGas, endGas uint64, d time.Duration, err error) {
+}
+
+func (t *ReentrancyTracer) CaptureExit(output []byte, gasUsed uint64, err error) {
+	if size := len(t.frames); size > 1 {
+		t.frames = t.frames[:size-1]
+	}
+}
+
+func (t *ReentrancyTracer) CaptureSelfDestruct(from common.Address, to common.Address, value *big.Int) {
+}
+
+func (t *ReentrancyTracer) CaptureAccountRead(account common.Address) error {
+	return nil
+}
+
+func (t *ReentrancyTracer) CaptureAccountWrite(account common.Address) error {
+	return nil
+}
+
+// Reentrancies returns the reentrant calls in the order they were made,
+// read-only ones included.
+func (t *ReentrancyTracer) Reentrancies() []Reentrancy {
+	return t.reentrancies
+}
+
+// GetResult returns the reentrant calls encoded as a JSON array.
+func (t *ReentrancyTracer) GetResult() (json.RawMessage, error) {
+	reentrancies := t.reentrancies
+	if reentrancies == nil {
+		reentrancies = []Reentrancy{}
+	}
+	return json.Marshal(reentrancies)
+}
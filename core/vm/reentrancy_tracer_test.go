@@ -0,0 +1,51 @@
+package vm
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/holiman/uint256"
+
+	"github.com/ledgerwatch/erigon/common"
+)
+
+func TestReentrancyTracer(t *testing.T) {
+	var (
+		vault   = common.HexToAddress("0xaa")
+		attack  = common.HexToAddress("0xbb")
+		library = common.HexToAddress("0xcc")
+	)
+	tracer := NewReentrancyTracer()
+	vmenv, s := newTestEVM(t, Config{Debug: true, Tracer: tracer})
+	// Without call data: DELEGATECALL(gas, 0xcc, 0, 0, 0, 0), then
+	// CALL(gas, 0xbb, 0, 0, 0, 0, 0) at pc 30. STOP otherwise
+	s.SetCode(vault, []byte{byte(CALLDATASIZE), byte(PUSH1), 33, byte(JUMPI),
+		byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0xcc, byte(GAS), byte(DELEGATECALL), byte(POP),
+		byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0xbb, byte(GAS), byte(CALL), byte(POP),
+		byte(STOP), byte(JUMPDEST), byte(STOP)})
+	// CALL(gas, 0xaa, 0, 0, 1, 0, 0) at pc 13, STATICCALL(gas, 0xaa, 0, 1, 0, 0)
+	// at pc 26
+	s.SetCode(attack, []byte{byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 1, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0xaa, byte(GAS), byte(CALL), byte(POP),
+		byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 1, byte(PUSH1), 0, byte(PUSH1), 0xaa, byte(GAS), byte(STATICCALL), byte(POP),
+		byte(STOP)})
+	s.SetCode(library, []byte{byte(STOP)})
+	if _, _, err := vmenv.Call(AccountRef(common.Address{}), vault, nil, 1000000, new(uint256.Int), false /* bailout */); err != nil {
+		t.Fatal(err)
+	}
+	want := []Reentrancy{
+		{Address: vault, Caller: attack, Type: "CALL", Depth: 2, CallPC: 13, OuterDepth: 0, OuterPC: 30},
+		{Address: vault, Caller: attack, Type: "STATICCALL", Depth: 2, CallPC: 26, OuterDepth: 0, OuterPC: 30, ReadOnly: true},
+	}
+	if have := tracer.Reentrancies(); !reflect.DeepEqual(have, want) {
+		t.Errorf("have reentrancies %+v, want %+v", have, want)
+	}
+	res, err := tracer.GetResult()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded []Reentrancy
+	if err := json.Unmarshal(res, &decoded); err != nil || !reflect.DeepEqual(decoded, want) {
+		t.Errorf("unexpected result %s: %v", res, err)
+	}
+}
@@ -17,12 +17,14 @@
 package runtime
 
 import (
+	"errors"
 	"fmt"
 	"math/big"
 	"os"
 	"strings"
 	"testing"
 
+	"github.com/holiman/uint256"
 	"github.com/ledgerwatch/erigon-lib/kv/memdb"
 	"github.com/ledgerwatch/erigon/accounts/abi"
 	"github.com/ledgerwatch/erigon/common"
@@ -593,3 +595,183 @@ func TestEip2929Cases(t *testing.T) {
 			"account (cheap)", code)
 	}
 }
+
+// TestEip1153 checks the TLOAD and TSTORE semantics of EIP-1153 about
+// transient storage
+func TestEip1153(t *testing.T) {
+	var (
+		gasLimit = uint64(100000)
+		slot     = common.BigToHash(big.NewInt(1))
+		value    = uint256.NewInt(0x22)
+	)
+	stored := func(statedb *state.IntraBlockState, addr common.Address) uint256.Int {
+		return statedb.GetTransientState(addr, slot)
+	}
+	// returnSlot pushes TLOAD(0x1) and returns it as a 32 byte word
+	returnSlot := []byte{
+		byte(vm.PUSH1), 0x01, byte(vm.TLOAD),
+		byte(vm.PUSH1), 0x00, byte(vm.MSTORE),
+		byte(vm.PUSH1), 0x20, byte(vm.PUSH1), 0x00, byte(vm.RETURN),
+	}
+	// storeSlot does TSTORE(0x1, 0x22)
+	storeSlot := []byte{byte(vm.PUSH1), 0x22, byte(vm.PUSH1), 0x01, byte(vm.TSTORE)}
+	var (
+		a = common.HexToAddress("0x0a")
+		b = common.HexToAddress("0x0b") // TSTORE(0x1, 0x22), STOP
+		c = common.HexToAddress("0x0c") // TSTORE(0x1, 0x22), REVERT
+		d = common.HexToAddress("0x0d") // TLOAD(0x1), STOP
+	)
+	newState := func(t *testing.T, code []byte) (*state.IntraBlockState, *Config) {
+		_, tx := memdb.NewTestTx(t)
+		statedb := state.New(state.NewDbStateReader(tx))
+		statedb.SetCode(a, code)
+		statedb.SetCode(b, append(append([]byte{}, storeSlot...), byte(vm.STOP)))
+		statedb.SetCode(c, append(append([]byte{}, storeSlot...), byte(vm.PUSH1), 0x00, byte(vm.DUP1), byte(vm.REVERT)))
+		statedb.SetCode(d, []byte{byte(vm.PUSH1), 0x01, byte(vm.TLOAD), byte(vm.POP), byte(vm.STOP)})
+		return statedb, &Config{State: statedb, kv: tx, GasLimit: gasLimit}
+	}
+
+	t.Run("tload after tstore", func(t *testing.T) {
+		statedb, cfg := newState(t, append(append([]byte{}, storeSlot...), returnSlot...))
+		ret, leftOver, err := Call(a, nil, cfg)
+		if err != nil {
+			t.Fatal("didn't expect error", err)
+		}
+		if got := new(uint256.Int).SetBytes(ret); !got.Eq(value) {
+			t.Errorf("expected %v, got %v", value, got)
+		}
+		// Both TSTORE and TLOAD cost 100, the PUSHes and the MSTORE the rest
+		if used := gasLimit - leftOver; used != 224 {
+			t.Errorf("expected 224 gas used, got %d", used)
+		}
+		if got := stored(statedb, a); !got.Eq(value) {
+			t.Errorf("expected transient slot %v, got %v", value, &got)
+		}
+		var persistent uint256.Int
+		statedb.GetState(a, &slot, &persistent)
+		if !persistent.IsZero() {
+			t.Errorf("transient store leaked into storage: %v", &persistent)
+		}
+	})
+
+	t.Run("tload of unset slot", func(t *testing.T) {
+		_, cfg := newState(t, returnSlot)
+		ret, _, err := Call(a, nil, cfg)
+		if err != nil {
+			t.Fatal("didn't expect error", err)
+		}
+		if got := new(uint256.Int).SetBytes(ret); !got.IsZero() {
+			t.Errorf("expected 0, got %v", got)
+		}
+	})
+
+	t.Run("lasts for the transaction", func(t *testing.T) {
+		// With call data store the slot, without it return it
+		code := []byte{
+			byte(vm.CALLDATASIZE), byte(vm.PUSH1), 0x0f, byte(vm.JUMPI),
+		}
+		code = append(code, returnSlot...)
+		code = append(code, byte(vm.JUMPDEST))
+		code = append(code, storeSlot...)
+		statedb, cfg := newState(t, code)
+		if _, _, err := Call(a, []byte{1}, cfg); err != nil {
+			t.Fatal("didn't expect error", err)
+		}
+		ret, _, err := Call(a, nil, cfg)
+		if err != nil {
+			t.Fatal("didn't expect error", err)
+		}
+		if got := new(uint256.Int).SetBytes(ret); !got.Eq(value) {
+			t.Errorf("expected %v from a later call, got %v", value, got)
+		}
+		statedb.Prepare(common.Hash{1}, common.Hash{}, 1)
+		ret, _, err = Call(a, nil, cfg)
+		if err != nil {
+			t.Fatal("didn't expect error", err)
+		}
+		if got := new(uint256.Int).SetBytes(ret); !got.IsZero() {
+			t.Errorf("expected 0 in the next transaction, got %v", got)
+		}
+	})
+
+	t.Run("reverted with the frame", func(t *testing.T) {
+		var code []byte
+		for _, addr := range []common.Address{b, c} {
+			code = append(code,
+				byte(vm.PUSH1), 0x00, byte(vm.DUP1), byte(vm.DUP1), byte(vm.DUP1), byte(vm.DUP1),
+				byte(vm.PUSH1), addr[19], byte(vm.GAS), byte(vm.CALL), byte(vm.POP))
+		}
+		statedb, cfg := newState(t, code)
+		if _, _, err := Call(a, nil, cfg); err != nil {
+			t.Fatal("didn't expect error", err)
+		}
+		if got := stored(statedb, b); !got.Eq(value) {
+			t.Errorf("expected transient slot %v in the callee, got %v", value, &got)
+		}
+		if got := stored(statedb, c); !got.IsZero() {
+			t.Errorf("expected reverted transient slot, got %v", &got)
+		}
+		if got := stored(statedb, a); !got.IsZero() {
+			t.Errorf("expected the caller's transient slot untouched, got %v", &got)
+		}
+	})
+
+	t.Run("delegatecall uses the caller's storage", func(t *testing.T) {
+		code := []byte{
+			byte(vm.PUSH1), 0x00, byte(vm.DUP1), byte(vm.DUP1), byte(vm.DUP1),
+			byte(vm.PUSH1), b[19], byte(vm.GAS), byte(vm.DELEGATECALL), byte(vm.POP),
+		}
+		statedb, cfg := newState(t, append(code, returnSlot...))
+		ret, _, err := Call(a, nil, cfg)
+		if err != nil {
+			t.Fatal("didn't expect error", err)
+		}
+		if got := new(uint256.Int).SetBytes(ret); !got.Eq(value) {
+			t.Errorf("expected %v, got %v", value, got)
+		}
+		if got := stored(statedb, b); !got.IsZero() {
+			t.Errorf("expected the delegate's transient slot untouched, got %v", &got)
+		}
+	})
+
+	t.Run("tstore is a write in staticcall", func(t *testing.T) {
+		var code []byte
+		for i, addr := range []common.Address{b, d} {
+			code = append(code,
+				byte(vm.PUSH1), 0x00, byte(vm.DUP1), byte(vm.DUP1), byte(vm.DUP1),
+				// A failed call consumes all the gas it is given
+				byte(vm.PUSH1), addr[19], byte(vm.PUSH2), 0x27, 0x10, byte(vm.STATICCALL),
+				byte(vm.PUSH1), byte(i*32), byte(vm.MSTORE))
+		}
+		code = append(code, byte(vm.PUSH1), 0x40, byte(vm.PUSH1), 0x00, byte(vm.RETURN))
+		statedb, cfg := newState(t, code)
+		ret, _, err := Call(a, nil, cfg)
+		if err != nil {
+			t.Fatal("didn't expect error", err)
+		}
+		if len(ret) != 64 {
+			t.Fatalf("expected 64 bytes, got %x", ret)
+		}
+		if ok := new(uint256.Int).SetBytes(ret[:32]); !ok.IsZero() {
+			t.Error("expected TSTORE to fail in a static call")
+		}
+		if ok := new(uint256.Int).SetBytes(ret[32:]); !ok.Eq(uint256.NewInt(1)) {
+			t.Error("expected TLOAD to succeed in a static call")
+		}
+		if got := stored(statedb, b); !got.IsZero() {
+			t.Errorf("expected no transient slot, got %v", &got)
+		}
+	})
+
+	t.Run("undefined before cancun", func(t *testing.T) {
+		for _, op := range []vm.OpCode{vm.TLOAD, vm.TSTORE} {
+			_, _, err := Execute([]byte{byte(vm.PUSH1), 0x01, byte(vm.DUP1), byte(op)}, nil, &Config{
+				ChainConfig: params.AllEthashProtocolChanges,
+			}, 0)
+			var invalid *vm.ErrInvalidOpCode
+			if !errors.As(err, &invalid) {
+				t.Errorf("%v: expected invalid opcode, got %v", op, err)
+			}
+		}
+	})
+}
@@ -0,0 +1,93 @@
+package vm
+
+import (
+	"fmt"
+	"math/big"
+
+	"github.com/holiman/uint256"
+
+	"github.com/ledgerwatch/erigon/common/math"
+	"github.com/ledgerwatch/erigon/core/vm/stack"
+	"github.com/ledgerwatch/erigon/params"
+)
+
+// RunSingleOp executes op alone under the given rules, against a stack holding
+// stackInputs and a memory initialised to memory. The stack is given top first,
+// like stack.Back, and returned the same way after the operation, along with
+// the gas it used.
+//
+// There is no state, transaction or call frame behind the operation: the block
+// and transaction context are zero and the code is empty. The opcodes reading
+// the state or calling out are rejected with ErrContextRequired. It is meant
+// for testing the semantics of single opcodes.
+func RunSingleOp(op OpCode, stackInputs []*uint256.Int, memory []byte, rules params.Rules) (stackOutputs []*uint256.Int, gas uint64, err error) {
+	switch op {
+	case BALANCE, SELFBALANCE, EXTCODESIZE, EXTCODECOPY, EXTCODEHASH, SLOAD, SSTORE, TLOAD, TSTORE,
+		LOG0, LOG1, LOG2, LOG3, LOG4, CREATE, CREATE2, CALL, CALLCODE, DELEGATECALL, STATICCALL, SELFDESTRUCT:
+		return nil, 0, fmt.Errorf("%w: %v", ErrContextRequired, op)
+	}
+	evm := &EVM{
+		context:    BlockContext{Difficulty: new(big.Int), BaseFee: new(uint256.Int)},
+		txContext:  TxContext{GasPrice: new(big.Int)},
+		chainRules: &rules,
+	}
+	in := NewEVMInterpreter(evm, evm.config)
+	evm.interpreter = in
+
+	operation := in.jt[op]
+	if operation == nil {
+		return nil, 0, &ErrInvalidOpCode{opcode: op}
+	}
+	st := stack.New()
+	for i := len(stackInputs) - 1; i >= 0; i-- {
+		st.Push(stackInputs[i])
+	}
+	if sLen := st.Len(); sLen < operation.minStack {
+		return nil, 0, &ErrStackUnderflow{stackLen: sLen, required: operation.minStack}
+	} else if sLen > operation.maxStack {
+		return nil, 0, &ErrStackOverflow{stackLen: sLen, limit: operation.maxStack}
+	}
+	// The initial memory is already paid for
+	mem := NewMemory()
+	if size := toWordSize(uint64(len(memory))) * 32; size > 0 {
+		if _, err := memoryGasCost(mem, size); err != nil {
+			return nil, 0, err
+		}
+		mem.Resize(size)
+		mem.Set(0, uint64(len(memory)), memory)
+	}
+	contract := NewContract(AccountRef{}, AccountRef{}, new(uint256.Int), math.MaxUint64, false /* skipAnalysis */)
+	scope := &ScopeContext{Memory: mem, Stack: st, Contract: contract}
+
+	gas = operation.constantGas
+	var memorySize uint64
+	if operation.memorySize != nil {
+		memSize, overflow := operation.memorySize(st)
+		if overflow {
+			return nil, 0, ErrGasUintOverflow
+		}
+		if memorySize, overflow = math.SafeMul(toWordSize(memSize), 32); overflow {
+			return nil, 0, ErrGasUintOverflow
+		}
+	}
+	if operation.dynamicGas != nil {
+		dynamicCost, err := operation.dynamicGas(evm, contract, st, mem, memorySize)
+		if err != nil {
+			return nil, 0, ErrOutOfGas
+		}
+		gas += dynamicCost
+	}
+	contract.Gas -= gas
+	if memorySize > 0 {
+		mem.Resize(memorySize)
+	}
+	pc := uint64(0)
+	if _, err = operation.execute(&pc, in, scope); err != nil {
+		return nil, gas, err
+	}
+	stackOutputs = make([]*uint256.Int, st.Len())
+	for i := range stackOutputs {
+		stackOutputs[i] = st.Back(i).Clone()
+	}
+	return stackOutputs, gas, nil
+}
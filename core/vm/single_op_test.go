@@ -0,0 +1,45 @@
+package vm
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/holiman/uint256"
+
+	"github.com/ledgerwatch/erigon/params"
+)
+
+func TestRunSingleOp(t *testing.T) {
+	rules := *params.TestChainConfig.Rules(0)
+	// SUB takes the top of the stack first
+	out, gas, err := RunSingleOp(SUB, []*uint256.Int{uint256.NewInt(10), uint256.NewInt(3), uint256.NewInt(1)}, nil, rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != 2 || out[0].Uint64() != 7 || out[1].Uint64() != 1 || gas != GasFastestStep {
+		t.Errorf("unexpected SUB result %v, gas %d", out, gas)
+	}
+	// The initial memory is read as it is and not charged for
+	mem := make([]byte, 32)
+	mem[31] = 42
+	if out, gas, err = RunSingleOp(MLOAD, []*uint256.Int{new(uint256.Int)}, mem, rules); err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != 1 || out[0].Uint64() != 42 || gas != GasFastestStep {
+		t.Errorf("unexpected MLOAD result %v, gas %d", out, gas)
+	}
+	// Expanding it is
+	if _, gas, err = RunSingleOp(MSTORE, []*uint256.Int{uint256.NewInt(32), uint256.NewInt(1)}, mem, rules); err != nil {
+		t.Fatal(err)
+	}
+	if want := GasFastestStep + params.MemoryGas; gas != want {
+		t.Errorf("MSTORE gas mismatch: have %d, want %d", gas, want)
+	}
+	var underflow *ErrStackUnderflow
+	if _, _, err = RunSingleOp(ADD, []*uint256.Int{uint256.NewInt(1)}, nil, rules); !errors.As(err, &underflow) {
+		t.Errorf("expected a stack underflow, got %v", err)
+	}
+	if _, _, err = RunSingleOp(CALL, make([]*uint256.Int, 7), nil, rules); !errors.Is(err, ErrContextRequired) {
+		t.Errorf("expected CALL to be rejected, got %v", err)
+	}
+}
@@ -82,6 +82,19 @@ func (st *Stack) Back(n int) *uint256.Int {
 	return &st.Data[st.Len()-n-1]
 }
 
+// CopyTop copies the topmost items into dst, the top of the stack first, and
+// returns how many were copied: the smaller of len(dst) and the stack height.
+func (st *Stack) CopyTop(dst []uint256.Int) int {
+	n := len(dst)
+	if n > st.Len() {
+		n = st.Len()
+	}
+	for i := 0; i < n; i++ {
+		dst[i] = st.Data[st.Len()-i-1]
+	}
+	return n
+}
+
 func (st *Stack) Reset() {
 	st.Data = st.Data[:0]
 }
@@ -0,0 +1,138 @@
+package vm
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/holiman/uint256"
+
+	"github.com/ledgerwatch/erigon/common"
+	"github.com/ledgerwatch/erigon/common/hexutil"
+)
+
+// BalanceDiff is a balance changed by a transaction.
+type BalanceDiff struct {
+	From *hexutil.Big `json:"from"`
+	To   *hexutil.Big `json:"to"`
+}
+
+// NonceDiff is a nonce changed by a transaction.
+type NonceDiff struct {
+	From hexutil.Uint64 `json:"from"`
+	To   hexutil.Uint64 `json:"to"`
+}
+
+// CodeDiff is a code changed by a transaction.
+type CodeDiff struct {
+	From hexutil.Bytes `json:"from"`
+	To   hexutil.Bytes `json:"to"`
+}
+
+// StorageDiff is a storage slot changed by a transaction.
+type StorageDiff struct {
+	From common.Hash `json:"from"`
+	To   common.Hash `json:"to"`
+}
+
+// StateDiffAccount holds the net changes made to an account by a transaction,
+// nil fields are unchanged. A created account is diffed against an empty one,
+// a destroyed account against an empty one too. Accounts created and left empty
+// or destroyed by the same transaction are not reported.
+type StateDiffAccount struct {
+	Created   bool                        `json:"created,omitempty"`
+	Destroyed bool                        `json:"destroyed,omitempty"`
+	Balance   *BalanceDiff                `json:"balance,omitempty"`
+	Nonce     *NonceDiff                  `json:"nonce,omitempty"`
+	Code      *CodeDiff                   `json:"code,omitempty"`
+	Storage   map[common.Hash]StorageDiff `json:"storage,omitempty"`
+}
+
+// StateDiff is the set of accounts changed by a transaction, keyed by address.
+type StateDiff map[common.Address]*StateDiffAccount
+
+var _ Tracer = (*StateDiffTracer)(nil)
+
+// StateDiffTracer is a native tracer computing the net state changes of a
+// transaction. The accounts and slots are read when first touched, like the
+// PrestateTracer does, and compared with the state at the end of the
+// execution. What was only read, or written back to its original value, is
+// left out.
+type StateDiffTracer struct {
+	*PrestateTracer
+	diff StateDiff
+}
+
+// NewStateDiffTracer returns a new state diff tracer.
+func NewStateDiffTracer() *StateDiffTracer {
+	return &StateDiffTracer{PrestateTracer: NewPrestateTracer(false), diff: make(StateDiff)}
+}
+
+func (t *StateDiffTracer) CaptureEnd(depth int, output []byte, startGas, endGas uint64, d time.Duration, err error) {
+	if depth != 0 {
+		return
+	}
+	t.processStateDiff()
+}
+
+// processStateDiff compares the touched accounts with their current state.
+func (t *StateDiffTracer) processStateDiff() {
+	ibs := t.env.IntraBlockState()
+	for addr, pre := range t.pre {
+		_, created := t.missing[addr]
+		destroyed := !ibs.Exist(addr) || ibs.HasSuicided(addr)
+		// Accounts that didn't exist before and are gone or left empty (and
+		// so removed by EIP-161) never made it to the state.
+		if created && (destroyed || ibs.Empty(addr)) {
+			continue
+		}
+		var (
+			account = &StateDiffAccount{Created: created, Destroyed: destroyed}
+			balance = new(uint256.Int)
+			nonce   uint64
+			code    []byte
+		)
+		if !destroyed {
+			balance, nonce, code = ibs.GetBalance(addr), ibs.GetNonce(addr), ibs.GetCode(addr)
+		}
+		changed := created || destroyed
+		if balance.ToBig().Cmp(pre.Balance.ToInt()) != 0 {
+			account.Balance, changed = &BalanceDiff{From: pre.Balance, To: (*hexutil.Big)(balance.ToBig())}, true
+		}
+		if nonce != pre.Nonce {
+			account.Nonce, changed = &NonceDiff{From: hexutil.Uint64(pre.Nonce), To: hexutil.Uint64(nonce)}, true
+		}
+		if !bytes.Equal(code, pre.Code) {
+			account.Code, changed = &CodeDiff{From: pre.Code, To: common.CopyBytes(code)}, true
+		}
+		for key, prev := range pre.Storage {
+			var value uint256.Int
+			if !destroyed {
+				ibs.GetState(addr, &key, &value)
+			}
+			if current := common.Hash(value.Bytes32()); current != prev {
+				if account.Storage == nil {
+					account.Storage = make(map[common.Hash]StorageDiff)
+				}
+				account.Storage[key], changed = StorageDiff{From: prev, To: current}, true
+			}
+		}
+		if changed {
+			t.diff[addr] = account
+		}
+	}
+}
+
+// Diff returns the accounts changed by the transaction.
+func (t *StateDiffTracer) Diff() StateDiff {
+	return t.diff
+}
+
+// GetResult returns the state diff encoded as JSON.
+func (t *StateDiffTracer) GetResult() (json.RawMessage, error) {
+	if t.env == nil {
+		return nil, errors.New("no transaction traced")
+	}
+	return json.Marshal(t.diff)
+}
@@ -0,0 +1,96 @@
+package vm
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/holiman/uint256"
+
+	"github.com/ledgerwatch/erigon/common"
+	"github.com/ledgerwatch/erigon/crypto"
+)
+
+func TestStateDiffTracer(t *testing.T) {
+	var (
+		caller    = common.HexToAddress("0x01")
+		outer     = common.HexToAddress("0xaa")
+		recipient = common.HexToAddress("0xbb")
+		queried   = common.HexToAddress("0xcc")
+		destroyed = common.HexToAddress("0xdd")
+		created   = crypto.CreateAddress(outer, 0)
+	)
+	// call performs a CALL(gas, addr, value, 0, 0, 0, 0)
+	call := func(addr, value byte) []byte {
+		return []byte{byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), value, byte(PUSH1), addr, byte(GAS), byte(CALL), byte(POP)}
+	}
+	code := []byte{
+		// SSTORE(1, SLOAD(0) + 1), then SSTORE(0, 41) which doesn't change it
+		byte(PUSH1), 0, byte(SLOAD), byte(PUSH1), 1, byte(ADD), byte(PUSH1), 1, byte(SSTORE),
+		byte(PUSH1), 41, byte(PUSH1), 0, byte(SSTORE),
+		byte(PUSH1), 0xcc, byte(BALANCE), byte(POP),
+	}
+	code = append(code, call(0xbb, 5)...)
+	code = append(code, call(0xdd, 0)...)
+	// CREATE(0, 0, 0)
+	code = append(code, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(CREATE), byte(POP), byte(STOP))
+
+	tracer := NewStateDiffTracer()
+	vmenv, s := newTestEVM(t, Config{Debug: true, Tracer: tracer})
+	vmenv.context.Transfer = func(db IntraBlockState, sender, recipient common.Address, amount *uint256.Int, bailout bool) {
+		db.SubBalance(sender, amount)
+		db.AddBalance(recipient, amount)
+	}
+	s.SetCode(outer, code)
+	s.SetState(outer, &common.Hash{}, *uint256.NewInt(41))
+	s.AddBalance(outer, uint256.NewInt(10))
+	s.SetCode(destroyed, []byte{byte(PUSH1), 0xbb, byte(SELFDESTRUCT)})
+	s.AddBalance(destroyed, uint256.NewInt(3))
+	s.AddAddressToAccessList(outer)
+
+	if _, _, err := vmenv.Call(AccountRef(caller), outer, nil, 1000000, new(uint256.Int), false /* bailout */); err != nil {
+		t.Fatal(err)
+	}
+	diff := tracer.Diff()
+	if len(diff) != 4 {
+		t.Errorf("expected 4 changed accounts, got %d", len(diff))
+	}
+	for _, addr := range []common.Address{caller, queried} {
+		if _, ok := diff[addr]; ok {
+			t.Errorf("unchanged account %x in the diff", addr)
+		}
+	}
+	// Only the modified slot is reported, along with the nonce bumped by CREATE
+	acc := diff[outer]
+	if acc == nil || acc.Created || acc.Destroyed || acc.Code != nil {
+		t.Fatalf("unexpected diff of the called account %+v", acc)
+	}
+	if acc.Balance == nil || acc.Balance.From.ToInt().Uint64() != 10 || acc.Balance.To.ToInt().Uint64() != 5 {
+		t.Errorf("unexpected balance diff %+v", acc.Balance)
+	}
+	if acc.Nonce == nil || acc.Nonce.From != 0 || acc.Nonce.To != 1 {
+		t.Errorf("unexpected nonce diff %+v", acc.Nonce)
+	}
+	slot1 := common.BigToHash(common.Big1)
+	if len(acc.Storage) != 1 || acc.Storage[slot1] != (StorageDiff{From: common.Hash{}, To: common.BigToHash(uint256.NewInt(42).ToBig())}) {
+		t.Errorf("unexpected storage diff %v", acc.Storage)
+	}
+	// The recipient received the value transfer and the selfdestructed balance
+	if acc := diff[recipient]; acc == nil || !acc.Created || acc.Balance == nil || acc.Balance.To.ToInt().Uint64() != 8 {
+		t.Errorf("unexpected diff of the recipient %+v", acc)
+	}
+	if acc := diff[destroyed]; acc == nil || !acc.Destroyed || acc.Balance == nil || acc.Balance.To.ToInt().Sign() != 0 || acc.Code == nil || len(acc.Code.To) != 0 {
+		t.Errorf("unexpected diff of the destroyed account %+v", acc)
+	}
+	if acc := diff[created]; acc == nil || !acc.Created || acc.Nonce == nil || acc.Nonce.To != 1 {
+		t.Errorf("unexpected diff of the created account %+v", acc)
+	}
+
+	res, err := tracer.GetResult()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded map[common.Address]json.RawMessage
+	if err := json.Unmarshal(res, &decoded); err != nil || len(decoded) != 4 {
+		t.Errorf("unexpected result %s: %v", res, err)
+	}
+}
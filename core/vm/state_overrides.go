@@ -0,0 +1,76 @@
+package vm
+
+import (
+	"fmt"
+
+	"github.com/holiman/uint256"
+
+	"github.com/ledgerwatch/erigon/common"
+	"github.com/ledgerwatch/erigon/core/state"
+)
+
+// OverrideAccount holds the fields of an account replaced by StateOverrides,
+// nil fields keep their original value.
+type OverrideAccount struct {
+	Nonce     *uint64
+	Code      *[]byte
+	Balance   *uint256.Int
+	State     map[common.Hash]uint256.Int // Replaces the whole storage
+	StateDiff map[common.Hash]uint256.Int // Replaces the given slots only
+}
+
+// StateOverrides replaces parts of the state of a set of accounts, for what-if
+// execution. Accounts that don't exist are created.
+type StateOverrides map[common.Address]OverrideAccount
+
+// storageReplacer is implemented by states that can replace the whole storage
+// of an account.
+type storageReplacer interface {
+	SetStorage(addr common.Address, storage state.Storage)
+}
+
+// Apply writes the overrides to the state. The changes are journaled like any
+// other, so they are discarded by reverting to an earlier snapshot.
+func (overrides StateOverrides) Apply(ibs IntraBlockState) error {
+	for addr, account := range overrides {
+		if account.State != nil && account.StateDiff != nil {
+			return fmt.Errorf("account %s has both state and state diff overrides", addr.Hex())
+		}
+		if account.Nonce != nil {
+			ibs.SetNonce(addr, *account.Nonce)
+		}
+		if account.Code != nil {
+			ibs.SetCode(addr, *account.Code)
+		}
+		if account.Balance != nil {
+			// IntraBlockState has no balance setter, go through zero
+			ibs.SubBalance(addr, ibs.GetBalance(addr).Clone())
+			ibs.AddBalance(addr, account.Balance)
+		}
+		if account.State != nil {
+			replacer, ok := ibs.(storageReplacer)
+			if !ok {
+				return fmt.Errorf("state overrides: storage of %s cannot be replaced", addr.Hex())
+			}
+			replacer.SetStorage(addr, account.State)
+		}
+		for key, value := range account.StateDiff {
+			key := key
+			ibs.SetState(addr, &key, value)
+		}
+	}
+	return nil
+}
+
+// WithStateOverrides applies the overrides to the state of the EVM and calls
+// run, after which the state is reverted: neither the overrides nor the effects
+// of run persist.
+func (evm *EVM) WithStateOverrides(overrides StateOverrides, run func() error) error {
+	ibs := evm.intraBlockState
+	snapshot := ibs.Snapshot()
+	defer ibs.RevertToSnapshot(snapshot)
+	if err := overrides.Apply(ibs); err != nil {
+		return err
+	}
+	return run()
+}
@@ -0,0 +1,74 @@
+package vm
+
+import (
+	"testing"
+
+	"github.com/holiman/uint256"
+
+	"github.com/ledgerwatch/erigon/common"
+)
+
+func TestStateOverrides(t *testing.T) {
+	var (
+		patched = common.HexToAddress("0xaa")
+		created = common.HexToAddress("0xbb")
+		slot1   = common.BigToHash(common.Big1)
+	)
+	vmenv, s := newTestEVM(t, Config{})
+	// RETURN(SLOAD(1))
+	sload := []byte{byte(PUSH1), 1, byte(SLOAD), byte(PUSH1), 0, byte(MSTORE), byte(PUSH1), 32, byte(PUSH1), 0, byte(RETURN)}
+	s.SetCode(patched, []byte{byte(STOP)})
+	s.SetState(patched, &slot1, *uint256.NewInt(5))
+	s.AddAddressToAccessList(patched)
+	s.AddAddressToAccessList(created)
+
+	call := func(addr common.Address) uint64 {
+		ret, _, err := vmenv.Call(AccountRef(common.Address{}), addr, nil, 100000, new(uint256.Int), false /* bailout */)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ret) == 0 {
+			return 0
+		}
+		return new(uint256.Int).SetBytes(ret).Uint64()
+	}
+	nonce := uint64(3)
+	overrides := StateOverrides{
+		// The whole storage is replaced, slot 1 reads as empty
+		patched: {Code: &sload, State: map[common.Hash]uint256.Int{{}: *uint256.NewInt(7)}},
+		created: {Code: &sload, Nonce: &nonce, Balance: uint256.NewInt(100), StateDiff: map[common.Hash]uint256.Int{slot1: *uint256.NewInt(9)}},
+	}
+	err := vmenv.WithStateOverrides(overrides, func() error {
+		if got := call(patched); got != 0 {
+			t.Errorf("replaced storage: got %d, want 0", got)
+		}
+		if got := call(created); got != 9 {
+			t.Errorf("new account storage: got %d, want 9", got)
+		}
+		if s.GetNonce(created) != nonce || s.GetBalance(created).Uint64() != 100 {
+			t.Errorf("new account not overridden")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing persists beyond the callback
+	if s.Exist(created) {
+		t.Errorf("overridden account still exists")
+	}
+	if len(s.GetCode(patched)) != 1 {
+		t.Errorf("code override persisted")
+	}
+	var value uint256.Int
+	s.GetState(patched, &slot1, &value)
+	if value.Uint64() != 5 {
+		t.Errorf("storage override persisted: slot 1 is %d", value.Uint64())
+	}
+
+	overrides = StateOverrides{patched: {State: map[common.Hash]uint256.Int{}, StateDiff: map[common.Hash]uint256.Int{}}}
+	if err := vmenv.WithStateOverrides(overrides, func() error { return nil }); err == nil {
+		t.Error("expected an error for both state and state diff")
+	}
+}
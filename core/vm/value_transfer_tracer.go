@@ -0,0 +1,162 @@
+package vm
+
+import (
+	"encoding/json"
+	"math/big"
+	"time"
+
+	"github.com/holiman/uint256"
+
+	"github.com/ledgerwatch/erigon/common"
+	"github.com/ledgerwatch/erigon/common/hexutil"
+)
+
+// ValueTransferFee is the type of the transfer recorded by
+// ValueTransferTracer.CaptureFee.
+const ValueTransferFee = "FEE"
+
+// ValueTransfer is a movement of ETH recorded by the ValueTransferTracer. Type
+// is the opcode moving the value, CALL for the transaction itself, or
+// ValueTransferFee.
+type ValueTransfer struct {
+	From     common.Address `json:"from"`
+	To       common.Address `json:"to"`
+	Value    *hexutil.Big   `json:"value"`
+	Type     string         `json:"type"`
+	Depth    int            `json:"depth"`              // of the frame receiving the value, or self-destructing
+	Reverted bool           `json:"reverted,omitempty"` // undone by the failure of the frame or an enclosing one
+}
+
+var _ Tracer = (*ValueTransferTracer)(nil)
+
+// ValueTransferTracer is a native tracer listing the value transfers of a
+// transaction in execution order, the "internal transactions": the value of
+// the transaction and of CALLs, the endowment of created contracts and the
+// balance of self-destructed ones. CALLCODE is left out as it sends the value
+// to the caller itself, and so are zero-valued transfers.
+type ValueTransferTracer struct {
+	env          *EVM
+	transfers    []ValueTransfer
+	starts       []int // index of the first transfer of every open frame, but the outermost
+	dropReverted bool  // drop the transfers of failed frames instead of flagging them
+}
+
+// NewValueTransferTracer returns a new value transfer tracer. Transfers of
+// failed frames are flagged as reverted, or dropped if dropReverted is set.
+func NewValueTransferTracer(dropReverted bool) *ValueTransferTracer {
+	return &ValueTransferTracer{dropReverted: dropReverted}
+}
+
+// record appends a transfer unless no value is moved.
+func (t *ValueTransferTracer) record(typ string, from, to common.Address, value *big.Int, depth int) {
+	if value == nil || value.Sign() <= 0 {
+		return
+	}
+	t.transfers = append(t.transfers, ValueTransfer{
+		From:  from,
+		To:    to,
+		Value: (*hexutil.Big)(new(big.Int).Set(value)),
+		Type:  typ,
+		Depth: depth,
+	})
+}
+
+// revert handles the failure of a frame whose first transfer is at start.
+func (t *ValueTransferTracer) revert(start int) {
+	if t.dropReverted {
+		t.transfers = t.transfers[:start]
+		return
+	}
+	for i := start; i < len(t.transfers); i++ {
+		t.transfers[i].Reverted = true
+	}
+}
+
+func (t *ValueTransferTracer) CaptureStart(env *EVM, depth int, from common.Address, to common.Address, precompile bool, create bool, callType CallType, input []byte, gas uint64, value *big.Int, code []byte) {
+	if depth != 0 {
+		return
+	}
+	t.env, t.transfers, t.starts = env, nil, nil
+	typ := CALL
+	switch callType {
+	case CREATET:
+		typ = CREATE
+	case CREATE2T:
+		typ = CREATE2
+	}
+	t.record(typ.String(), from, to, value, 0)
+}
+
+func (t *ValueTransferTracer) CaptureEnter(typ OpCode, from common.Address, to common.Address, input []byte, gas uint64, value *uint256.Int) {
+	t.starts = append(t.starts, len(t.transfers))
+	if typ != CALLCODE && value != nil {
+		t.record(typ.String(), from, to, value.ToBig(), len(t.starts))
+	}
+}
+
+func (t *ValueTransferTracer) CaptureState(env *EVM, pc uint64, op OpCode, gas, cost uint64, scope *ScopeContext, rData []byte, depth int, err error) {
+}
+
+func (t *ValueTransferTracer) CaptureFault(env *EVM, pc uint64, op OpCode, gas, cost uint64, scope *ScopeContext, depth int, err error) {
+}
+
+func (t *ValueTransferTracer) CaptureEnd(depth int, output []byte, startGas, endGas uint64, d time.Duration, err error) {
+	if depth == 0 && err != nil {
+		t.revert(0)
+	}
+}
+
+func (t *ValueTransferTracer) CaptureExit(output []byte, gasUsed uint64, err error) {
+	size := len(t.starts)
+	if size == 0 {
+		return
+	}
+	start := t.starts[size-1]
+	t.starts = t.starts[:size-1]
+	if err != nil {
+		t.revert(start)
+	}
+}
+
+// CaptureSelfDestruct records the balance sent to the beneficiary.
+func (t *ValueTransferTracer) CaptureSelfDestruct(from common.Address, to common.Address, value *big.Int) {
+	t.record(SELFDESTRUCT.String(), from, to, value, len(t.starts))
+}
+
+func (t *ValueTransferTracer) CaptureAccountRead(account common.Address) error {
+	return nil
+}
+
+func (t *ValueTransferTracer) CaptureAccountWrite(account common.Address) error {
+	return nil
+}
+
+// CaptureFee records the priority fee paid by the sender to the coinbase for
+// gasUsed, the gas used by the whole transaction, at the gas price of the
+// transaction less the base fee since London. The EVM doesn't charge fees, so
+// it is up to the caller to report them once the transaction is applied.
+func (t *ValueTransferTracer) CaptureFee(gasUsed uint64) {
+	if t.env == nil {
+		return
+	}
+	tip := t.env.GasPrice()
+	if baseFee := t.env.Context().BaseFee; t.env.ChainRules().IsLondon && baseFee != nil {
+		tip.Sub(tip, baseFee.ToBig())
+	}
+	fee := tip.Mul(tip, new(big.Int).SetUint64(gasUsed))
+	t.record(ValueTransferFee, t.env.Origin(), t.env.Context().Coinbase, fee, 0)
+}
+
+// Transfers returns the recorded transfers.
+func (t *ValueTransferTracer) Transfers() []ValueTransfer {
+	return t.transfers
+}
+
+// GetResult returns the recorded transfers encoded as a JSON array.
+func (t *ValueTransferTracer) GetResult() (json.RawMessage, error) {
+	transfers := t.transfers
+	if transfers == nil {
+		transfers = []ValueTransfer{}
+	}
+	return json.Marshal(transfers)
+}
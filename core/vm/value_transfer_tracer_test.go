@@ -0,0 +1,77 @@
+package vm
+
+import (
+	"encoding/json"
+	"math/big"
+	"testing"
+
+	"github.com/holiman/uint256"
+
+	"github.com/ledgerwatch/erigon/common"
+	"github.com/ledgerwatch/erigon/common/hexutil"
+)
+
+func TestValueTransferTracer(t *testing.T) {
+	var (
+		caller   = common.HexToAddress("0x01")
+		outer    = common.HexToAddress("0xaa")
+		payee    = common.HexToAddress("0xbb")
+		reverter = common.HexToAddress("0xcc")
+		nested   = common.HexToAddress("0xdd")
+		destruct = common.HexToAddress("0xee")
+		coinbase = common.HexToAddress("0xcb")
+	)
+	// call performs a CALL(gas, addr, value, 0, 0, 0, 0)
+	call := func(addr, value byte) []byte {
+		return []byte{byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), value, byte(PUSH1), addr, byte(GAS), byte(CALL), byte(POP)}
+	}
+	code := append(call(0xbb, 3), call(0xcc, 2)...)
+	code = append(code, call(0xee, 0)...)
+
+	for _, drop := range []bool{false, true} {
+		tracer := NewValueTransferTracer(drop)
+		vmenv, s := newTestEVM(t, Config{Debug: true, Tracer: tracer})
+		vmenv.context.Coinbase = coinbase
+		vmenv.txContext.Origin = caller
+		vmenv.txContext.GasPrice = big.NewInt(2)
+		s.SetCode(outer, code)
+		s.SetCode(payee, []byte{byte(STOP)})
+		s.SetCode(reverter, append(call(0xdd, 1), byte(PUSH1), 0, byte(PUSH1), 0, byte(REVERT)))
+		s.SetCode(destruct, []byte{byte(PUSH1), 0xbb, byte(SELFDESTRUCT)})
+		s.AddBalance(destruct, uint256.NewInt(5))
+		if _, _, err := vmenv.Call(AccountRef(caller), outer, nil, 1000000, uint256.NewInt(10), false /* bailout */); err != nil {
+			t.Fatal(err)
+		}
+		tracer.CaptureFee(21000)
+
+		want := []ValueTransfer{
+			{From: caller, To: outer, Value: (*hexutil.Big)(big.NewInt(10)), Type: "CALL", Depth: 0},
+			{From: outer, To: payee, Value: (*hexutil.Big)(big.NewInt(3)), Type: "CALL", Depth: 1},
+			{From: outer, To: reverter, Value: (*hexutil.Big)(big.NewInt(2)), Type: "CALL", Depth: 1, Reverted: true},
+			{From: reverter, To: nested, Value: (*hexutil.Big)(big.NewInt(1)), Type: "CALL", Depth: 2, Reverted: true},
+			{From: destruct, To: payee, Value: (*hexutil.Big)(big.NewInt(5)), Type: "SELFDESTRUCT", Depth: 1},
+			{From: caller, To: coinbase, Value: (*hexutil.Big)(big.NewInt(42000)), Type: ValueTransferFee, Depth: 0},
+		}
+		if drop {
+			want = append(want[:2], want[4:]...)
+		}
+		have, _ := json.Marshal(tracer.Transfers())
+		expected, _ := json.Marshal(want)
+		if string(have) != string(expected) {
+			t.Errorf("drop %t: unexpected transfers\nhave %s\nwant %s", drop, have, expected)
+		}
+	}
+}
+
+func TestValueTransferTracerFailedTx(t *testing.T) {
+	contract := common.HexToAddress("0xaa")
+	tracer := NewValueTransferTracer(false)
+	vmenv, s := newTestEVM(t, Config{Debug: true, Tracer: tracer})
+	s.SetCode(contract, []byte{byte(PUSH1), 0, byte(PUSH1), 0, byte(REVERT)})
+	if _, _, err := vmenv.Call(AccountRef(common.Address{}), contract, nil, 100000, uint256.NewInt(1), false /* bailout */); err == nil {
+		t.Fatal("expected the call to revert")
+	}
+	if transfers := tracer.Transfers(); len(transfers) != 1 || !transfers[0].Reverted {
+		t.Errorf("expected the reverted value of the transaction, got %+v", transfers)
+	}
+}
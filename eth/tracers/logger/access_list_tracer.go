@@ -20,6 +20,7 @@ import (
 	"math/big"
 	"time"
 
+	"github.com/holiman/uint256"
 	"github.com/ledgerwatch/erigon/common"
 	"github.com/ledgerwatch/erigon/core/types"
 	"github.com/ledgerwatch/erigon/core/vm"
@@ -141,6 +142,9 @@ func NewAccessListTracer(acl types.AccessList, from, to common.Address, precompi
 func (a *AccessListTracer) CaptureStart(env *vm.EVM, depth int, from common.Address, to common.Address, precompile bool, create bool, callType vm.CallType, input []byte, gas uint64, value *big.Int, code []byte) {
 }
 
+func (a *AccessListTracer) CaptureEnter(typ vm.OpCode, from common.Address, to common.Address, input []byte, gas uint64, value *uint256.Int) {
+}
+
 // CaptureState captures all opcodes that touch storage or addresses and adds them to the accesslist.
 func (a *AccessListTracer) CaptureState(env *vm.EVM, pc uint64, op vm.OpCode, gas, cost uint64, scope *vm.ScopeContext, rData []byte, depth int, err error) {
 	stack := scope.Stack
@@ -170,6 +174,8 @@ func (*AccessListTracer) CaptureFault(env *vm.EVM, pc uint64, op vm.OpCode, gas,
 }
 func (*AccessListTracer) CaptureEnd(depth int, output []byte, startGas, endGas uint64, t time.Duration, err error) {
 }
+func (*AccessListTracer) CaptureExit(output []byte, gasUsed uint64, err error) {
+}
 func (*AccessListTracer) CaptureSelfDestruct(from common.Address, to common.Address, value *big.Int) {
 }
 func (*AccessListTracer) CaptureAccountRead(account common.Address) error {
@@ -607,6 +607,9 @@ func (jst *Tracer) CaptureStart(env *vm.EVM, depth int, from common.Address, to
 	jst.ctx["intrinsicGas"] = intrinsicGas
 }
 
+func (jst *Tracer) CaptureEnter(typ vm.OpCode, from common.Address, to common.Address, input []byte, gas uint64, value *uint256.Int) {
+}
+
 // CaptureState implements the Tracer interface to trace a single step of VM execution.
 func (jst *Tracer) CaptureState(env *vm.EVM, pc uint64, op vm.OpCode, gas, cost uint64, scope *vm.ScopeContext, rdata []byte, depth int, err error) {
 	if jst.err != nil {
@@ -667,6 +670,9 @@ func (jst *Tracer) CaptureEnd(depth int, output []byte, startGas, endGas uint64,
 	}
 }
 
+func (jst *Tracer) CaptureExit(output []byte, gasUsed uint64, err error) {
+}
+
 func (jst *Tracer) CaptureSelfDestruct(from, to common.Address, value *big.Int) {
 }
 
@@ -195,6 +195,7 @@ func (e *RevertError) ErrorData() interface{} {
 // execution status, the amount of gas used and the return value
 type ExecutionResult struct {
 	Gas         uint64         `json:"gas"`
+	ExtraGas    uint64         `json:"extraGas,omitempty"`
 	Failed      bool           `json:"failed"`
 	ReturnValue string         `json:"returnValue"`
 	StructLogs  []StructLogRes `json:"structLogs"`
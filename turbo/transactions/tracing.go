@@ -156,6 +156,11 @@ func TraceTx(
 		stream.WriteObjectField("gas")
 		stream.WriteUint64(result.UsedGas)
 		stream.WriteMore()
+		if result.ExtraGas > 0 {
+			stream.WriteObjectField("extraGas")
+			stream.WriteUint64(result.ExtraGas)
+			stream.WriteMore()
+		}
 		stream.WriteObjectField("failed")
 		stream.WriteBool(result.Failed())
 		stream.WriteMore()
@@ -214,6 +219,9 @@ func NewJsonStreamLogger(cfg *vm.LogConfig, ctx context.Context, stream *jsonite
 func (l *JsonStreamLogger) CaptureStart(env *vm.EVM, depth int, from common.Address, to common.Address, precompile bool, create bool, calltype vm.CallType, input []byte, gas uint64, value *big.Int, code []byte) {
 }
 
+func (l *JsonStreamLogger) CaptureEnter(typ vm.OpCode, from common.Address, to common.Address, input []byte, gas uint64, value *uint256.Int) {
+}
+
 // CaptureState logs a new structured log message and pushes it out to the environment
 //
 // CaptureState also tracks SLOAD/SSTORE ops to track storage change.
@@ -350,6 +358,9 @@ func (l *JsonStreamLogger) CaptureFault(env *vm.EVM, pc uint64, op vm.OpCode, ga
 func (l *JsonStreamLogger) CaptureEnd(depth int, output []byte, startGas, endGas uint64, t time.Duration, err error) {
 }
 
+func (l *JsonStreamLogger) CaptureExit(output []byte, gasUsed uint64, err error) {
+}
+
 func (l *JsonStreamLogger) CaptureSelfDestruct(from common.Address, to common.Address, value *big.Int) {
 }
 